@@ -0,0 +1,713 @@
+package kvnode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+const defaultUser = "default"
+
+var (
+	errNoPermCommand   = errors.New("NOPERM this user has no permissions to run this command")
+	errNoPermKey       = errors.New("NOPERM this user has no permissions to access one of the keys used as arguments")
+	errNoPermNamespace = errors.New("NOPERM this user has no permissions to access this namespace")
+)
+
+// aclUser is a user that is managed by the ACL command.
+// A user is never modified once it's stored, instead it's replaced.
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string // sha256 hex digests
+	patterns  []string // key patterns
+	allkeys   bool
+	commands  []string // +cmd, -cmd, +@category, -@category in order
+	// namespaces are the namespaces that the user is bound to. A user
+	// without namespaces may use every database and namespace.
+	namespaces []string
+	// rateLimit and bandwidthLimit are the commands and the bytes per
+	// second that the connections of the user may send together. Zero
+	// means no limit.
+	rateLimit      int
+	bandwidthLimit int
+}
+
+// copy returns a copy of the user that is safe to modify.
+func (u *aclUser) copy() *aclUser {
+	nu := *u
+	nu.passwords = append([]string(nil), u.passwords...)
+	nu.patterns = append([]string(nil), u.patterns...)
+	nu.commands = append([]string(nil), u.commands...)
+	nu.namespaces = append([]string(nil), u.namespaces...)
+	return &nu
+}
+
+func hashPassword(pass string) string {
+	h := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(h[:])
+}
+
+func removeString(list []string, s string) []string {
+	for i := 0; i < len(list); i++ {
+		if list[i] == s {
+			list = append(list[:i], list[i+1:]...)
+			i--
+		}
+	}
+	return list
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// applyRule applies a single ACL SETUSER rule.
+func (u *aclUser) applyRule(rule string) error {
+	lrule := strings.ToLower(rule)
+	switch lrule {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = nil
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = nil
+		return nil
+	case "allkeys":
+		u.allkeys = true
+		u.patterns = nil
+		return nil
+	case "resetkeys":
+		u.allkeys = false
+		u.patterns = nil
+		return nil
+	case "allcommands":
+		u.commands = []string{"+@all"}
+		return nil
+	case "nocommands":
+		u.commands = nil
+		return nil
+	case "allnamespaces":
+		u.namespaces = nil
+		return nil
+	case "reset":
+		*u = aclUser{name: u.name}
+		return nil
+	}
+	if strings.HasPrefix(lrule, "ratelimit:") || strings.HasPrefix(lrule, "bandwidth:") {
+		i := strings.IndexByte(lrule, ':')
+		n, err := strconv.ParseUint(lrule[i+1:], 10, 31)
+		if err != nil {
+			return errors.New("ERR Error in ACL SETUSER modifier '" + rule + "': The limit must be a positive integer")
+		}
+		if lrule[:i] == "ratelimit" {
+			u.rateLimit = int(n)
+		} else {
+			u.bandwidthLimit = int(n)
+		}
+		return nil
+	}
+	if strings.HasPrefix(lrule, "ns:") {
+		if !validNamespace(rule[3:]) {
+			return errors.New("ERR Error in ACL SETUSER modifier '" + rule + "': Invalid namespace name")
+		}
+		u.namespaces = appendUnique(u.namespaces, rule[3:])
+		return nil
+	}
+	if len(rule) < 2 {
+		return errors.New("ERR Error in ACL SETUSER modifier '" + rule + "': Syntax error")
+	}
+	switch rule[0] {
+	case '>':
+		u.passwords = appendUnique(u.passwords, hashPassword(rule[1:]))
+		u.nopass = false
+	case '<':
+		u.passwords = removeString(u.passwords, hashPassword(rule[1:]))
+	case '#':
+		if _, err := hex.DecodeString(rule[1:]); err != nil || len(rule) != 65 {
+			return errors.New("ERR Error in ACL SETUSER modifier '" + rule + "': The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.passwords = appendUnique(u.passwords, strings.ToLower(rule[1:]))
+		u.nopass = false
+	case '!':
+		u.passwords = removeString(u.passwords, strings.ToLower(rule[1:]))
+	case '~':
+		if rule == "~*" {
+			u.allkeys = true
+			u.patterns = nil
+		} else if !u.allkeys {
+			u.patterns = appendUnique(u.patterns, rule[1:])
+		}
+	case '+', '-':
+		name := lrule[1:]
+		if name[0] == '@' {
+			if !validCategory(name[1:]) {
+				return errors.New("ERR Error in ACL SETUSER modifier '" + rule + "': Unknown command or category name in ACL")
+			}
+		} else if _, ok := commands[name]; !ok {
+			return errors.New("ERR Error in ACL SETUSER modifier '" + rule + "': Unknown command or category name in ACL")
+		}
+		if lrule == "+@all" || lrule == "-@all" {
+			// all previous command rules are overridden.
+			u.commands = nil
+		}
+		u.commands = append(removeString(u.commands, lrule), lrule)
+	default:
+		return errors.New("ERR Error in ACL SETUSER modifier '" + rule + "': Syntax error")
+	}
+	return nil
+}
+
+// validCategory returns true if any command belongs to the category.
+func validCategory(category string) bool {
+	for _, info := range commands {
+		if info.hasCategory(category) {
+			return true
+		}
+	}
+	return false
+}
+
+// describe returns the rules that recreate the user.
+func (u *aclUser) describe() string {
+	var rules []string
+	if u.enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, hash := range u.passwords {
+		rules = append(rules, "#"+hash)
+	}
+	if u.allkeys {
+		rules = append(rules, "~*")
+	}
+	for _, pattern := range u.patterns {
+		rules = append(rules, "~"+pattern)
+	}
+	if len(u.commands) == 0 {
+		rules = append(rules, "-@all")
+	}
+	rules = append(rules, u.commands...)
+	for _, ns := range u.namespaces {
+		rules = append(rules, "ns:"+ns)
+	}
+	if u.rateLimit > 0 {
+		rules = append(rules, "ratelimit:"+strconv.Itoa(u.rateLimit))
+	}
+	if u.bandwidthLimit > 0 {
+		rules = append(rules, "bandwidth:"+strconv.Itoa(u.bandwidthLimit))
+	}
+	return strings.Join(rules, " ")
+}
+
+// parseUser parses the output of describe.
+func parseUser(name, desc string) (*aclUser, error) {
+	u := &aclUser{name: name}
+	for _, rule := range strings.Fields(desc) {
+		if err := u.applyRule(rule); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// canRun returns true if the user is allowed to run the command.
+func (u *aclUser) canRun(name string) bool {
+	info, ok := commands[name]
+	if !ok {
+		return false
+	}
+	var allowed bool
+	for _, rule := range u.commands {
+		var match bool
+		if rule[1] == '@' {
+			match = info.hasCategory(rule[2:])
+		} else {
+			// a command rule also matches its subcommands.
+			match = rule[1:] == name || strings.HasPrefix(name, rule[1:]+"|")
+		}
+		if match {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+// canUseNamespace returns true if the user may use the namespace, where an
+// empty namespace means the numbered databases.
+func (u *aclUser) canUseNamespace(ns string) bool {
+	if len(u.namespaces) == 0 {
+		return true
+	}
+	for _, name := range u.namespaces {
+		if name == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessKey returns true if the user is allowed to access the key.
+func (u *aclUser) canAccessKey(key []byte) bool {
+	if u.allkeys {
+		return true
+	}
+	skey := string(key)
+	for _, pattern := range u.patterns {
+		if match.Match(skey, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessPattern returns true if every key that matches the pattern is
+// accessible by the user. Only key patterns in the form "prefix*" are
+// considered, since those are the only ones that can be proven to cover
+// all of the matching keys.
+func (u *aclUser) canAccessPattern(pattern []byte) bool {
+	if u.allkeys {
+		return true
+	}
+	spattern := string(pattern)
+	if i := strings.IndexAny(spattern, "*?[\\"); i != -1 {
+		spattern = spattern[:i]
+	}
+	for _, upattern := range u.patterns {
+		if !strings.HasSuffix(upattern, "*") {
+			continue
+		}
+		prefix := upattern[:len(upattern)-1]
+		if strings.IndexAny(prefix, "*?[\\") != -1 {
+			continue
+		}
+		if strings.HasPrefix(spattern, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPassword returns true if the password is valid for the user.
+func (u *aclUser) checkPassword(pass string) bool {
+	if u.nopass {
+		return true
+	}
+	var ok bool
+	hash := hashPassword(pass)
+	for _, h := range u.passwords {
+		if passwordEqual(h, hash) {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// user returns the user with the specified name, or nil if the user does not
+// exist. The default user always exists and, unless it was modified with
+// ACL SETUSER, uses the server password.
+func (kvm *Machine) user(name string) *aclUser {
+	kvm.amu.RLock()
+	u := kvm.users[name]
+	kvm.amu.RUnlock()
+	if u == nil && name == defaultUser {
+		u, _ = newDefaultUser(defaultUserSeed(kvm.options().Password))
+	}
+	return u
+}
+
+// defaultUserSeed returns the password rule of the default user for the
+// server password, which is "nopass" or the "#hash" of the password.
+func defaultUserSeed(password string) string {
+	if password == "" {
+		return "nopass"
+	}
+	return "#" + hashPassword(password)
+}
+
+// newDefaultUser returns the default user, which isn't stored yet, with the
+// password rule of defaultUserSeed.
+func newDefaultUser(seed string) (*aclUser, error) {
+	u := &aclUser{
+		name:     defaultUser,
+		enabled:  true,
+		allkeys:  true,
+		commands: []string{"+@all"},
+	}
+	if seed != "nopass" && !strings.HasPrefix(seed, "#") {
+		return nil, errors.New("ERR invalid default user seed")
+	}
+	if err := u.applyRule(seed); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// loadUsers reads the users from the database. The caller must hold the
+// machine lock.
+func (kvm *Machine) loadUsers() error {
+	users := make(map[string]*aclUser)
+	iter := kvm.db.NewIterator(util.BytesPrefix([]byte{'u'}), nil)
+	for ok := iter.First(); ok; ok = iter.Next() {
+		name := string(iter.Key()[1:])
+		u, err := parseUser(name, string(iter.Value()))
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		users[name] = u
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	kvm.amu.Lock()
+	kvm.users = users
+	kvm.amu.Unlock()
+	return nil
+}
+
+// storeUsers writes all users to the database. The caller must hold the
+// machine lock.
+func (kvm *Machine) storeUsers() error {
+	var batch leveldb.Batch
+	kvm.amu.RLock()
+	for name, u := range kvm.users {
+		batch.Put(makeKey('u', []byte(name)), []byte(u.describe()))
+	}
+	kvm.amu.RUnlock()
+	return kvm.db.Write(&batch, nil)
+}
+
+// checkCommand returns an error if the client is not allowed to run the
+// command, which may be a subcommand such as "client|kill". Unknown commands
+// are not checked.
+func (kvm *Machine) checkCommand(c *client, name string, cmd redcon.Command) error {
+	info, ok := commands[name]
+	if !ok {
+		return nil
+	}
+	if info.privileged && kvm.options().AdminAddr != "" && !c.admin {
+		return errNotAdmin
+	}
+	return kvm.checkACL(c, name, cmd)
+}
+
+// checkACL returns an error if the client is not permitted to run the
+// command.
+func (kvm *Machine) checkACL(c *client, name string, cmd redcon.Command) error {
+	u := kvm.user(c.userName())
+	if u == nil || !u.enabled || !u.canRun(name) {
+		return errNoPermCommand
+	}
+	info := commands[name]
+	for _, key := range commandKeys(info, cmd.Args) {
+		if !u.canAccessKey(key) {
+			return errNoPermKey
+		}
+	}
+	if info.pattern > 0 && info.pattern < len(cmd.Args) {
+		if !u.canAccessPattern(cmd.Args[info.pattern]) {
+			return errNoPermKey
+		}
+	}
+	return nil
+}
+
+func (kvm *Machine) cmdACL(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errors.New("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	case "setuser":
+		return kvm.cmdACLSetuser(m, conn, cmd)
+	case "deluser":
+		return kvm.cmdACLDeluser(m, conn, cmd)
+	case "getuser":
+		return kvm.cmdACLGetuser(m, conn, cmd)
+	case "list":
+		return kvm.cmdACLList(m, conn, cmd, false)
+	case "users":
+		return kvm.cmdACLList(m, conn, cmd, true)
+	case "whoami":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		conn.WriteBulkString(kvm.client(conn).userName())
+		return nil, nil
+	}
+}
+
+// setuser applies the rules to the user, creating the user if needed. The
+// rules of the default user begin with "seed" and the password rule that
+// the default user starts from while it isn't stored, which is the server
+// password of the node that proposed the command. Every node then applies
+// the same user, whatever its own server password.
+func (kvm *Machine) setuser(name string, rules [][]byte) (*aclUser, error) {
+	var seeded *aclUser
+	if name == defaultUser {
+		seed := defaultUserSeed(kvm.options().Password)
+		if len(rules) >= 2 && string(rules[0]) == "seed" {
+			seed = string(rules[1])
+			rules = rules[2:]
+		}
+		var err error
+		if seeded, err = newDefaultUser(seed); err != nil {
+			return nil, err
+		}
+	}
+	var u *aclUser
+	kvm.amu.RLock()
+	if cu := kvm.users[name]; cu != nil {
+		u = cu.copy()
+	}
+	kvm.amu.RUnlock()
+	if u == nil {
+		if seeded != nil {
+			u = seeded
+		} else {
+			u = &aclUser{name: name}
+		}
+	}
+	for _, rule := range rules {
+		if err := u.applyRule(string(rule)); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+func (kvm *Machine) cmdACLSetuser(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name := string(cmd.Args[2])
+	if conn != nil {
+		// the node that proposes the command hashes the passwords, so they
+		// aren't written to the raft log in the clear.
+		cmd = hashRules(cmd)
+		if name == defaultUser {
+			cmd = seedRules(cmd, defaultUserSeed(kvm.options().Password))
+		}
+	}
+	// validate the rules prior to applying
+	if _, err := kvm.setuser(name, cmd.Args[3:]); err != nil {
+		return nil, err
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			u, err := kvm.setuser(name, cmd.Args[3:])
+			if err != nil {
+				return nil, err
+			}
+			err = kvm.db.Put(makeKey('u', []byte(name)), []byte(u.describe()), nil)
+			if err != nil {
+				return nil, err
+			}
+			kvm.amu.Lock()
+			kvm.users[name] = u
+			kvm.amu.Unlock()
+			return nil, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteString("OK")
+			return nil, nil
+		},
+	)
+}
+
+// seedRules returns an ACL SETUSER command for the default user with the
+// "seed" rule of setuser before its rules.
+func seedRules(cmd redcon.Command, seed string) redcon.Command {
+	args := make([][]byte, 0, len(cmd.Args)+2)
+	args = append(args, cmd.Args[:3]...)
+	args = append(args, []byte("seed"), []byte(seed))
+	args = append(args, cmd.Args[3:]...)
+	return redcon.Command{Raw: buildCommand(args...), Args: args}
+}
+
+// hashRules returns an ACL SETUSER command with its >password and <password
+// rules replaced by the #hash and !hash rules of the same passwords.
+func hashRules(cmd redcon.Command) redcon.Command {
+	args := make([][]byte, len(cmd.Args))
+	copy(args, cmd.Args)
+	for i := 3; i < len(args); i++ {
+		if len(args[i]) == 0 {
+			continue
+		}
+		switch args[i][0] {
+		case '>':
+			args[i] = []byte("#" + hashPassword(string(args[i][1:])))
+		case '<':
+			args[i] = []byte("!" + hashPassword(string(args[i][1:])))
+		}
+	}
+	return redcon.Command{Raw: buildCommand(args...), Args: args}
+}
+
+func (kvm *Machine) cmdACLDeluser(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	for i := 2; i < len(cmd.Args); i++ {
+		if string(cmd.Args[i]) == defaultUser {
+			return nil, errors.New("ERR The 'default' user cannot be removed")
+		}
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			var batch leveldb.Batch
+			var names []string
+			kvm.amu.RLock()
+			for i := 2; i < len(cmd.Args); i++ {
+				name := string(cmd.Args[i])
+				if kvm.users[name] != nil {
+					batch.Delete(makeKey('u', cmd.Args[i]))
+					names = append(names, name)
+				}
+			}
+			kvm.amu.RUnlock()
+			if err := kvm.db.Write(&batch, nil); err != nil {
+				return nil, err
+			}
+			kvm.amu.Lock()
+			for _, name := range names {
+				delete(kvm.users, name)
+			}
+			kvm.amu.Unlock()
+			return len(names), nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteInt(v.(int))
+			return nil, nil
+		},
+	)
+}
+
+func (kvm *Machine) cmdACLGetuser(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			u := kvm.user(string(cmd.Args[2]))
+			if u == nil {
+				writeNull(conn)
+				return nil, nil
+			}
+			var flags []string
+			if u.enabled {
+				flags = append(flags, "on")
+			} else {
+				flags = append(flags, "off")
+			}
+			if u.allkeys {
+				flags = append(flags, "allkeys")
+			}
+			if u.nopass {
+				flags = append(flags, "nopass")
+			}
+			var commands string
+			if len(u.commands) == 0 {
+				commands = "-@all"
+			} else {
+				commands = strings.Join(u.commands, " ")
+			}
+			writeMap(conn, 7)
+			conn.WriteBulkString("flags")
+			conn.WriteArray(len(flags))
+			for _, flag := range flags {
+				conn.WriteBulkString(flag)
+			}
+			conn.WriteBulkString("passwords")
+			conn.WriteArray(len(u.passwords))
+			for _, hash := range u.passwords {
+				conn.WriteBulkString(hash)
+			}
+			conn.WriteBulkString("commands")
+			conn.WriteBulkString(commands)
+			conn.WriteBulkString("keys")
+			if u.allkeys {
+				conn.WriteArray(1)
+				conn.WriteBulkString("*")
+			} else {
+				conn.WriteArray(len(u.patterns))
+				for _, pattern := range u.patterns {
+					conn.WriteBulkString(pattern)
+				}
+			}
+			conn.WriteBulkString("namespaces")
+			conn.WriteArray(len(u.namespaces))
+			for _, ns := range u.namespaces {
+				conn.WriteBulkString(ns)
+			}
+			conn.WriteBulkString("ratelimit")
+			conn.WriteInt(u.rateLimit)
+			conn.WriteBulkString("bandwidth")
+			conn.WriteInt(u.bandwidthLimit)
+			return nil, nil
+		},
+	)
+}
+
+func (kvm *Machine) cmdACLList(m finn.Applier, conn redcon.Conn, cmd redcon.Command, namesOnly bool) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			users := map[string]*aclUser{defaultUser: kvm.user(defaultUser)}
+			kvm.amu.RLock()
+			for name, u := range kvm.users {
+				users[name] = u
+			}
+			kvm.amu.RUnlock()
+			names := make([]string, 0, len(users))
+			for name := range users {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			conn.WriteArray(len(names))
+			for _, name := range names {
+				if namesOnly {
+					conn.WriteBulkString(name)
+				} else {
+					conn.WriteBulkString("user " + name + " " + users[name].describe())
+				}
+			}
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,92 @@
+package kvnode
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/redcon"
+)
+
+func TestHashRules(t *testing.T) {
+	cmd, err := redcon.Parse(buildCommand([]byte("ACL"), []byte("SETUSER"),
+		[]byte(">bob"), []byte("on"), []byte(">secret"), []byte("<old"), []byte("~app:*")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := hashRules(cmd)
+	want := []string{"ACL", "SETUSER", ">bob", "on", "#" + hashPassword("secret"),
+		"!" + hashPassword("old"), "~app:*"}
+	args := make([]string, len(got.Args))
+	for i, arg := range got.Args {
+		args[i] = string(arg)
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("expected %q, got %q", want, args)
+	}
+	parsed, err := redcon.Parse(got.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.Args, got.Args) {
+		t.Fatalf("the raw command doesn't match the arguments")
+	}
+}
+
+func TestACLSetuserPassword(t *testing.T) {
+	tn := startNode(t, nil)
+	defer tn.close()
+	conn := tn.dial()
+	defer conn.Close()
+	if _, err := conn.Do("ACL", "SETUSER", "bob", "on", ">secret", "+@all", "~*"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := conn.Do("AUTH", "bob", "wrong")
+	expectError(t, err, "WRONGPASS")
+	if _, err := conn.Do("AUTH", "bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("ACL", "SETUSER", "bob", "<secret"); err != nil {
+		t.Fatal(err)
+	}
+	other := tn.dial()
+	defer other.Close()
+	_, err = other.Do("AUTH", "bob", "secret")
+	expectError(t, err, "WRONGPASS")
+	if user, err := redis.String(conn.Do("ACL", "WHOAMI")); err != nil || user != "bob" {
+		t.Fatalf("expected bob, got %q %v", user, err)
+	}
+}
+
+func TestACLSetuserDefaultSeed(t *testing.T) {
+	// the nodes of a cluster may be started with different passwords, and
+	// the default user of the log entry is seeded by the proposing node.
+	m1, close1 := openMachine(t, &Options{Password: "one"})
+	defer close1()
+	m2, close2 := openMachine(t, &Options{Password: "two"})
+	defer close2()
+	cmd, err := redcon.Parse(buildCommand([]byte("ACL"), []byte("SETUSER"),
+		[]byte("default"), []byte("~app:*")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = seedRules(hashRules(cmd), defaultUserSeed(m1.options().Password))
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		args[i] = string(arg)
+	}
+	for _, m := range []*Machine{m1, m2} {
+		if _, err := applyCommand(m, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u1, u2 := m1.user(defaultUser), m2.user(defaultUser)
+	if u1.describe() != u2.describe() {
+		t.Fatalf("expected the same user, got %q and %q", u1.describe(), u2.describe())
+	}
+	if !u2.checkPassword("one") || u2.checkPassword("two") {
+		t.Fatalf("expected the password of the proposing node")
+	}
+	_, err = applyCommand(m2, "ACL", "SETUSER", "default", "seed", ">plain")
+	expectError(t, err, "invalid default user seed")
+}
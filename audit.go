@@ -0,0 +1,159 @@
+package kvnode
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// auditRedacted replaces secrets, such as passwords, in the audit log.
+const auditRedacted = "(redacted)"
+
+// auditLog is an append-only log of the administrative and write commands
+// of clients. Each record is a line of JSON.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// auditRecord is a line in the audit log.
+type auditRecord struct {
+	Time     string   `json:"time"`
+	ClientID int64    `json:"client_id"`
+	Addr     string   `json:"addr"`
+	User     string   `json:"user"`
+	Authed   bool     `json:"authenticated"`
+	Admin    bool     `json:"admin"`
+	Keyspace string   `json:"keyspace"`
+	Command  string   `json:"command"`
+	Keys     []string `json:"keys,omitempty"`
+	Args     []string `json:"args,omitempty"`
+	Result   string   `json:"result"`
+}
+
+// openAuditLog opens the audit log for appending, creating it if needed.
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f}, nil
+}
+
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// audited returns true if the command is recorded in the audit log, which
+// are the commands that change data or the server, and authentication.
+func audited(name string, args [][]byte) bool {
+	switch name {
+	case "auth", "hello":
+		return name == "auth" || len(args) > 2
+	}
+	flagged := func(info commandInfo) bool {
+		for _, flag := range info.flags {
+			if flag == "write" || flag == "admin" {
+				return true
+			}
+		}
+		return false
+	}
+	if flagged(commands[name]) {
+		return true
+	}
+	if len(args) > 1 {
+		return flagged(commands[name+"|"+strings.ToLower(string(args[1]))])
+	}
+	return false
+}
+
+// auditArgs returns the arguments of an administrative command that are
+// recorded, with the secrets redacted. The values of write commands are not
+// recorded, only their keys.
+func auditArgs(name string, args [][]byte) (keys, rargs []string) {
+	for _, key := range commandKeys(commands[name], args) {
+		keys = append(keys, string(key))
+	}
+	var sub string
+	if len(args) > 1 {
+		sub = strings.ToLower(string(args[1]))
+	}
+	var admin bool
+	for _, info := range []commandInfo{commands[name], commands[name+"|"+sub]} {
+		for _, flag := range info.flags {
+			admin = admin || flag == "admin"
+		}
+	}
+	if !admin && name != "auth" && name != "hello" {
+		return keys, nil
+	}
+	for i, arg := range args[1:] {
+		s := string(arg)
+		switch name {
+		case "auth":
+			// only the user name is kept.
+			if i == len(args)-2 {
+				s = auditRedacted
+			}
+		case "hello":
+			// the password follows "AUTH username".
+			if i > 1 && strings.EqualFold(string(args[i-1]), "auth") {
+				s = auditRedacted
+			}
+		case "acl":
+			// passwords and their hashes are rules that start with
+			// one of '>', '<', '#' or '!'.
+			if sub == "setuser" && i > 1 && len(s) > 0 &&
+				strings.IndexByte("><#!", s[0]) != -1 {
+				s = s[:1] + auditRedacted
+			}
+		case "config":
+			if sub == "set" && i > 1 && i%2 == 0 &&
+				strings.EqualFold(string(args[i]), "requirepass") {
+				s = auditRedacted
+			}
+		}
+		rargs = append(rargs, s)
+	}
+	return keys, rargs
+}
+
+// record appends a record of a command. Write errors are logged, since
+// failing the command would make the node unavailable.
+func (a *auditLog) record(c *client, ks keyspace, cmd redcon.Command, err error) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	c.mu.Lock()
+	rec := auditRecord{
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		ClientID: c.id,
+		Addr:     c.addr,
+		User:     c.userName(),
+		Authed:   c.authed,
+		Admin:    c.admin,
+		Keyspace: ks.String(),
+		Command:  name,
+		Result:   "ok",
+	}
+	c.mu.Unlock()
+	rec.Keys, rec.Args = auditArgs(name, cmd.Args)
+	if err != nil {
+		rec.Result = err.Error()
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(rec)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(buf.Bytes()); err != nil {
+		log.Warningf("audit log: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package kvnode
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errNoAuth        = errors.New("NOAUTH Authentication required.")
+	errWrongPass     = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	errAuthNotNeeded = errors.New("ERR Client sent AUTH, but no password is set")
+)
+
+// passwordEqual compares two passwords in constant time.
+func passwordEqual(a, b string) bool {
+	// hashing first ensures that the comparison does not leak the length
+	// of the password.
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// authorized returns true when the client is allowed to run commands.
+// Clients that have not authenticated are allowed when the default user
+// does not require a password.
+func (kvm *Machine) authorized(c *client) bool {
+	if c.authed {
+		return true
+	}
+	u := kvm.user(defaultUser)
+	return u.enabled && u.nopass
+}
+
+func (kvm *Machine) cmdAuth(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	var name, pass string
+	switch len(cmd.Args) {
+	default:
+		return nil, finn.ErrWrongNumberOfArguments
+	case 2:
+		name, pass = defaultUser, string(cmd.Args[1])
+	case 3:
+		name, pass = string(cmd.Args[1]), string(cmd.Args[2])
+	}
+	u := kvm.user(name)
+	if name == defaultUser && len(cmd.Args) == 2 && u.nopass {
+		return nil, errAuthNotNeeded
+	}
+	c := kvm.client(conn)
+	if u == nil || !u.enabled || !u.checkPassword(pass) {
+		return nil, errWrongPass
+	}
+	c.mu.Lock()
+	c.user = name
+	c.authed = true
+	c.mu.Unlock()
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// cmdHello handles "HELLO [protover [AUTH username password] [SETNAME name]]".
+func (kvm *Machine) cmdHello(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	c := kvm.client(conn)
+	proto := c.proto
+	if len(cmd.Args) > 1 {
+		n, err := strconv.ParseInt(string(cmd.Args[1]), 10, 64)
+		if err != nil {
+			return nil, errors.New("ERR Protocol version is not an integer or out of range")
+		}
+		if n != 2 && n != 3 {
+			return nil, errors.New("NOPROTO unsupported protocol version")
+		}
+		proto = int(n)
+	}
+	var name []byte
+	var setname bool
+	for i := 2; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		default:
+			return nil, errSyntaxError
+		case "auth":
+			if i+2 >= len(cmd.Args) {
+				return nil, errSyntaxError
+			}
+			u := kvm.user(string(cmd.Args[i+1]))
+			if u == nil || !u.enabled || !u.checkPassword(string(cmd.Args[i+2])) {
+				return nil, errWrongPass
+			}
+			c.mu.Lock()
+			c.user = string(cmd.Args[i+1])
+			c.authed = true
+			c.mu.Unlock()
+			i += 2
+		case "setname":
+			if i+1 >= len(cmd.Args) {
+				return nil, errSyntaxError
+			}
+			name = cmd.Args[i+1]
+			if !validClientName(name) {
+				return nil, errClientName
+			}
+			setname = true
+			i++
+		}
+	}
+	if !kvm.authorized(c) {
+		return nil, errNoAuth
+	}
+	if proto == 0 {
+		proto = 2
+	}
+	c.mu.Lock()
+	c.proto = proto
+	if setname {
+		c.name = string(name)
+	}
+	c.mu.Unlock()
+	writeMap(conn, 6)
+	conn.WriteBulkString("server")
+	conn.WriteBulkString("kvnode")
+	conn.WriteBulkString("version")
+	conn.WriteBulkString(Version)
+	conn.WriteBulkString("proto")
+	conn.WriteInt(proto)
+	conn.WriteBulkString("id")
+	conn.WriteInt64(c.id)
+	conn.WriteBulkString("mode")
+	conn.WriteBulkString("standalone")
+	conn.WriteBulkString("modules")
+	conn.WriteArray(0)
+	return nil, nil
+}
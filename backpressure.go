@@ -0,0 +1,52 @@
+package kvnode
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var errBusyWrites = errors.New("BUSY too many pending writes, try again later")
+
+// backpressureApplier refuses the writes of clients with a BUSY error while
+// the node has MaxPendingWrites writes that are proposed but not yet
+// applied, so that a stalled disk or a lagging raft log doesn't queue writes
+// without bound.
+type backpressureApplier struct {
+	finn.Applier
+	kvm *Machine
+}
+
+func (m backpressureApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn == nil || mutate == nil {
+		return m.Applier.Apply(conn, cmd, mutate, respond)
+	}
+	if err := m.kvm.admitWrites(); err != nil {
+		return nil, err
+	}
+	m.kvm.addPending(1)
+	defer m.kvm.addPending(-1)
+	return m.Applier.Apply(conn, cmd, mutate, respond)
+}
+
+// admitWrites returns errBusyWrites when the node has too many pending
+// writes.
+func (kvm *Machine) admitWrites() error {
+	max := kvm.options().MaxPendingWrites
+	if max > 0 && atomic.LoadInt64(&kvm.pending) >= int64(max) {
+		atomic.AddInt64(&kvm.stats.busy, 1)
+		return errBusyWrites
+	}
+	return nil
+}
+
+// addPending adds to the number of pending writes.
+func (kvm *Machine) addPending(n int) {
+	atomic.AddInt64(&kvm.pending, int64(n))
+}
@@ -0,0 +1,156 @@
+package kvnode
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix is the prefix of the bind addresses of Unix sockets.
+const unixPrefix = "unix:"
+
+// Bind is an additional address for accepting client connections, with the
+// settings of its listener. Its connections are relayed to the primary
+// address.
+type Bind struct {
+	// Addr is an ip:port, such as "0.0.0.0:4920" or "[::]:4920", or the
+	// path of a Unix socket.
+	Addr string
+	// Unix is true when Addr is the path of a Unix socket. The socket file
+	// is replaced when the listener starts, and removed when it stops.
+	Unix bool
+	// Perm is the permission bits of the socket file of a Unix socket, such
+	// as 0770, or zero for the default of the umask.
+	Perm os.FileMode
+	// TLS accepts TLS connections, with the TLS configuration of the
+	// options.
+	TLS bool
+	// Admin permits privileged commands, like the admin listener.
+	Admin bool
+	// User, when set, is the user that connections are authenticated as,
+	// without a password, such as for a Unix socket that only trusted
+	// processes can open.
+	User string
+}
+
+// ParseBind parses a bind address, which is followed by optional settings
+// that are separated by spaces, such as "[::]:4920 tls" or
+// "unix:/run/kvnode.sock perm=770 user=app". The settings are tls, admin,
+// user=name and, for Unix sockets, perm=octal.
+func ParseBind(s string) (Bind, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Bind{}, errors.New("empty bind address")
+	}
+	var b Bind
+	if strings.HasPrefix(fields[0], unixPrefix) {
+		b.Addr = fields[0][len(unixPrefix):]
+		b.Unix = true
+		if b.Addr == "" {
+			return Bind{}, errors.New("invalid bind address '" + fields[0] + "'")
+		}
+	} else {
+		if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+			return Bind{}, errors.New("invalid bind address '" + fields[0] + "'")
+		}
+		b.Addr = fields[0]
+	}
+	for _, field := range fields[1:] {
+		name, value := field, ""
+		if i := strings.IndexByte(field, '='); i >= 0 {
+			name, value = field[:i], field[i+1:]
+		}
+		switch {
+		case name == "tls" && value == "":
+			b.TLS = true
+		case name == "admin" && value == "":
+			b.Admin = true
+		case name == "user" && value != "":
+			b.User = value
+		case name == "perm" && b.Unix:
+			perm, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || perm > 0777 {
+				return Bind{}, errors.New("invalid socket permissions '" + value + "'")
+			}
+			b.Perm = os.FileMode(perm)
+		default:
+			return Bind{}, errors.New("invalid bind setting '" + field + "'")
+		}
+	}
+	return b, nil
+}
+
+// String returns the bind address in the format of ParseBind.
+func (b Bind) String() string {
+	s := b.Addr
+	if b.Unix {
+		s = unixPrefix + s
+		if b.Perm != 0 {
+			s += " perm=" + strconv.FormatUint(uint64(b.Perm), 8)
+		}
+	}
+	if b.TLS {
+		s += " tls"
+	}
+	if b.Admin {
+		s += " admin"
+	}
+	if b.User != "" {
+		s += " user=" + b.User
+	}
+	return s
+}
+
+// bindList returns bind addresses as a comma separated list, like the bind
+// flag.
+func bindList(binds []Bind) string {
+	list := make([]string, len(binds))
+	for i, b := range binds {
+		list[i] = b.String()
+	}
+	return strings.Join(list, ",")
+}
+
+// network returns the network of the listener. Literal IPv4 and IPv6
+// addresses are bound to their own family, so that "0.0.0.0:4920" and
+// "[::]:4920" may be bound together, while a host name or an empty host
+// binds both families.
+func (b Bind) network() string {
+	if b.Unix {
+		return "unix"
+	}
+	host, _, _ := net.SplitHostPort(b.Addr)
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// listen binds the listener of the address.
+func (b Bind) listen() (net.Listener, error) {
+	if !b.Unix {
+		return net.Listen(b.network(), b.Addr)
+	}
+	// replace the socket of a previous process, but nothing else.
+	if fi, err := os.Lstat(b.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(b.Addr)
+	}
+	ln, err := net.Listen("unix", b.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if b.Perm != 0 {
+		if err := os.Chmod(b.Addr, b.Perm); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
@@ -0,0 +1,568 @@
+package kvnode
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errNoSuchClient = errors.New("ERR No such client")
+	errClientName   = errors.New("ERR Client names cannot contain spaces, newlines or special characters.")
+)
+
+// lastClientID is used to assign each client a unique id.
+var lastClientID int64
+
+// client is the state of a single client connection. It's stored as the
+// connection context.
+type client struct {
+	// id is the unique id of the client.
+	id int64
+	// lastActive is the unix nano time of the last command. It's accessed
+	// atomically.
+	lastActive int64
+	// created is the time that the client was created.
+	created time.Time
+	// counted is true when the connection counts towards MaxClients.
+	counted bool
+
+	// mu guards the fields below that are changed after the client is
+	// created, since they're read by other connections with CLIENT LIST.
+	// The connection itself may read them without locking.
+	mu sync.Mutex
+	// name is the name assigned by the client.
+	name string
+	// proto is the RESP protocol version, 2 or 3.
+	proto int
+	// addr is the address of the client. For relayed connections this is
+	// the address of the actual client rather than the relay.
+	addr string
+	// user is the identity of the client, if known.
+	user string
+	// authed is true when the client has authenticated.
+	authed bool
+	// admin is true when the client connected through the admin listener.
+	admin bool
+	// lastCmd is the name of the last command that was processed.
+	lastCmd string
+	// db is the selected logical database.
+	db int
+	// ns is the selected namespace, which takes precedence over db.
+	ns string
+	// traceparent is the trace context for the next command.
+	traceparent string
+	// reqid is the request id for the next command.
+	reqid string
+	// minrev is the revision that the reads of the next command wait for.
+	minrev uint64
+	// lastrev is the revision of the database after the last write of the
+	// client.
+	lastrev uint64
+	// staleReads is true when the reads of the client are served from the
+	// local store.
+	staleReads bool
+	// syncWrites is true when the storage writes of the commands of the
+	// client are synced.
+	syncWrites bool
+	// pipe is the batch of pipelined writes that's being queued. It's only
+	// used by the connection.
+	pipe *pipelineBatch
+	// tx is the read-only transaction that's being queued, between MULTI
+	// READONLY and EXEC. It's only used by the connection.
+	tx *readTx
+	// limits are the rate limiters of the connection.
+	limits rateLimits
+	// hooked is true when OnConnect was called for the client, and refused
+	// is its error, which disconnects the client.
+	hooked  bool
+	refused error
+	// track is the tracking state of the client with CLIENT TRACKING on.
+	// It's only used by the connection.
+	track *tracking
+	// out is the size of the replies, for the output buffer limit.
+	out outputQueue
+}
+
+// userName returns the name of the user for the client.
+func (c *client) userName() string {
+	if c.user == "" {
+		return defaultUser
+	}
+	return c.user
+}
+
+// client returns the state for a client connection. The state is created
+// when the first command arrives, at which point a relayed connection is
+// guaranteed to be registered.
+func (kvm *Machine) client(conn redcon.Conn) *client {
+	if c, ok := conn.Context().(*client); ok {
+		return c
+	}
+	now := time.Now()
+	c := &client{
+		id:         atomic.AddInt64(&lastClientID, 1),
+		lastActive: now.UnixNano(),
+		created:    now,
+		addr:       conn.RemoteAddr(),
+		proto:      2,
+	}
+	if info := kvm.relay(c.addr); info != nil {
+		c.addr = info.remoteAddr
+		c.admin = info.admin
+		if info.user != "" {
+			// the listener vouches for its connections.
+			c.user = info.user
+			c.authed = true
+		}
+		if kvm.options().TLSCertUsers && info.certName != "" {
+			// a verified certificate is as good as a password.
+			c.user = info.certName
+			c.authed = true
+		}
+	}
+	conn.SetContext(c)
+	if conn.NetConn() != nil {
+		kvm.cmu.Lock()
+		kvm.clients[c] = conn
+		c.counted = kvm.conns[conn]
+		kvm.cmu.Unlock()
+		if hooks := kvm.options().Hooks; hooks != nil && hooks.OnConnect != nil {
+			c.hooked = true
+			c.refused = hooks.OnConnect(c.hookInfo())
+		}
+	}
+	return c
+}
+
+// setLastCmd sets the name of the last command that was processed.
+func (c *client) setLastCmd(name string) {
+	c.mu.Lock()
+	c.lastCmd = name
+	c.mu.Unlock()
+}
+
+// info returns a description of the client in the CLIENT LIST format.
+func (c *client) info(now time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+	flags := "N"
+	if c.admin {
+		flags = "A"
+	}
+	if c.staleReads {
+		flags += "S"
+	}
+	if c.syncWrites {
+		flags += "F"
+	}
+	cmd := c.lastCmd
+	if cmd == "" {
+		cmd = "NULL"
+	}
+	return "id=" + strconv.FormatInt(c.id, 10) +
+		" addr=" + c.addr +
+		" name=" + c.name +
+		" age=" + strconv.FormatInt(int64(now.Sub(c.created)/time.Second), 10) +
+		" idle=" + strconv.FormatInt(int64(idle/time.Second), 10) +
+		" flags=" + flags +
+		" db=" + strconv.Itoa(c.db) +
+		" ns=" + c.ns +
+		" user=" + c.userName() +
+		" resp=" + strconv.Itoa(c.proto) +
+		" cmd=" + cmd
+}
+
+// validClientName returns true if the name may be used as a client name.
+func validClientName(name []byte) bool {
+	for _, b := range name {
+		if b < '!' || b > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// touch marks the client as active.
+func (c *client) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// removeClient unregisters the client of a connection, if any.
+func (kvm *Machine) removeClient(conn redcon.Conn) {
+	if c, ok := conn.Context().(*client); ok {
+		kvm.cmu.Lock()
+		delete(kvm.clients, c)
+		kvm.cmu.Unlock()
+	}
+}
+
+// reapClients closes client connections that have been idle for longer
+// than the idle timeout, or open for longer than the max lifetime. It runs
+// until the machine is closed.
+func (kvm *Machine) reapClients() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-kvm.done:
+			return
+		case now := <-t.C:
+			var expired []redcon.Conn
+			kvm.cmu.Lock()
+			for c, conn := range kvm.clients {
+				idle := now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+				if (kvm.options().IdleTimeout > 0 && idle > kvm.options().IdleTimeout) ||
+					(kvm.options().MaxLifetime > 0 && now.Sub(c.created) > kvm.options().MaxLifetime) {
+					expired = append(expired, conn)
+					delete(kvm.clients, c)
+				}
+			}
+			kvm.cmu.Unlock()
+			for _, conn := range expired {
+				// closing the net conn unblocks the connection's reader,
+				// which cleans up the rest.
+				conn.NetConn().Close()
+			}
+		}
+	}
+}
+
+// setRelay registers the connection info for a relayed connection, keyed on
+// the local address of the relay's upstream connection. A nil info removes
+// the registration.
+func (kvm *Machine) setRelay(key string, info *relayInfo) {
+	kvm.rmu.Lock()
+	defer kvm.rmu.Unlock()
+	if info == nil {
+		delete(kvm.relays, key)
+	} else {
+		kvm.relays[key] = info
+	}
+}
+
+// relay returns the connection info for a relayed connection, or nil if the
+// connection did not arrive through a relay.
+func (kvm *Machine) relay(remoteAddr string) *relayInfo {
+	kvm.rmu.Lock()
+	defer kvm.rmu.Unlock()
+	return kvm.relays[remoteAddr]
+}
+
+// errMaxClients is written to connections that are rejected because the
+// server has reached the maximum number of clients.
+const errMaxClients = "-ERR max number of clients reached\r\n"
+
+// acceptConn counts a new connection. When the connection is refused by the
+// allow and deny lists or protected mode, or when the maximum number of
+// clients has been reached, an error is written and false is returned so the
+// connection is closed. The raft peers and the local host, which includes
+// the gateways and the relays, aren't limited by MaxClients, so a flood of
+// clients can't lock them out.
+func (kvm *Machine) acceptConn(conn redcon.Conn) bool {
+	atomic.AddInt64(&kvm.stats.connections, 1)
+	atomic.AddInt32(&kvm.nconns, 1)
+	if !kvm.ipAllowed(conn.RemoteAddr(), conn.NetConn().LocalAddr().String()) {
+		atomic.AddInt32(&kvm.nconns, -1)
+		atomic.AddInt64(&kvm.stats.rejected, 1)
+		conn.NetConn().Write([]byte(errIPDenied))
+		log.Warningf("address not allowed, rejected %s", conn.RemoteAddr())
+		return false
+	}
+	if !kvm.peerAllowed(conn.RemoteAddr(), conn.NetConn().LocalAddr().String()) {
+		atomic.AddInt32(&kvm.nconns, -1)
+		atomic.AddInt64(&kvm.stats.rejected, 1)
+		conn.NetConn().Write([]byte(errPeersOnly))
+		log.Warningf("not a raft peer, rejected %s", conn.RemoteAddr())
+		return false
+	}
+	if kvm.protectedDenied(kvm.addr, conn.RemoteAddr()) {
+		atomic.AddInt32(&kvm.nconns, -1)
+		atomic.AddInt64(&kvm.stats.rejected, 1)
+		conn.NetConn().Write([]byte(errProtectedMode))
+		log.Warningf("protected mode, rejected %s", conn.RemoteAddr())
+		return false
+	}
+	if kvm.dropping() {
+		atomic.AddInt32(&kvm.nconns, -1)
+		atomic.AddInt64(&kvm.stats.rejected, 1)
+		conn.NetConn().Write([]byte(errDropping))
+		return false
+	}
+	counted := !kvm.isPeer(conn.RemoteAddr(), conn.NetConn().LocalAddr().String())
+	if counted && !kvm.admitClient() {
+		atomic.AddInt32(&kvm.nconns, -1)
+		atomic.AddInt64(&kvm.stats.rejected, 1)
+		// the connection has not been handed to a reader yet, so write
+		// to the underlying conn directly.
+		conn.NetConn().Write([]byte(errMaxClients))
+		log.Warningf("max number of clients reached, rejected %s",
+			conn.RemoteAddr())
+		return false
+	}
+	kvm.cmu.Lock()
+	kvm.conns[conn] = counted
+	kvm.cmu.Unlock()
+	return true
+}
+
+// admitClient counts a client towards MaxClients, and returns false when the
+// maximum number of clients has been reached. An admitted client is
+// uncounted with releaseClient.
+func (kvm *Machine) admitClient() bool {
+	n := atomic.AddInt32(&kvm.nclients, 1)
+	if max := kvm.options().MaxClients; max > 0 && int(n) > max {
+		atomic.AddInt32(&kvm.nclients, -1)
+		return false
+	}
+	return true
+}
+
+// releaseClient uncounts a client of admitClient.
+func (kvm *Machine) releaseClient() {
+	atomic.AddInt32(&kvm.nclients, -1)
+}
+
+// connClosed uncounts a closed connection. Detached connections are still
+// open, and are uncounted by their owner with detachedClosed.
+func (kvm *Machine) connClosed(conn redcon.Conn, err error) {
+	// detached connections are never idle or expired.
+	kvm.removeClient(conn)
+	if c, ok := conn.Context().(*client); ok {
+		kvm.stopTracking(c)
+	}
+	kvm.cmu.Lock()
+	counted := kvm.conns[conn]
+	delete(kvm.conns, conn)
+	kvm.cmu.Unlock()
+	if err != nil && err.Error() == "detached" {
+		return
+	}
+	atomic.AddInt32(&kvm.nconns, -1)
+	if counted {
+		kvm.releaseClient()
+	}
+	if c, ok := conn.Context().(*client); ok {
+		kvm.hookDisconnect(c)
+	}
+}
+
+// ConnAccept and ConnClosed are the callbacks of finn.Options for programs
+// that embed the machine, so that its limits apply to the connections, and
+// the clients are released and OnDisconnect is called when they're closed.
+func (kvm *Machine) ConnAccept(conn redcon.Conn) bool {
+	return kvm.acceptConn(conn)
+}
+
+func (kvm *Machine) ConnClosed(conn redcon.Conn, err error) {
+	kvm.connClosed(conn, err)
+}
+
+// detachedClosed uncounts a detached connection of a client that has been
+// closed.
+func (kvm *Machine) detachedClosed(c *client) {
+	atomic.AddInt32(&kvm.nconns, -1)
+	if c.counted {
+		kvm.releaseClient()
+	}
+	kvm.hookDisconnect(c)
+}
+
+// hookDisconnect calls OnDisconnect for a client that OnConnect was called
+// for.
+func (kvm *Machine) hookDisconnect(c *client) {
+	if hooks := kvm.options().Hooks; c.hooked && hooks != nil && hooks.OnDisconnect != nil {
+		hooks.OnDisconnect(c.hookInfo())
+	}
+}
+
+// numConns returns the number of open connections.
+func (kvm *Machine) numConns() int {
+	return int(atomic.LoadInt32(&kvm.nconns))
+}
+
+// listClients returns the registered clients, ordered by id.
+func (kvm *Machine) listClients() []*client {
+	kvm.cmu.Lock()
+	clients := make([]*client, 0, len(kvm.clients))
+	for c := range kvm.clients {
+		clients = append(clients, c)
+	}
+	kvm.cmu.Unlock()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].id < clients[j].id
+	})
+	return clients
+}
+
+// cmdClient handles the CLIENT subcommands:
+//
+//	CLIENT ID
+//	CLIENT INFO
+//	CLIENT GETNAME
+//	CLIENT SETNAME name
+//	CLIENT STALEREADS ON|OFF
+//	CLIENT SYNCWRITES ON|OFF
+//	CLIENT TRACKING ON|OFF [BCAST] [PREFIX prefix [PREFIX prefix ...]]
+//	CLIENT LIST [ID id [id ...]]
+//	CLIENT KILL addr
+//	CLIENT KILL [ID id] [ADDR addr] [USER username] [SKIPME yes|no]
+func (kvm *Machine) cmdClient(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	c := kvm.client(conn)
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errors.New("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	case "id":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		conn.WriteInt64(c.id)
+	case "info":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		conn.WriteBulkString(c.info(time.Now()) + "\n")
+	case "getname":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		if c.name == "" {
+			writeNull(conn)
+		} else {
+			conn.WriteBulkString(c.name)
+		}
+	case "setname":
+		if len(cmd.Args) != 3 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		if !validClientName(cmd.Args[2]) {
+			return nil, errClientName
+		}
+		c.mu.Lock()
+		c.name = string(cmd.Args[2])
+		c.mu.Unlock()
+		conn.WriteString("OK")
+	case "stalereads":
+		return kvm.cmdClientStaleReads(c, conn, cmd)
+	case "syncwrites":
+		return kvm.cmdClientSyncWrites(c, conn, cmd)
+	case "tracking":
+		return kvm.cmdClientTracking(c, conn, cmd)
+	case "list":
+		return kvm.cmdClientList(c, conn, cmd)
+	case "kill":
+		return kvm.cmdClientKill(c, conn, cmd)
+	}
+	return nil, nil
+}
+
+func (kvm *Machine) cmdClientList(c *client, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	var ids map[int64]bool
+	if len(cmd.Args) > 2 {
+		if strings.ToLower(string(cmd.Args[2])) != "id" || len(cmd.Args) == 3 {
+			return nil, errSyntaxError
+		}
+		ids = make(map[int64]bool)
+		for _, arg := range cmd.Args[3:] {
+			id, err := strconv.ParseInt(string(arg), 10, 64)
+			if err != nil || id <= 0 {
+				return nil, errors.New("ERR Invalid client ID")
+			}
+			ids[id] = true
+		}
+	}
+	now := time.Now()
+	var buf []byte
+	for _, other := range kvm.listClients() {
+		if ids != nil && !ids[other.id] {
+			continue
+		}
+		buf = append(buf, other.info(now)...)
+		buf = append(buf, '\n')
+	}
+	conn.WriteBulk(buf)
+	return nil, nil
+}
+
+func (kvm *Machine) cmdClientKill(c *client, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	var id int64
+	var addr, user string
+	skipme := true
+	if len(cmd.Args) == 3 {
+		// the old form, which kills a single client by address.
+		addr = string(cmd.Args[2])
+		skipme = false
+	} else {
+		if len(cmd.Args)%2 != 0 {
+			return nil, errSyntaxError
+		}
+		for i := 2; i < len(cmd.Args); i += 2 {
+			val := string(cmd.Args[i+1])
+			switch strings.ToLower(string(cmd.Args[i])) {
+			default:
+				return nil, errSyntaxError
+			case "id":
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n <= 0 {
+					return nil, errors.New("ERR client-id should be greater than 0")
+				}
+				id = n
+			case "addr":
+				addr = val
+			case "user":
+				user = val
+			case "skipme":
+				switch strings.ToLower(val) {
+				default:
+					return nil, errSyntaxError
+				case "yes":
+					skipme = true
+				case "no":
+					skipme = false
+				}
+			}
+		}
+	}
+	var conns []redcon.Conn
+	kvm.cmu.Lock()
+	for other, oconn := range kvm.clients {
+		other.mu.Lock()
+		match := (id == 0 || other.id == id) &&
+			(addr == "" || other.addr == addr) &&
+			(user == "" || other.userName() == user) &&
+			(!skipme || other != c)
+		other.mu.Unlock()
+		if match {
+			conns = append(conns, oconn)
+		}
+	}
+	kvm.cmu.Unlock()
+	for _, oconn := range conns {
+		if oconn == conn {
+			// closing our own connection must wait for the reply.
+			defer oconn.Close()
+		} else {
+			oconn.NetConn().Close()
+		}
+	}
+	if len(cmd.Args) == 3 {
+		if len(conns) == 0 {
+			return nil, errNoSuchClient
+		}
+		conn.WriteString("OK")
+	} else {
+		conn.WriteInt(len(conns))
+	}
+	return nil, nil
+}
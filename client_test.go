@@ -0,0 +1,59 @@
+package kvnode
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestMaxClients(t *testing.T) {
+	tn := startNode(t, &Options{MaxClients: 1})
+	defer tn.close()
+	r, err := listenRelay(Bind{Addr: "127.0.0.1:0"}, tn.addr, nil, tn.m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	first, err := redis.Dial("tcp", r.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err := first.Do("PING"); err != nil {
+		t.Fatal(err)
+	}
+	second, err := redis.Dial("tcp", r.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	_, err = second.Do("PING")
+	expectError(t, err, "max number of clients reached")
+	// the connections of the local host, such as those of the relays and
+	// the gateways, aren't limited.
+	for i := 0; i < 3; i++ {
+		conn := tn.dial()
+		defer conn.Close()
+		if _, err := conn.Do("SET", "key", "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a client that's gone makes room for another.
+	first.Close()
+	for i := 0; ; i++ {
+		third, err := redis.Dial("tcp", r.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = third.Do("PING")
+		third.Close()
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("expected the client to be accepted, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,325 @@
+// kvnode-bench is a load generator for kvnode clusters. It runs a mix of
+// commands against one or more nodes, and reports the latencies of each
+// command split by the raft role of the node that served it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/redlog"
+)
+
+var log = redlog.New(os.Stderr)
+
+// benchCommands are the commands that can be in the mix. Every host gets
+// the same mix, so the writes that are sent to a follower show up as TRY
+// redirects.
+var benchCommands = map[string]bool{
+	"set": true, "get": true, "mget": true, "mset": true, "del": true,
+}
+
+// mixEntry is a command of the mix with its weight.
+type mixEntry struct {
+	name   string
+	weight int
+}
+
+// parseMix parses a mix such as "set:1,get:4".
+func parseMix(s string) ([]mixEntry, int, error) {
+	var mix []mixEntry
+	var total int
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, weight := item, 1
+		if i := strings.IndexByte(item, ':'); i != -1 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 0 {
+				return nil, 0, fmt.Errorf("invalid weight in --mix: %s", item)
+			}
+			name, weight = item[:i], n
+		}
+		name = strings.ToLower(name)
+		if !benchCommands[name] {
+			return nil, 0, fmt.Errorf("unknown command in --mix: %s", name)
+		}
+		mix = append(mix, mixEntry{name, weight})
+		total += weight
+	}
+	if total == 0 {
+		return nil, 0, fmt.Errorf("empty --mix")
+	}
+	return mix, total, nil
+}
+
+// keyGen picks the key numbers that are accessed.
+type keyGen func() int
+
+// newKeyGen returns a key generator for a distribution of keys.
+func newKeyGen(dist string, keys int, rng *rand.Rand, seq *int64) (keyGen, error) {
+	switch dist {
+	case "uniform":
+		return func() int { return rng.Intn(keys) }, nil
+	case "zipf":
+		z := rand.NewZipf(rng, 1.1, 1, uint64(keys-1))
+		return func() int { return int(z.Uint64()) }, nil
+	case "sequential":
+		return func() int { return int((atomic.AddInt64(seq, 1) - 1) % int64(keys)) }, nil
+	}
+	return nil, fmt.Errorf("invalid --dist, expected uniform, zipf or sequential")
+}
+
+// stat is the results of a command on the nodes of a role.
+type stat struct {
+	lats     []time.Duration
+	errors   int
+	redirect int
+}
+
+// statKey is a command on the nodes of a role.
+type statKey struct {
+	role string
+	cmd  string
+}
+
+// nodeRole returns the raft role of a node from INFO raft.
+func nodeRole(host, password string) (string, error) {
+	conn, err := redis.Dial("tcp", host, redis.DialPassword(password))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	info, err := redis.String(conn.Do("INFO", "raft"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, "role:") {
+			return strings.TrimSpace(line[5:]), nil
+		}
+	}
+	return "unknown", nil
+}
+
+// percentile returns the latency at p of sorted latencies.
+func percentile(lats []time.Duration, p float64) time.Duration {
+	if len(lats) == 0 {
+		return 0
+	}
+	i := int(float64(len(lats))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(lats) {
+		i = len(lats) - 1
+	}
+	return lats[i]
+}
+
+func main() {
+	var hosts string
+	var password string
+	var clients int
+	var requests int
+	var pipeline int
+	var dataSize int
+	var keys int
+	var mgetKeys int
+	var mixStr string
+	var dist string
+	var prefix string
+	var seed int64
+	flag.StringVar(&hosts, "hosts", "127.0.0.1:4920", "Nodes to benchmark, separated by commas")
+	flag.StringVar(&password, "a", "", "Password to AUTH with")
+	flag.IntVar(&clients, "c", 50, "Number of connections to each node")
+	flag.IntVar(&requests, "n", 100000, "Total number of requests")
+	flag.IntVar(&pipeline, "P", 1, "Pipeline this many requests on each connection")
+	flag.IntVar(&dataSize, "d", 64, "Size of the values in bytes")
+	flag.IntVar(&keys, "r", 100000, "Number of distinct keys")
+	flag.IntVar(&mgetKeys, "k", 10, "Number of keys of each MGET, MSET and DEL")
+	flag.StringVar(&mixStr, "mix", "set:1,get:1", "Commands and their weights, such as set:1,get:4,mget:1,mset:1,del:1")
+	flag.StringVar(&dist, "dist", "uniform", "Key distribution (uniform,zipf,sequential)")
+	flag.StringVar(&prefix, "prefix", "bench:", "Prefix of the keys")
+	flag.Int64Var(&seed, "seed", 1, "Seed of the random key and command choices")
+	flag.Parse()
+	mix, mixTotal, err := parseMix(mixStr)
+	if err == nil && (clients < 1 || requests < 1 || pipeline < 1 || keys < 1 || mgetKeys < 1) {
+		err = fmt.Errorf("-c, -n, -P, -r and -k must be positive")
+	}
+	if err != nil {
+		log.Warningf("%v", err)
+		os.Exit(1)
+	}
+	var nodes []string
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			nodes = append(nodes, host)
+		}
+	}
+	roles := make(map[string]string)
+	for _, host := range nodes {
+		role, err := nodeRole(host, password)
+		if err != nil {
+			log.Warningf("%s: %v", host, err)
+			os.Exit(1)
+		}
+		roles[host] = role
+		fmt.Printf("%s: %s\n", host, role)
+	}
+	value := strings.Repeat("x", dataSize)
+	var remaining = int64(requests)
+	var seq int64
+	var mu sync.Mutex
+	stats := make(map[statKey]*stat)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, host := range nodes {
+		for j := 0; j < clients; j++ {
+			conn, err := redis.Dial("tcp", host, redis.DialPassword(password))
+			if err != nil {
+				log.Warningf("%s: %v", host, err)
+				os.Exit(1)
+			}
+			rng := rand.New(rand.NewSource(seed + int64(i*clients+j)))
+			gen, err := newKeyGen(dist, keys, rng, &seq)
+			if err != nil {
+				log.Warningf("%v", err)
+				os.Exit(1)
+			}
+			wg.Add(1)
+			go func(conn redis.Conn, role string) {
+				defer wg.Done()
+				defer conn.Close()
+				local := make(map[string]*stat)
+				key := func() string { return prefix + strconv.Itoa(gen()) }
+				names := make([]string, 0, pipeline)
+				for {
+					n := int(atomic.AddInt64(&remaining, -int64(pipeline)))
+					if n <= -pipeline {
+						break
+					}
+					count := pipeline
+					if n < 0 {
+						count += n
+					}
+					names = names[:0]
+					sent := time.Now()
+					for k := 0; k < count; k++ {
+						var name string
+						w := rng.Intn(mixTotal)
+						for _, e := range mix {
+							if w < e.weight {
+								name = e.name
+								break
+							}
+							w -= e.weight
+						}
+						var args []interface{}
+						switch name {
+						case "set":
+							args = []interface{}{key(), value}
+						case "get":
+							args = []interface{}{key()}
+						case "mget", "del":
+							for l := 0; l < mgetKeys; l++ {
+								args = append(args, key())
+							}
+						case "mset":
+							for l := 0; l < mgetKeys; l++ {
+								args = append(args, key(), value)
+							}
+						}
+						conn.Send(name, args...)
+						names = append(names, name)
+					}
+					if err := conn.Flush(); err != nil {
+						log.Warningf("%v", err)
+						return
+					}
+					for _, name := range names {
+						_, err := conn.Receive()
+						lat := time.Since(sent)
+						s := local[name]
+						if s == nil {
+							s = &stat{}
+							local[name] = s
+						}
+						s.lats = append(s.lats, lat)
+						if err != nil {
+							if _, ok := err.(redis.Error); !ok {
+								log.Warningf("%v", err)
+								return
+							}
+							if strings.HasPrefix(err.Error(), "TRY ") {
+								s.redirect++
+							} else {
+								s.errors++
+							}
+						}
+					}
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				for name, s := range local {
+					k := statKey{role, name}
+					all := stats[k]
+					if all == nil {
+						all = &stat{}
+						stats[k] = all
+					}
+					all.lats = append(all.lats, s.lats...)
+					all.errors += s.errors
+					all.redirect += s.redirect
+				}
+			}(conn, roles[host])
+		}
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	var total int
+	var order []statKey
+	for k, s := range stats {
+		order = append(order, k)
+		total += len(s.lats)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].role != order[j].role {
+			return order[i].role < order[j].role
+		}
+		return order[i].cmd < order[j].cmd
+	})
+	fmt.Printf("%d requests in %.2f seconds, %.0f requests per second\n",
+		total, elapsed.Seconds(), float64(total)/elapsed.Seconds())
+	fmt.Printf("%-10s %-6s %9s %9s %9s %9s %9s %8s %8s\n",
+		"role", "cmd", "requests", "rps", "p50", "p99", "max", "errors", "redirect")
+	for _, k := range order {
+		s := stats[k]
+		sort.Slice(s.lats, func(i, j int) bool { return s.lats[i] < s.lats[j] })
+		fmt.Printf("%-10s %-6s %9d %9.0f %9s %9s %9s %8d %8d\n",
+			k.role, k.cmd, len(s.lats), float64(len(s.lats))/elapsed.Seconds(),
+			round(percentile(s.lats, 0.5)), round(percentile(s.lats, 0.99)),
+			round(percentile(s.lats, 1)), s.errors, s.redirect)
+	}
+}
+
+// round rounds a latency for display.
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d / time.Millisecond * time.Millisecond
+	case d >= time.Millisecond:
+		return d / time.Microsecond * time.Microsecond
+	}
+	return d
+}
@@ -0,0 +1,89 @@
+// kvnode-migrate upgrades the database of a stopped node to the layout of
+// this release, and changes its encryption or the compression of its values.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/tidwall/kvnode"
+)
+
+func main() {
+	var dir string
+	var dryRun bool
+	var keyFile, keyEnv string
+	var newKeyFile, newKeyEnv string
+	var decrypt bool
+	var compressionThreshold int
+	flag.StringVar(&dir, "data", "data", "Data directory of the node, which must be stopped")
+	flag.BoolVar(&dryRun, "dry-run", false, "Report the changes without making them")
+	flag.StringVar(&keyFile, "encryption-key-file", "", "File of the AES key that the database is encrypted with")
+	flag.StringVar(&keyEnv, "encryption-key-env", "", "Environment variable of the AES key that the database is encrypted with")
+	flag.StringVar(&newKeyFile, "new-encryption-key-file", "", "Encrypt the database with the AES key in this file")
+	flag.StringVar(&newKeyEnv, "new-encryption-key-env", "", "Encrypt the database with the AES key in this environment variable")
+	flag.BoolVar(&decrypt, "decrypt", false, "Decrypt the database")
+	flag.IntVar(&compressionThreshold, "compression-threshold", -1, "Compress the values of at least this many bytes with snappy, zero to decompress them. -1 keeps the values")
+	flag.Parse()
+
+	var opts kvnode.MigrateOptions
+	opts.DryRun = dryRun
+	var err error
+	if opts.EncryptionKey, err = keyProvider(keyFile, keyEnv); err != nil {
+		fatal(err)
+	}
+	if opts.NewEncryptionKey, err = keyProvider(newKeyFile, newKeyEnv); err != nil {
+		fatal(err)
+	}
+	if decrypt && opts.NewEncryptionKey != nil {
+		fatal(fmt.Errorf("--decrypt can't be used with a new encryption key"))
+	}
+	opts.Rekey = decrypt || opts.NewEncryptionKey != nil
+	if compressionThreshold >= 0 {
+		opts.Recompress = true
+		opts.CompressionThreshold = compressionThreshold
+	}
+	rep, err := kvnode.Migrate(dir, &opts)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("format: %d\n", rep.Format)
+	var kinds []string
+	for kind := range rep.Keys {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Printf("%s: %d\n", kind, rep.Keys[kind])
+	}
+	if len(rep.Changes) == 0 {
+		fmt.Printf("the database is up to date\n")
+		return
+	}
+	verb := "changed"
+	if dryRun {
+		verb = "would change"
+	}
+	for _, change := range rep.Changes {
+		fmt.Printf("%s: %s\n", verb, change)
+	}
+}
+
+func keyProvider(file, env string) (kvnode.KeyProvider, error) {
+	switch {
+	case file != "" && env != "":
+		return nil, fmt.Errorf("a key file and a key variable can't be used together")
+	case file != "":
+		return kvnode.FileKey(file), nil
+	case env != "":
+		return kvnode.EnvKey(env), nil
+	}
+	return nil, nil
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "kvnode-migrate: %v\n", err)
+	os.Exit(1)
+}
@@ -1,16 +1,78 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/tidwall/finn"
 	"github.com/tidwall/kvnode"
 	"github.com/tidwall/redlog"
 )
 
+var log = redlog.New(os.Stderr)
+
+// serverConfig is the configuration of the server, from the command line,
+// the environment and the config file.
+type serverConfig struct {
+	addr, dir, logdir, join string
+	fastlog                 bool
+	consistency, durability finn.Level
+	parseSnapshot           string
+	tlsCertFile             string
+	tlsKeyFile              string
+	tlsClientCAFile         string
+	opts                    kvnode.Options
+}
+
 func main() {
+	fs := flag.CommandLine
+	config, err := loadConfig(fs, os.Args[1:])
+	if err != nil {
+		log.Warningf("%v", err)
+		os.Exit(1)
+	}
+	if config.parseSnapshot != "" {
+		err := kvnode.WriteRedisCommandsFromEncryptedSnapshot(os.Stdout, config.parseSnapshot,
+			config.opts.EncryptionKey)
+		if err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	opts := config.opts
+	if opts.TLSAddr != "" || tlsBinds(opts.Binds) {
+		files, err := kvnode.LoadTLSFiles(config.tlsCertFile, config.tlsKeyFile, config.tlsClientCAFile)
+		if err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+		opts.TLSFiles = files
+	}
+	opts.Reload = func() (*kvnode.Options, error) {
+		fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		config, err := loadConfig(fs, os.Args[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &config.opts, nil
+	}
+	if err := kvnode.ListenAndServe(config.addr, config.join, config.dir, config.logdir,
+		config.fastlog, config.consistency, config.durability, &opts); err != nil {
+		log.Warningf("%v", err)
+	}
+}
+
+// loadConfig parses the flags of the command line, and then loads the
+// flags that weren't on the command line from the environment and the
+// config file.
+func loadConfig(fs *flag.FlagSet, args []string) (*serverConfig, error) {
+	var configFile string
 	var addr string
 	var dir string
 	var logdir string
@@ -19,23 +81,157 @@ func main() {
 	var durability string
 	var fastlog bool
 	var parseSnapshot string
-	flag.BoolVar(&fastlog, "fastlog", false, "use FastLog as the raftlog")
-	flag.StringVar(&addr, "addr", "127.0.0.1:4920", "bind/discoverable ip:port")
-	flag.StringVar(&dir, "data", "data", "data directory")
-	flag.StringVar(&logdir, "log-dir", "", "log directory. If blank it will equals --data")
-	flag.StringVar(&join, "join", "", "Join a cluster by providing an address")
-	flag.StringVar(&consistency, "consistency", "high", "Consistency (low,medium,high)")
-	flag.StringVar(&durability, "durability", "high", "Durability (low,medium,high)")
-	flag.StringVar(&parseSnapshot, "parse-snapshot", "", "Parse and output a snapshot to Redis format")
-	flag.Parse()
-	var log = redlog.New(os.Stderr)
-	if parseSnapshot != "" {
-		err := kvnode.WriteRedisCommandsFromSnapshot(os.Stdout, parseSnapshot)
-		if err != nil {
-			log.Warningf("%v", err)
-			os.Exit(1)
-		}
-		return
+	var tlsAddr string
+	var tlsCertFile string
+	var tlsKeyFile string
+	var tlsClientCAFile string
+	var tlsCertUsers bool
+	var requirePass string
+	var adminAddr string
+	var httpAddr string
+	var grpcAddr string
+	var memcacheAddr string
+	var k8sService string
+	var autoRejoin bool
+	var proxyProtocol bool
+	var inmem bool
+	var maxClients int
+	var idleTimeout time.Duration
+	var maxLifetime time.Duration
+	var clientRateLimit int
+	var clientBandwidthLimit int
+	outputLimits := kvnode.OutputBufferLimits{
+		Pubsub:  kvnode.OutputBufferLimit{Hard: 32 << 20, Soft: 8 << 20, SoftSeconds: 60},
+		Monitor: kvnode.OutputBufferLimit{Hard: 32 << 20, Soft: 8 << 20, SoftSeconds: 60},
+	}
+	var databases int
+	var binds string
+	var protectedMode bool
+	var allow string
+	var deny string
+	var trustedProxies string
+	var peerNetworks string
+	var traceLog bool
+	var logLevel string
+	var readyMaxLag int
+	var auditLog string
+	var adminHTTPAddr string
+	var debugEndpoints bool
+	var hotKeysSampling int
+	var staleReads bool
+	var replicaReads bool
+	var forwardWrites int
+	var flushRequireForce bool
+	var groupCommitWindow time.Duration
+	var groupCommitMax int
+	var compressionThreshold int
+	var revisionRetention time.Duration
+	var coldDir string
+	var coldAfter time.Duration
+	var maxKeySize int
+	var minFreeDiskMB int
+	var maxValueSize int
+	var pdelChunkSize int
+	var maxPendingWrites int
+	var commandWorkers int
+	var leveldbWriteBufferMB int
+	var leveldbBlockCacheMB int
+	var readCacheMB int
+	var encryptionKeyFile string
+	var encryptionKeyEnv string
+	var recoverDB bool
+	var compactionWindow string
+	var compactionRateMB int
+	var snapshotRateMB int
+	var raftLogMaxSizeMB int
+	var raftLogShrink bool
+	var maxKeys int
+	var maxBytesMB int
+	var evictionPolicy string
+	var leveldbTableSizeMB int
+	var leveldbOpenFiles int
+	var leveldbCompression string
+	fs.StringVar(&configFile, "config", os.Getenv("KVNODE_CONFIG"), "Config file with one flag per line, such as 'max-keys 1000'. Flags and KVNODE_ environment variables, such as KVNODE_MAX_KEYS, take precedence")
+	fs.BoolVar(&fastlog, "fastlog", false, "use FastLog as the raftlog")
+	fs.StringVar(&addr, "addr", "127.0.0.1:4920", "bind/discoverable ip:port")
+	fs.StringVar(&dir, "data", "data", "data directory")
+	fs.StringVar(&logdir, "log-dir", "", "log directory. If blank it will equals --data")
+	fs.StringVar(&join, "join", "", "Join a cluster by providing an address, or a comma separated list of addresses that are tried in turn")
+	fs.BoolVar(&autoRejoin, "auto-rejoin", false, "Ask the leader to add the node again when it has had no leader for a while, such as after it was removed from the cluster")
+	fs.StringVar(&consistency, "consistency", "high", "Consistency (low,medium,high)")
+	fs.StringVar(&durability, "durability", "high", "Durability (low,medium,high)")
+	fs.StringVar(&parseSnapshot, "parse-snapshot", "", "Parse and output a snapshot to Redis format")
+	fs.StringVar(&tlsAddr, "tls-addr", "", "bind ip:port for TLS client connections")
+	fs.StringVar(&tlsCertFile, "tls-cert", "", "TLS certificate file")
+	fs.StringVar(&tlsKeyFile, "tls-key", "", "TLS private key file")
+	fs.StringVar(&tlsClientCAFile, "tls-client-ca", "", "Require TLS clients to present a certificate signed by this CA file")
+	fs.BoolVar(&tlsCertUsers, "tls-cert-users", false, "Use the common name of client certificates as the connection user")
+	fs.StringVar(&requirePass, "requirepass", "", "Require clients to AUTH with this password")
+	fs.StringVar(&adminAddr, "admin-addr", "", "bind ip:port for privileged commands, such as 127.0.0.1:4930")
+	fs.StringVar(&httpAddr, "http-addr", "", "bind ip:port for the HTTP gateway")
+	fs.StringVar(&grpcAddr, "grpc-addr", "", "bind ip:port for the gRPC API")
+	fs.StringVar(&memcacheAddr, "memcache-addr", "", "bind ip:port for the memcached gateway, such as 127.0.0.1:11211")
+	fs.StringVar(&k8sService, "k8s-service", "", "Headless service of the StatefulSet that the node is a pod of. The pod IP and the port of --addr are the address, and the cluster is bootstrapped or joined")
+	fs.BoolVar(&proxyProtocol, "proxy-protocol", false, "Accept PROXY protocol headers from load balancers")
+	fs.BoolVar(&inmem, "inmem", false, "Keep the data in memory. It's rebuilt from the raft log on restart")
+	fs.IntVar(&maxClients, "maxclients", 10000, "Maximum number of concurrent client connections. Zero is unlimited")
+	fs.DurationVar(&idleTimeout, "idle-timeout", 0, "Close client connections that are idle for this duration, such as 5m")
+	fs.DurationVar(&maxLifetime, "max-conn-lifetime", 0, "Close client connections that are open for this duration, such as 1h")
+	fs.IntVar(&clientRateLimit, "client-rate-limit", 0, "Commands per second that each connection may send. Zero is unlimited")
+	fs.IntVar(&clientBandwidthLimit, "client-bandwidth-limit", 0, "Bytes of commands per second that each connection may send. Zero is unlimited")
+	fs.Var(&outputLimits, "client-output-buffer-limit", "Output buffer limits of the normal, pubsub and monitor clients, as 'class hard soft seconds' for each class")
+	fs.IntVar(&databases, "databases", 16, "Number of logical databases for SELECT")
+	fs.StringVar(&binds, "bind", "", "Additional bind ip:port addresses or unix:path sockets, separated by commas, each followed by settings such as 'tls', 'admin', 'user=name' or 'perm=770'")
+	fs.BoolVar(&protectedMode, "protected-mode", true, "Refuse connections from other hosts when bound to all interfaces without a password")
+	fs.StringVar(&allow, "allow", "", "Only accept connections from these CIDR blocks, separated by commas")
+	fs.StringVar(&deny, "deny", "", "Refuse connections from these CIDR blocks, separated by commas")
+	fs.StringVar(&trustedProxies, "trusted-proxies", "", "Accept PROXY protocol headers from these CIDR blocks, separated by commas")
+	fs.StringVar(&peerNetworks, "peer-networks", "", "CIDR blocks of the nodes that may join, separated by commas, which the primary address accepts while TLS, a password or --admin-addr is on")
+	fs.IntVar(&readyMaxLag, "ready-max-lag", 1000, "Raft entries a node may be behind while /readyz reports it as ready")
+	fs.StringVar(&adminHTTPAddr, "admin-http-addr", "", "bind ip:port for the pprof and expvar endpoints, such as 127.0.0.1:4931")
+	fs.BoolVar(&debugEndpoints, "debug-endpoints", false, "Enable the pprof and expvar endpoints of --admin-http-addr")
+	fs.DurationVar(&groupCommitWindow, "group-commit-window", 0, "Wait this long for concurrent writes to propose them as one raft entry, such as 200us")
+	fs.IntVar(&groupCommitMax, "group-commit-max", 256, "Maximum number of writes in a group commit")
+	fs.IntVar(&maxPendingWrites, "max-pending-writes", 10000, "Refuse writes with BUSY while this many are waiting to be applied. Zero is unlimited")
+	fs.IntVar(&commandWorkers, "command-workers", 64, "Commands of clients that run at once, while the others wait. Priority commands like INFO and SHUTDOWN never wait. Zero is unlimited")
+	fs.IntVar(&pdelChunkSize, "pdel-chunk-size", 1000, "Number of keys that PDEL deletes in each raft entry")
+	fs.IntVar(&compressionThreshold, "compression-threshold", 0, "Compress values of at least this many bytes with snappy. Zero disables it")
+	fs.IntVar(&minFreeDiskMB, "min-free-disk-mb", 512, "Refuse writes while the data or log directory has less free space than this, in MiB. Zero disables it")
+	fs.IntVar(&maxKeySize, "max-key-size", 64*1024, "Refuse writes of keys longer than this many bytes. Zero is unlimited")
+	fs.IntVar(&maxValueSize, "max-value-size", 64*1024*1024, "Refuse writes of values larger than this many bytes. Zero is unlimited")
+	fs.IntVar(&maxKeys, "max-keys", 0, "Most keys that the node holds, see --eviction-policy. Zero is unlimited")
+	fs.IntVar(&maxBytesMB, "max-bytes-mb", 0, "Most MiB of keys and values that the node holds, see --eviction-policy. Zero is unlimited")
+	fs.StringVar(&evictionPolicy, "eviction-policy", "noeviction", "What to do over --max-keys or --max-bytes-mb (noeviction,allkeys-lru,allkeys-oldest)")
+	fs.StringVar(&encryptionKeyFile, "encryption-key-file", "", "Encrypt the data files with the AES key in this file, in hex or raw bytes")
+	fs.StringVar(&encryptionKeyEnv, "encryption-key-env", "", "Encrypt the data files with the AES key in this environment variable, in hex")
+	fs.StringVar(&compactionWindow, "compaction-window", "", "Compact the whole storage each day in this window of local time, such as 01:00-05:00")
+	fs.IntVar(&compactionRateMB, "compaction-rate-mb", 0, "MiB per second that compactions may write outside --compaction-window and while snapshots are taken. Zero is unlimited")
+	fs.IntVar(&snapshotRateMB, "snapshot-rate-mb", 0, "MiB per second that snapshots are written at. Zero is unlimited")
+	fs.IntVar(&raftLogMaxSizeMB, "raft-log-max-size-mb", 0, "Take a snapshot and shrink the raft log when it's larger than this many MiB, at most once a minute. Zero is unlimited")
+	fs.BoolVar(&raftLogShrink, "raft-log-shrink", false, "Shrink the raft log after every snapshot, to give back the space of the deleted entries")
+	fs.BoolVar(&recoverDB, "recover-db", false, "Recover the database when it's corrupted, rather than failing to start. The keys of damaged blocks are lost")
+	fs.IntVar(&readCacheMB, "read-cache-mb", 0, "Cache the values that GET reads in this many MiB of memory. Zero disables it")
+	fs.DurationVar(&revisionRetention, "revision-retention", 0, "Keep the previous values of keys this long for GET key AT revision, such as 10m")
+	fs.StringVar(&coldDir, "cold-dir", "", "Move cold keys to objects in this directory, such as a bucket that's mounted on every node")
+	fs.DurationVar(&coldAfter, "cold-after", 0, "Move keys that weren't written or read for this long to --cold-dir, such as 720h")
+	fs.IntVar(&leveldbWriteBufferMB, "leveldb-write-buffer-mb", 0, "LevelDB memtable size in MiB. Zero uses the LevelDB default of 4")
+	fs.IntVar(&leveldbBlockCacheMB, "leveldb-block-cache-mb", 0, "LevelDB block cache size in MiB. Zero uses the LevelDB default of 8")
+	fs.IntVar(&leveldbTableSizeMB, "leveldb-table-size-mb", 0, "LevelDB table size for compactions in MiB. Zero uses the LevelDB default of 2")
+	fs.IntVar(&leveldbOpenFiles, "leveldb-open-files", 0, "Maximum number of open LevelDB table files. Zero uses the LevelDB default of 500")
+	fs.StringVar(&leveldbCompression, "leveldb-compression", "snappy", "LevelDB table compression (snappy,none)")
+	fs.BoolVar(&flushRequireForce, "flush-require-force", false, "Require FLUSHDB FORCE and FLUSHALL FORCE")
+	fs.BoolVar(&staleReads, "stale-reads", false, "Serve reads from the local store on any node, regardless of --consistency")
+	fs.BoolVar(&replicaReads, "replica-reads", false, "Serve reads from the local store of followers, which answer writes with READONLY and the leader address")
+	fs.IntVar(&forwardWrites, "forward-writes", 0, "With --replica-reads, forward writes of up to this many bytes from followers to the leader. Zero forwards none")
+	fs.IntVar(&hotKeysSampling, "hotkeys-sampling", 100, "Sample one of every N commands for HOTKEYS. Zero disables it")
+	fs.StringVar(&auditLog, "audit-log", "", "Append administrative and write commands to this file")
+	fs.StringVar(&logLevel, "loglevel", "notice", "Log level (debug,verbose,notice,warning)")
+	fs.BoolVar(&traceLog, "trace-log", false, "Log the spans of commands that are sampled with TRACEPARENT")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := kvnode.LoadConfig(fs, configFile); err != nil {
+		return nil, err
 	}
 	var lconsistency finn.Level
 	switch strings.ToLower(consistency) {
@@ -62,7 +258,120 @@ func main() {
 	if logdir == "" {
 		logdir = dir
 	}
-	if err := kvnode.ListenAndServe(addr, join, dir, logdir, fastlog, lconsistency, ldurability); err != nil {
-		log.Warningf("%v", err)
+	var opts kvnode.Options
+	opts.ConfigFile = configFile
+	opts.LogLevel = logLevel
+	opts.Password = requirePass
+	opts.AdminAddr = adminAddr
+	opts.HTTPAddr = httpAddr
+	opts.GRPCAddr = grpcAddr
+	opts.MemcacheAddr = memcacheAddr
+	opts.K8sService = k8sService
+	opts.AutoRejoin = autoRejoin
+	opts.ReadyMaxLag = readyMaxLag
+	opts.AuditLog = auditLog
+	opts.AdminHTTPAddr = adminHTTPAddr
+	opts.DebugEndpoints = debugEndpoints
+	opts.HotKeysSampling = hotKeysSampling
+	opts.StaleReads = staleReads
+	opts.ReplicaReads = replicaReads
+	opts.ForwardWrites = forwardWrites
+	opts.FlushRequireForce = flushRequireForce
+	opts.CompressionThreshold = compressionThreshold
+	opts.RevisionRetention = revisionRetention
+	if coldDir != "" {
+		opts.ColdStore = kvnode.DirStore(coldDir)
+	}
+	opts.ColdAfter = coldAfter
+	opts.MaxKeySize = maxKeySize
+	opts.MinFreeDiskMB = minFreeDiskMB
+	opts.MaxValueSize = maxValueSize
+	opts.PdelChunkSize = pdelChunkSize
+	opts.MaxPendingWrites = maxPendingWrites
+	opts.CommandWorkers = commandWorkers
+	opts.LevelDBWriteBuffer = leveldbWriteBufferMB << 20
+	opts.LevelDBBlockCache = leveldbBlockCacheMB << 20
+	opts.ReadCacheSize = readCacheMB << 20
+	switch {
+	case encryptionKeyFile != "" && encryptionKeyEnv != "":
+		return nil, errors.New("--encryption-key-file and --encryption-key-env can't be used together")
+	case encryptionKeyFile != "":
+		opts.EncryptionKey = kvnode.FileKey(encryptionKeyFile)
+	case encryptionKeyEnv != "":
+		opts.EncryptionKey = kvnode.EnvKey(encryptionKeyEnv)
+	}
+	opts.RecoverDB = recoverDB
+	opts.CompactionWindow = compactionWindow
+	opts.CompactionRate = compactionRateMB << 20
+	opts.SnapshotRate = snapshotRateMB << 20
+	opts.RaftLogMaxSize = raftLogMaxSizeMB << 20
+	opts.RaftLogShrink = raftLogShrink
+	opts.MaxKeys = maxKeys
+	opts.MaxBytes = maxBytesMB << 20
+	opts.EvictionPolicy = evictionPolicy
+	opts.LevelDBTableSize = leveldbTableSizeMB << 20
+	opts.LevelDBOpenFiles = leveldbOpenFiles
+	opts.LevelDBCompression = leveldbCompression
+	opts.GroupCommitWindow = groupCommitWindow
+	opts.GroupCommitMax = groupCommitMax
+	opts.ProxyProtocol = proxyProtocol
+	opts.InMemory = inmem
+	opts.MaxClients = maxClients
+	opts.IdleTimeout = idleTimeout
+	opts.MaxLifetime = maxLifetime
+	opts.ClientRateLimit = clientRateLimit
+	opts.ClientBandwidthLimit = clientBandwidthLimit
+	opts.OutputBufferLimits = outputLimits
+	opts.Databases = databases
+	opts.ProtectedMode = protectedMode
+	for _, bind := range splitList(binds) {
+		b, err := kvnode.ParseBind(bind)
+		if err != nil {
+			return nil, err
+		}
+		opts.Binds = append(opts.Binds, b)
+	}
+	opts.Allow = splitList(allow)
+	opts.Deny = splitList(deny)
+	opts.TrustedProxies = splitList(trustedProxies)
+	opts.PeerNetworks = splitList(peerNetworks)
+	if proxyProtocol && len(opts.TrustedProxies) == 0 {
+		return nil, errors.New("--proxy-protocol requires --trusted-proxies")
+	}
+	if traceLog {
+		opts.Tracer = kvnode.NewLogTracer()
+	}
+	opts.TLSAddr = tlsAddr
+	opts.TLSCertUsers = tlsCertUsers
+	return &serverConfig{
+		addr: addr, dir: dir, logdir: logdir, join: join,
+		fastlog:     fastlog,
+		consistency: lconsistency, durability: ldurability,
+		parseSnapshot:   parseSnapshot,
+		tlsCertFile:     tlsCertFile,
+		tlsKeyFile:      tlsKeyFile,
+		tlsClientCAFile: tlsClientCAFile,
+		opts:            opts,
+	}, nil
+}
+
+// tlsBinds returns true if any of the bind addresses accepts TLS.
+func tlsBinds(binds []kvnode.Bind) bool {
+	for _, b := range binds {
+		if b.TLS {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList returns the non-empty items of a comma separated list.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
 }
@@ -0,0 +1,407 @@
+// kvnodectl is the admin tool of kvnode clusters. It wraps the admin
+// commands, so operators don't have to remember the raw commands, and it
+// sends the commands that must run on the leader to the leader.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/kvnode"
+	"github.com/tidwall/redcon"
+)
+
+// restoreBatch is the number of commands of a restore that are pipelined
+// before their replies are read.
+const restoreBatch = 1000
+
+const usage = `Usage: kvnodectl [options] command [args...]
+
+Commands:
+  status                      Show the raft state, the leader and the peers
+  add-node addr               Add a node to the cluster
+  remove-node addr            Remove a node from the cluster
+  snapshot                    Take a raft snapshot, which is the backup
+  shrink-log                  Shrink the raft log
+  restore state.bin           Write the keys of a snapshot to the cluster
+  config get pattern...       Show configuration parameters
+  config set name value...    Change configuration parameters
+  config rewrite              Write the configuration to the config file
+  latency [subcommand...]     Show the slowest commands (LATENCY LATEST)
+  clients                     List the client connections
+  kill-client filter...       Close client connections, such as ID 5
+  info [section...]           Show the INFO sections
+  compact [prefix]            Compact the storage
+
+Options:
+`
+
+// client is a connection to a node, with the options to connect to other
+// nodes of the cluster.
+type client struct {
+	redis.Conn
+	addr     string
+	user     string
+	password string
+	tls      *tls.Config
+	// key provides the key of encrypted snapshots, for restore.
+	key kvnode.KeyProvider
+}
+
+func dial(addr, user, password string, tlsConfig *tls.Config) (*client, error) {
+	opts := []redis.DialOption{redis.DialConnectTimeout(5 * time.Second)}
+	if tlsConfig != nil {
+		opts = append(opts, redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+			d := &net.Dialer{Timeout: 5 * time.Second}
+			return tls.DialWithDialer(d, network, addr, tlsConfig)
+		}))
+	}
+	conn, err := redis.Dial("tcp", addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		args := []interface{}{password}
+		if user != "" {
+			args = []interface{}{user, password}
+		}
+		if _, err := conn.Do("AUTH", args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &client{Conn: conn, addr: addr, user: user, password: password, tls: tlsConfig}, nil
+}
+
+// leader returns a connection to the leader, which is the client itself
+// when it's connected to the leader.
+func (c *client) leader() (*client, error) {
+	leader, err := redis.String(c.Do("RAFTLEADER"))
+	if err == redis.ErrNil {
+		return nil, errors.New("the cluster has no leader")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if leader == c.addr {
+		return c, nil
+	}
+	return dial(leader, c.user, c.password, c.tls)
+}
+
+// doLeader runs a command on the leader. The leader answers directly, and
+// the other nodes answer with "TRY addr", which is followed once.
+func (c *client) doLeader(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Do(cmd, args...)
+	if err == nil || !strings.HasPrefix(err.Error(), "TRY ") {
+		return reply, err
+	}
+	lc, err2 := dial(strings.TrimPrefix(err.Error(), "TRY "), c.user, c.password, c.tls)
+	if err2 != nil {
+		return nil, err
+	}
+	defer lc.Close()
+	return lc.Do(cmd, args...)
+}
+
+func main() {
+	var addr, user, password string
+	var useTLS, tlsInsecure bool
+	var tlsCAFile, tlsCertFile, tlsKeyFile string
+	var encryptionKeyFile string
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&addr, "addr", "127.0.0.1:4920", "Address of the node")
+	flag.StringVar(&user, "user", "", "ACL user to AUTH with")
+	flag.StringVar(&password, "a", os.Getenv("KVNODE_PASSWORD"), "Password to AUTH with, or $KVNODE_PASSWORD")
+	flag.BoolVar(&useTLS, "tls", false, "Connect over TLS")
+	flag.StringVar(&tlsCAFile, "tls-ca", "", "CA file that verifies the certificate of the node")
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "Client certificate file, for mutual TLS")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "Client private key file, for mutual TLS")
+	flag.BoolVar(&tlsInsecure, "tls-insecure", false, "Skip the verification of the certificate of the node")
+	flag.StringVar(&encryptionKeyFile, "encryption-key-file", "", "Key file of the nodes, which restore decrypts snapshots with")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var tlsConfig *tls.Config
+	if useTLS {
+		var err error
+		tlsConfig, err = clientTLSConfig(tlsCAFile, tlsCertFile, tlsKeyFile, tlsInsecure)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	c, err := dial(addr, user, password, tlsConfig)
+	if err != nil {
+		fatal(err)
+	}
+	defer c.Close()
+	if encryptionKeyFile != "" {
+		c.key = kvnode.FileKey(encryptionKeyFile)
+	}
+	if err := run(c, args[0], args[1:]); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "kvnodectl: %v\n", err)
+	os.Exit(1)
+}
+
+// clientTLSConfig returns the TLS configuration for connecting to a node.
+func clientTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// run runs a command of the tool.
+func run(c *client, name string, args []string) error {
+	want := func(min, max int) error {
+		if len(args) < min || (max >= 0 && len(args) > max) {
+			return fmt.Errorf("wrong number of arguments for '%s'", name)
+		}
+		return nil
+	}
+	var reply interface{}
+	var err error
+	switch name {
+	default:
+		return fmt.Errorf("unknown command '%s', see kvnodectl -h", name)
+	case "status":
+		if err := want(0, 0); err != nil {
+			return err
+		}
+		return status(c)
+	case "add-node":
+		if err := want(1, 1); err != nil {
+			return err
+		}
+		reply, err = c.doLeader("RAFTADDPEER", args[0])
+	case "remove-node":
+		if err := want(1, 1); err != nil {
+			return err
+		}
+		reply, err = c.doLeader("RAFTREMOVEPEER", args[0])
+	case "snapshot":
+		if err := want(0, 0); err != nil {
+			return err
+		}
+		reply, err = c.Do("RAFTSNAPSHOT")
+	case "shrink-log":
+		if err := want(0, 0); err != nil {
+			return err
+		}
+		reply, err = c.Do("RAFTSHRINKLOG")
+	case "restore":
+		if err := want(1, 1); err != nil {
+			return err
+		}
+		return restore(c, args[0])
+	case "config":
+		if err := want(1, -1); err != nil {
+			return err
+		}
+		switch strings.ToLower(args[0]) {
+		case "set":
+			reply, err = c.doLeader("CONFIG", strArgs(args)...)
+		default:
+			reply, err = c.Do("CONFIG", strArgs(args)...)
+		}
+	case "latency":
+		if len(args) == 0 {
+			args = []string{"LATEST"}
+		}
+		reply, err = c.Do("LATENCY", strArgs(args)...)
+	case "clients":
+		if err := want(0, 0); err != nil {
+			return err
+		}
+		reply, err = c.Do("CLIENT", "LIST")
+	case "kill-client":
+		if err := want(1, -1); err != nil {
+			return err
+		}
+		reply, err = c.Do("CLIENT", strArgs(append([]string{"KILL"}, args...))...)
+	case "info":
+		reply, err = c.Do("INFO", strArgs(args)...)
+	case "compact":
+		if err := want(0, 1); err != nil {
+			return err
+		}
+		reply, err = c.doLeader("COMPACT", strArgs(args)...)
+	}
+	if err != nil {
+		return err
+	}
+	printReply(os.Stdout, reply, "")
+	return nil
+}
+
+func strArgs(args []string) []interface{} {
+	iargs := make([]interface{}, len(args))
+	for i, arg := range args {
+		iargs[i] = arg
+	}
+	return iargs
+}
+
+// status prints the raft state of the node, the leader, and the peers that
+// the node knows about.
+func status(c *client) error {
+	state, err := redis.String(c.Do("RAFTSTATE"))
+	if err != nil {
+		return err
+	}
+	leader, err := redis.String(c.Do("RAFTLEADER"))
+	if err == redis.ErrNil {
+		leader = "(none)"
+	} else if err != nil {
+		return err
+	}
+	peers, err := redis.StringMap(c.Do("RAFTPEERS"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("node:   %s\n", c.addr)
+	fmt.Printf("state:  %s\n", state)
+	fmt.Printf("leader: %s\n", leader)
+	var addrs []string
+	for addr := range peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	fmt.Printf("peers:  %d\n", len(addrs))
+	for _, addr := range addrs {
+		fmt.Printf("  %s %s\n", addr, peers[addr])
+	}
+	return nil
+}
+
+// restore writes the keys of a snapshot to the leader, like piping the
+// output of "kvnode-server --parse-snapshot" to "redis-cli --pipe".
+func restore(c *client, path string) error {
+	lc, err := c.leader()
+	if err != nil {
+		return err
+	}
+	if lc != c {
+		defer lc.Close()
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(kvnode.WriteRedisCommandsFromEncryptedSnapshot(pw, path, c.key))
+	}()
+	defer pr.Close()
+	rd := redcon.NewReader(pr)
+	var sent, keys int
+	flush := func() error {
+		if err := lc.Flush(); err != nil {
+			return err
+		}
+		for ; sent > 0; sent-- {
+			if _, err := lc.Receive(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for {
+		cmd, err := rd.ReadCommand()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		args := make([]interface{}, len(cmd.Args)-1)
+		for i, arg := range cmd.Args[1:] {
+			args[i] = arg
+		}
+		if err := lc.Send(string(cmd.Args[0]), args...); err != nil {
+			return err
+		}
+		if strings.EqualFold(string(cmd.Args[0]), "set") {
+			keys++
+		}
+		if sent++; sent == restoreBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	fmt.Printf("restored %d keys to %s\n", keys, lc.addr)
+	return nil
+}
+
+// printReply prints a reply the way redis-cli does.
+func printReply(w io.Writer, reply interface{}, indent string) {
+	switch v := reply.(type) {
+	case nil:
+		fmt.Fprintln(w, "(nil)")
+	case int64:
+		fmt.Fprintf(w, "(integer) %d\n", v)
+	case string:
+		fmt.Fprintln(w, v)
+	case []byte:
+		s := string(v)
+		if strings.Contains(s, "\n") {
+			fmt.Fprint(w, strings.Replace(s, "\r\n", "\n", -1))
+			if !strings.HasSuffix(s, "\n") {
+				fmt.Fprintln(w)
+			}
+		} else {
+			fmt.Fprintf(w, "%q\n", s)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			fmt.Fprintln(w, "(empty array)")
+		}
+		for i, item := range v {
+			prefix := fmt.Sprintf("%d) ", i+1)
+			if i > 0 {
+				fmt.Fprint(w, indent)
+			}
+			fmt.Fprint(w, prefix)
+			printReply(w, item, indent+strings.Repeat(" ", len(prefix)))
+		}
+	default:
+		fmt.Fprintln(w, v)
+	}
+}
@@ -0,0 +1,411 @@
+package kvnode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	// coldInterval is how often the leader sweeps the keys for keys to move
+	// to the cold store.
+	coldInterval = time.Second
+	// coldSweep is the number of keys that each sweep checks.
+	coldSweep = 1024
+	// coldBatch is the most keys that a TIER entry moves.
+	coldBatch = 128
+	// coldMinSize is the smallest stored value that's moved to the cold
+	// store, since the stubs of smaller values would save little.
+	coldMinSize = 256
+	// coldWarmQueue is the number of cold keys that were read and are
+	// waiting to be moved back to the database.
+	coldWarmQueue = 1024
+)
+
+var (
+	errNoColdStore = errors.New("ERR the value is in cold storage, " +
+		"and no cold store is configured")
+	errColdObject = errors.New("ERR the object of the value in cold storage " +
+		"doesn't match its key")
+)
+
+// ColdStore is the object storage of the cold tier, such as a bucket, that
+// the values of keys that weren't used for Options.ColdAfter are moved to.
+// The database keeps a stub of each value, with the name of its object.
+// Every node of a cluster must be able to read the objects that the leader
+// writes, and objects are never deleted by the node, since stubs may live
+// on in snapshots and backups.
+type ColdStore interface {
+	// Put stores an object, replacing it when it exists.
+	Put(name string, data []byte) error
+	// Get returns an object.
+	Get(name string) ([]byte, error)
+}
+
+// DirStore returns a ColdStore that keeps the objects as files in a
+// directory, such as a bucket or a network file system that's mounted on
+// every node.
+func DirStore(dir string) ColdStore {
+	return dirStore(dir)
+}
+
+type dirStore string
+
+// path returns the file of an object. The objects are spread over
+// subdirectories of the first two characters of their names.
+func (d dirStore) path(name string) string {
+	return filepath.Join(string(d), name[:2], name)
+}
+
+func (d dirStore) Put(name string, data []byte) error {
+	path := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// the object is written to a temporary file and renamed, so that a
+	// partial object is never read.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d dirStore) Get(name string) ([]byte, error) {
+	return ioutil.ReadFile(d.path(name))
+}
+
+// coldName returns the name of the object of a version of a database key,
+// which is the same on every node and for every attempt to move it.
+func coldName(key []byte, version uint64) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:]) + "-" + strconv.FormatUint(version, 16)
+}
+
+// coldState is the state of the cold tier on the node.
+type coldState struct {
+	// warm holds the cold keys that were read, to be moved back to the
+	// database by the leader.
+	warm chan coldKey
+	// pending is the database keys that are in warm.
+	pending sync.Map
+}
+
+// coldKey is a key whose value was read from the cold store.
+type coldKey struct {
+	key    []byte // the database key
+	object []byte // the stored value of the object
+}
+
+// keyspaceOfKey returns the keyspace of a database key, which is false for
+// keys that aren't in a database or a namespace.
+func keyspaceOfKey(key []byte) (keyspace, bool) {
+	if ns, _, ok := parseNSKey(key); ok {
+		return keyspace{ns: ns}, true
+	}
+	if db, _, ok := parseDBKey(key); ok {
+		return keyspace{db: db}, true
+	}
+	return keyspace{}, false
+}
+
+// fetchCold returns the stored value of the object of a stub from the cold
+// store.
+func (kvm *Machine) fetchCold(stub []byte) ([]byte, error) {
+	store := kvm.options().ColdStore
+	if store == nil {
+		return nil, errNoColdStore
+	}
+	object, err := store.Get(coldObject(stub))
+	if err != nil {
+		return nil, errors.New("ERR reading the value from cold storage: " + err.Error())
+	}
+	if valueVersion(object) != valueVersion(stub) {
+		return nil, errColdObject
+	}
+	atomic.AddInt64(&kvm.stats.coldReads, 1)
+	return object, nil
+}
+
+// loadValue returns the value of a stored value, like decodeValue, but the
+// values of stubs are read from the cold store. When key, the database key
+// of the value, is not nil, the read is an access of the key, and the key
+// is moved back to the database.
+func (kvm *Machine) loadValue(key, stored []byte) ([]byte, error) {
+	if coldObject(stored) == "" {
+		return decodeValue(stored)
+	}
+	object, err := kvm.fetchCold(stored)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		kvm.queueWarm(key, object)
+	}
+	return decodeValue(object)
+}
+
+// scanValue returns the value of a stored value that's scanned, reading the
+// values of stubs from the cold store. Scans aren't accesses of the keys, so
+// cold keys stay in the store.
+func (kvm *Machine) scanValue(stored []byte) ([]byte, error) {
+	return kvm.loadValue(nil, stored)
+}
+
+// queueWarm queues a cold key that was read, to be moved back to the
+// database. The key is dropped when the queue is full, so reads never wait.
+func (kvm *Machine) queueWarm(key, object []byte) {
+	if _, loaded := kvm.cold.pending.LoadOrStore(string(key), true); loaded {
+		return
+	}
+	w := coldKey{key: append([]byte(nil), key...), object: object}
+	select {
+	case kvm.cold.warm <- w:
+	default:
+		kvm.cold.pending.Delete(string(key))
+	}
+}
+
+// warmKeys moves the cold keys of a write back to the database before the
+// write is proposed, for the writes that compare the values of keys, which
+// refuse cold values when they're applied. Errors are left to the write.
+func (kvm *Machine) warmKeys(ks keyspace, keys [][]byte) {
+	if kvm.options().ColdStore == nil {
+		return
+	}
+	for _, key := range keys {
+		key = ks.key(key)
+		kvm.dbmu.RLock()
+		stored, err := kvm.db.Get(key, nil)
+		kvm.dbmu.RUnlock()
+		if err != nil || coldObject(stored) == "" {
+			continue
+		}
+		if object, err := kvm.fetchCold(stored); err == nil {
+			kvm.warm(coldKey{key: key, object: object})
+		}
+	}
+}
+
+// warm proposes "UNTIER key object", which moves a cold key back to the
+// database.
+func (kvm *Machine) warm(w coldKey) error {
+	_, err := kvm.exec([]byte("untier"), w.key, w.object)
+	return err
+}
+
+// tierKeys moves the keys that weren't written or read for ColdAfter to the
+// ColdStore, and moves the cold keys that are read back to the database.
+// The leader sweeps the keys, like evictKeys, writes the values of the
+// chosen keys to the store, and proposes "TIER key version [key version
+// ...]", so that every node replaces the same values with stubs.
+func (kvm *Machine) tierKeys() {
+	var sweep evictSweep
+	t := time.NewTicker(coldInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-kvm.done:
+			return
+		case w := <-kvm.cold.warm:
+			if err := kvm.warm(w); err != nil && !isNotLeader(err) {
+				log.Warningf("moving a key back from cold storage: %v", err)
+			}
+			kvm.cold.pending.Delete(string(w.key))
+			continue
+		case <-t.C:
+		}
+		opts := kvm.options()
+		if opts.ColdStore == nil || opts.ColdAfter <= 0 {
+			continue
+		}
+		if stats, _, err := kvm.raftInfo(); err != nil || stats["state"] != "Leader" {
+			continue
+		}
+		if err := kvm.tierOnce(opts, &sweep); err != nil && !isNotLeader(err) {
+			log.Warningf("moving keys to cold storage: %v", err)
+		}
+	}
+}
+
+// isNotLeader returns true for the errors of writes that are proposed on a
+// node that isn't the leader.
+func isNotLeader(err error) bool {
+	if _, ok := err.(*NotLeaderError); ok {
+		return true
+	}
+	return err.Error() == raft.ErrNotLeader.Error() || err == errNotReady
+}
+
+// tierOnce sweeps the next coldSweep keys, and moves the keys that weren't
+// used for ColdAfter to the cold store.
+func (kvm *Machine) tierOnce(opts *Options, sweep *evictSweep) error {
+	kvm.dbmu.RLock()
+	ss, err := kvm.db.GetSnapshot()
+	kvm.dbmu.RUnlock()
+	if err != nil {
+		return err
+	}
+	keys, values, err := sweep.next(ss, coldSweep)
+	ss.Release()
+	if err != nil {
+		return err
+	}
+	cutoff := uint64(time.Now().Add(-opts.ColdAfter).UnixNano())
+	args := [][]byte{[]byte("tier")}
+	chosen := make(map[string]bool)
+	propose := func() error {
+		if len(args) == 1 {
+			return nil
+		}
+		_, err := kvm.exec(args...)
+		args = args[:1]
+		return err
+	}
+	for i, key := range keys {
+		// values without a version were written by older releases, and
+		// their last use isn't known.
+		version := valueVersion(values[i])
+		if version == 0 || len(values[i]) < coldMinSize || chosen[string(key)] ||
+			coldObject(values[i]) != "" || kvm.lastUse(policyLRU, key, values[i]) > cutoff {
+			continue
+		}
+		chosen[string(key)] = true
+		if err := opts.ColdStore.Put(coldName(key, version), values[i]); err != nil {
+			return err
+		}
+		args = append(args, key, []byte(strconv.FormatUint(version, 10)))
+		if len(args)-1 == coldBatch*2 {
+			if err := propose(); err != nil {
+				return err
+			}
+		}
+	}
+	return propose()
+}
+
+// tierChange returns true when the change of a key at a revision, which
+// left the stored value, moved the value to or from the cold store. Stubs
+// are only written by TIER, and UNTIER replaces a stub with the value of
+// the same version, which no other write does.
+func tierChange(ss Snapshot, key []byte, rev uint64, stored []byte) (bool, error) {
+	if coldObject(stored) != "" {
+		return true, nil
+	}
+	prev, err := valueAt(ss, key, rev-1)
+	if err != nil {
+		return false, err
+	}
+	return coldObject(prev) != "" && valueVersion(prev) == valueVersion(stored), nil
+}
+
+// cmdTier handles "TIER key version [key version ...]", which replaces the
+// values of keys with the stubs of their objects in the cold store. Keys
+// that were written since they were chosen, or were deleted, are skipped.
+// The keys are database keys. It's only proposed by the node.
+func (kvm *Machine) cmdTier(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 3 || len(cmd.Args)%2 == 0 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			batches := make(map[keyspace]*leveldb.Batch)
+			var order []keyspace
+			var tiered int
+			for i := 1; i < len(cmd.Args); i += 2 {
+				key := cmd.Args[i]
+				version, err := strconv.ParseUint(string(cmd.Args[i+1]), 10, 64)
+				if err != nil {
+					return nil, errVersion
+				}
+				ks, ok := keyspaceOfKey(key)
+				if !ok {
+					continue
+				}
+				stored, err := kvm.db.Get(key, nil)
+				if err == leveldb.ErrNotFound {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				if valueVersion(stored) != version || coldObject(stored) != "" {
+					continue
+				}
+				batch := batches[ks]
+				if batch == nil {
+					batch = new(leveldb.Batch)
+					batches[ks] = batch
+					order = append(order, ks)
+				}
+				batch.Put(key, encodeStub(stored, coldName(key, version)))
+				tiered++
+			}
+			for _, ks := range order {
+				if err := kvm.writeBatch(ks, batches[ks]); err != nil {
+					return nil, err
+				}
+			}
+			atomic.AddInt64(&kvm.stats.coldStored, int64(tiered))
+			return tiered, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteInt(v.(int))
+			return nil, nil
+		},
+	)
+}
+
+// cmdUntier handles "UNTIER key object", which replaces the stub of a cold
+// key with the stored value of its object, when the stub is still for the
+// version of the object. The key is a database key. It's only proposed by
+// the node.
+func (kvm *Machine) cmdUntier(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key, object := cmd.Args[1], cmd.Args[2]
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			ks, ok := keyspaceOfKey(key)
+			if !ok {
+				return 0, nil
+			}
+			stored, err := kvm.db.Get(key, nil)
+			if err == leveldb.ErrNotFound {
+				return 0, nil
+			} else if err != nil {
+				return nil, err
+			}
+			if coldObject(stored) == "" || valueVersion(stored) != valueVersion(object) {
+				return 0, nil
+			}
+			var batch leveldb.Batch
+			batch.Put(key, object)
+			if err := kvm.writeBatch(ks, &batch); err != nil {
+				return nil, err
+			}
+			atomic.AddInt64(&kvm.stats.coldLoaded, 1)
+			return 1, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteInt(v.(int))
+			return nil, nil
+		},
+	)
+}
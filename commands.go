@@ -0,0 +1,497 @@
+package kvnode
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// commandInfo describes a command that is handled by the machine.
+type commandInfo struct {
+	// arity is the number of arguments, including the command name.
+	// A negative value means at least that many arguments.
+	arity int
+	// flags are the Redis command flags, such as "write" or "readonly".
+	flags []string
+	// firstKey, lastKey and step are the positions of the key arguments.
+	// A negative lastKey is relative to the end of the arguments.
+	firstKey, lastKey, step int
+	// keys returns the key arguments of commands with keys that move,
+	// rather than firstKey, lastKey and step.
+	keys func(args [][]byte) [][]byte
+	// pattern is the position of a key pattern argument, or zero.
+	pattern int
+	// categories are the ACL categories, without the '@' prefix.
+	categories []string
+	// privileged commands are only allowed on the admin listener, when
+	// one is configured.
+	privileged bool
+	// priority commands skip the command lane, so that the node can be
+	// observed and managed while the other commands wait for a worker.
+	priority bool
+}
+
+// commands are all of the commands handled by the machine. Subcommands that
+// need more restrictions than their command are named "command|subcommand".
+var commands = map[string]commandInfo{
+	"auth": {arity: -2, flags: []string{"noscript", "loading", "stale", "fast"},
+		categories: []string{"connection", "fast"}, priority: true},
+	"hello": {arity: -1, flags: []string{"noscript", "loading", "stale", "fast"},
+		categories: []string{"connection", "fast"}, priority: true},
+	"client": {arity: -2, flags: []string{"noscript", "loading", "stale"},
+		categories: []string{"connection", "slow"}},
+	"client|list": {arity: -2, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "connection", "slow", "dangerous"},
+		privileged: true, priority: true},
+	"client|kill": {arity: -3, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "connection", "slow", "dangerous"},
+		privileged: true, priority: true},
+	// ping and quit are handled by the raft layer and never reach the
+	// machine, they're here for COMMAND.
+	"ping": {arity: -1, flags: []string{"fast"},
+		categories: []string{"connection", "fast"}},
+	"quit": {arity: -1, flags: []string{"noscript", "loading", "stale", "fast"},
+		categories: []string{"connection", "fast"}},
+	"select": {arity: 2, flags: []string{"loading", "stale", "fast"},
+		categories: []string{"connection", "fast"}},
+	"time": {arity: 1, flags: []string{"loading", "stale", "fast"},
+		categories: []string{"fast"}},
+	"hlc": {arity: -1, flags: []string{"stale", "fast"},
+		categories: []string{"fast"}},
+	"hlc|update": {arity: 3, flags: []string{"write", "fast"},
+		categories: []string{"write", "fast"}},
+	"echo": {arity: 2, flags: []string{"fast"},
+		categories: []string{"connection", "fast"}},
+	"traceparent": {arity: 2, flags: []string{"loading", "stale", "fast"},
+		categories: []string{"connection", "fast"}},
+	"reqid": {arity: 2, flags: []string{"loading", "stale", "fast"},
+		categories: []string{"connection", "fast"}},
+	"minrev": {arity: 2, flags: []string{"loading", "stale", "fast"},
+		categories: []string{"connection", "fast"}},
+	"lastrev": {arity: 1, flags: []string{"loading", "stale", "fast"},
+		categories: []string{"connection", "fast"}},
+	"multi": {arity: 2, flags: []string{"loading", "stale", "fast"},
+		categories: []string{"transaction", "fast"}},
+	"exec": {arity: 1, flags: []string{"readonly", "loading", "stale"},
+		categories: []string{"read", "transaction", "slow"}},
+	"discard": {arity: 1, flags: []string{"loading", "stale", "fast"},
+		categories: []string{"transaction", "fast"}},
+	"set": {arity: -3, flags: []string{"write"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"write", "keyspace", "slow"}},
+	"mset": {arity: -3, flags: []string{"write"}, firstKey: 1, lastKey: -1, step: 2,
+		categories: []string{"write", "keyspace", "slow"}},
+	"mappend": {arity: -3, flags: []string{"write"}, firstKey: 1, lastKey: -1, step: 2,
+		categories: []string{"write", "keyspace", "slow"}},
+	"msetif": {arity: -4, flags: []string{"write", "movablekeys"}, firstKey: 1, lastKey: -1, step: 3,
+		keys:       msetifKeys,
+		categories: []string{"write", "keyspace", "slow"}},
+	"fcall": {arity: -3, flags: []string{"write", "movablekeys"},
+		keys:       fcallKeys,
+		categories: []string{"write", "scripting", "slow"}},
+	"fcall_ro": {arity: -3, flags: []string{"readonly", "movablekeys"},
+		keys:       fcallKeys,
+		categories: []string{"read", "scripting", "slow"}},
+	"get": {arity: -2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"read", "keyspace", "fast"}},
+	"revision": {arity: 1, flags: []string{"readonly", "fast"},
+		categories: []string{"read", "keyspace", "fast"}},
+	"getver": {arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"read", "keyspace", "fast"}},
+	"keyinfo": {arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+		categories: []string{"read", "keyspace", "fast"}},
+	"mget": {arity: -2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: -1, step: 1,
+		categories: []string{"read", "keyspace", "fast"}},
+	"del": {arity: -2, flags: []string{"write"}, firstKey: 1, lastKey: -1, step: 1,
+		categories: []string{"write", "keyspace", "slow"}},
+	"delif": {arity: -3, flags: []string{"write", "movablekeys"}, firstKey: 2, lastKey: -1, step: 1,
+		keys:       delifKeys,
+		categories: []string{"write", "keyspace", "slow"}},
+	"pdel": {arity: -2, flags: []string{"write"}, pattern: 1,
+		categories: []string{"write", "keyspace", "slow", "dangerous"}},
+	"popmatch": {arity: 2, flags: []string{"write"}, pattern: 1,
+		categories: []string{"write", "keyspace", "slow"}},
+	"keys": {arity: -2, flags: []string{"readonly", "sort_for_script"}, pattern: 1,
+		categories: []string{"read", "keyspace", "slow", "dangerous"}},
+	"watchkeys": {arity: -2, flags: []string{"readonly", "pubsub"}, pattern: 1,
+		categories: []string{"read", "pubsub", "slow"}},
+	"flushdb": {arity: -1, flags: []string{"write"},
+		categories: []string{"write", "keyspace", "slow", "dangerous"},
+		privileged: true},
+	"flushall": {arity: -1, flags: []string{"write"},
+		categories: []string{"write", "keyspace", "slow", "dangerous"},
+		privileged: true},
+	"shutdown": {arity: -1, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"},
+		privileged: true, priority: true},
+	"monitor": {arity: 1, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"},
+		privileged: true, priority: true},
+	"config": {arity: -2, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"},
+		privileged: true, priority: true},
+	"info": {arity: -1, flags: []string{"loading", "stale"},
+		categories: []string{"slow", "dangerous"}, priority: true},
+	"command": {arity: -1, flags: []string{"loading", "stale"},
+		categories: []string{"connection", "slow"}},
+	"acl": {arity: -2, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"},
+		privileged: true},
+	"latency": {arity: -2, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"},
+		privileged: true, priority: true},
+	"bigkeys": {arity: -1, flags: []string{"admin", "noscript", "readonly"},
+		categories: []string{"admin", "keyspace", "read", "slow", "dangerous"},
+		privileged: true},
+	"prefixstats": {arity: -2, flags: []string{"admin", "noscript", "readonly"},
+		categories: []string{"admin", "keyspace", "read", "slow", "dangerous"},
+		privileged: true},
+	"compact": {arity: -1, flags: []string{"admin", "noscript", "stale"},
+		categories: []string{"admin", "keyspace", "slow", "dangerous"},
+		privileged: true},
+	"checkdb": {arity: 1, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"},
+		privileged: true},
+	"dbstats": {arity: -1, flags: []string{"admin", "noscript", "stale"},
+		categories: []string{"admin", "keyspace", "slow", "dangerous"},
+		privileged: true},
+	"object": {arity: -2, flags: []string{"readonly"}, firstKey: 2, lastKey: 2, step: 1,
+		categories: []string{"read", "keyspace", "slow"}},
+	"memory": {arity: -2, flags: []string{"readonly"},
+		categories: []string{"read", "slow"}},
+	"memory|usage": {arity: -3, flags: []string{"readonly"}, firstKey: 2, lastKey: 2, step: 1,
+		categories: []string{"read", "keyspace", "slow"}},
+	"memory|stats": {arity: 2, flags: []string{"readonly", "loading", "stale"},
+		categories: []string{"read", "slow"}},
+	"debug": {arity: -2, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"}},
+	"debug|object": {arity: 3, flags: []string{"admin", "noscript", "readonly"}, firstKey: 2, lastKey: 2, step: 1,
+		categories: []string{"admin", "keyspace", "read", "slow", "dangerous"}},
+	"debug|sleep": {arity: 3, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"},
+		privileged: true},
+	"debug|drop-follower": {arity: 3, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"},
+		privileged: true},
+	"debug|snapshot": {arity: 2, flags: []string{"admin", "noscript", "stale"},
+		categories: []string{"admin", "slow", "dangerous"},
+		privileged: true},
+	"hotkeys": {arity: -1, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "keyspace", "slow", "dangerous"},
+		privileged: true},
+	"raft": {arity: -2, flags: []string{"noscript", "loading", "stale"},
+		categories: []string{"slow"}, priority: true},
+	"raft|addpeer": {arity: 3, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"},
+		privileged: true},
+	"raft|removepeer": {arity: 3, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"},
+		privileged: true},
+	"raft|snapshot": {arity: 2, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"}},
+	"raft|shrinklog": {arity: 2, flags: []string{"admin", "noscript", "loading", "stale"},
+		categories: []string{"admin", "slow", "dangerous"}},
+	"raft|leader": {arity: 2, flags: []string{"noscript", "loading", "stale"},
+		categories: []string{"slow"}},
+	"raft|state": {arity: 2, flags: []string{"noscript", "loading", "stale"},
+		categories: []string{"slow"}},
+	"raft|stats": {arity: 2, flags: []string{"noscript", "loading", "stale"},
+		categories: []string{"slow"}},
+	"raft|peers": {arity: 2, flags: []string{"noscript", "loading", "stale"},
+		categories: []string{"slow"}},
+	"namespace": {arity: -2, flags: []string{"loading", "stale"},
+		categories: []string{"keyspace", "connection", "slow"}},
+	"namespace|create": {arity: -3, flags: []string{"admin", "write"},
+		categories: []string{"admin", "keyspace", "slow", "dangerous"},
+		privileged: true},
+	"namespace|quota": {arity: -3, flags: []string{"admin", "write"},
+		categories: []string{"admin", "keyspace", "slow", "dangerous"},
+		privileged: true},
+	"namespace|drop": {arity: 3, flags: []string{"admin", "write"},
+		categories: []string{"admin", "keyspace", "slow", "dangerous"},
+		privileged: true},
+}
+
+// commandDoc is the documentation for a command that's returned by
+// COMMAND DOCS.
+type commandDoc struct {
+	group, summary string
+}
+
+// commandDocs are the docs for the commands.
+var commandDocs = map[string]commandDoc{
+	"auth":        {"connection", "Authenticates the connection."},
+	"hello":       {"connection", "Handshakes with the server."},
+	"client":      {"connection", "A container for client connection commands."},
+	"client|list": {"connection", "Lists open connections."},
+	"client|kill": {"connection", "Terminates open connections."},
+	"ping":        {"connection", "Returns the server's liveliness response."},
+	"quit":        {"connection", "Closes the connection."},
+	"select":      {"connection", "Changes the selected database."},
+	"time":        {"server", "Returns the server time."},
+	"hlc":         {"server", "Returns the hybrid logical clock of the node."},
+	"hlc|update":  {"server", "Advances the hybrid logical clock of the cluster past a timestamp."},
+	"echo":        {"connection", "Returns the given string."},
+	"traceparent": {"connection", "Sets the trace context of the next command."},
+	"reqid":       {"connection", "Sets the request id of the next write, which is applied at most once."},
+	"minrev":      {"connection", "Makes the next read wait for the node to apply a revision."},
+	"lastrev":     {"connection", "Returns the revision of the last write of the connection."},
+	"multi":       {"transactions", "Starts a read-only transaction."},
+	"exec":        {"transactions", "Runs the reads of a read-only transaction on a single snapshot."},
+	"discard":     {"transactions", "Discards a read-only transaction."},
+	"set":         {"string", "Sets the string value of a key."},
+	"mset":        {"string", "Atomically sets the string values of one or more keys."},
+	"mappend":     {"string", "Atomically appends to the string values of one or more keys."},
+	"msetif":      {"string", "Atomically sets the string values of one or more keys when all of their guards pass."},
+	"fcall":       {"scripting", "Calls a function that the node registered."},
+	"fcall_ro":    {"scripting", "Calls a read-only function that the node registered."},
+	"get":         {"string", "Returns the string value of a key."},
+	"getver":      {"string", "Returns the version of a key."},
+	"keyinfo":     {"generic", "Returns the creation and modification times and the write count of a key."},
+	"revision":    {"server", "Returns the current and the oldest readable revisions."},
+	"mget":        {"string", "Atomically returns the string values of one or more keys."},
+	"del":         {"generic", "Deletes one or more keys."},
+	"delif":       {"generic", "Deletes keys when the value matches."},
+	"pdel":        {"generic", "Deletes all keys that match a pattern."},
+	"popmatch":    {"generic", "Deletes the first key that matches a pattern, and returns it and its value."},
+	"keys":        {"generic", "Returns the keys, and optionally the values, that match a pattern."},
+	"watchkeys":   {"pubsub", "Streams the changes to keys that match a pattern."},
+	"flushdb":     {"server", "Removes all keys from the selected database."},
+	"flushall":    {"server", "Removes all keys from all databases."},
+	"shutdown":    {"server", "Stops the server."},
+	"monitor":     {"server", "Streams the commands that are processed by the server."},
+	"config":      {"server", "Gets or sets configuration parameters."},
+	"info":        {"server", "Returns information about the server."},
+	"command":     {"server", "Returns details about the commands."},
+	"acl":         {"server", "A container for access control list commands."},
+	"latency":     {"server", "A container for latency diagnostics commands."},
+	"bigkeys":     {"server", "Returns the keys with the biggest values."},
+	"hotkeys":     {"server", "Returns the most accessed keys."},
+	"prefixstats": {"server", "Returns the number and the sizes of the keys with a prefix."},
+	"object":      {"generic", "A container for key introspection commands."},
+	"memory":      {"server", "A container for memory diagnostics commands."},
+	"debug":       {"server", "A container for debugging commands."},
+	"raft":        {"cluster", "A container for raft commands."},
+	"compact":     {"server", "Compacts the storage of the node, or the history of revisions."},
+	"checkdb":     {"server", "Verifies the checksums of the storage of the node."},
+	"dbstats":     {"server", "Returns the statistics of the storage of the node."},
+
+	"memory|usage":        {"server", "Returns the approximate bytes that a key takes in the database."},
+	"memory|stats":        {"server", "Returns the memory, storage, cache and buffer usage of the node."},
+	"debug|object":        {"server", "Returns how a key is stored."},
+	"debug|sleep":         {"server", "Stalls the apply of writes on the node."},
+	"debug|drop-follower": {"server", "Cuts the follower off from the leader."},
+	"debug|snapshot":      {"server", "Takes a raft snapshot of the node."},
+
+	"raft|addpeer":    {"cluster", "Adds a node to the cluster."},
+	"raft|removepeer": {"cluster", "Removes a node from the cluster."},
+	"raft|snapshot":   {"cluster", "Takes a raft snapshot of the node."},
+	"raft|shrinklog":  {"cluster", "Compacts the raft log of the node."},
+	"raft|leader":     {"cluster", "Returns the address of the leader."},
+	"raft|state":      {"cluster", "Returns the raft state of the node."},
+	"raft|stats":      {"cluster", "Returns the raft statistics of the node."},
+	"raft|peers":      {"cluster", "Returns the addresses of the nodes of the cluster."},
+
+	"namespace":        {"server", "A container for namespace commands."},
+	"namespace|create": {"server", "Creates a namespace with optional quotas."},
+	"namespace|quota":  {"server", "Changes the quotas of a namespace."},
+	"namespace|drop":   {"server", "Deletes a namespace and all of its keys."},
+}
+
+// commandKeys returns the key arguments of a command.
+func commandKeys(info commandInfo, args [][]byte) [][]byte {
+	if info.keys != nil {
+		return info.keys(args)
+	}
+	if info.firstKey == 0 || info.firstKey >= len(args) {
+		return nil
+	}
+	last := info.lastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	var keys [][]byte
+	for i := info.firstKey; i <= last && i < len(args); i += info.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// hasCategory returns true if the command belongs to the ACL category.
+func (info commandInfo) hasCategory(category string) bool {
+	if category == "all" {
+		return true
+	}
+	for _, c := range info.categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFlag returns true if the command has the flag.
+func (info commandInfo) hasFlag(flag string) bool {
+	for _, f := range info.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// subcommands returns the names of the subcommands of a command, sorted.
+func subcommands(name string) []string {
+	var names []string
+	for sub := range commands {
+		if strings.HasPrefix(sub, name+"|") {
+			names = append(names, sub)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeCommandInfo writes the COMMAND INFO reply for a command.
+func writeCommandInfo(conn redcon.Conn, name string, info commandInfo) {
+	conn.WriteArray(10)
+	conn.WriteBulkString(name)
+	conn.WriteInt(info.arity)
+	conn.WriteArray(len(info.flags))
+	for _, flag := range info.flags {
+		conn.WriteString(flag)
+	}
+	conn.WriteInt(info.firstKey)
+	conn.WriteInt(info.lastKey)
+	conn.WriteInt(info.step)
+	conn.WriteArray(len(info.categories))
+	for _, category := range info.categories {
+		conn.WriteString("@" + category)
+	}
+	conn.WriteArray(0) // tips
+	conn.WriteArray(0) // key specs
+	subs := subcommands(name)
+	conn.WriteArray(len(subs))
+	for _, sub := range subs {
+		writeCommandInfo(conn, sub, commands[sub])
+	}
+}
+
+// writeCommandDoc writes the COMMAND DOCS reply for a command.
+func writeCommandDoc(conn redcon.Conn, name string) {
+	doc := commandDocs[name]
+	subs := subcommands(name)
+	n := 2
+	if len(subs) > 0 {
+		n++
+	}
+	writeMap(conn, n)
+	conn.WriteBulkString("summary")
+	conn.WriteBulkString(doc.summary)
+	conn.WriteBulkString("group")
+	conn.WriteBulkString(doc.group)
+	if len(subs) > 0 {
+		conn.WriteBulkString("subcommands")
+		writeMap(conn, len(subs))
+		for _, sub := range subs {
+			conn.WriteBulkString(sub)
+			writeCommandDoc(conn, sub)
+		}
+	}
+}
+
+// cmdCommand handles the COMMAND subcommands:
+//
+//	COMMAND
+//	COMMAND COUNT
+//	COMMAND LIST
+//	COMMAND INFO [name ...]
+//	COMMAND DOCS [name ...]
+//	COMMAND GETKEYS command [arg ...]
+func (kvm *Machine) cmdCommand(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	var names []string
+	for name := range commands {
+		if !strings.Contains(name, "|") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(cmd.Args) == 1 {
+		conn.WriteArray(len(names))
+		for _, name := range names {
+			writeCommandInfo(conn, name, commands[name])
+		}
+		return nil, nil
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errors.New("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	case "count":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		conn.WriteInt(len(names))
+	case "list":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		conn.WriteArray(len(names))
+		for _, name := range names {
+			conn.WriteBulkString(name)
+		}
+	case "info":
+		if len(cmd.Args) > 2 {
+			names = names[:0]
+			for _, arg := range cmd.Args[2:] {
+				names = append(names, strings.ToLower(string(arg)))
+			}
+		}
+		conn.WriteArray(len(names))
+		for _, name := range names {
+			if info, ok := commands[name]; ok {
+				writeCommandInfo(conn, name, info)
+			} else {
+				conn.WriteNull()
+			}
+		}
+	case "docs":
+		if len(cmd.Args) > 2 {
+			names = names[:0]
+			for _, arg := range cmd.Args[2:] {
+				name := strings.ToLower(string(arg))
+				if _, ok := commands[name]; ok {
+					names = append(names, name)
+				}
+			}
+		}
+		writeMap(conn, len(names))
+		for _, name := range names {
+			conn.WriteBulkString(name)
+			writeCommandDoc(conn, name)
+		}
+	case "getkeys":
+		if len(cmd.Args) < 3 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		args := cmd.Args[2:]
+		info, ok := commands[strings.ToLower(string(args[0]))]
+		if !ok {
+			return nil, errors.New("ERR Invalid command specified")
+		}
+		if (info.arity > 0 && len(args) != info.arity) ||
+			(info.arity < 0 && len(args) < -info.arity) {
+			return nil, errors.New("ERR Invalid number of arguments specified for command")
+		}
+		keys := commandKeys(info, args)
+		if len(keys) == 0 {
+			return nil, errors.New("ERR The command has no key arguments")
+		}
+		conn.WriteArray(len(keys))
+		for _, key := range keys {
+			conn.WriteBulk(key)
+		}
+	}
+	return nil, nil
+}
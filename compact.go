@@ -0,0 +1,128 @@
+package kvnode
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// storageSize returns the size of the storage on disk. For in-memory
+// storage it's the estimated size of the data. The caller holds dbmu.
+func (kvm *Machine) storageSize() (int64, error) {
+	if kvm.options().InMemory {
+		ranges := append(keyspaceRanges[:len(keyspaceRanges):len(keyspaceRanges)],
+			*util.BytesPrefix([]byte{'n'}))
+		sizes, err := kvm.db.SizeOf(ranges)
+		return sizes.Sum(), err
+	}
+	var size int64
+	err := filepath.Walk(kvm.dbPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// files are removed while compacting.
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// cmdCompact handles "COMPACT [prefix]", which compacts the storage of this
+// node, and replies with the size of the storage before and after. With a
+// prefix, only the keys of the keyspace of the client that start with the
+// prefix are compacted. Compaction isn't replicated, as each node has its
+// own storage.
+func (kvm *Machine) cmdCompact(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) == 3 {
+		switch strings.ToLower(string(cmd.Args[1])) {
+		case "revision":
+			return kvm.cmdCompactRevision(m, conn, cmd)
+		case "pause":
+			return kvm.cmdCompactPause(m, conn, cmd)
+		}
+	}
+	if len(cmd.Args) > 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var r util.Range
+	if len(cmd.Args) == 2 {
+		r = *util.BytesPrefix(keyspaceOf(m).key(cmd.Args[1]))
+	}
+	kvm.dbmu.RLock()
+	defer kvm.dbmu.RUnlock()
+	before, err := kvm.storageSize()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if err := kvm.db.CompactRange(r); err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+	after, err := kvm.storageSize()
+	if err != nil {
+		return nil, err
+	}
+	writeMap(conn, 3)
+	conn.WriteBulkString("before_bytes")
+	conn.WriteInt64(before)
+	conn.WriteBulkString("after_bytes")
+	conn.WriteInt64(after)
+	conn.WriteBulkString("elapsed_ms")
+	conn.WriteInt64(int64(elapsed / time.Millisecond))
+	return nil, nil
+}
+
+// cmdCompactRevision handles "COMPACT REVISION revision", which discards the
+// history up to a revision, so that the earlier revisions can't be read or
+// watched from anymore. It replies with the number of history entries that
+// were discarded. Unlike COMPACT, it goes through the raft log, since every
+// node keeps the same history.
+func (kvm *Machine) cmdCompactRevision(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	rev, err := strconv.ParseUint(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		return nil, errRevision
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			if rev > atomic.LoadUint64(&kvm.revision) {
+				return nil, errRevisionNewer
+			}
+			var total int
+			for {
+				var batch leveldb.Batch
+				n, err := kvm.pruneHistory(&batch, rev+1)
+				if err != nil {
+					return nil, err
+				}
+				if err := kvm.db.Write(&batch, kvm.writeOptions()); err != nil {
+					return nil, err
+				}
+				total += n
+				if n < historyPrune {
+					break
+				}
+			}
+			kvm.raiseFloor(rev)
+			return total, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			n, _ := v.(int)
+			conn.WriteInt(n)
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,200 @@
+package kvnode
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errCompactionWindow = errors.New("invalid compaction window, expected HH:MM-HH:MM")
+	errCompactionRate   = errors.New("ERR compaction-rate must be set to pause compactions")
+)
+
+// compactionCheck is how often the window is checked for opening.
+const compactionCheck = time.Minute
+
+// compactionWindow is the time of day, in minutes, when heavy compactions
+// run. The window may wrap around midnight.
+type compactionWindow struct {
+	start, end int
+}
+
+// parseCompactionWindow parses a window such as "01:30-05:00", in local time.
+// An empty window is nil.
+func parseCompactionWindow(s string) (*compactionWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, errCompactionWindow
+	}
+	var w compactionWindow
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return nil, errCompactionWindow
+		}
+		m := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			w.start = m
+		} else {
+			w.end = m
+		}
+	}
+	if w.start == w.end {
+		return nil, errCompactionWindow
+	}
+	return &w, nil
+}
+
+// contains returns true when the window is open at a time.
+func (w *compactionWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// compactionCtl is the state of the scheduling of compactions.
+type compactionCtl struct {
+	// snapshots is the number of snapshots being written, which pause
+	// compactions.
+	snapshots int32
+	// pausedUntil is the unix time in nanoseconds until which COMPACT PAUSE
+	// pauses compactions.
+	pausedUntil int64
+	// last is the unix time of the last compaction of a window.
+	last    int64
+	limiter rateLimiter
+}
+
+// window returns the compaction window, or nil.
+func (kvm *Machine) window() *compactionWindow {
+	w, _ := kvm.cwindow.Load().(*compactionWindow)
+	return w
+}
+
+// compactionsPaused returns true while a snapshot is written or COMPACT
+// PAUSE is in effect.
+func (kvm *Machine) compactionsPaused(now time.Time) bool {
+	return atomic.LoadInt32(&kvm.compact.snapshots) > 0 ||
+		now.UnixNano() < atomic.LoadInt64(&kvm.compact.pausedUntil)
+}
+
+// tableWriteRate returns the limit of the bytes per second that LevelDB
+// writes to its tables, which is CompactionRate outside of the compaction
+// window and while compactions are paused, and otherwise zero for no limit.
+func (kvm *Machine) tableWriteRate(now time.Time) int {
+	rate := kvm.options().CompactionRate
+	if rate <= 0 {
+		return 0
+	}
+	if kvm.compactionsPaused(now) {
+		return rate
+	}
+	if w := kvm.window(); w != nil && !w.contains(now) {
+		return rate
+	}
+	return 0
+}
+
+// throttleTables waits until n bytes may be written to the tables. It's
+// called by the flushes of the memtable and the compactions of LevelDB,
+// which run in the background.
+func (kvm *Machine) throttleTables(n int) {
+	for {
+		now := time.Now()
+		if kvm.compact.limiter.allow(kvm.tableWriteRate(now), n, now) {
+			return
+		}
+		select {
+		case <-kvm.done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// compactInWindows compacts the whole storage once each time the compaction
+// window opens, so that the heavy compactions happen there rather than
+// during the traffic.
+func (kvm *Machine) compactInWindows() {
+	t := time.NewTicker(compactionCheck)
+	defer t.Stop()
+	var compacted bool
+	for {
+		select {
+		case <-kvm.done:
+			return
+		case now := <-t.C:
+			w := kvm.window()
+			if w == nil || !w.contains(now) {
+				compacted = false
+				continue
+			}
+			if compacted || kvm.options().InMemory || kvm.compactionsPaused(now) {
+				continue
+			}
+			compacted = true
+			kvm.compactAll()
+		}
+	}
+}
+
+// compactAll compacts the whole storage, and logs the outcome.
+func (kvm *Machine) compactAll() {
+	kvm.dbmu.RLock()
+	defer kvm.dbmu.RUnlock()
+	before, err := kvm.storageSize()
+	if err != nil {
+		log.Warningf("compaction window: %v", err)
+		return
+	}
+	log.Noticef("compaction window: compacting the storage")
+	start := time.Now()
+	if err := kvm.db.CompactRange(util.Range{}); err != nil {
+		log.Warningf("compaction window: %v", err)
+		return
+	}
+	atomic.StoreInt64(&kvm.compact.last, time.Now().Unix())
+	after, err := kvm.storageSize()
+	if err != nil {
+		log.Warningf("compaction window: %v", err)
+		return
+	}
+	log.Noticef("compaction window: compacted the storage from %s to %s in %s",
+		humanBytes(uint64(before)), humanBytes(uint64(after)), time.Since(start))
+}
+
+// cmdCompactPause handles "COMPACT PAUSE seconds", which limits the
+// compactions of this node to compaction-rate for a number of seconds, such
+// as during a backup, even in the compaction window. Zero seconds resumes
+// them. It replies with OK.
+func (kvm *Machine) cmdCompactPause(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	secs, err := strconv.ParseUint(string(cmd.Args[2]), 10, 32)
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if secs > 0 && kvm.options().CompactionRate <= 0 {
+		return nil, errCompactionRate
+	}
+	var until int64
+	if secs > 0 {
+		until = time.Now().Add(time.Duration(secs) * time.Second).UnixNano()
+		log.Noticef("compactions are paused for %d seconds", secs)
+	} else {
+		log.Noticef("compactions are resumed")
+	}
+	atomic.StoreInt64(&kvm.compact.pausedUntil, until)
+	conn.WriteString("OK")
+	return nil, nil
+}
@@ -0,0 +1,188 @@
+package kvnode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/golang/snappy"
+)
+
+var (
+	errValueEncoding = errors.New("ERR unknown value encoding")
+	errColdValue     = errors.New("ERR the value is in cold storage")
+)
+
+// valueMagic starts the values that are stored with an encoding header,
+// which is the magic followed by the encoding byte. Other values are stored
+// as they are, which includes every value that was written before values
+// were compressed.
+var valueMagic = []byte{0xff, 'K', 'V', 'Z'}
+
+// The encodings of values with a header.
+const (
+	valueRaw    = 0
+	valueSnappy = 1
+	// valueCold is the stub of a value that was moved to the cold store,
+	// which holds the name of its object.
+	valueCold = 2
+)
+
+// valueVersioned is set in the encoding byte of values that have a version,
+// which follows the encoding byte as 8 bytes in big endian.
+const valueVersioned = 0x80
+
+// valueMetadata is set in the encoding byte of versioned values that have
+// the metadata of their key, which follows the version as the version of
+// the first write and the number of writes, each as 8 bytes in big endian.
+const valueMetadata = 0x40
+
+// valueFlags are the bits of the encoding byte that aren't the encoding.
+const valueFlags = valueVersioned | valueMetadata
+
+// encodeValue returns the stored form of a value. Values of at least
+// threshold bytes are compressed with snappy, when that makes them smaller.
+// Values that happen to start with the magic get a raw header, so that
+// they're not mistaken for encoded values. A threshold of zero disables
+// compression. A version of zero stores the value without a version, and a
+// nil meta stores it without metadata. Metadata is only stored with a
+// version.
+func encodeValue(value []byte, threshold int, version uint64, meta *keyMeta) []byte {
+	n := len(valueMagic) + 1
+	if version == 0 {
+		meta = nil
+	}
+	if version > 0 {
+		n += 8
+	}
+	if meta != nil {
+		n += 16
+	}
+	header := func(buf []byte, enc byte) {
+		copy(buf, valueMagic)
+		if version > 0 {
+			enc |= valueVersioned
+			binary.BigEndian.PutUint64(buf[len(valueMagic)+1:], version)
+		}
+		if meta != nil {
+			enc |= valueMetadata
+			binary.BigEndian.PutUint64(buf[len(valueMagic)+9:], meta.created)
+			binary.BigEndian.PutUint64(buf[len(valueMagic)+17:], meta.writes)
+		}
+		buf[len(valueMagic)] = enc
+	}
+	if threshold > 0 && len(value) >= threshold {
+		buf := make([]byte, n+snappy.MaxEncodedLen(len(value)))
+		enc := snappy.Encode(buf[n:], value)
+		if n+len(enc) < len(value) {
+			header(buf, valueSnappy)
+			return buf[:n+len(enc)]
+		}
+	}
+	if version > 0 || bytes.HasPrefix(value, valueMagic) {
+		buf := make([]byte, n, n+len(value))
+		header(buf, valueRaw)
+		return append(buf, value...)
+	}
+	return value
+}
+
+// valueVersion returns the version of a stored value, which is zero for
+// values without a version.
+func valueVersion(stored []byte) uint64 {
+	n := len(valueMagic) + 1
+	if !bytes.HasPrefix(stored, valueMagic) || len(stored) < n+8 ||
+		stored[n-1]&valueVersioned == 0 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(stored[n:])
+}
+
+// valueMeta returns the metadata of the key of a stored value, or nil for
+// values without metadata.
+func valueMeta(stored []byte) *keyMeta {
+	n := len(valueMagic) + 1
+	if !bytes.HasPrefix(stored, valueMagic) || len(stored) < n+24 ||
+		stored[n-1]&valueFlags != valueFlags {
+		return nil
+	}
+	return &keyMeta{
+		created: binary.BigEndian.Uint64(stored[n+8:]),
+		writes:  binary.BigEndian.Uint64(stored[n+16:]),
+	}
+}
+
+// valueEncoding returns the name of the encoding of a stored value, which
+// is "raw", "snappy" or "cold".
+func valueEncoding(stored []byte) string {
+	n := len(valueMagic) + 1
+	if bytes.HasPrefix(stored, valueMagic) && len(stored) >= n {
+		switch stored[n-1] &^ valueFlags {
+		case valueSnappy:
+			return "snappy"
+		case valueCold:
+			return "cold"
+		}
+	}
+	return "raw"
+}
+
+// encodeStub returns the stub of a stored value that was moved to the cold
+// store as an object, which keeps the version and the metadata of the
+// value.
+func encodeStub(stored []byte, object string) []byte {
+	stub := encodeValue([]byte(object), 0, valueVersion(stored), valueMeta(stored))
+	stub[len(valueMagic)] = stub[len(valueMagic)]&valueFlags | valueCold
+	return stub
+}
+
+// coldObject returns the name of the object of a stub, or "" for values
+// that aren't stubs.
+func coldObject(stored []byte) string {
+	if valueEncoding(stored) != "cold" {
+		return ""
+	}
+	enc, n := stored[len(valueMagic)], len(valueMagic)+1
+	if enc&valueVersioned != 0 {
+		n += 8
+	}
+	if enc&valueFlags == valueFlags {
+		n += 16
+	}
+	if len(stored) < n {
+		return ""
+	}
+	return string(stored[n:])
+}
+
+// decodeValue returns the value of a stored value. The value may share
+// memory with the stored value.
+func decodeValue(stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, valueMagic) || len(stored) == len(valueMagic) {
+		return stored, nil
+	}
+	n := len(valueMagic) + 1
+	enc := stored[n-1]
+	if enc&valueVersioned != 0 {
+		if len(stored) < n+8 {
+			return nil, errValueEncoding
+		}
+		n += 8
+		if enc&valueMetadata != 0 {
+			if len(stored) < n+16 {
+				return nil, errValueEncoding
+			}
+			n += 16
+		}
+		enc &^= valueFlags
+	}
+	switch enc {
+	case valueRaw:
+		return stored[n:], nil
+	case valueSnappy:
+		return snappy.Decode(nil, stored[n:])
+	case valueCold:
+		return nil, errColdValue
+	}
+	return nil, errValueEncoding
+}
@@ -0,0 +1,432 @@
+package kvnode
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+var errNoConfigFile = errors.New("ERR The server is running without a config file")
+
+// configParam is a configuration parameter that's available to CONFIG GET
+// and CONFIG SET.
+type configParam struct {
+	get func(o *Options) string
+	// set changes the parameter on the options. Immutable parameters have
+	// a nil set.
+	set func(o *Options, val string) error
+	// replicated parameters are changed through the raft log, so that the
+	// whole cluster shares the same value. Other parameters only change on
+	// the node that receives the command.
+	replicated bool
+}
+
+// configParams are all of the configuration parameters.
+var configParams = map[string]configParam{
+	"maxclients": intParam(func(o *Options) *int { return &o.MaxClients }),
+	"client-rate-limit": intParam(func(o *Options) *int {
+		return &o.ClientRateLimit
+	}),
+	"client-bandwidth-limit": intParam(func(o *Options) *int {
+		return &o.ClientBandwidthLimit
+	}),
+	"client-output-buffer-limit": {
+		get: func(o *Options) string { return o.OutputBufferLimits.String() },
+		set: func(o *Options, val string) error {
+			return o.OutputBufferLimits.Set(val)
+		},
+	},
+	"hotkeys-sampling": intParam(func(o *Options) *int { return &o.HotKeysSampling }),
+	"timeout": secondsParam(func(o *Options) *time.Duration {
+		return &o.IdleTimeout
+	}),
+	"max-conn-lifetime": secondsParam(func(o *Options) *time.Duration {
+		return &o.MaxLifetime
+	}),
+	"group-commit-window": microsecondsParam(func(o *Options) *time.Duration {
+		return &o.GroupCommitWindow
+	}),
+	"group-commit-max": intParam(func(o *Options) *int { return &o.GroupCommitMax }),
+	"max-pending-writes": intParam(func(o *Options) *int {
+		return &o.MaxPendingWrites
+	}),
+	"command-workers": intParam(func(o *Options) *int {
+		return &o.CommandWorkers
+	}),
+	"pdel-chunk-size": intParam(func(o *Options) *int { return &o.PdelChunkSize }),
+	"compression-threshold": intParam(func(o *Options) *int {
+		return &o.CompressionThreshold
+	}),
+	"min-free-disk-mb": intParam(func(o *Options) *int { return &o.MinFreeDiskMB }),
+	"max-key-size":     intParam(func(o *Options) *int { return &o.MaxKeySize }),
+	"max-value-size":   intParam(func(o *Options) *int { return &o.MaxValueSize }),
+	"max-keys":         replicatedParam(intParam(func(o *Options) *int { return &o.MaxKeys })),
+	"max-bytes":        replicatedParam(sizeParam(func(o *Options) *int { return &o.MaxBytes })),
+	"eviction-policy": replicatedParam(configParam{
+		get: func(o *Options) string { return o.EvictionPolicy },
+		set: func(o *Options, val string) error {
+			val = strings.ToLower(val)
+			if strings.HasPrefix(val, "volatile-") {
+				return errors.New("argument '" + val + "' is not supported, keys have no TTLs")
+			}
+			if !evictionPolicies[val] {
+				return errors.New("argument must be 'noeviction', 'allkeys-lru' or 'allkeys-oldest'")
+			}
+			o.EvictionPolicy = val
+			return nil
+		},
+	}),
+	"loglevel": {
+		get: func(o *Options) string { return o.LogLevel },
+		set: func(o *Options, val string) error {
+			val = strings.ToLower(val)
+			if _, ok := logLevels[val]; !ok {
+				return errors.New("argument must be 'debug', 'verbose', 'notice' or 'warning'")
+			}
+			o.LogLevel = val
+			return nil
+		},
+	},
+	"read-cache-size": intParam(func(o *Options) *int { return &o.ReadCacheSize }),
+	"revision-retention": replicatedParam(secondsParam(func(o *Options) *time.Duration {
+		return &o.RevisionRetention
+	})),
+	"cold-after": replicatedParam(secondsParam(func(o *Options) *time.Duration {
+		return &o.ColdAfter
+	})),
+	"key-metadata": replicatedParam(boolParam(func(o *Options) *bool { return &o.KeyMetadata })),
+	"compaction-window": {
+		get: func(o *Options) string { return o.CompactionWindow },
+		set: func(o *Options, val string) error {
+			if _, err := parseCompactionWindow(val); err != nil {
+				return errors.New("argument must be a window such as 01:00-05:00, or empty")
+			}
+			o.CompactionWindow = val
+			return nil
+		},
+	},
+	"compaction-rate":   intParam(func(o *Options) *int { return &o.CompactionRate }),
+	"snapshot-rate":     intParam(func(o *Options) *int { return &o.SnapshotRate }),
+	"raft-log-max-size": sizeParam(func(o *Options) *int { return &o.RaftLogMaxSize }),
+	"raft-log-shrink":   boolParam(func(o *Options) *bool { return &o.RaftLogShrink }),
+	"requirepass": {
+		get:        func(o *Options) string { return o.Password },
+		set:        func(o *Options, val string) error { o.Password = val; return nil },
+		replicated: true,
+	},
+	"tls-addr":        immutableParam(func(o *Options) string { return o.TLSAddr }),
+	"admin-addr":      immutableParam(func(o *Options) string { return o.AdminAddr }),
+	"http-addr":       immutableParam(func(o *Options) string { return o.HTTPAddr }),
+	"grpc-addr":       immutableParam(func(o *Options) string { return o.GRPCAddr }),
+	"memcache-addr":   immutableParam(func(o *Options) string { return o.MemcacheAddr }),
+	"admin-http-addr": immutableParam(func(o *Options) string { return o.AdminHTTPAddr }),
+	"debug-endpoints": boolParam(func(o *Options) *bool { return &o.DebugEndpoints }),
+	"stale-reads":     boolParam(func(o *Options) *bool { return &o.StaleReads }),
+	"replica-reads":   boolParam(func(o *Options) *bool { return &o.ReplicaReads }),
+	"forward-writes":  intParam(func(o *Options) *int { return &o.ForwardWrites }),
+	"flush-require-force": boolParam(func(o *Options) *bool {
+		return &o.FlushRequireForce
+	}),
+	"auto-rejoin":    boolParam(func(o *Options) *bool { return &o.AutoRejoin }),
+	"ready-max-lag":  intParam(func(o *Options) *int { return &o.ReadyMaxLag }),
+	"proxy-protocol": immutableParam(func(o *Options) string { return yesno(o.ProxyProtocol) }),
+	"inmem":          immutableParam(func(o *Options) string { return yesno(o.InMemory) }),
+	"audit-log":      immutableParam(func(o *Options) string { return o.AuditLog }),
+	"leveldb-write-buffer": immutableParam(func(o *Options) string {
+		return strconv.Itoa(o.LevelDBWriteBuffer)
+	}),
+	"leveldb-block-cache": immutableParam(func(o *Options) string {
+		return strconv.Itoa(o.LevelDBBlockCache)
+	}),
+	"leveldb-table-size": immutableParam(func(o *Options) string {
+		return strconv.Itoa(o.LevelDBTableSize)
+	}),
+	"leveldb-open-files": immutableParam(func(o *Options) string {
+		return strconv.Itoa(o.LevelDBOpenFiles)
+	}),
+	"leveldb-compression": immutableParam(func(o *Options) string { return o.LevelDBCompression }),
+	"recover-db":          immutableParam(func(o *Options) string { return yesno(o.RecoverDB) }),
+	"databases":           immutableParam(func(o *Options) string { return strconv.Itoa(o.Databases) }),
+	"bind":                immutableParam(func(o *Options) string { return bindList(o.Binds) }),
+	"protected-mode":      boolParam(func(o *Options) *bool { return &o.ProtectedMode }),
+	"allow":               cidrParam(func(o *Options) *[]string { return &o.Allow }),
+	"deny":                cidrParam(func(o *Options) *[]string { return &o.Deny }),
+	"trusted-proxies":     cidrParam(func(o *Options) *[]string { return &o.TrustedProxies }),
+	"peer-networks":       cidrParam(func(o *Options) *[]string { return &o.PeerNetworks }),
+}
+
+func intParam(field func(o *Options) *int) configParam {
+	return configParam{
+		get: func(o *Options) string { return strconv.Itoa(*field(o)) },
+		set: func(o *Options, val string) error {
+			n, err := strconv.ParseUint(val, 10, 31)
+			if err != nil {
+				return errors.New("argument must be a positive integer")
+			}
+			*field(o) = int(n)
+			return nil
+		},
+	}
+}
+
+// sizeParam is a size in bytes, which may be larger than an intParam.
+func sizeParam(field func(o *Options) *int) configParam {
+	return configParam{
+		get: func(o *Options) string { return strconv.Itoa(*field(o)) },
+		set: func(o *Options, val string) error {
+			n, err := strconv.ParseUint(val, 10, 63)
+			if err != nil {
+				return errors.New("argument must be a positive integer")
+			}
+			*field(o) = int(n)
+			return nil
+		},
+	}
+}
+
+// boolParam is a flag that's read and written as yes or no.
+func boolParam(field func(o *Options) *bool) configParam {
+	return configParam{
+		get: func(o *Options) string { return yesno(*field(o)) },
+		set: func(o *Options, val string) error {
+			switch strings.ToLower(val) {
+			case "yes":
+				*field(o) = true
+			case "no":
+				*field(o) = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+	}
+}
+
+// cidrParam is a list of CIDR blocks that's separated by spaces.
+func cidrParam(field func(o *Options) *[]string) configParam {
+	return configParam{
+		get: func(o *Options) string { return strings.Join(*field(o), " ") },
+		set: func(o *Options, val string) error {
+			list := strings.Fields(val)
+			if _, err := parseCIDRs(list); err != nil {
+				return err
+			}
+			*field(o) = list
+			return nil
+		},
+	}
+}
+
+// secondsParam is a duration that's read and written as seconds.
+func secondsParam(field func(o *Options) *time.Duration) configParam {
+	return configParam{
+		get: func(o *Options) string {
+			return strconv.FormatInt(int64(*field(o)/time.Second), 10)
+		},
+		set: func(o *Options, val string) error {
+			n, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return errors.New("argument must be a positive number of seconds")
+			}
+			*field(o) = time.Duration(n) * time.Second
+			return nil
+		},
+	}
+}
+
+// microsecondsParam is a duration that's read and written in microseconds.
+func microsecondsParam(field func(o *Options) *time.Duration) configParam {
+	return configParam{
+		get: func(o *Options) string {
+			return strconv.FormatInt(int64(*field(o)/time.Microsecond), 10)
+		},
+		set: func(o *Options, val string) error {
+			n, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return errors.New("argument must be a positive number of microseconds")
+			}
+			*field(o) = time.Duration(n) * time.Microsecond
+			return nil
+		},
+	}
+}
+
+// replicatedParam is a parameter that's changed through the raft log.
+func replicatedParam(p configParam) configParam {
+	p.replicated = true
+	return p
+}
+
+func immutableParam(get func(o *Options) string) configParam {
+	return configParam{get: get}
+}
+
+func yesno(v bool) string {
+	if v {
+		return "yes"
+	}
+	return "no"
+}
+
+// applyConfig changes the parameters on the options.
+func applyConfig(opts *Options, params map[string]string) error {
+	for name, val := range params {
+		p, ok := configParams[name]
+		if !ok {
+			return errors.New("ERR Unknown option or number of arguments for CONFIG SET - '" + name + "'")
+		}
+		if p.set == nil {
+			return errors.New("ERR CONFIG SET failed (possibly related to argument '" + name + "') - can't set immutable config")
+		}
+		if err := p.set(opts, val); err != nil {
+			return errors.New("ERR CONFIG SET failed (possibly related to argument '" + name + "') - " + err.Error())
+		}
+	}
+	return nil
+}
+
+// setConfig applies the parameters to a copy of the options, which then
+// replaces the current options. Nothing is changed when an error occurs.
+func (kvm *Machine) setConfig(params map[string]string) error {
+	kvm.cfgmu.Lock()
+	defer kvm.cfgmu.Unlock()
+	opts := *kvm.options()
+	if err := applyConfig(&opts, params); err != nil {
+		return err
+	}
+	return kvm.storeOptions(&opts)
+}
+
+// loadConfig applies the replicated parameters that are stored in the
+// database.
+func (kvm *Machine) loadConfig() error {
+	params := make(map[string]string)
+	iter := kvm.db.NewIterator(util.BytesPrefix([]byte{'c'}), nil)
+	for ok := iter.First(); ok; ok = iter.Next() {
+		name := string(iter.Key()[1:])
+		if p, ok := configParams[name]; ok && p.replicated {
+			params[name] = string(iter.Value())
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return kvm.setConfig(params)
+}
+
+// storeConfig writes the replicated parameters to the database. The caller
+// must hold the machine lock.
+func (kvm *Machine) storeConfig() error {
+	var batch leveldb.Batch
+	opts := kvm.options()
+	for name, p := range configParams {
+		if p.replicated {
+			batch.Put(makeKey('c', []byte(name)), []byte(p.get(opts)))
+		}
+	}
+	return kvm.db.Write(&batch, nil)
+}
+
+// cmdConfig handles the CONFIG subcommands:
+//
+//	CONFIG GET pattern [pattern ...]
+//	CONFIG SET parameter value [parameter value ...]
+//	CONFIG REWRITE
+func (kvm *Machine) cmdConfig(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errors.New("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	case "get":
+		return kvm.cmdConfigGet(m, conn, cmd)
+	case "set":
+		return kvm.cmdConfigSet(m, conn, cmd)
+	case "rewrite":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		return nil, errNoConfigFile
+	}
+}
+
+func (kvm *Machine) cmdConfigGet(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var names []string
+	for name := range configParams {
+		for _, pattern := range cmd.Args[2:] {
+			if match.Match(name, strings.ToLower(string(pattern))) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	opts := kvm.options()
+	writeMap(conn, len(names))
+	for _, name := range names {
+		conn.WriteBulkString(name)
+		conn.WriteBulkString(configParams[name].get(opts))
+	}
+	return nil, nil
+}
+
+func (kvm *Machine) cmdConfigSet(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 4 || len(cmd.Args)%2 != 0 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	all := make(map[string]string)
+	local := make(map[string]string)
+	replicated := make(map[string]string)
+	for i := 2; i < len(cmd.Args); i += 2 {
+		name := strings.ToLower(string(cmd.Args[i]))
+		val := string(cmd.Args[i+1])
+		all[name] = val
+		if configParams[name].replicated {
+			replicated[name] = val
+		} else {
+			local[name] = val
+		}
+	}
+	// validate all of the parameters prior to applying.
+	opts := *kvm.options()
+	if err := applyConfig(&opts, all); err != nil {
+		return nil, err
+	}
+	if len(replicated) == 0 {
+		if err := kvm.setConfig(local); err != nil {
+			return nil, err
+		}
+		conn.WriteString("OK")
+		return nil, nil
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			if err := kvm.setConfig(replicated); err != nil {
+				return nil, err
+			}
+			return nil, kvm.storeConfig()
+		},
+		func(v interface{}) (interface{}, error) {
+			if err := kvm.setConfig(local); err != nil {
+				return nil, err
+			}
+			conn.WriteString("OK")
+			return nil, nil
+		},
+	)
+}
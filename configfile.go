@@ -0,0 +1,117 @@
+package kvnode
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ConfigEnvPrefix is the prefix of the environment variables that set the
+// flags of the server, such as KVNODE_MAX_KEYS for --max-keys.
+const ConfigEnvPrefix = "KVNODE_"
+
+// LoadConfig sets the flags of a parsed flag set from the environment and
+// from a config file. A flag that's on the command line takes precedence
+// over its environment variable, which takes precedence over the config
+// file, which takes precedence over the default. The file has one flag per
+// line, as the name and the value separated by spaces, such as
+//
+//	# limits
+//	max-keys 1000000
+//	eviction-policy allkeys-lru
+//	tls-cert "/etc/kvnode/server.pem"
+//
+// Values with spaces are quoted, and boolean flags take yes or no.
+func LoadConfig(fs *flag.FlagSet, path string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var file map[string]string
+	if path != "" {
+		var err error
+		if file, err = ReadConfigFile(path); err != nil {
+			return err
+		}
+		for name := range file {
+			if fs.Lookup(name) == nil {
+				return errors.New(path + ": unknown option '" + name + "'")
+			}
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		env := ConfigEnvPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		source := env
+		val, ok := os.LookupEnv(env)
+		if !ok {
+			source = path
+			val, ok = file[f.Name]
+		}
+		if !ok {
+			return
+		}
+		if ferr := fs.Set(f.Name, configBool(f, val)); ferr != nil {
+			err = errors.New(source + ": invalid value '" + val + "' for " + f.Name + ": " + ferr.Error())
+		}
+	})
+	return err
+}
+
+// configBool translates yes and no to the values of a boolean flag.
+func configBool(f *flag.Flag, val string) string {
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		switch strings.ToLower(val) {
+		case "yes":
+			return "true"
+		case "no":
+			return "false"
+		}
+	}
+	return val
+}
+
+// ReadConfigFile reads the options of a config file. The names may be
+// written with the dashes of flags, such as --max-keys.
+func ReadConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	opts := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lerr := func(msg string) error {
+			return errors.New(path + ":" + strconv.Itoa(n) + ": " + msg)
+		}
+		var name, val string
+		if i := strings.IndexAny(line, " \t"); i != -1 {
+			name, val = line[:i], strings.TrimSpace(line[i+1:])
+		} else {
+			name = line
+		}
+		name = strings.ToLower(strings.TrimLeft(name, "-"))
+		if val == "" {
+			return nil, lerr("missing value for '" + name + "'")
+		}
+		if val[0] == '"' {
+			if val, err = strconv.Unquote(val); err != nil {
+				return nil, lerr("invalid quoted value for '" + name + "'")
+			}
+		}
+		if _, ok := opts[name]; ok {
+			return nil, lerr("duplicate option '" + name + "'")
+		}
+		opts[name] = val
+	}
+	return opts, s.Err()
+}
@@ -0,0 +1,323 @@
+package kvnode
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// defaultDatabases is the default number of logical databases.
+const defaultDatabases = 16
+
+var errDBIndex = errors.New("ERR DB index is out of range")
+
+// dbPrefix returns the key prefix of a logical database. Database 0 uses the
+// 'k' prefix, which predates multiple databases, and the others use
+// "d{index}:". Neither contains pattern characters, so patterns may be
+// matched against prefixed keys.
+func dbPrefix(db int) []byte {
+	if db == 0 {
+		return []byte{'k'}
+	}
+	prefix := append([]byte{'d'}, strconv.Itoa(db)...)
+	return append(prefix, ':')
+}
+
+// keyspace is the logical database or the namespace that a command applies
+// to. The namespace takes precedence over the database.
+type keyspace struct {
+	db int
+	ns string
+}
+
+// allKeyspaces is used to publish watch events to every keyspace.
+var allKeyspaces = keyspace{db: -1}
+
+// prefix returns the key prefix of the keyspace.
+func (ks keyspace) prefix() []byte {
+	if ks.ns != "" {
+		return nsPrefix(ks.ns)
+	}
+	return dbPrefix(ks.db)
+}
+
+// key returns the database key for a key in the keyspace.
+func (ks keyspace) key(key []byte) []byte {
+	return ks.appendKey(make([]byte, 0, len(ks.ns)+len(key)+8), key)
+}
+
+// appendKey appends the database key for a key in the keyspace to dst.
+func (ks keyspace) appendKey(dst, key []byte) []byte {
+	switch {
+	case ks.ns != "":
+		dst = append(append(dst, 'n'), ks.ns...)
+		dst = append(dst, ':')
+	case ks.db == 0:
+		dst = append(dst, 'k')
+	default:
+		dst = strconv.AppendInt(append(dst, 'd'), int64(ks.db), 10)
+		dst = append(dst, ':')
+	}
+	return append(dst, key...)
+}
+
+// appendKeys appends the database keys for every step argument, starting
+// with the first, to the buffer. It returns the keys, which are slices of
+// the buffer.
+func (ks keyspace) appendKeys(buf *[]byte, args [][]byte, step int) [][]byte {
+	ends := make([]int, 0, (len(args)+step-1)/step)
+	for i := 0; i < len(args); i += step {
+		*buf = ks.appendKey(*buf, args[i])
+		ends = append(ends, len(*buf))
+	}
+	keys := make([][]byte, len(ends))
+	start := 0
+	for i, end := range ends {
+		keys[i] = (*buf)[start:end:end]
+		start = end
+	}
+	return keys
+}
+
+// String returns the namespace, or the index of the database.
+func (ks keyspace) String() string {
+	if ks.ns != "" {
+		return ks.ns
+	}
+	return strconv.Itoa(ks.db)
+}
+
+// parseDBKey returns the logical database and the key of a database key.
+// False is returned when the key is not in a logical database, such as an
+// ACL user.
+func parseDBKey(key []byte) (int, []byte, bool) {
+	if len(key) > 0 && key[0] == 'k' {
+		return 0, key[1:], true
+	}
+	if len(key) > 0 && key[0] == 'd' {
+		i := bytes.IndexByte(key, ':')
+		if i > 1 {
+			db, err := strconv.Atoi(string(key[1:i]))
+			if err == nil && db > 0 {
+				return db, key[i+1:], true
+			}
+		}
+	}
+	return 0, nil, false
+}
+
+// keyspaceApplier is the applier for a command on a keyspace other than
+// database 0. Commands that are proposed to the raft log are wrapped as
+// "DBEXEC index command [arg ...]" or "NSEXEC namespace command [arg ...]",
+// so that they're applied to the same keyspace on every node.
+type keyspaceApplier struct {
+	finn.Applier
+	ks keyspace
+}
+
+func (m keyspaceApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn != nil && mutate != nil {
+		args := [][]byte{[]byte("dbexec"), []byte(m.ks.String())}
+		if m.ks.ns != "" {
+			args[0] = []byte("nsexec")
+		}
+		args = append(args, cmd.Args...)
+		cmd = redcon.Command{Raw: buildCommand(args...), Args: args}
+	}
+	return m.Applier.Apply(conn, cmd, mutate, respond)
+}
+
+// keyspaceOf returns the keyspace that a command applies to.
+func keyspaceOf(m finn.Applier) keyspace {
+	if m, ok := m.(keyspaceApplier); ok {
+		return m.ks
+	}
+	return keyspace{}
+}
+
+// unwrapKeyspace returns the command and keyspace of a "DBEXEC" or "NSEXEC"
+// command from the raft log.
+func unwrapKeyspace(cmd redcon.Command) (redcon.Command, keyspace, error) {
+	var ks keyspace
+	if len(cmd.Args) < 3 {
+		return cmd, ks, finn.ErrWrongNumberOfArguments
+	}
+	if strings.ToLower(string(cmd.Args[0])) == "nsexec" {
+		ks.ns = string(cmd.Args[1])
+	} else {
+		db, err := strconv.Atoi(string(cmd.Args[1]))
+		if err != nil || db < 0 {
+			return cmd, ks, errDBIndex
+		}
+		ks.db = db
+	}
+	args := cmd.Args[2:]
+	return redcon.Command{Raw: buildCommand(args...), Args: args}, ks, nil
+}
+
+// clientKeyspace returns the keyspace of the client. Clients of users that
+// are bound to namespaces are moved to the first of those namespaces when
+// they're not in one of them.
+func (kvm *Machine) clientKeyspace(c *client) keyspace {
+	u := kvm.user(c.userName())
+	if u != nil && len(u.namespaces) > 0 && !u.canUseNamespace(c.ns) {
+		c.mu.Lock()
+		c.ns = u.namespaces[0]
+		c.mu.Unlock()
+	}
+	return keyspace{db: c.db, ns: c.ns}
+}
+
+// cmdSelect handles "SELECT index". It also leaves the namespace of the
+// connection, if any.
+func (kvm *Machine) cmdSelect(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	n, err := strconv.ParseInt(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if n < 0 || n >= int64(kvm.options().Databases) {
+		return nil, errDBIndex
+	}
+	c := kvm.client(conn)
+	if u := kvm.user(c.userName()); u != nil && len(u.namespaces) > 0 {
+		return nil, errNoPermNamespace
+	}
+	c.mu.Lock()
+	c.db = int(n)
+	c.ns = ""
+	c.mu.Unlock()
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// deleteKeyspace deletes all keys in the keyspace. The caller must hold the
+// machine lock.
+func (kvm *Machine) deleteKeyspace(ks keyspace) error {
+	var batch leveldb.Batch
+	iter := kvm.db.NewIterator(util.BytesPrefix(ks.prefix()), nil)
+	for ok := iter.First(); ok; ok = iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	kvm.truncateHistory(&batch)
+	if err := kvm.writeDB(&batch); err != nil {
+		return err
+	}
+	kvm.resetUsage()
+	if ns := kvm.namespaces[ks.ns]; ns != nil {
+		ns.keys, ns.bytes = 0, 0
+	}
+	return nil
+}
+
+// checkFlush checks the arguments of "FLUSHDB [FORCE]" and
+// "FLUSHALL [FORCE]". Clients must pass FORCE when the flush-require-force
+// option is set, but the commands in the raft log are applied regardless.
+func (kvm *Machine) checkFlush(conn redcon.Conn, cmd redcon.Command) error {
+	var force bool
+	switch len(cmd.Args) {
+	default:
+		return finn.ErrWrongNumberOfArguments
+	case 1:
+	case 2:
+		if strings.ToLower(string(cmd.Args[1])) != "force" {
+			return errSyntaxError
+		}
+		force = true
+	}
+	if conn != nil && !force && kvm.options().FlushRequireForce {
+		return errors.New("ERR " + strings.ToUpper(string(cmd.Args[0])) +
+			" requires FORCE while flush-require-force is set")
+	}
+	return nil
+}
+
+// cmdFlushdb handles "FLUSHDB [FORCE]", which deletes all keys in the
+// selected database or namespace.
+func (kvm *Machine) cmdFlushdb(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if err := kvm.checkFlush(conn, cmd); err != nil {
+		return nil, err
+	}
+	ks := keyspaceOf(m)
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			if err := kvm.deleteKeyspace(ks); err != nil {
+				return nil, err
+			}
+			kvm.watches.publish(ks, kvm.applyStamp, "flushdb", nil, nil)
+			return nil, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteString("OK")
+			return nil, nil
+		},
+	)
+}
+
+// cmdFlushall handles "FLUSHALL [FORCE]", which deletes all keys in every
+// database and namespace. The namespaces themselves remain.
+func (kvm *Machine) cmdFlushall(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if err := kvm.checkFlush(conn, cmd); err != nil {
+		return nil, err
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			stamps, err := kvm.recentStamps()
+			if err != nil {
+				return nil, err
+			}
+			if err := kvm.resetDB(); err != nil {
+				return nil, err
+			}
+			kvm.rcache.clear()
+			kvm.resetUsage()
+			// users and config are not part of the keyspace
+			if err := kvm.storeUsers(); err != nil {
+				return nil, err
+			}
+			if err := kvm.storeConfig(); err != nil {
+				return nil, err
+			}
+			if err := kvm.storeNamespaces(); err != nil {
+				return nil, err
+			}
+			kvm.reqseq = 0
+			// the stamps of recent writes are kept, so that the writes
+			// before the flush are not applied again.
+			var batch leveldb.Batch
+			for _, key := range stamps {
+				batch.Put(key, nil)
+			}
+			kvm.truncateHistory(&batch)
+			if err := kvm.db.Write(&batch, nil); err != nil {
+				return nil, err
+			}
+			kvm.watches.publish(allKeyspaces, kvm.applyStamp, "flushall", nil, nil)
+			return nil, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteString("OK")
+			return nil, nil
+		},
+	)
+}
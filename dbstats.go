@@ -0,0 +1,314 @@
+package kvnode
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// keySample is the number of keys that DBSTATS counts with a prefix before
+// it estimates the rest.
+const keySample = 1000
+
+// dbLevels is the number of levels of LevelDB that are reported.
+const dbLevels = 7
+
+// ioStats counts the bytes that LevelDB reads and writes. The journal gets
+// the writes of the clients, and the tables get the flushes of the memtable
+// and the compactions, so together they give the write amplification.
+type ioStats struct {
+	journalWritten int64
+	tableWritten   int64
+	tableRead      int64
+	// throttle, when set, waits until n bytes may be written to the tables.
+	throttle func(n int)
+}
+
+// wrap returns the storage with its reads and writes counted.
+func (st *ioStats) wrap(stor storage.Storage) storage.Storage {
+	return &statStorage{Storage: stor, stats: st}
+}
+
+type statStorage struct {
+	storage.Storage
+	stats *ioStats
+}
+
+func (s *statStorage) Open(fd storage.FileDesc) (storage.Reader, error) {
+	r, err := s.Storage.Open(fd)
+	if err != nil || fd.Type != storage.TypeTable {
+		return r, err
+	}
+	return &statReader{Reader: r, n: &s.stats.tableRead}, nil
+}
+
+func (s *statStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	w, err := s.Storage.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+	switch fd.Type {
+	case storage.TypeJournal:
+		return &statWriter{Writer: w, n: &s.stats.journalWritten}, nil
+	case storage.TypeTable:
+		return &statWriter{Writer: w, n: &s.stats.tableWritten, throttle: s.stats.throttle}, nil
+	}
+	return w, nil
+}
+
+type statReader struct {
+	storage.Reader
+	n *int64
+}
+
+func (r *statReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+func (r *statReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+type statWriter struct {
+	storage.Writer
+	n        *int64
+	throttle func(n int)
+}
+
+func (w *statWriter) Write(p []byte) (int, error) {
+	if w.throttle != nil {
+		w.throttle(len(p))
+	}
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// levelStats are the tables of a level of LevelDB, and the compactions into
+// the level since the database was opened.
+type levelStats struct {
+	level          int
+	tables         int
+	size           int64
+	compactionTime time.Duration
+	compactionRead int64
+	compactionSize int64
+}
+
+// dbStats are the internals of LevelDB that DBSTATS and the metrics report.
+type dbStats struct {
+	levels         []levelStats
+	journalWritten int64
+	tableWritten   int64
+	tableRead      int64
+	openTables     int64
+	cachedBlock    int64
+	aliveIters     int64
+	aliveSnaps     int64
+}
+
+// writeAmplification is the number of bytes that were written to disk for
+// each byte that was written to the journal.
+func (st *dbStats) writeAmplification() float64 {
+	if st.journalWritten == 0 {
+		return 0
+	}
+	return float64(st.journalWritten+st.tableWritten) / float64(st.journalWritten)
+}
+
+// readAmplification is the most tables that a read looks up, which is every
+// table of level 0, and one table of every other level.
+func (st *dbStats) readAmplification() int {
+	var n int
+	for _, l := range st.levels {
+		switch {
+		case l.level == 0:
+			n += l.tables
+		case l.tables > 0:
+			n++
+		}
+	}
+	return n
+}
+
+// dbStats returns the internals of LevelDB. The caller holds dbmu.
+func (kvm *Machine) dbStats() (*dbStats, error) {
+	st := &dbStats{
+		journalWritten: atomic.LoadInt64(&kvm.iostats.journalWritten),
+		tableWritten:   atomic.LoadInt64(&kvm.iostats.tableWritten),
+		tableRead:      atomic.LoadInt64(&kvm.iostats.tableRead),
+	}
+	for i := 0; i < dbLevels; i++ {
+		v, err := kvm.db.GetProperty("leveldb.num-files-at-level" + strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		tables, _ := strconv.Atoi(v)
+		st.levels = append(st.levels, levelStats{level: i, tables: tables})
+	}
+	// the sizes and the compactions are only in the table of
+	// leveldb.stats, which has a row for each level with tables or
+	// compactions, in MiB and seconds.
+	v, err := kvm.db.GetProperty("leveldb.stats")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(v, "\n") {
+		cols := strings.Split(line, "|")
+		if len(cols) != 6 {
+			continue
+		}
+		level, err := strconv.Atoi(strings.TrimSpace(cols[0]))
+		if err != nil || level < 0 || level >= len(st.levels) {
+			continue
+		}
+		var nums [4]float64
+		for i := range nums {
+			nums[i], _ = strconv.ParseFloat(strings.TrimSpace(cols[i+2]), 64)
+		}
+		l := &st.levels[level]
+		l.size = int64(nums[0] * (1 << 20))
+		l.compactionTime = time.Duration(nums[1] * float64(time.Second))
+		l.compactionRead = int64(nums[2] * (1 << 20))
+		l.compactionSize = int64(nums[3] * (1 << 20))
+	}
+	for _, p := range []struct {
+		name string
+		n    *int64
+	}{
+		{"openedtables", &st.openTables},
+		{"cachedblock", &st.cachedBlock},
+		{"aliveiters", &st.aliveIters},
+		{"alivesnaps", &st.aliveSnaps},
+	} {
+		if v, err := kvm.db.GetProperty("leveldb." + p.name); err == nil {
+			// cachedblock is "<nil>" without a block cache.
+			*p.n, _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return st, nil
+}
+
+// approxKeys returns the number of keys with a prefix. Up to keySample keys
+// are counted, and beyond that the number is estimated from the size on disk
+// of the counted keys and of all of the keys. The caller holds dbmu.
+func (kvm *Machine) approxKeys(prefix []byte) (int64, error) {
+	r := util.BytesPrefix(prefix)
+	iter := kvm.db.NewIterator(r, &opt.ReadOptions{DontFillCache: true})
+	defer iter.Release()
+	var n int64
+	ok := iter.First()
+	for ; ok && n < keySample; ok = iter.Next() {
+		n++
+	}
+	if !ok {
+		return n, iter.Error()
+	}
+	sizes, err := kvm.db.SizeOf([]util.Range{{Start: r.Start, Limit: iter.Key()}, *r})
+	if err != nil {
+		return 0, err
+	}
+	if sizes[0] > 0 && sizes[1] > sizes[0] {
+		// the keys that are still in the memtable have no size.
+		n = n * sizes[1] / sizes[0]
+	}
+	return n, nil
+}
+
+// cmdDBStats handles "DBSTATS [prefix ...]", which replies with the levels
+// of the storage of this node, the bytes that LevelDB read and wrote since
+// the node started and the amplification, the open tables, iterators and
+// snapshots, and the number of keys in the keyspace of the client. With
+// prefixes, the number of keys with each prefix is included. The numbers of
+// keys are estimated beyond a thousand keys.
+func (kvm *Machine) cmdDBStats(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	ks := keyspaceOf(m)
+	kvm.dbmu.RLock()
+	defer kvm.dbmu.RUnlock()
+	st, err := kvm.dbStats()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := kvm.approxKeys(ks.prefix())
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make([]int64, len(cmd.Args)-1)
+	for i, prefix := range cmd.Args[1:] {
+		if prefixes[i], err = kvm.approxKeys(ks.key(prefix)); err != nil {
+			return nil, err
+		}
+	}
+	var tables int
+	var size int64
+	for _, l := range st.levels {
+		tables += l.tables
+		size += l.size
+	}
+	n := 13
+	if len(prefixes) > 0 {
+		n++
+	}
+	writeMap(conn, n)
+	conn.WriteBulkString("levels")
+	conn.WriteArray(len(st.levels))
+	for _, l := range st.levels {
+		writeMap(conn, 6)
+		conn.WriteBulkString("level")
+		conn.WriteInt(l.level)
+		conn.WriteBulkString("tables")
+		conn.WriteInt(l.tables)
+		conn.WriteBulkString("bytes")
+		conn.WriteInt64(l.size)
+		conn.WriteBulkString("compaction_sec")
+		writeDouble(conn, l.compactionTime.Seconds(), 3)
+		conn.WriteBulkString("compaction_read_bytes")
+		conn.WriteInt64(l.compactionRead)
+		conn.WriteBulkString("compaction_written_bytes")
+		conn.WriteInt64(l.compactionSize)
+	}
+	conn.WriteBulkString("tables")
+	conn.WriteInt(tables)
+	conn.WriteBulkString("bytes")
+	conn.WriteInt64(size)
+	conn.WriteBulkString("journal_written_bytes")
+	conn.WriteInt64(st.journalWritten)
+	conn.WriteBulkString("table_written_bytes")
+	conn.WriteInt64(st.tableWritten)
+	conn.WriteBulkString("table_read_bytes")
+	conn.WriteInt64(st.tableRead)
+	conn.WriteBulkString("write_amplification")
+	writeDouble(conn, st.writeAmplification(), 2)
+	conn.WriteBulkString("read_amplification")
+	conn.WriteInt(st.readAmplification())
+	conn.WriteBulkString("open_tables")
+	conn.WriteInt64(st.openTables)
+	conn.WriteBulkString("cached_block_bytes")
+	conn.WriteInt64(st.cachedBlock)
+	conn.WriteBulkString("open_iterators")
+	conn.WriteInt64(st.aliveIters)
+	conn.WriteBulkString("open_snapshots")
+	conn.WriteInt64(st.aliveSnaps)
+	conn.WriteBulkString("keys")
+	conn.WriteInt64(keys)
+	if len(prefixes) > 0 {
+		conn.WriteBulkString("prefixes")
+		writeMap(conn, len(prefixes))
+		for i, prefix := range cmd.Args[1:] {
+			conn.WriteBulk(prefix)
+			conn.WriteInt64(prefixes[i])
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,74 @@
+package kvnode
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// adminHTTP serves the profiling and runtime variables of the process. The
+// endpoints are only served while DebugEndpoints is enabled, and require a
+// user that may run CONFIG.
+type adminHTTP struct {
+	m   *Machine
+	srv *http.Server
+}
+
+// listenAdminHTTP binds the admin HTTP listener and starts serving in the
+// background.
+func listenAdminHTTP(laddr string, m *Machine) (*adminHTTP, error) {
+	ln, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	a := &adminHTTP{m: m}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	a.srv = &http.Server{Handler: a.guard(mux)}
+	go a.srv.Serve(ln)
+	return a, nil
+}
+
+// Close stops the admin HTTP listener.
+func (a *adminHTTP) Close() error {
+	return a.srv.Close()
+}
+
+// guard only passes requests while the endpoints are enabled, from
+// addresses that are allowed, and from users that may run CONFIG. Requests
+// use basic auth, which may be omitted when the default user has no
+// password.
+func (a *adminHTTP) guard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.m.options().DebugEndpoints {
+			http.NotFound(w, r)
+			return
+		}
+		if !a.m.ipAllowed(r.RemoteAddr, "") {
+			http.Error(w, errIPDenied[1:len(errIPDenied)-2], http.StatusForbidden)
+			return
+		}
+		name, pass, ok := r.BasicAuth()
+		if !ok {
+			name = defaultUser
+		}
+		u := a.m.user(name)
+		if u == nil || !u.enabled || (ok && !u.checkPassword(pass)) ||
+			(!ok && !u.nopass) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kvnode"`)
+			http.Error(w, errWrongPass.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !u.canRun("config") {
+			http.Error(w, errNoPermCommand.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,165 @@
+package kvnode
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/raft-redcon"
+	"github.com/tidwall/redcon"
+)
+
+const errDropping = "-ERR connections are dropped by DEBUG DROP-FOLLOWER\r\n"
+
+var errDropLeader = errors.New("ERR DEBUG DROP-FOLLOWER must run on a follower")
+
+// stallPoll is how often a stalled apply checks whether it may continue.
+const stallPoll = 100 * time.Millisecond
+
+// cmdDebug handles the DEBUG subcommands:
+//
+//	DEBUG OBJECT key
+//	DEBUG SLEEP seconds
+//	DEBUG DROP-FOLLOWER seconds
+//	DEBUG SNAPSHOT
+//
+// SLEEP, DROP-FOLLOWER and SNAPSHOT inject faults for tests against a live
+// cluster, and only run on the admin listener, even when it's not
+// configured.
+func (kvm *Machine) cmdDebug(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	sub := strings.ToLower(string(cmd.Args[1]))
+	switch sub {
+	default:
+		return nil, errors.New("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	case "object":
+		return kvm.cmdDebugObject(m, conn, cmd)
+	case "sleep", "drop-follower", "snapshot":
+	}
+	if !kvm.client(conn).admin {
+		return nil, errNotAdmin
+	}
+	switch sub {
+	case "sleep":
+		return kvm.cmdDebugSleep(m, conn, cmd)
+	case "drop-follower":
+		return kvm.cmdDebugDropFollower(m, conn, cmd)
+	default:
+		return kvm.cmdDebugSnapshot(m, conn, cmd)
+	}
+}
+
+// parseDebugSeconds parses the seconds of DEBUG SLEEP and DEBUG
+// DROP-FOLLOWER, and returns the time until which they last, which is zero
+// for zero seconds.
+func parseDebugSeconds(cmd redcon.Command) (int64, uint64, error) {
+	if len(cmd.Args) != 3 {
+		return 0, 0, finn.ErrWrongNumberOfArguments
+	}
+	secs, err := strconv.ParseUint(string(cmd.Args[2]), 10, 32)
+	if err != nil {
+		return 0, 0, errors.New("ERR value is not an integer or out of range")
+	}
+	if secs == 0 {
+		return 0, 0, nil
+	}
+	return time.Now().Add(time.Duration(secs) * time.Second).UnixNano(), secs, nil
+}
+
+// cmdDebugSleep handles "DEBUG SLEEP seconds", which stalls the apply of the
+// raft log on this node for a number of seconds, so that the node falls
+// behind on applied writes while it keeps receiving them. Zero seconds
+// resumes it. It replies with OK without waiting.
+func (kvm *Machine) cmdDebugSleep(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	until, secs, err := parseDebugSeconds(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if secs > 0 {
+		log.Warningf("debug: the apply of writes is stalled for %d seconds", secs)
+	} else {
+		log.Noticef("debug: the apply of writes is resumed")
+	}
+	atomic.StoreInt64(&kvm.stallUntil, until)
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// waitStall waits while DEBUG SLEEP stalls the apply of the raft log.
+func (kvm *Machine) waitStall() {
+	for time.Now().UnixNano() < atomic.LoadInt64(&kvm.stallUntil) {
+		select {
+		case <-kvm.done:
+			return
+		case <-time.After(stallPoll):
+		}
+	}
+}
+
+// cmdDebugDropFollower handles "DEBUG DROP-FOLLOWER seconds", which cuts a
+// follower off from the leader for a number of seconds, so that it lags
+// behind the raft log. The connections of the raft transport are closed,
+// and every new connection is refused until the time is up, while the
+// clients that are connected keep working. Zero seconds accepts connections
+// again. The follower may start an election when the time is longer than
+// its election timeout. It replies with OK.
+func (kvm *Machine) cmdDebugDropFollower(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	until, secs, err := parseDebugSeconds(cmd)
+	if err != nil {
+		return nil, err
+	}
+	stats, _, err := kvm.raftInfo()
+	if err != nil {
+		return nil, err
+	}
+	if stats["state"] == "Leader" {
+		return nil, errDropLeader
+	}
+	atomic.StoreInt64(&kvm.dropUntil, until)
+	if secs == 0 {
+		log.Noticef("debug: connections are accepted again")
+		conn.WriteString("OK")
+		return nil, nil
+	}
+	log.Warningf("debug: connections are dropped for %d seconds", secs)
+	// the connections that aren't clients are those of the raft transport.
+	var drop []redcon.Conn
+	kvm.cmu.Lock()
+	for c := range kvm.conns {
+		if _, ok := c.Context().(*client); !ok {
+			drop = append(drop, c)
+		}
+	}
+	kvm.cmu.Unlock()
+	for _, c := range drop {
+		c.NetConn().Close()
+	}
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// dropping returns true while DEBUG DROP-FOLLOWER refuses connections.
+func (kvm *Machine) dropping() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&kvm.dropUntil)
+}
+
+// cmdDebugSnapshot handles "DEBUG SNAPSHOT", which takes a raft snapshot of
+// this node and compacts its raft log. It replies with OK once the snapshot
+// is written.
+func (kvm *Machine) cmdDebugSnapshot(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	// the node does not expose the raft snapshot directly, so ask the
+	// local server for one.
+	if _, _, err := raftredcon.Do(kvm.addr, nil, []byte("raftsnapshot")); err != nil {
+		return nil, err
+	}
+	conn.WriteString("OK")
+	return nil, nil
+}
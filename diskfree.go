@@ -0,0 +1,15 @@
+//go:build !windows
+
+package kvnode
+
+import "syscall"
+
+// diskFree returns the bytes that are available to the process on the file
+// system of a directory.
+func diskFree(dir string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
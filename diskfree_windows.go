@@ -0,0 +1,6 @@
+package kvnode
+
+// diskFree isn't supported on Windows, where the disk guard is disabled.
+func diskFree(dir string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,71 @@
+package kvnode
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var errDiskLow = &kindError{"MISCONF free disk space is below min-free-disk, " +
+	"writes are refused until space is freed", ErrReadOnly}
+
+// diskWrites are the writes that are accepted while free disk space is low,
+// since they free space.
+var diskWrites = map[string]bool{
+	"del": true, "delif": true, "pdel": true, "flushdb": true, "flushall": true,
+}
+
+// guardDisk checks the free space of the data and raft log directories
+// every second, and refuses the writes of clients while the space of either
+// one is below MinFreeDiskMB, so that LevelDB and the raft log never run out
+// of space in the middle of a write.
+func (kvm *Machine) guardDisk(dirs ...string) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		kvm.checkDiskSpace(dirs)
+		select {
+		case <-kvm.done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// checkDiskSpace updates the free space and switches the node to refusing
+// writes, or back, when it crosses the threshold.
+func (kvm *Machine) checkDiskSpace(dirs []string) {
+	free := int64(-1)
+	for _, dir := range dirs {
+		n, ok := diskFree(dir)
+		if ok && (free < 0 || n < free) {
+			free = n
+		}
+	}
+	atomic.StoreInt64(&kvm.diskFree, free)
+	min := int64(kvm.options().MinFreeDiskMB) * 1024 * 1024
+	low := free >= 0 && min > 0 && free < min
+	var v int32
+	if low {
+		v = 1
+	}
+	if atomic.SwapInt32(&kvm.diskLow, v) != v {
+		if low {
+			log.Warningf("free disk space is %s, refusing writes", humanBytes(uint64(free)))
+		} else {
+			log.Noticef("free disk space is %s, accepting writes", humanBytes(uint64(free)))
+		}
+	}
+}
+
+// checkDisk refuses the writes of clients, other than deletes, while free
+// disk space is low.
+func (kvm *Machine) checkDisk(name string) error {
+	if atomic.LoadInt32(&kvm.diskLow) == 0 || diskWrites[name] {
+		return nil
+	}
+	if info, ok := commands[name]; !ok || !info.hasCategory("write") {
+		return nil
+	}
+	atomic.AddInt64(&kvm.stats.diskRefused, 1)
+	return errDiskLow
+}
@@ -0,0 +1,76 @@
+package kvnode
+
+import (
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// syncWriteOptions sync the LevelDB log of a write before it returns.
+var syncWriteOptions = &opt.WriteOptions{Sync: true}
+
+// syncApplier marks the writes of a client that has CLIENT SYNCWRITES on.
+// The writes are wrapped as "SYNCEXEC command" in the raft log, so that
+// every node syncs the storage write of the command.
+type syncApplier struct {
+	finn.Applier
+}
+
+func (m syncApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn != nil && mutate != nil {
+		args := append([][]byte{[]byte("syncexec")}, cmd.Args...)
+		cmd = redcon.Command{Raw: buildCommand(args...), Args: args}
+	}
+	return m.Applier.Apply(conn, cmd, mutate, respond)
+}
+
+// unwrapSync returns the command of a "SYNCEXEC command" entry.
+func unwrapSync(cmd redcon.Command) (redcon.Command, error) {
+	if len(cmd.Args) < 2 {
+		return cmd, finn.ErrWrongNumberOfArguments
+	}
+	args := cmd.Args[1:]
+	return redcon.Command{Raw: buildCommand(args...), Args: args}, nil
+}
+
+// writeOptions returns the options for the storage writes of the command
+// that's being applied.
+func (kvm *Machine) writeOptions() *opt.WriteOptions {
+	if kvm.syncing {
+		return syncWriteOptions
+	}
+	return nil
+}
+
+// cmdClientSyncWrites handles "CLIENT SYNCWRITES ON|OFF".
+func (kvm *Machine) cmdClientSyncWrites(c *client, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var on bool
+	switch strings.ToLower(string(cmd.Args[2])) {
+	default:
+		return nil, errSyntaxError
+	case "on":
+		on = true
+	case "off":
+	}
+	c.mu.Lock()
+	c.syncWrites = on
+	c.mu.Unlock()
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// syncing returns true if the client has CLIENT SYNCWRITES on.
+func (c *client) syncing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.syncWrites
+}
@@ -0,0 +1,362 @@
+package kvnode
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// encryptionFile is the file in the database directory of an encrypted
+// database, which holds a nonce and the nonce encrypted with the key, so
+// that a wrong key is detected before any data is read.
+const encryptionFile = "ENCRYPTION"
+
+var (
+	errEncryptionKey = errors.New("invalid encryption key, " +
+		"expected 16, 24 or 32 bytes, or as many bytes in hex")
+	errWrongKey    = errors.New("the encryption key doesn't match the database")
+	errEncryptedDB = errors.New("the database is encrypted, an encryption key is required")
+	errPlaintextDB = errors.New("the database is not encrypted, it can't be opened with an encryption key")
+	errShortFile   = errors.New("encrypted file is too short")
+	errEntryNoKey  = errors.New("the raft log entry is encrypted, an encryption key is required")
+	errEntryKey    = errors.New("the raft log entry can't be decrypted, the nodes of a cluster need the same encryption key")
+)
+
+// KeyProvider returns the key that the storage is encrypted with, which is
+// 16, 24 or 32 bytes for AES-128, AES-192 or AES-256. It's called once, when
+// the machine is opened, so it may fetch the key from a KMS.
+type KeyProvider func() ([]byte, error)
+
+// EnvKey returns a KeyProvider that reads the key from an environment
+// variable, which holds the key in hex.
+func EnvKey(name string) KeyProvider {
+	return func() ([]byte, error) {
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, errors.New("environment variable " + name + " is not set")
+		}
+		return parseKey([]byte(val))
+	}
+}
+
+// FileKey returns a KeyProvider that reads the key from a file, which holds
+// the key in hex, or the raw bytes of the key.
+func FileKey(path string) KeyProvider {
+	return func() ([]byte, error) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return parseKey(data)
+	}
+}
+
+// parseKey returns the key of a key file or variable.
+func parseKey(data []byte) ([]byte, error) {
+	if text := bytes.TrimSpace(data); len(text) == 32 || len(text) == 48 || len(text) == 64 {
+		if key, err := hex.DecodeString(string(text)); err == nil {
+			return key, nil
+		}
+	}
+	if len(data) == 16 || len(data) == 24 || len(data) == 32 {
+		return data, nil
+	}
+	return nil, errEncryptionKey
+}
+
+// loadKey returns the key of a KeyProvider.
+func loadKey(provider KeyProvider) ([]byte, error) {
+	key, err := provider()
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, errEncryptionKey
+	}
+	return key, nil
+}
+
+// storageCipher returns the cipher of the key of a KeyProvider.
+func storageCipher(provider KeyProvider) (cipher.Block, error) {
+	key, err := loadKey(provider)
+	if err != nil {
+		return nil, err
+	}
+	return aes.NewCipher(key)
+}
+
+// entryCipher returns the cipher that the raft log entries are sealed with,
+// whose key is derived from the encryption key, so that it's not the key of
+// the database files.
+func entryCipher(key []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kvnode raft log"))
+	block, err := aes.NewCipher(mac.Sum(nil)[:len(key)])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealApplier seals the writes that the node proposes with AES-GCM, as
+// "CRYPTEXEC sealed" entries, so that the raft log, which is sent to the
+// other nodes and is on their disks too, doesn't hold the keys and values.
+// It's the innermost applier, so the entries are sealed as a whole.
+type sealApplier struct {
+	finn.Applier
+	aead cipher.AEAD
+}
+
+func (m sealApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn != nil && mutate != nil {
+		sealed := make([]byte, m.aead.NonceSize(), m.aead.NonceSize()+len(cmd.Raw)+m.aead.Overhead())
+		if _, err := rand.Read(sealed); err != nil {
+			return nil, err
+		}
+		sealed = m.aead.Seal(sealed, sealed, cmd.Raw, nil)
+		args := [][]byte{[]byte("cryptexec"), sealed}
+		cmd = redcon.Command{Raw: buildCommand(args...), Args: args}
+	}
+	return m.Applier.Apply(conn, cmd, mutate, respond)
+}
+
+// sealEntries returns the applier that the node proposes the writes of a
+// command with, which seals them when the node has an encryption key.
+func (kvm *Machine) sealEntries(m finn.Applier) finn.Applier {
+	if _, ok := m.(sealApplier); ok || kvm.entries == nil {
+		return m
+	}
+	return sealApplier{m, kvm.entries}
+}
+
+// unwrapEntry returns the command of a "CRYPTEXEC sealed" entry.
+func (kvm *Machine) unwrapEntry(cmd redcon.Command) (redcon.Command, error) {
+	if len(cmd.Args) != 2 {
+		return cmd, finn.ErrWrongNumberOfArguments
+	}
+	if kvm.entries == nil {
+		return cmd, errEntryNoKey
+	}
+	sealed := cmd.Args[1]
+	size := kvm.entries.NonceSize()
+	if len(sealed) < size {
+		return cmd, errEntryKey
+	}
+	raw, err := kvm.entries.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return cmd, errEntryKey
+	}
+	return redcon.Parse(raw)
+}
+
+// openStorage opens the storage of the database in a directory, which is
+// encrypted with the cipher when it's not nil.
+func openStorage(path string, block cipher.Block) (storage.Storage, error) {
+	stor, err := storage.OpenFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkEncryption(path, block); err != nil {
+		stor.Close()
+		return nil, err
+	}
+	if err := checkFormat(path); err != nil {
+		stor.Close()
+		return nil, err
+	}
+	if block == nil {
+		return stor, nil
+	}
+	return &cryptStorage{Storage: stor, block: block}, nil
+}
+
+// checkEncryption checks that a database is encrypted with the cipher, or
+// that it's not encrypted when the cipher is nil. A new database is marked
+// as encrypted.
+func checkEncryption(path string, block cipher.Block) error {
+	name := filepath.Join(path, encryptionFile)
+	data, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if block == nil {
+		if err == nil {
+			return errEncryptedDB
+		}
+		return nil
+	}
+	check := make([]byte, aes.BlockSize)
+	if err == nil {
+		if len(data) != 2*aes.BlockSize {
+			return errors.New("invalid " + encryptionFile + " file")
+		}
+		block.Encrypt(check, data[:aes.BlockSize])
+		if !bytes.Equal(check, data[aes.BlockSize:]) {
+			return errWrongKey
+		}
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(path, "CURRENT")); err == nil {
+		return errPlaintextDB
+	}
+	nonce := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	block.Encrypt(check, nonce)
+	return ioutil.WriteFile(name, append(nonce, check...), 0600)
+}
+
+// cryptStorage encrypts the files of LevelDB with AES in CTR mode, which
+// allows the random reads of the tables. Every file starts with the random
+// initial counter block that the rest of the file is encrypted with, so the
+// keys, the values and the structure of the files are all encrypted. CTR
+// isn't authenticated, so changes to the files aren't detected.
+type cryptStorage struct {
+	storage.Storage
+	block cipher.Block
+}
+
+// Log drops the messages of LevelDB, since they mention keys.
+func (s *cryptStorage) Log(str string) {}
+
+func (s *cryptStorage) Open(fd storage.FileDesc) (storage.Reader, error) {
+	r, err := s.Storage.Open(fd)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := r.ReadAt(iv, 0); err != nil {
+		r.Close()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = &storage.ErrCorrupted{Fd: fd, Err: errShortFile}
+		}
+		return nil, err
+	}
+	return &cryptReader{r: r, block: s.block, iv: iv}, nil
+}
+
+func (s *cryptStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	w, err := s.Storage.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if _, err := w.Write(iv); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &cryptWriter{w: w, stream: cipher.NewCTR(s.block, iv)}, nil
+}
+
+// cryptReader decrypts a file. Offsets are relative to the end of the
+// initial counter block.
+type cryptReader struct {
+	r     storage.Reader
+	block cipher.Block
+	iv    []byte
+	off   int64 // the offset of Read
+}
+
+func (r *cryptReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off+aes.BlockSize)
+	r.xor(p[:n], off)
+	return n, err
+}
+
+func (r *cryptReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *cryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		r.off = offset
+	case io.SeekCurrent:
+		r.off += offset
+	case io.SeekEnd:
+		end, err := r.r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		r.off = end - aes.BlockSize + offset
+	}
+	return r.off, nil
+}
+
+func (r *cryptReader) Close() error {
+	return r.r.Close()
+}
+
+// xor decrypts the bytes at an offset of the file, by starting the key
+// stream at the counter block of the offset.
+func (r *cryptReader) xor(p []byte, off int64) {
+	if len(p) == 0 {
+		return
+	}
+	iv := append([]byte(nil), r.iv...)
+	addCounter(iv, uint64(off/aes.BlockSize))
+	stream := cipher.NewCTR(r.block, iv)
+	if skip := off % aes.BlockSize; skip > 0 {
+		var pad [aes.BlockSize]byte
+		stream.XORKeyStream(pad[:skip], pad[:skip])
+	}
+	stream.XORKeyStream(p, p)
+}
+
+// addCounter adds to a counter block, which is a big-endian integer, the way
+// that CTR mode increments it.
+func addCounter(iv []byte, n uint64) {
+	var carry uint64
+	for i := len(iv) - 1; i >= 0 && (n > 0 || carry > 0); i-- {
+		sum := uint64(iv[i]) + n&0xff + carry
+		iv[i] = byte(sum)
+		carry = sum >> 8
+		n >>= 8
+	}
+}
+
+// cryptWriter encrypts a file, which LevelDB writes from start to end.
+type cryptWriter struct {
+	w      storage.Writer
+	stream cipher.Stream
+	buf    []byte
+}
+
+func (w *cryptWriter) Write(p []byte) (int, error) {
+	if cap(w.buf) < len(p) {
+		w.buf = make([]byte, len(p))
+	}
+	buf := w.buf[:len(p)]
+	w.stream.XORKeyStream(buf, p)
+	return w.w.Write(buf)
+}
+
+func (w *cryptWriter) Sync() error  { return w.w.Sync() }
+func (w *cryptWriter) Close() error { return w.w.Close() }
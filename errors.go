@@ -0,0 +1,106 @@
+package kvnode
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// The kinds of errors that the in-process API returns. The errors may carry
+// more details, such as the address of the leader, and are checked with
+// errors.Is. Since every value is a string, there is no error for the wrong
+// type of value.
+var (
+	// ErrNotFound is returned when a key does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrNotLeader is returned for writes on a node that isn't the leader.
+	// The error is a *NotLeaderError, which has the address of the leader.
+	ErrNotLeader = errors.New("not the leader")
+	// ErrReadOnly is returned for writes while the node refuses them, such
+	// as while its free disk space is below MinFreeDiskMB.
+	ErrReadOnly = errors.New("read-only")
+	// ErrTooLarge is returned for writes with a key longer than MaxKeySize
+	// or a value larger than MaxValueSize. The error is a *TooLargeError.
+	ErrTooLarge = errors.New("too large")
+)
+
+// NotLeaderError is the error of a write on a node that isn't the leader.
+type NotLeaderError struct {
+	// Leader is the address of the leader, or empty during an election.
+	Leader string
+	// ReadOnly is true on a follower with ReplicaReads, which answers
+	// writes with READONLY rather than TRY.
+	ReadOnly bool
+}
+
+// Error returns the reply that clients get, which tells them where to retry.
+func (e *NotLeaderError) Error() string {
+	switch {
+	case e.ReadOnly && e.Leader == "":
+		return "READONLY leader not known"
+	case e.ReadOnly:
+		return "READONLY " + e.Leader
+	case e.Leader == "":
+		return "ERR leader not known"
+	}
+	return "TRY " + e.Leader
+}
+
+// Is returns true for ErrNotLeader.
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+// TooLargeError is the error of a write with a key or a value over its
+// limit.
+type TooLargeError struct {
+	// What is "key" or "value".
+	What string
+	// Size is the size of the key or the value, and Limit is the limit, in
+	// bytes.
+	Size, Limit int
+}
+
+func (e *TooLargeError) Error() string {
+	return "ERR " + e.What + " of " + strconv.Itoa(e.Size) +
+		" bytes exceeds the limit of " + strconv.Itoa(e.Limit) + " bytes"
+}
+
+// Is returns true for ErrTooLarge.
+func (e *TooLargeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+// kindError is an error reply that's one of the kinds of errors, such as
+// ErrReadOnly.
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// notLeader returns the error of a write on a node that isn't the leader.
+func (kvm *Machine) notLeader() *NotLeaderError {
+	_, leader, _ := kvm.raftInfo()
+	return &NotLeaderError{Leader: leader, ReadOnly: kvm.options().ReplicaReads}
+}
+
+// redirect returns the address of the leader from a "TRY addr" or a
+// "READONLY addr" reply.
+func redirect(err error) (string, bool) {
+	msg := err.Error()
+	for _, prefix := range []string{"TRY ", "READONLY "} {
+		if strings.HasPrefix(msg, prefix) {
+			addr := strings.TrimSpace(msg[len(prefix):])
+			return addr, addr != "" && !strings.Contains(addr, " ")
+		}
+	}
+	return "", false
+}
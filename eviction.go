@@ -0,0 +1,411 @@
+package kvnode
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	// evictInterval is how often the usage of the keys is checked.
+	evictInterval = 100 * time.Millisecond
+	// evictSamples is the number of keys that are swept for each key that's
+	// evicted. More samples are closer to an exact LRU, and slower.
+	evictSamples = 16
+	// evictBatch is the most keys that an EVICT entry deletes.
+	evictBatch = 128
+	// accessSlots is the number of slots that the access times of keys are
+	// hashed to.
+	accessSlots = 1 << 15
+)
+
+// The eviction policies.
+const (
+	policyNoEviction = "noeviction"
+	policyLRU        = "allkeys-lru"
+	policyOldest     = "allkeys-oldest"
+)
+
+var evictionPolicies = map[string]bool{
+	policyNoEviction: true, policyLRU: true, policyOldest: true,
+}
+
+var errEvictionPolicy = errors.New("invalid eviction policy, " +
+	"must be noeviction, allkeys-lru or allkeys-oldest")
+
+// errVolatilePolicy refuses the volatile policies of Redis, such as
+// volatile-ttl, which only evict keys with TTLs. Keys have no TTLs until
+// expirations are supported, so these policies would never evict a key.
+var errVolatilePolicy = errors.New("the volatile eviction policies are " +
+	"not supported, since keys have no TTLs")
+
+// checkEvictionPolicy returns an error for a policy that isn't supported.
+func checkEvictionPolicy(policy string) error {
+	if strings.HasPrefix(policy, "volatile-") {
+		return errVolatilePolicy
+	}
+	if !evictionPolicies[policy] {
+		return errEvictionPolicy
+	}
+	return nil
+}
+
+var errOverCapacity = errors.New("OOM the keys are over max-keys or max-bytes, " +
+	"writes are refused until keys are deleted")
+
+// evictRanges are the ranges of the database that hold the keys of the
+// logical databases and the namespaces, which are the keys that count
+// towards MaxKeys and MaxBytes.
+var evictRanges = []util.Range{
+	*util.BytesPrefix([]byte{'d'}),
+	*util.BytesPrefix([]byte{'k'}),
+	*util.BytesPrefix([]byte{'n'}),
+}
+
+// keyspaceUsage is the number of keys and their size, in bytes, of all
+// databases and namespaces. It's only tracked while MaxKeys or MaxBytes are
+// set, and counted is 1 while it is. It's accessed atomically.
+type keyspaceUsage struct {
+	keys    int64
+	bytes   int64
+	counted int32
+}
+
+// accessClock holds the time, in nanoseconds, that keys were last accessed by
+// the commands of clients for the LRU policy. Keys are hashed to the slots,
+// so a key may seem more recently accessed than it was.
+type accessClock [accessSlots]uint64
+
+func accessSlot(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % accessSlots
+}
+
+// touchKeys records the access of the keys of a command.
+func (kvm *Machine) touchKeys(ks keyspace, keys [][]byte) {
+	now := uint64(time.Now().UnixNano())
+	buf := getKeyBuf()
+	defer putKeyBuf(buf)
+	for _, key := range keys {
+		*buf = ks.appendKey((*buf)[:0], key)
+		atomic.StoreUint64(&kvm.access[accessSlot(*buf)], now)
+	}
+}
+
+// lastUse returns the time, in nanoseconds, that a key was last written or,
+// for the LRU policy, accessed.
+func (kvm *Machine) lastUse(policy string, key, value []byte) uint64 {
+	last := valueVersion(value)
+	if policy == policyLRU {
+		if at := atomic.LoadUint64(&kvm.access[accessSlot(key)]); at > last {
+			last = at
+		}
+	}
+	return last
+}
+
+// trackUsage adds the changes of a batch to the usage, before the batch is
+// written. It returns a function that applies them once the batch is
+// written. The caller must hold the machine lock, or the locks of the keys.
+func (kvm *Machine) trackUsage(batch *leveldb.Batch) (func(), error) {
+	if atomic.LoadInt32(&kvm.usage.counted) == 0 {
+		return func() {}, nil
+	}
+	d := &usageDelta{get: kvm.appliedValue, sizes: make(map[string]int)}
+	if err := batch.Replay(d); err != nil {
+		return nil, err
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return func() { kvm.addUsage(d.keys, d.bytes) }, nil
+}
+
+func (kvm *Machine) addUsage(keys, bytes int64) {
+	if atomic.LoadInt32(&kvm.usage.counted) == 1 {
+		atomic.AddInt64(&kvm.usage.keys, keys)
+		atomic.AddInt64(&kvm.usage.bytes, bytes)
+	}
+}
+
+// resetUsage makes the usage count again, after the keys were deleted or
+// replaced at once.
+func (kvm *Machine) resetUsage() {
+	atomic.StoreInt32(&kvm.usage.counted, 0)
+}
+
+// countUsage counts the keys and their size. It holds the machine lock, so
+// writes wait for the count, which only happens when the limits are set or
+// after a flush.
+func (kvm *Machine) countUsage() error {
+	kvm.mu.Lock()
+	defer kvm.mu.Unlock()
+	kvm.dbmu.RLock()
+	defer kvm.dbmu.RUnlock()
+	// the pending writes of a group are written first, since the writes
+	// that follow the count are tracked with the values they replace.
+	if err := kvm.flushGroup(); err != nil {
+		return err
+	}
+	var keys, bytes int64
+	for i := range evictRanges {
+		iter := kvm.db.NewIterator(&evictRanges[i], nil)
+		for ok := iter.First(); ok; ok = iter.Next() {
+			keys++
+			bytes += int64(len(iter.Key()) + len(iter.Value()))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&kvm.usage.keys, keys)
+	atomic.StoreInt64(&kvm.usage.bytes, bytes)
+	atomic.StoreInt32(&kvm.usage.counted, 1)
+	return nil
+}
+
+// overCapacity returns the number of keys and bytes that the usage is over
+// the limits.
+func (kvm *Machine) overCapacity(opts *Options) (keys, bytes int64) {
+	if atomic.LoadInt32(&kvm.usage.counted) == 0 {
+		return 0, 0
+	}
+	if opts.MaxKeys > 0 {
+		keys = atomic.LoadInt64(&kvm.usage.keys) - int64(opts.MaxKeys)
+	}
+	if opts.MaxBytes > 0 {
+		bytes = atomic.LoadInt64(&kvm.usage.bytes) - int64(opts.MaxBytes)
+	}
+	return keys, bytes
+}
+
+// checkCapacity refuses the writes of clients, other than deletes, while the
+// keys are over the limits and the policy is noeviction.
+func (kvm *Machine) checkCapacity(name string) error {
+	opts := kvm.options()
+	if opts.EvictionPolicy != policyNoEviction || diskWrites[name] {
+		return nil
+	}
+	if keys, bytes := kvm.overCapacity(opts); keys <= 0 && bytes <= 0 {
+		return nil
+	}
+	if info, ok := commands[name]; !ok || !info.hasCategory("write") {
+		return nil
+	}
+	atomic.AddInt64(&kvm.stats.oomRefused, 1)
+	return errOverCapacity
+}
+
+// evictKeys keeps the usage of the keys within MaxKeys and MaxBytes. The
+// leader chooses the keys to evict, and proposes them to the raft log as
+// "EVICT key [key ...]", so that every node deletes the same keys. Keys are
+// chosen by sweeping the keyspace in order, and evicting the least recently
+// used keys of every evictSamples times as many keys, which approximates LRU.
+func (kvm *Machine) evictKeys() {
+	var sweep evictSweep
+	var idle time.Time // followers wait before trying again
+	t := time.NewTicker(evictInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-kvm.done:
+			return
+		case now := <-t.C:
+			if now.Before(idle) {
+				continue
+			}
+		}
+		opts := kvm.options()
+		if opts.MaxKeys == 0 && opts.MaxBytes == 0 {
+			kvm.resetUsage()
+			continue
+		}
+		if atomic.LoadInt32(&kvm.usage.counted) == 0 {
+			if err := kvm.countUsage(); err != nil {
+				log.Warningf("counting keys: %v", err)
+				continue
+			}
+		}
+		if opts.EvictionPolicy == policyNoEviction {
+			continue
+		}
+		for {
+			n, err := kvm.evictOnce(opts, &sweep)
+			if err != nil {
+				if err.Error() != raft.ErrNotLeader.Error() && err != errNotReady {
+					log.Warningf("evicting keys: %v", err)
+				}
+				idle = time.Now().Add(time.Second)
+				break
+			}
+			if n < evictBatch {
+				break
+			}
+		}
+	}
+}
+
+// evictOnce proposes the eviction of up to evictBatch keys, and returns
+// the number of keys.
+func (kvm *Machine) evictOnce(opts *Options, sweep *evictSweep) (int, error) {
+	overKeys, overBytes := kvm.overCapacity(opts)
+	if overKeys <= 0 && overBytes <= 0 {
+		return 0, nil
+	}
+	kvm.dbmu.RLock()
+	ss, err := kvm.db.GetSnapshot()
+	kvm.dbmu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	// the keys are chosen from evictSamples times as many keys as are
+	// evicted, so that hot keys that are next to each other are kept.
+	n := evictBatch
+	if overBytes <= 0 && overKeys < int64(n) {
+		n = int(overKeys)
+	}
+	keys, values, err := sweep.next(ss, n*evictSamples)
+	ss.Release()
+	if err != nil {
+		return 0, err
+	}
+	order := make([]int, len(keys))
+	last := make([]uint64, len(keys))
+	for i := range keys {
+		order[i] = i
+		last[i] = kvm.lastUse(opts.EvictionPolicy, keys[i], values[i])
+	}
+	sort.SliceStable(order, func(a, b int) bool { return last[order[a]] < last[order[b]] })
+	args := [][]byte{[]byte("evict")}
+	chosen := make(map[string]bool)
+	for _, i := range order {
+		if len(args)-1 == n || (overKeys <= 0 && overBytes <= 0) {
+			break
+		}
+		if chosen[string(keys[i])] {
+			// the sweep wrapped around a small keyspace.
+			continue
+		}
+		chosen[string(keys[i])] = true
+		args = append(args, keys[i])
+		overKeys--
+		overBytes -= int64(len(keys[i]) + len(values[i]))
+	}
+	if len(args) == 1 {
+		return 0, nil
+	}
+	_, err = kvm.exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	return len(args) - 1, nil
+}
+
+// evictSweep is the position of the sweep over the keys. It's only used by
+// the evictKeys goroutine.
+type evictSweep struct {
+	rng    int    // the index of the range in evictRanges
+	cursor []byte // the last key of the range that was swept, or nil
+}
+
+// next returns the next keys of the sweep and their stored values, which
+// continues from the first key after the last key.
+func (s *evictSweep) next(ss Snapshot, n int) (keys, values [][]byte, err error) {
+	for i := 0; i <= len(evictRanges) && len(keys) < n; i++ {
+		iter := ss.NewIterator(&evictRanges[s.rng], nil)
+		var ok bool
+		if s.cursor == nil {
+			ok = iter.First()
+		} else if ok = iter.Seek(s.cursor); ok && string(iter.Key()) == string(s.cursor) {
+			ok = iter.Next()
+		}
+		for ; ok && len(keys) < n; ok = iter.Next() {
+			keys = append(keys, append([]byte(nil), iter.Key()...))
+			values = append(values, append([]byte(nil), iter.Value()...))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, nil, err
+		}
+		if ok || len(keys) == n {
+			s.cursor = keys[len(keys)-1]
+			break
+		}
+		// the range is swept, so the sweep moves on to the next one.
+		s.rng = (s.rng + 1) % len(evictRanges)
+		s.cursor = nil
+	}
+	return keys, values, nil
+}
+
+// cmdEvict handles "EVICT key [key ...]", which deletes keys that were
+// chosen for eviction by the leader. The keys are database keys, which are
+// in any database or namespace. It's only proposed by the node.
+func (kvm *Machine) cmdEvict(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			type eviction struct {
+				batch leveldb.Batch
+				keys  [][]byte
+			}
+			evictions := make(map[keyspace]*eviction)
+			var order []keyspace
+			var evicted int
+			for _, key := range cmd.Args[1:] {
+				var ks keyspace
+				if ns, _, ok := parseNSKey(key); ok {
+					ks.ns = ns
+				} else if db, _, ok := parseDBKey(key); ok {
+					ks.db = db
+				} else {
+					continue
+				}
+				if has, err := kvm.db.Has(key, nil); err != nil {
+					return nil, err
+				} else if !has {
+					continue
+				}
+				e := evictions[ks]
+				if e == nil {
+					e = new(eviction)
+					evictions[ks] = e
+					order = append(order, ks)
+				}
+				e.batch.Delete(key)
+				e.keys = append(e.keys, key[len(ks.prefix()):])
+			}
+			for _, ks := range order {
+				e := evictions[ks]
+				if err := kvm.writeBatch(ks, &e.batch); err != nil {
+					return nil, err
+				}
+				for _, key := range e.keys {
+					kvm.watches.publish(ks, kvm.applyStamp, "del", key, nil)
+				}
+				evicted += len(e.keys)
+			}
+			atomic.AddInt64(&kvm.stats.evicted, int64(evicted))
+			return evicted, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteInt(v.(int))
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,256 @@
+package kvnode
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/hashicorp/raft"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	// forwardConns is the number of connections to the leader that writes
+	// are forwarded through at once. The other writes wait for one.
+	forwardConns = 16
+	// forwardTimeout is how long a forwarded write waits for its reply.
+	forwardTimeout = 5 * time.Second
+	// forwardName is the client name of the connections that forward
+	// writes, whose writes aren't forwarded again, so that nodes that
+	// disagree about the leader don't forward writes to each other.
+	forwardName = "kvnode-forward"
+)
+
+// errForwardLost is the error of a forwarded write whose reply was lost.
+var errForwardLost = errors.New("ERR the reply of the leader to the write was lost, so the write may have been applied")
+
+// dialError is the error of a forwarded write that wasn't sent, since the
+// leader couldn't be reached.
+type dialError struct {
+	error
+}
+
+// forwardedWrite is a write of a client that a follower forwards to the
+// leader, in the keyspace of the client, and with its request id.
+type forwardedWrite struct {
+	ks    keyspace
+	reqid string
+	args  [][]byte
+}
+
+// forwarder has a pool of connections to the leader, which is replaced when
+// the leader changes.
+type forwarder struct {
+	mu     sync.Mutex
+	leader string
+	pool   *redis.Pool
+}
+
+// get returns a connection to the leader from the pool, or a new one.
+func (f *forwarder) get(leader, password string) redis.Conn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pool == nil || f.leader != leader {
+		if f.pool != nil {
+			f.pool.Close()
+		}
+		f.leader = leader
+		f.pool = &redis.Pool{
+			MaxIdle:     forwardConns,
+			MaxActive:   forwardConns,
+			IdleTimeout: time.Minute,
+			Wait:        true,
+			Dial: func() (redis.Conn, error) {
+				conn, err := redis.Dial("tcp", leader,
+					redis.DialConnectTimeout(time.Second),
+					redis.DialReadTimeout(forwardTimeout),
+					redis.DialWriteTimeout(time.Second))
+				if err != nil {
+					return nil, err
+				}
+				if password != "" {
+					if _, err := conn.Do("AUTH", password); err != nil {
+						conn.Close()
+						return nil, err
+					}
+				}
+				if _, err := conn.Do("CLIENT", "SETNAME", forwardName); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return conn, nil
+			},
+		}
+	}
+	return f.pool.Get()
+}
+
+// known returns the leader that the writes were last forwarded to.
+func (f *forwarder) known() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.leader
+}
+
+// reset closes the connections to the leader.
+func (f *forwarder) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pool != nil {
+		f.pool.Close()
+	}
+	f.leader, f.pool = "", nil
+}
+
+// forwarded returns the write of a command for forwarding, when the node is
+// a follower that forwards it. It's nil for commands that aren't forwarded,
+// which are the commands that aren't writes, the administrative writes,
+// writes larger than ForwardWrites, and writes that were forwarded already.
+func (kvm *Machine) forwarded(c *client, name string, cmd redcon.Command, ks keyspace, reqid string) *forwardedWrite {
+	opts := kvm.options()
+	info := commands[name]
+	if !opts.ReplicaReads || len(cmd.Raw) > opts.ForwardWrites ||
+		!info.hasFlag("write") || info.hasFlag("admin") {
+		return nil
+	}
+	c.mu.Lock()
+	name = c.name
+	c.mu.Unlock()
+	if name == forwardName {
+		return nil
+	}
+	return &forwardedWrite{ks: ks, reqid: reqid, args: cmd.Args}
+}
+
+// notLeaderError returns true for the error of a write on a follower.
+func notLeaderError(err error) bool {
+	return err != nil && err.Error() == raft.ErrNotLeader.Error()
+}
+
+// forward sends a write to the leader, and writes its reply to the client.
+// A write that can't reach the leader fails with the READONLY error of the
+// node, and a write whose reply is lost isn't sent again, unless it has a
+// request id. The connections are authenticated with the password of the default
+// user, so the leader checks the permissions of the default user rather
+// than of the client.
+func (kvm *Machine) forward(c *client, conn redcon.Conn, w *forwardedWrite) error {
+	leader := kvm.fwd.known()
+	if leader == "" {
+		leader = kvm.notLeader().Leader
+	}
+	for i := 0; i < 2 && leader != ""; i++ {
+		reply, rev, err := kvm.forwardTo(leader, w)
+		if err == nil {
+			atomic.AddInt64(&kvm.stats.forwarded, 1)
+			writeForwarded(conn, reply)
+			c.lastrev = rev
+			return nil
+		}
+		if _, ok := err.(redis.Error); ok {
+			addr, ok := redirect(err)
+			if !ok {
+				// the reply of the leader.
+				return err
+			}
+			leader = addr
+		} else if _, ok := err.(dialError); ok || w.reqid != "" {
+			// the write wasn't sent, or its request id applies it at most
+			// once, so it's sent again.
+			log.Verbosef("forward: %s is unreachable: %v", leader, err)
+			kvm.fwd.reset()
+			leader = kvm.notLeader().Leader
+		} else {
+			// the leader may have applied the write, such as when its
+			// reply timed out, so it's not sent again.
+			log.Verbosef("forward: %s did not reply: %v", leader, err)
+			kvm.fwd.reset()
+			return errForwardLost
+		}
+	}
+	return kvm.notLeader()
+}
+
+// forwardTo sends a write to the leader, and returns its reply, and the
+// revision of the leader after it, for LASTREV.
+func (kvm *Machine) forwardTo(leader string, w *forwardedWrite) (interface{}, uint64, error) {
+	conn := kvm.fwd.get(leader, kvm.options().Password)
+	defer conn.Close()
+	if err := conn.Err(); err != nil {
+		return nil, 0, dialError{err}
+	}
+	if w.ks.ns != "" {
+		conn.Send("NAMESPACE", "USE", w.ks.ns)
+	} else {
+		conn.Send("SELECT", w.ks.db)
+	}
+	if w.reqid != "" {
+		conn.Send("REQID", w.reqid)
+	}
+	args := make([]interface{}, len(w.args)-1)
+	for i, arg := range w.args[1:] {
+		args[i] = arg
+	}
+	conn.Send(string(w.args[0]), args...)
+	conn.Send("LASTREV")
+	if err := conn.Flush(); err != nil {
+		return nil, 0, err
+	}
+	// every reply is read, so that the connection can be used again.
+	n := 3
+	if w.reqid != "" {
+		n++
+	}
+	replies := make([]interface{}, n)
+	errs := make([]error, n)
+	for i := range replies {
+		replies[i], errs[i] = conn.Receive()
+		if _, ok := errs[i].(redis.Error); errs[i] != nil && !ok {
+			return nil, 0, errs[i]
+		}
+	}
+	for _, err := range errs[:n-1] {
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	rev, err := redis.Uint64(replies[n-1], errs[n-1])
+	if err != nil {
+		return nil, 0, err
+	}
+	return replies[n-2], rev, nil
+}
+
+// writeForwarded writes the reply of a forwarded write.
+func writeForwarded(conn redcon.Conn, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		writeNull(conn)
+	case string:
+		conn.WriteString(v)
+	case []byte:
+		conn.WriteBulk(v)
+	case int64:
+		conn.WriteInt64(v)
+	case []interface{}:
+		conn.WriteArray(len(v))
+		for _, v := range v {
+			writeForwarded(conn, v)
+		}
+	case redis.Error:
+		conn.WriteError(string(v))
+	default:
+		conn.WriteError("ERR unexpected reply")
+	}
+}
+
+// copyArgs returns a copy of the arguments of a command, which outlives the
+// read buffer of the connection.
+func copyArgs(args [][]byte) [][]byte {
+	cp := make([][]byte, len(args))
+	for i, arg := range args {
+		cp[i] = append([]byte(nil), arg...)
+	}
+	return cp
+}
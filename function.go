@@ -0,0 +1,281 @@
+package kvnode
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errKeyNotDeclared   = errors.New("ERR the key isn't one of the keys of the call")
+	errFunctionReadOnly = errors.New("ERR the function can't write in a read-only call")
+)
+
+// Function is a Go function that clients call by name with FCALL, which
+// embedders register in Options.Functions, on every node. A call is
+// proposed to the raft log with its keys and args, and every node runs the
+// function when it applies the call, so the function must be
+// deterministic: its writes and reply may only depend on its keys and args,
+// the values that it reads, and the time of the FunctionTx.
+type Function struct {
+	// Call runs the function on the keys and the args of a call. It
+	// returns the reply to the client, which is nil, a string, a []byte, an
+	// int, an int64, an error, or a []interface{} of them. When it returns
+	// an error, the call fails and none of its writes are applied.
+	Call func(tx *FunctionTx, keys, args [][]byte) (interface{}, error)
+	// ReadOnly functions don't write, so they may also be called with
+	// FCALL_RO, which is served like a read, without the raft log.
+	ReadOnly bool
+}
+
+// FunctionTx is the access of a call of a Function to the keys of the call,
+// in the database or the namespace of the client. The writes of a call are
+// applied at once when the function returns, and the reads see them.
+type FunctionTx struct {
+	kvm      *Machine
+	keys     map[string][]byte // the database keys of the keys of the call
+	readOnly bool
+	time     time.Time
+	batch    leveldb.Batch
+	meta     map[string]*keyMeta
+	written  map[string][]byte // the values that the call wrote, nil if deleted
+	events   []functionEvent
+}
+
+// functionEvent is a write of a call, which is published to the watchers
+// when the call is applied.
+type functionEvent struct {
+	op         string
+	key, value []byte
+}
+
+// functionReply is the reply of a call, which isn't mistaken for the error
+// of a write by the group commit.
+type functionReply struct {
+	v interface{}
+}
+
+// Time returns the time of the call, which is the time that the leader
+// assigned to the write, so that it's the same on every node.
+func (tx *FunctionTx) Time() time.Time {
+	return tx.time
+}
+
+// Get returns the value of a key, or ErrNotFound.
+func (tx *FunctionTx) Get(key []byte) ([]byte, error) {
+	dbkey, ok := tx.keys[string(key)]
+	if !ok {
+		return nil, errKeyNotDeclared
+	}
+	if value, ok := tx.written[string(key)]; ok {
+		if value == nil {
+			return nil, ErrNotFound
+		}
+		return append([]byte(nil), value...), nil
+	}
+	stored, err := tx.kvm.db.Get(dbkey, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeValue(stored)
+}
+
+// Set sets the value of a key.
+func (tx *FunctionTx) Set(key, value []byte) error {
+	dbkey, ok := tx.keys[string(key)]
+	if !ok {
+		return errKeyNotDeclared
+	}
+	if tx.readOnly {
+		return errFunctionReadOnly
+	}
+	meta, err := tx.kvm.nextMeta(dbkey, tx.meta)
+	if err != nil {
+		return err
+	}
+	threshold := tx.kvm.options().CompressionThreshold
+	tx.batch.Put(dbkey, encodeValue(value, threshold, tx.kvm.applyStamp, meta))
+	value = append([]byte{}, value...)
+	tx.written[string(key)] = value
+	tx.events = append(tx.events, functionEvent{"set", key, value})
+	return nil
+}
+
+// Delete deletes a key, and returns true if it existed.
+func (tx *FunctionTx) Delete(key []byte) (bool, error) {
+	if tx.readOnly {
+		if _, ok := tx.keys[string(key)]; !ok {
+			return false, errKeyNotDeclared
+		}
+		return false, errFunctionReadOnly
+	}
+	if _, err := tx.Get(key); err == ErrNotFound {
+		return false, nil
+	} else if err != nil && err != errColdValue {
+		return false, err
+	}
+	tx.batch.Delete(tx.keys[string(key)])
+	tx.written[string(key)] = nil
+	tx.events = append(tx.events, functionEvent{"del", key, nil})
+	return true, nil
+}
+
+// parseFcall parses "FCALL function numkeys [key ...] [arg ...]", and
+// returns the keys and the args.
+func parseFcall(args [][]byte) (keys, fargs [][]byte, err error) {
+	if len(args) < 3 {
+		return nil, nil, finn.ErrWrongNumberOfArguments
+	}
+	n, err := strconv.Atoi(string(args[2]))
+	switch {
+	case err != nil:
+		return nil, nil, errors.New("ERR value is not an integer or out of range")
+	case n < 0:
+		return nil, nil, errors.New("ERR Number of keys can't be negative")
+	case n > len(args)-3:
+		return nil, nil, errors.New("ERR Number of keys can't be greater than number of args")
+	}
+	return args[3 : 3+n], args[3+n:], nil
+}
+
+// fcallKeys returns the keys of a FCALL command.
+func fcallKeys(args [][]byte) [][]byte {
+	keys, _, err := parseFcall(args)
+	if err != nil {
+		return nil
+	}
+	return keys
+}
+
+// cmdFcall handles "FCALL function numkeys [key ...] [arg ...]", which calls
+// a Function through the raft log, and FCALL_RO, which calls a read-only
+// Function like a read.
+func (kvm *Machine) cmdFcall(m finn.Applier, conn redcon.Conn, cmd redcon.Command, readOnly bool) (interface{}, error) {
+	keys, args, err := parseFcall(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(string(cmd.Args[1]))
+	fn, ok := kvm.options().Functions[name]
+	if !ok || fn.Call == nil {
+		return nil, errors.New("ERR Function not found")
+	}
+	if readOnly && !fn.ReadOnly {
+		return nil, errors.New("ERR Can not execute a script with write flag using *_ro command.")
+	}
+	ks := keyspaceOf(m)
+	if conn != nil {
+		kvm.warmKeys(ks, keys)
+	}
+	call := func(stamp uint64) (interface{}, error) {
+		buf := getKeyBuf()
+		defer putKeyBuf(buf)
+		dbkeys := ks.appendKeys(buf, keys, 1)
+		tx := &FunctionTx{
+			kvm:      kvm,
+			keys:     make(map[string][]byte, len(keys)),
+			readOnly: readOnly,
+			time:     time.Unix(0, int64(stamp)),
+			meta:     make(map[string]*keyMeta),
+			written:  make(map[string][]byte),
+		}
+		for i, key := range keys {
+			tx.keys[string(key)] = dbkeys[i]
+		}
+		if !readOnly {
+			defer kvm.lockKeys(ks, dbkeys)()
+		}
+		v, err := fn.Call(tx, keys, args)
+		if err != nil {
+			return nil, functionError(err)
+		}
+		if tx.batch.Len() > 0 {
+			if err := kvm.writeBatch(ks, &tx.batch); err != nil {
+				return nil, err
+			}
+			for _, e := range tx.events {
+				kvm.watches.publish(ks, kvm.applyStamp, e.op, e.key, e.value)
+			}
+		}
+		return functionReply{v}, nil
+	}
+	if readOnly {
+		return m.Apply(conn, cmd, nil,
+			func(interface{}) (interface{}, error) {
+				kvm.dbmu.RLock()
+				v, err := call(uint64(time.Now().UnixNano()))
+				kvm.dbmu.RUnlock()
+				if err != nil {
+					return nil, err
+				}
+				writeFunctionReply(conn, v.(functionReply).v)
+				return nil, nil
+			},
+		)
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			return call(kvm.applyStamp)
+		},
+		func(v interface{}) (interface{}, error) {
+			reply, ok := v.(functionReply)
+			if !ok {
+				// a retry of a request whose result wasn't stored.
+				return nil, errBadResult
+			}
+			writeFunctionReply(conn, reply.v)
+			return nil, nil
+		},
+	)
+}
+
+// functionError returns the error reply of a call that failed, which has
+// the ERR prefix unless it has an error code, such as "WRONGTYPE".
+func functionError(err error) error {
+	msg := err.Error()
+	code := msg
+	if i := strings.IndexByte(msg, ' '); i >= 0 {
+		code = msg[:i]
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] < 'A' || code[i] > 'Z' {
+			return errors.New("ERR " + msg)
+		}
+	}
+	if code == "" {
+		return errors.New("ERR " + msg)
+	}
+	return err
+}
+
+// writeFunctionReply writes the reply of a call.
+func writeFunctionReply(conn redcon.Conn, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		writeNull(conn)
+	case string:
+		conn.WriteBulkString(v)
+	case []byte:
+		conn.WriteBulk(v)
+	case int:
+		conn.WriteInt(v)
+	case int64:
+		conn.WriteInt64(v)
+	case error:
+		conn.WriteError(functionError(v).Error())
+	case []interface{}:
+		conn.WriteArray(len(v))
+		for _, v := range v {
+			writeFunctionReply(conn, v)
+		}
+	default:
+		conn.WriteError("ERR the function returned an unsupported reply")
+	}
+}
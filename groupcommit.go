@@ -0,0 +1,275 @@
+package kvnode
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// defaultGroupCommitMax is the default maximum number of commands in a
+// group.
+const defaultGroupCommitMax = 256
+
+// groupWrite is a write that's waiting for its group to be applied.
+type groupWrite struct {
+	raw  []byte
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// groupCommit coalesces the writes that arrive within a window into a
+// single "GROUPEXEC command [command ...]" raft entry, where each command
+// is the RESP encoding of a write. The group is applied as one LevelDB batch
+// where possible.
+type groupCommit struct {
+	mu      sync.Mutex
+	pending []*groupWrite
+	timer   *time.Timer
+	applier finn.Applier
+}
+
+// submit adds a write to the current group and waits until the group has
+// been applied. The applier is the node applier that proposes to the raft
+// log.
+func (g *groupCommit) submit(m finn.Applier, raw []byte, window time.Duration, max int) (interface{}, error) {
+	w := &groupWrite{raw: raw, done: make(chan struct{})}
+	g.mu.Lock()
+	g.applier = m
+	g.pending = append(g.pending, w)
+	switch {
+	case len(g.pending) >= max:
+		if g.timer != nil {
+			g.timer.Stop()
+			g.timer = nil
+		}
+		group := g.pending
+		g.pending = nil
+		go g.propose(m, group)
+	case len(g.pending) == 1:
+		g.timer = time.AfterFunc(window, g.flush)
+	}
+	g.mu.Unlock()
+	<-w.done
+	return w.val, w.err
+}
+
+// flush proposes the current group when its window ends.
+func (g *groupCommit) flush() {
+	g.mu.Lock()
+	group, m := g.pending, g.applier
+	g.pending, g.timer = nil, nil
+	g.mu.Unlock()
+	if len(group) > 0 {
+		g.propose(m, group)
+	}
+}
+
+// propose proposes a group and passes the results to the writes. A group of
+// one write is proposed as it is.
+func (g *groupCommit) propose(m finn.Applier, group []*groupWrite) {
+	args := [][]byte{[]byte("groupexec")}
+	for _, w := range group {
+		args = append(args, w.raw)
+	}
+	cmd := redcon.Command{Raw: buildCommand(args...), Args: args}
+	if len(group) == 1 {
+		cmd = redcon.Command{Raw: group[0].raw}
+	}
+	var val interface{}
+	_, err := m.Apply(&localConn{}, cmd,
+		func() (interface{}, error) { return nil, nil },
+		func(v interface{}) (interface{}, error) {
+			val = v
+			return nil, nil
+		},
+	)
+	vals, _ := val.([]interface{})
+	for i, w := range group {
+		switch {
+		case err != nil:
+			w.err = err
+		case len(group) == 1:
+			w.val = val
+		case i < len(vals):
+			w.val = vals[i]
+			if e, ok := vals[i].(error); ok {
+				w.val, w.err = nil, e
+			}
+		}
+		close(w.done)
+	}
+}
+
+// groupApplier sends the writes of clients to the group commit, rather
+// than proposing each one, and queues the writes that are pipelined. Only
+// the applier that seals the entries is inside it, so that the writes are
+// already wrapped by the other appliers.
+type groupApplier struct {
+	finn.Applier
+	kvm *Machine
+}
+
+func (m groupApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn != nil && mutate != nil {
+		if pipe := m.kvm.client(conn).pipe; pipe != nil && pipe.cur != nil {
+			// a pipelined write, which is proposed with its batch.
+			pipe.cur.raw, pipe.cur.respond = cmd.Raw, respond
+			return nil, nil
+		}
+	}
+	opts := m.kvm.options()
+	if conn == nil || mutate == nil || opts.GroupCommitWindow <= 0 {
+		return m.Applier.Apply(conn, cmd, mutate, respond)
+	}
+	v, err := m.kvm.group.submit(m.Applier, cmd.Raw,
+		opts.GroupCommitWindow, opts.GroupCommitMax)
+	if err != nil {
+		return nil, err
+	}
+	return respond(v)
+}
+
+// groupBatch is the LevelDB batch that a group of blind writes is applied
+// with. Blind writes, such as SET, only read the values that they replace,
+// which may be in the batch, so they may be applied together. Other commands
+// flush the batch before they run.
+type groupBatch struct {
+	batch leveldb.Batch
+	// values are the values of the keys that are written by the batch,
+	// where nil is a delete, so that the writes of the group read the
+	// writes before them.
+	values map[string]*[]byte
+	active bool // the running command is a blind write
+	sync   bool // a write in the batch is synced
+}
+
+// Put and Delete implement leveldb.BatchReplay, so that the batch of a
+// command is appended to the group.
+func (b *groupBatch) Put(key, value []byte) {
+	b.batch.Put(key, value)
+	value = append([]byte(nil), value...)
+	b.setValue(key, &value)
+}
+
+func (b *groupBatch) Delete(key []byte) {
+	b.batch.Delete(key)
+	b.setValue(key, nil)
+}
+
+func (b *groupBatch) setValue(key []byte, value *[]byte) {
+	if b.values == nil {
+		b.values = make(map[string]*[]byte)
+	}
+	b.values[string(key)] = value
+}
+
+// appliedValue returns the stored value of a database key, as seen by the
+// write that's being applied, which includes the pending writes of its
+// group, or leveldb.ErrNotFound.
+func (kvm *Machine) appliedValue(key []byte) ([]byte, error) {
+	if value, ok := kvm.gbatch.values[string(key)]; ok {
+		if value == nil {
+			return nil, leveldb.ErrNotFound
+		}
+		return *value, nil
+	}
+	return kvm.db.Get(key, nil)
+}
+
+// blindWrite returns true if the wrapped command is a write that doesn't
+// read the database, other than the values that it replaces, for the
+// history, usage and metadata of the keys, which are read with appliedValue.
+// Namespace writes read the sizes of the existing values for the quotas.
+func blindWrite(args [][]byte) bool {
+	for len(args) > 2 {
+		switch strings.ToLower(string(args[0])) {
+		case "verexec", "traceexec", "dbexec":
+			args = args[2:]
+			continue
+		case "syncexec":
+			args = args[1:]
+			continue
+		case "set":
+			// SET with IFVERSION reads the version of the key.
+			return len(args) == 3
+		case "mset":
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+// flushGroup writes the pending blind writes of the group. The caller must
+// hold the machine lock.
+func (kvm *Machine) flushGroup() error {
+	if kvm.gbatch.batch.Len() == 0 {
+		return nil
+	}
+	var wo *opt.WriteOptions
+	if kvm.gbatch.sync {
+		wo = syncWriteOptions
+	}
+	defer func() {
+		kvm.gbatch.batch.Reset()
+		kvm.gbatch.values = nil
+		kvm.gbatch.sync = false
+	}()
+	if err := kvm.db.Write(&kvm.gbatch.batch, wo); err != nil {
+		return err
+	}
+	return kvm.gbatch.batch.Replay(&kvm.rcache)
+}
+
+// cmdGroupexec applies a group of writes from the raft log, and returns
+// the result of each one.
+func (kvm *Machine) cmdGroupexec(m finn.Applier, cmd redcon.Command) (interface{}, error) {
+	vals := make([]interface{}, len(cmd.Args)-1)
+	var pending []int // the writes in the batch
+	flush := func() {
+		kvm.mu.Lock()
+		err := kvm.flushGroup()
+		kvm.gbatch.active = false
+		kvm.mu.Unlock()
+		if err != nil {
+			for _, i := range pending {
+				vals[i] = err
+			}
+		}
+		pending = pending[:0]
+	}
+	for i, raw := range cmd.Args[1:] {
+		sub, err := redcon.Parse(raw)
+		if err != nil {
+			vals[i] = err
+			continue
+		}
+		blind := blindWrite(sub.Args)
+		if blind {
+			kvm.mu.Lock()
+			kvm.gbatch.active = true
+			kvm.mu.Unlock()
+		} else {
+			flush()
+		}
+		v, err := kvm.Command(m, nil, sub)
+		if err != nil {
+			v = err
+		} else if blind {
+			pending = append(pending, i)
+		}
+		vals[i] = v
+	}
+	flush()
+	return vals, nil
+}
@@ -0,0 +1,162 @@
+package kvnode
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestBlindWrite(t *testing.T) {
+	tests := []struct {
+		args  []string
+		blind bool
+	}{
+		{[]string{"SET", "key", "value"}, true},
+		{[]string{"set", "key", "value", "IFVERSION", "1"}, false},
+		{[]string{"MSET", "a", "1", "b", "2"}, true},
+		{[]string{"DEL", "key"}, false},
+		{[]string{"set", "key"}, false},
+		{[]string{"verexec", "1", "set", "key", "value"}, true},
+		{[]string{"verexec", "1", "del", "key"}, false},
+		{[]string{"syncexec", "set", "key", "value"}, true},
+		{[]string{"traceexec", "00-trace-span-01", "mset", "a", "1"}, true},
+		{[]string{"verexec", "1", "dbexec", "2", "set", "key", "value"}, true},
+		{[]string{"nsexec", "ns", "set", "key", "value"}, false},
+	}
+	for _, test := range tests {
+		args := make([][]byte, len(test.args))
+		for i, arg := range test.args {
+			args[i] = []byte(arg)
+		}
+		if blind := blindWrite(args); blind != test.blind {
+			t.Errorf("blindWrite(%q) = %v, want %v", test.args, blind, test.blind)
+		}
+	}
+}
+
+func TestGroupexec(t *testing.T) {
+	m, closeMachine := openMachine(t, nil)
+	defer closeMachine()
+	group := []string{"groupexec"}
+	for _, args := range [][]string{
+		{"set", "a", "1"},
+		{"set", "b", "2"},
+		// DEL reads the database, so the writes before it are written
+		// first.
+		{"del", "a"},
+		{"set", "a", "3"},
+		{"set", "c"},
+		{"mset", "d", "4", "e", "5"},
+		{"set", "d", "6"},
+	} {
+		bargs := make([][]byte, len(args))
+		for i, arg := range args {
+			bargs[i] = []byte(arg)
+		}
+		group = append(group, string(buildCommand(bargs...)))
+	}
+	v, err := applyCommand(m, group...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals := v.([]interface{})
+	if len(vals) != len(group)-1 {
+		t.Fatalf("expected %d results, got %d", len(group)-1, len(vals))
+	}
+	if n, ok := vals[2].(int); !ok || n != 1 {
+		t.Fatalf("expected DEL to delete 1 key, got %v", vals[2])
+	}
+	if _, ok := vals[4].(error); !ok {
+		t.Fatalf("expected an error for SET without a value, got %v", vals[4])
+	}
+	for key, want := range map[string]string{"a": "3", "b": "2", "d": "6", "e": "5"} {
+		value, err := m.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if string(value) != want {
+			t.Fatalf("%s: expected %q, got %q", key, want, value)
+		}
+	}
+	if _, err := m.Get([]byte("c")); err != ErrNotFound {
+		t.Fatalf("c: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	tn := startNode(t, &Options{GroupCommitWindow: 20 * time.Millisecond})
+	defer tn.close()
+	const writers = 32
+	first := tn.lastIndex()
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn := tn.dial()
+			defer conn.Close()
+			_, errs[i] = conn.Do("SET", fmt.Sprintf("key:%d", i), strconv.Itoa(i))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := tn.lastIndex() - first; n >= writers {
+		t.Fatalf("expected the writes to be grouped, got %d entries for %d writes",
+			n, writers)
+	}
+	conn := tn.dial()
+	defer conn.Close()
+	for i := 0; i < writers; i++ {
+		value, err := redis.String(conn.Do("GET", fmt.Sprintf("key:%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != strconv.Itoa(i) {
+			t.Fatalf("key:%d: expected %d, got %q", i, i, value)
+		}
+	}
+}
+
+func TestGroupexecHistory(t *testing.T) {
+	m, closeMachine := openMachine(t, &Options{RevisionRetention: time.Minute})
+	defer closeMachine()
+	// the writes of a group read the values that the writes before them
+	// replace, which aren't written yet, for the history.
+	base := uint64(time.Now().UnixNano())
+	group := []string{"groupexec"}
+	for i := 1; i <= 3; i++ {
+		stamp := []byte(strconv.FormatUint(base+uint64(i), 10))
+		group = append(group, string(buildCommand(
+			[]byte("verexec"), stamp, []byte("set"), []byte("key"), []byte(strconv.Itoa(i)))))
+	}
+	if _, err := applyCommand(m, group...); err != nil {
+		t.Fatal(err)
+	}
+	ss, err := m.db.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Release()
+	for i := 1; i <= 3; i++ {
+		stored, err := getAt(ss, keyspace{}.key([]byte("key")), base+uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := decodeValue(stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != strconv.Itoa(i) {
+			t.Fatalf("at %d: expected %d, got %q", base+uint64(i), i, value)
+		}
+	}
+}
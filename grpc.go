@@ -0,0 +1,380 @@
+package kvnode
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/kvnode/kvnodepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcGateway serves the gRPC API of kvnodepb. Like the HTTP gateway, calls
+// are translated into commands and executed on the node, or forwarded to the
+// leader when required.
+type grpcGateway struct {
+	kvnodepb.UnimplementedKVServer
+	addr  string
+	laddr string
+	m     *Machine
+	srv   *grpc.Server
+}
+
+// listenGRPC binds the gRPC gateway and starts serving in the background.
+// The addr param is the node address that commands are sent to. The calls
+// are served over TLS when tlsConfig is provided, so that the credentials
+// of the "authorization" metadata aren't sent in the clear.
+func listenGRPC(laddr, addr string, tlsConfig *tls.Config, m *Machine) (*grpcGateway, error) {
+	ln, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	g := &grpcGateway{addr: addr, laddr: ln.Addr().String(), m: m}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(g.guardUnary),
+		grpc.StreamInterceptor(g.guardStream),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	g.srv = grpc.NewServer(opts...)
+	kvnodepb.RegisterKVServer(g.srv, g)
+	go g.srv.Serve(ln)
+	return g, nil
+}
+
+// Close stops the gRPC gateway, and ends the calls that are in progress.
+func (g *grpcGateway) Close() error {
+	g.srv.Stop()
+	return nil
+}
+
+// guard returns an error for calls from addresses that aren't allowed, or
+// that protected mode refuses. The commands of the gateway reach the node
+// over the loopback interface, which both always accept, so they're checked
+// here.
+func (g *grpcGateway) guard(ctx context.Context) error {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.PermissionDenied, errIPDenied[1:len(errIPDenied)-2])
+	}
+	var laddr string
+	if p.LocalAddr != nil {
+		laddr = p.LocalAddr.String()
+	}
+	if !g.m.ipAllowed(p.Addr.String(), laddr) {
+		return status.Error(codes.PermissionDenied, errIPDenied[1:len(errIPDenied)-2])
+	}
+	if g.m.protectedDenied(g.laddr, p.Addr.String()) {
+		return status.Error(codes.PermissionDenied, errGatewayProtected+"--grpc-addr")
+	}
+	return nil
+}
+
+// guardUnary guards the unary calls, and guardStream the streaming ones.
+func (g *grpcGateway) guardUnary(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := g.guard(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *grpcGateway) guardStream(srv interface{}, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+) error {
+	if err := g.guard(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// do executes a command on the node as the user of the call. A "TRY" or
+// "READONLY" response is followed to the leader.
+func (g *grpcGateway) do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	addr := g.addr
+	for i := 0; ; i++ {
+		reply, err := func() (interface{}, error) {
+			conn, err := g.dial(ctx, addr, gatewayTimeout)
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+			return conn.Do(args[0].(string), args[1:]...)
+		}()
+		if err != nil && i < gatewayMaxTries {
+			if leader, ok := redirect(err); ok {
+				addr = leader
+				continue
+			}
+		}
+		return reply, err
+	}
+}
+
+// dial connects to the node at addr, and authenticates with the credentials
+// of the "authorization" metadata of the call when provided. A zero
+// readTimeout waits for replies without a limit.
+func (g *grpcGateway) dial(ctx context.Context, addr string, readTimeout time.Duration) (redis.Conn, error) {
+	conn, err := redis.Dial("tcp", addr,
+		redis.DialConnectTimeout(gatewayTimeout),
+		redis.DialReadTimeout(readTimeout),
+		redis.DialWriteTimeout(gatewayTimeout))
+	if err != nil {
+		return nil, err
+	}
+	if user, pass, ok := grpcCredentials(ctx); ok {
+		if _, err := conn.Do("AUTH", user, pass); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// grpcCredentials returns the user and password of the "authorization"
+// metadata of a call, which is the same as the Authorization header of
+// HTTP basic authentication.
+func grpcCredentials(ctx context.Context) (user, pass string, ok bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		r := http.Request{Header: http.Header{"Authorization": {v}}}
+		if user, pass, ok = r.BasicAuth(); ok {
+			return user, pass, true
+		}
+	}
+	return "", "", false
+}
+
+// grpcError returns the status of an error that was returned by the node.
+func grpcError(err error) error {
+	if _, ok := err.(net.Error); ok {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	msg := err.Error()
+	code := codes.Unknown
+	switch {
+	case strings.HasPrefix(msg, "NOAUTH"), strings.HasPrefix(msg, "WRONGPASS"):
+		code = codes.Unauthenticated
+	case strings.HasPrefix(msg, "NOPERM"):
+		code = codes.PermissionDenied
+	case msg == errSyntaxError.Error(), msg == errRevision.Error(),
+		msg == errVersion.Error(), strings.HasPrefix(msg, "ERR wrong number"):
+		code = codes.InvalidArgument
+	case msg == errRevisionCompacted.Error():
+		code = codes.OutOfRange
+	case strings.HasPrefix(msg, "TRY "), strings.HasPrefix(msg, "READONLY "),
+		msg == "ERR leader not known", msg == "ERR raft not ready",
+		msg == errRevisionFuture.Error():
+		code = codes.Unavailable
+	}
+	return status.Error(code, msg)
+}
+
+// Get handles "GET key [AT revision]".
+func (g *grpcGateway) Get(ctx context.Context, req *kvnodepb.GetRequest) (*kvnodepb.GetResponse, error) {
+	args := []interface{}{"GET", req.Key}
+	if req.Revision != 0 {
+		args = append(args, "AT", formatUint(req.Revision))
+	}
+	value, err := redis.Bytes(g.do(ctx, args...))
+	if err == redis.ErrNil {
+		return &kvnodepb.GetResponse{}, nil
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvnodepb.GetResponse{Found: true, Value: value}, nil
+}
+
+// Put handles "SET key value [IFVERSION version]".
+func (g *grpcGateway) Put(ctx context.Context, req *kvnodepb.PutRequest) (*kvnodepb.PutResponse, error) {
+	args := []interface{}{"SET", req.Key, req.Value}
+	if req.IfVersion != nil {
+		args = append(args, "IFVERSION", formatUint(*req.IfVersion))
+	}
+	reply, err := g.do(ctx, args...)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvnodepb.PutResponse{Applied: reply != nil}, nil
+}
+
+// Delete handles "DEL key [key ...]".
+func (g *grpcGateway) Delete(ctx context.Context, req *kvnodepb.DeleteRequest) (*kvnodepb.DeleteResponse, error) {
+	args := []interface{}{"DEL"}
+	for _, key := range req.Keys {
+		args = append(args, key)
+	}
+	n, err := redis.Int64(g.do(ctx, args...))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvnodepb.DeleteResponse{Deleted: n}, nil
+}
+
+// Range handles "KEYS pattern [PIVOT prefix] [LIMIT count] [DESC]
+// [WITHVALUES]".
+func (g *grpcGateway) Range(ctx context.Context, req *kvnodepb.RangeRequest) (*kvnodepb.RangeResponse, error) {
+	pattern := req.Pattern
+	if pattern == "" {
+		pattern = "*"
+	}
+	args := []interface{}{"KEYS", pattern}
+	if len(req.Pivot) > 0 {
+		args = append(args, "PIVOT", req.Pivot)
+	}
+	if req.Limit != 0 {
+		args = append(args, "LIMIT", formatUint(req.Limit))
+	}
+	if req.Desc {
+		args = append(args, "DESC")
+	}
+	if !req.KeysOnly {
+		args = append(args, "WITHVALUES")
+	}
+	items, err := redis.ByteSlices(g.do(ctx, args...))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &kvnodepb.RangeResponse{}
+	if req.KeysOnly {
+		for _, key := range items {
+			res.Kvs = append(res.Kvs, &kvnodepb.KeyValue{Key: key})
+		}
+		return res, nil
+	}
+	for i := 0; i+1 < len(items); i += 2 {
+		res.Kvs = append(res.Kvs, &kvnodepb.KeyValue{Key: items[i], Value: items[i+1]})
+	}
+	return res, nil
+}
+
+// Txn handles "MSETIF key value guard [key value guard ...]".
+func (g *grpcGateway) Txn(ctx context.Context, req *kvnodepb.TxnRequest) (*kvnodepb.TxnResponse, error) {
+	args := []interface{}{"MSETIF"}
+	for _, put := range req.Puts {
+		args = append(args, put.Key, put.Value)
+		switch put.Guard {
+		default:
+			return nil, status.Error(codes.InvalidArgument, "unknown guard "+put.Guard.String())
+		case kvnodepb.Guard_GUARD_ANY:
+			args = append(args, "ANY")
+		case kvnodepb.Guard_GUARD_NX:
+			args = append(args, "NX")
+		case kvnodepb.Guard_GUARD_XX:
+			args = append(args, "XX")
+		case kvnodepb.Guard_GUARD_EQ:
+			args = append(args, "EQ", put.Expect)
+		case kvnodepb.Guard_GUARD_VERSION:
+			args = append(args, "VERSION", formatUint(put.Version))
+		}
+	}
+	reply, err := g.do(ctx, args...)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	failure, err := redis.ByteSlices(reply, nil)
+	if err != nil {
+		// the reply is OK when every guard passed.
+		return &kvnodepb.TxnResponse{Succeeded: true}, nil
+	}
+	if len(failure) != 2 {
+		return nil, status.Error(codes.Internal, "unexpected reply")
+	}
+	return &kvnodepb.TxnResponse{FailedKey: failure[0], Reason: string(failure[1])}, nil
+}
+
+// Watch handles "WATCHKEYS pattern [FROM revision] [WITHREV]", and streams
+// the events until the call ends.
+func (g *grpcGateway) Watch(req *kvnodepb.WatchRequest, stream kvnodepb.KV_WatchServer) error {
+	pattern := req.Pattern
+	if len(req.Prefix) > 0 {
+		if pattern != "" {
+			return status.Error(codes.InvalidArgument, "pattern and prefix are both set")
+		}
+		pattern = escapePattern(string(req.Prefix))
+	}
+	if pattern == "" {
+		pattern = "*"
+	}
+	args := []interface{}{pattern}
+	if req.FromRevision != 0 {
+		args = append(args, "FROM", formatUint(req.FromRevision))
+	}
+	if req.WithRevision {
+		args = append(args, "WITHREV")
+	}
+	ctx := stream.Context()
+	addr := g.addr
+	var conn redis.Conn
+	for i := 0; ; i++ {
+		var err error
+		if conn, err = g.dial(ctx, addr, 0); err != nil {
+			return grpcError(err)
+		}
+		if _, err = conn.Do("WATCHKEYS", args...); err == nil {
+			break
+		}
+		conn.Close()
+		if leader, ok := redirect(err); ok && i < gatewayMaxTries {
+			addr = leader
+			continue
+		}
+		return grpcError(err)
+	}
+	// the headers tell the client that the keys are watched.
+	if err := stream.SendHeader(nil); err != nil {
+		conn.Close()
+		return err
+	}
+	// closing the connection ends the Receive of the events.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	for {
+		vals, err := redis.Values(conn.Receive())
+		if err == nil && len(vals) < 3 {
+			err = errSyntaxError
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return grpcError(err)
+		}
+		ev := &kvnodepb.WatchEvent{}
+		ev.Op, _ = redis.String(vals[0], nil)
+		ev.Key, _ = redis.Bytes(vals[1], nil)
+		ev.Value, _ = redis.Bytes(vals[2], nil)
+		if len(vals) > 3 {
+			rev, _ := redis.Int64(vals[3], nil)
+			ev.Revision = uint64(rev)
+		}
+		if err := stream.Send(ev); err != nil {
+			return err
+		}
+	}
+}
+
+// formatUint formats an unsigned number for a command.
+func formatUint(n uint64) string {
+	return strconv.FormatUint(n, 10)
+}
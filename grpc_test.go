@@ -0,0 +1,252 @@
+package kvnode
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tidwall/kvnode/kvnodepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// startGRPC starts a gRPC gateway for a node, and returns a client of it.
+func startGRPC(t *testing.T, tn *testNode) (kvnodepb.KVClient, func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := ln.Addr().String()
+	ln.Close()
+	g, err := listenGRPC(laddr, tn.addr, nil, tn.m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := grpc.NewClient(laddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		g.Close()
+		t.Fatal(err)
+	}
+	return kvnodepb.NewKVClient(cc), func() {
+		cc.Close()
+		g.Close()
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	tn := startNode(t, &Options{RevisionRetention: time.Minute})
+	defer tn.close()
+	kv, closeGRPC := startGRPC(t, tn)
+	defer closeGRPC()
+	ctx := context.Background()
+	if _, err := kv.Put(ctx, &kvnodepb.PutRequest{Key: []byte("a"), Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	get, err := kv.Get(ctx, &kvnodepb.GetRequest{Key: []byte("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !get.Found || string(get.Value) != "1" {
+		t.Fatalf("expected 1, got %v %q", get.Found, get.Value)
+	}
+	if get, err = kv.Get(ctx, &kvnodepb.GetRequest{Key: []byte("missing")}); err != nil || get.Found {
+		t.Fatalf("expected a missing key, got %v %v", get, err)
+	}
+	stale := uint64(1)
+	put, err := kv.Put(ctx, &kvnodepb.PutRequest{Key: []byte("a"), Value: []byte("2"), IfVersion: &stale})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if put.Applied {
+		t.Fatal("expected a put with the wrong version not to be applied")
+	}
+	txn, err := kv.Txn(ctx, &kvnodepb.TxnRequest{Puts: []*kvnodepb.TxnPut{
+		{Key: []byte("a"), Value: []byte("3"), Guard: kvnodepb.Guard_GUARD_EQ, Expect: []byte("1")},
+		{Key: []byte("b"), Value: []byte("4"), Guard: kvnodepb.Guard_GUARD_NX},
+	}})
+	if err != nil || !txn.Succeeded {
+		t.Fatalf("expected the txn to succeed, got %v %v", txn, err)
+	}
+	txn, err = kv.Txn(ctx, &kvnodepb.TxnRequest{Puts: []*kvnodepb.TxnPut{
+		{Key: []byte("b"), Value: []byte("5"), Guard: kvnodepb.Guard_GUARD_NX},
+	}})
+	if err != nil || txn.Succeeded || string(txn.FailedKey) != "b" || txn.Reason != "exists" {
+		t.Fatalf("expected the txn to fail on b, got %v %v", txn, err)
+	}
+	rng, err := kv.Range(ctx, &kvnodepb.RangeRequest{Pattern: "?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rng.Kvs) != 2 || string(rng.Kvs[0].Key) != "a" || string(rng.Kvs[0].Value) != "3" ||
+		string(rng.Kvs[1].Key) != "b" || string(rng.Kvs[1].Value) != "4" {
+		t.Fatalf("unexpected range %v", rng.Kvs)
+	}
+	del, err := kv.Delete(ctx, &kvnodepb.DeleteRequest{Keys: [][]byte{[]byte("a"), []byte("b"), []byte("c")}})
+	if err != nil || del.Deleted != 2 {
+		t.Fatalf("expected 2 deleted keys, got %v %v", del, err)
+	}
+	_, err = kv.Get(ctx, &kvnodepb.GetRequest{Key: []byte("a"), Revision: math.MaxInt64})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable, got %v", err)
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	tn := startNode(t, nil)
+	defer tn.close()
+	kv, closeGRPC := startGRPC(t, tn)
+	defer closeGRPC()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := kv.Watch(ctx, &kvnodepb.WatchRequest{Prefix: []byte("user:")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the headers are sent once the keys are watched.
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"other", "user:1"} {
+		if _, err := kv.Put(ctx, &kvnodepb.PutRequest{Key: []byte(key), Value: []byte("Tom")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := kv.Delete(ctx, &kvnodepb.DeleteRequest{Keys: [][]byte{[]byte("user:1")}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []*kvnodepb.WatchEvent{
+		{Op: "set", Key: []byte("user:1"), Value: []byte("Tom")},
+		{Op: "del", Key: []byte("user:1")},
+	} {
+		ev, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Op != want.Op || string(ev.Key) != string(want.Key) || string(ev.Value) != string(want.Value) {
+			t.Fatalf("expected %s %q %q, got %s %q %q", want.Op, want.Key, want.Value, ev.Op, ev.Key, ev.Value)
+		}
+	}
+	both, err := kv.Watch(ctx, &kvnodepb.WatchRequest{Pattern: "*", Prefix: []byte("user:")})
+	if err == nil {
+		_, err = both.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	cancel()
+	if _, err := stream.Recv(); status.Code(err) != codes.Canceled {
+		t.Fatalf("expected Canceled, got %v", err)
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	tn := startNode(t, nil)
+	defer tn.close()
+	kv, closeGRPC := startGRPC(t, tn)
+	defer closeGRPC()
+	conn := tn.dial()
+	defer conn.Close()
+	if _, err := conn.Do("ACL", "SETUSER", "app", "on", ">secret", "~app:*", "+@all"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("ACL", "SETUSER", "default", "resetpass", ">admin"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	_, err := kv.Get(ctx, &kvnodepb.GetRequest{Key: []byte("app:1")})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated, got %v", err)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("app:secret"))
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", auth)
+	if _, err := kv.Put(ctx, &kvnodepb.PutRequest{Key: []byte("app:1"), Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = kv.Get(ctx, &kvnodepb.GetRequest{Key: []byte("other")})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+}
+
+func TestGRPCTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kvnode"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn := startNode(t, nil)
+	defer tn.close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := ln.Addr().String()
+	ln.Close()
+	g, err := listenGRPC(laddr, tn.addr, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}, tn.m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// a plaintext client can't call the API.
+	cc, err := grpc.NewClient(laddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	_, err = kvnodepb.NewKVClient(cc).Get(ctx, &kvnodepb.GetRequest{Key: []byte("a")})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable, got %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	cc, err = grpc.NewClient(laddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	kv := kvnodepb.NewKVClient(cc)
+	if _, err := kv.Put(ctx, &kvnodepb.PutRequest{Key: []byte("a"), Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	get, err := kv.Get(ctx, &kvnodepb.GetRequest{Key: []byte("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !get.Found || string(get.Value) != "1" {
+		t.Fatalf("expected 1, got %v %q", get.Found, get.Value)
+	}
+}
@@ -0,0 +1,70 @@
+package kvnode
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultReadyMaxLag is the default number of committed entries that a node
+// may have left to apply while it's ready.
+const defaultReadyMaxLag = 1000
+
+// readiness returns the state of the node for a readiness check. An error is
+// returned when the node has no leader, is behind by more than ReadyMaxLag
+// entries, or can't write to its data directory.
+func (kvm *Machine) readiness() (map[string]interface{}, error) {
+	stats, leader, err := kvm.raftInfo()
+	if err != nil {
+		return nil, err
+	}
+	if leader == "" {
+		return nil, errors.New("leader not known")
+	}
+	if kvm.isLoading() {
+		return nil, errors.New("loading the dataset")
+	}
+	if err := kvm.lostDB(); err != nil {
+		return nil, errors.New("database lost: " + err.Error())
+	}
+	commit, _ := strconv.ParseUint(stats["commit_index"], 10, 64)
+	applied, _ := strconv.ParseUint(stats["applied_index"], 10, 64)
+	var lag uint64
+	if commit > applied {
+		lag = commit - applied
+	}
+	if max := kvm.options().ReadyMaxLag; lag > uint64(max) {
+		return nil, errors.New("behind the leader by " +
+			strconv.FormatUint(lag, 10) + " entries")
+	}
+	if err := kvm.checkWritable(); err != nil {
+		return nil, errors.New("storage not writable: " + err.Error())
+	}
+	return map[string]interface{}{
+		"ok":     true,
+		"role":   strings.ToLower(stats["state"]),
+		"leader": leader,
+		"lag":    lag,
+	}, nil
+}
+
+// checkWritable writes and removes a file in the data directory, which is
+// where both the raft log and the database are stored.
+func (kvm *Machine) checkWritable() error {
+	f, err := ioutil.TempFile(kvm.dir, ".readyz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
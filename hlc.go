@@ -0,0 +1,87 @@
+package kvnode
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// The versions and revisions of writes are hybrid logical clock timestamps.
+// A timestamp is the wall clock of the leader in nanoseconds, unless the
+// clock is behind the last timestamp that the cluster assigned or observed,
+// in which case it's the last timestamp plus one, which is the logical part
+// of the clock. Timestamps only grow, they stay close to the wall clock, and
+// a write that follows another write, or an external event that was
+// observed with HLC UPDATE, has a greater timestamp.
+
+// hlcMaxOffset is how far ahead of the wall clock a timestamp from another
+// system may be. Timestamps further ahead are refused, so that a bad clock
+// elsewhere can't move the clock of the cluster into the future.
+const hlcMaxOffset = time.Second
+
+var errHLCOffset = errors.New("ERR timestamp is more than " +
+	hlcMaxOffset.String() + " ahead of the clock")
+
+// clock returns the current timestamp of the node, without assigning it.
+func (kvm *Machine) clock() uint64 {
+	now := uint64(time.Now().UnixNano())
+	if last := atomic.LoadUint64(&kvm.stamp); last >= now {
+		return last
+	}
+	return now
+}
+
+// checkOffset refuses a timestamp from another system that's too far ahead
+// of the wall clock. It's checked before the timestamp is proposed, rather
+// than when it's applied, so that every node applies the same writes.
+func checkOffset(ts uint64) error {
+	if int64(ts)-time.Now().UnixNano() > int64(hlcMaxOffset) {
+		return errHLCOffset
+	}
+	return nil
+}
+
+// cmdHLC handles "HLC", which returns the current timestamp of the node, and
+// "HLC UPDATE timestamp", which merges a timestamp from another system into
+// the clock of the cluster, so that the writes that follow it have greater
+// timestamps. The update goes through the raft log, so every node, and any
+// later leader, observes it. It returns the timestamp of the update.
+func (kvm *Machine) cmdHLC(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) == 1 {
+		conn.WriteInt64(int64(kvm.clock()))
+		return nil, nil
+	}
+	if strings.ToLower(string(cmd.Args[1])) != "update" {
+		return nil, errors.New("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	}
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	ts, err := strconv.ParseUint(string(cmd.Args[2]), 10, 63)
+	if err != nil {
+		return nil, errVersion
+	}
+	if conn != nil {
+		if err := checkOffset(ts); err != nil {
+			return nil, err
+		}
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.observeStamp(ts)
+			if kvm.applyStamp > ts {
+				ts = kvm.applyStamp
+			}
+			return ts, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteInt64(int64(v.(uint64)))
+			return nil, nil
+		},
+	)
+}
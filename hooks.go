@@ -0,0 +1,76 @@
+package kvnode
+
+import (
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// Hooks are functions that embedders can set to intercept the commands of
+// clients and to observe the writes that are applied, without changing the
+// machine. Any of them may be nil. They're called from the goroutines of the
+// connections and the raft log, and must be safe to call concurrently.
+type Hooks struct {
+	// OnConnect is called before the first command of a client, which is
+	// when the address of a relayed client is known. An error refuses the
+	// client, which is sent the error and disconnected.
+	OnConnect func(client ClientInfo) error
+	// OnCommand is called before a command of a client is authenticated
+	// and dispatched. It returns the args of the command that's executed,
+	// which may be rewritten into new args, or an error that's the reply
+	// to the command instead. The args must not be modified in place.
+	OnCommand func(client ClientInfo, args [][]byte) ([][]byte, error)
+	// OnApply is called on every node after a write was committed to the
+	// raft log and applied, with the keyspace of the write. The args are
+	// only valid during the call.
+	OnApply func(db int, namespace string, args [][]byte)
+	// OnDisconnect is called when a client that OnConnect was called for is
+	// closed.
+	OnDisconnect func(client ClientInfo)
+}
+
+// ClientInfo describes a client for the hooks.
+type ClientInfo struct {
+	ID   int64
+	Addr string
+	// User is the ACL user of the client, which is "default" until the
+	// client authenticates.
+	User string
+	Name string
+	// DB is the selected database, and Namespace is the selected namespace,
+	// which takes precedence when it's not empty.
+	DB        int
+	Namespace string
+}
+
+// hookInfo returns the description of the client for the hooks.
+func (c *client) hookInfo() ClientInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ClientInfo{
+		ID:        c.id,
+		Addr:      c.addr,
+		User:      c.userName(),
+		Name:      c.name,
+		DB:        c.db,
+		Namespace: c.ns,
+	}
+}
+
+// hookCommand passes a command of a client through OnCommand, and returns
+// the command that's executed.
+func (kvm *Machine) hookCommand(c *client, cmd redcon.Command) (redcon.Command, string, error) {
+	hooks := kvm.options().Hooks
+	args, err := hooks.OnCommand(c.hookInfo(), cmd.Args)
+	if err != nil {
+		return cmd, "", err
+	}
+	if len(args) == 0 {
+		return cmd, "", errSyntaxError
+	}
+	// the raw command is proposed to the raft log, so it's rebuilt.
+	if cmd, err = redcon.Parse(buildCommand(args...)); err != nil {
+		return cmd, "", err
+	}
+	return cmd, strings.ToLower(string(cmd.Args[0])), nil
+}
@@ -0,0 +1,314 @@
+package kvnode
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	gatewayTimeout  = time.Second * 15
+	gatewayMaxTries = 3
+)
+
+// gateway serves a JSON HTTP API. Requests are translated into commands and
+// executed on the node, or forwarded to the leader when required.
+type gateway struct {
+	addr  string
+	laddr string
+	m     *Machine
+	srv   *http.Server
+}
+
+// listenGateway binds the HTTP gateway and starts serving in the background.
+// The addr param is the node address that commands are sent to.
+func listenGateway(laddr, addr string, m *Machine) (*gateway, error) {
+	ln, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	g := &gateway{addr: addr, laddr: ln.Addr().String(), m: m}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", g.handleKeys)
+	mux.HandleFunc("/keys/", g.handleKey)
+	mux.HandleFunc("/watch", g.handleWatch)
+	mux.HandleFunc("/health", g.handleHealth)
+	mux.HandleFunc("/healthz", g.handleHealthz)
+	mux.HandleFunc("/readyz", g.handleReadyz)
+	mux.HandleFunc("/metrics", g.handleMetrics)
+	g.srv = &http.Server{Handler: g.guard(mux)}
+	go g.srv.Serve(ln)
+	return g, nil
+}
+
+// guard only passes requests from addresses that are allowed, and that
+// protected mode doesn't refuse. The commands of the gateway reach the node
+// over the loopback interface, which both always accept, so they're checked
+// here.
+func (g *gateway) guard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var laddr string
+		if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			laddr = a.String()
+		}
+		if !g.m.ipAllowed(r.RemoteAddr, laddr) {
+			writeJSON(w, http.StatusForbidden,
+				map[string]string{"error": errIPDenied[1 : len(errIPDenied)-2]})
+			return
+		}
+		if g.m.protectedDenied(g.laddr, r.RemoteAddr) {
+			writeJSON(w, http.StatusForbidden,
+				map[string]string{"error": errGatewayProtected + "--http-addr"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Close stops the HTTP gateway.
+func (g *gateway) Close() error {
+	return g.srv.Close()
+}
+
+// do executes a command on the node. Basic auth credentials, when provided,
+// are used to authenticate the command. A "TRY" or "READONLY" response is
+// followed to the leader.
+func (g *gateway) do(r *http.Request, args ...interface{}) (interface{}, error) {
+	addr := g.addr
+	for i := 0; ; i++ {
+		reply, err := func() (interface{}, error) {
+			conn, err := g.dial(r, addr, gatewayTimeout)
+			if err != nil {
+				return nil, err
+			}
+			defer conn.Close()
+			return conn.Do(args[0].(string), args[1:]...)
+		}()
+		if err != nil && i < gatewayMaxTries {
+			if leader, ok := redirect(err); ok {
+				addr = leader
+				continue
+			}
+		}
+		return reply, err
+	}
+}
+
+// dial connects to the node at addr, and authenticates with the basic auth
+// credentials of the request when provided. A zero readTimeout waits for
+// replies without a limit.
+func (g *gateway) dial(r *http.Request, addr string, readTimeout time.Duration) (redis.Conn, error) {
+	conn, err := redis.Dial("tcp", addr,
+		redis.DialConnectTimeout(gatewayTimeout),
+		redis.DialReadTimeout(readTimeout),
+		redis.DialWriteTimeout(gatewayTimeout))
+	if err != nil {
+		return nil, err
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		if _, err := conn.Do("AUTH", user, pass); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// writeJSON writes a JSON response with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		code = http.StatusInternalServerError
+		data = []byte(`{"error":"` + err.Error() + `"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+	w.Write([]byte{'\n'})
+}
+
+// writeError writes a JSON error response. The status code is derived from
+// the error that was returned by the node.
+func writeError(w http.ResponseWriter, err error) {
+	msg := err.Error()
+	code := http.StatusInternalServerError
+	switch {
+	case strings.HasPrefix(msg, "NOAUTH"), strings.HasPrefix(msg, "WRONGPASS"):
+		w.Header().Set("WWW-Authenticate", `Basic realm="kvnode"`)
+		code = http.StatusUnauthorized
+	case strings.HasPrefix(msg, "NOPERM"):
+		code = http.StatusForbidden
+	case strings.HasPrefix(msg, "ERR value of "), strings.HasPrefix(msg, "ERR key of "):
+		code = http.StatusRequestEntityTooLarge
+	case msg == errSyntaxError.Error(),
+		strings.HasPrefix(msg, "ERR wrong number"):
+		code = http.StatusBadRequest
+	case strings.HasPrefix(msg, "TRY "), strings.HasPrefix(msg, "READONLY "),
+		msg == "ERR leader not known", msg == "ERR raft not ready":
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+// handleKey handles GET, PUT and DELETE requests for "/keys/{key}".
+func (g *gateway) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+	if key == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing key"})
+		return
+	}
+	switch r.Method {
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed,
+			map[string]string{"error": "method not allowed"})
+	case "GET":
+		value, err := redis.Bytes(g.do(r, "GET", key))
+		if err == redis.ErrNil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"key": key, "value": string(value)})
+	case "PUT":
+		body := r.Body
+		max := g.m.options().MaxValueSize
+		if max > 0 {
+			// the body is limited before it's buffered, and a body that's
+			// one byte over the limit is refused by the node.
+			body = http.MaxBytesReader(w, r.Body, int64(max)+1)
+		}
+		value, err := ioutil.ReadAll(body)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{
+					"error": "ERR value exceeds the limit of " + strconv.Itoa(max) + " bytes",
+				})
+				return
+			}
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if _, err := g.do(r, "SET", key, value); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	case "DELETE":
+		n, err := redis.Int(g.do(r, "DEL", key))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"deleted": n})
+	}
+}
+
+// handleKeys handles "/keys?pattern=*&pivot=key&limit=100&desc=true&values=true".
+func (g *gateway) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed,
+			map[string]string{"error": "method not allowed"})
+		return
+	}
+	q := r.URL.Query()
+	pattern := q.Get("pattern")
+	if pattern == "" {
+		pattern = "*"
+	}
+	args := []interface{}{"KEYS", pattern}
+	if pivot := q.Get("pivot"); pivot != "" {
+		args = append(args, "PIVOT", pivot)
+	}
+	if limit := q.Get("limit"); limit != "" {
+		if _, err := strconv.ParseUint(limit, 10, 64); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+			return
+		}
+		args = append(args, "LIMIT", limit)
+	}
+	desc, _ := strconv.ParseBool(q.Get("desc"))
+	if desc {
+		args = append(args, "DESC")
+	}
+	values, _ := strconv.ParseBool(q.Get("values"))
+	if values {
+		args = append(args, "WITHVALUES")
+	}
+	items, err := redis.Strings(g.do(r, args...))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !values {
+		if items == nil {
+			items = []string{}
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"keys": items})
+		return
+	}
+	type item struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	res := make([]item, 0, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		res = append(res, item{items[i], items[i+1]})
+	}
+	writeJSON(w, http.StatusOK, map[string][]item{"items": res})
+}
+
+// handleHealth handles "/health" by checking that the node responds.
+func (g *gateway) handleHealth(w http.ResponseWriter, r *http.Request) {
+	reply, err := redis.String(g.do(r, "PING"))
+	if err == nil && reply != "PONG" {
+		err = errors.New("invalid response")
+	}
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// handleHealthz handles "/healthz", which only checks that the process is
+// alive, for liveness probes.
+func (g *gateway) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// handleReadyz handles "/readyz", which checks that the node can serve
+// traffic, for readiness probes and load balancers.
+func (g *gateway) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	state, err := g.m.readiness()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// handleMetrics handles "/metrics", which exposes the raft and replication
+// state and the internals of LevelDB in the Prometheus text format. The
+// state of the followers is only known by the leader.
+func (g *gateway) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	samples, err := g.m.metricSamples()
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(writePrometheus(samples))
+}
@@ -0,0 +1,31 @@
+package kvnode
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGatewayPutLimit(t *testing.T) {
+	tn := startNode(t, &Options{MaxValueSize: 10})
+	defer tn.close()
+	g := &gateway{addr: tn.addr, m: tn.m}
+	for _, tc := range []struct {
+		size int
+		code int
+	}{
+		{10, http.StatusOK},
+		// refused by the node.
+		{11, http.StatusRequestEntityTooLarge},
+		// refused by the gateway before it's buffered.
+		{1 << 20, http.StatusRequestEntityTooLarge},
+	} {
+		r := httptest.NewRequest("PUT", "/keys/a", strings.NewReader(strings.Repeat("x", tc.size)))
+		w := httptest.NewRecorder()
+		g.handleKey(w, r)
+		if code := w.Result().StatusCode; code != tc.code {
+			t.Fatalf("%d bytes: expected status %d, got %d: %s", tc.size, tc.code, code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package kvnode
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/match"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment, so that
+// proxies don't close it.
+const sseKeepAlive = 15 * time.Second
+
+// sseEvent is a change that's sent to an event stream, or the error that
+// ended the watch of a pattern.
+type sseEvent struct {
+	op    string
+	key   *string
+	value *string
+	rev   int64
+	err   error
+}
+
+// escapePattern returns a pattern that matches the keys with a prefix.
+func escapePattern(prefix string) string {
+	var b strings.Builder
+	for _, c := range prefix {
+		if c == '*' || c == '?' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String() + "*"
+}
+
+// handleWatch handles "/watch?prefix=user:&pattern=*&from=revision&withrev", which
+// streams the changes to the keys with the prefixes or that match the
+// patterns as server-sent events, through WATCHKEYS. Each prefix and pattern
+// is watched on its own connection to the node, so the access of the user
+// is checked for each of them, and the events of different prefixes aren't
+// ordered with each other. With from, or the Last-Event-ID header that
+// browsers send when they reconnect, the changes after the revision are sent
+// first and each event has its revision as its id. With withrev, the events
+// have their revision as their id without the history.
+func (g *gateway) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed,
+			map[string]string{"error": "method not allowed"})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError,
+			map[string]string{"error": "streaming is not supported"})
+		return
+	}
+	q := r.URL.Query()
+	var patterns []string
+	for _, prefix := range q["prefix"] {
+		patterns = append(patterns, escapePattern(prefix))
+	}
+	patterns = append(patterns, q["pattern"]...)
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	from := q.Get("from")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		from = id
+	}
+	if from != "" {
+		if _, err := strconv.ParseUint(from, 10, 64); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid revision"})
+			return
+		}
+	}
+	_, withrev := q["withrev"]
+	conns := make([]redis.Conn, 0, len(patterns))
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for _, pattern := range patterns {
+		conn, err := g.watch(r, pattern, from, withrev)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		conns = append(conns, conn)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(": watching\n\n"))
+	flusher.Flush()
+
+	events := make(chan sseEvent, watchBuffer)
+	done := make(chan struct{})
+	defer close(done)
+	for i, conn := range conns {
+		go readWatch(conn, patterns, i, events, done)
+	}
+	t := time.NewTicker(sseKeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-t.C:
+			w.Write([]byte(": keep-alive\n\n"))
+		case ev := <-events:
+			for {
+				writeSSE(w, ev)
+				if ev.err != nil {
+					flusher.Flush()
+					return
+				}
+				// write the pending events together.
+				if len(events) == 0 {
+					break
+				}
+				ev = <-events
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// watch starts a WATCHKEYS of a pattern on a connection to the node, and
+// follows a "TRY" or "READONLY" reply to the leader.
+func (g *gateway) watch(r *http.Request, pattern, from string, withrev bool) (redis.Conn, error) {
+	args := []interface{}{pattern}
+	if from != "" {
+		args = append(args, "FROM", from)
+	}
+	if withrev {
+		args = append(args, "WITHREV")
+	}
+	addr := g.addr
+	for i := 0; ; i++ {
+		conn, err := g.dial(r, addr, 0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = conn.Do("WATCHKEYS", args...); err == nil {
+			return conn, nil
+		}
+		conn.Close()
+		if leader, ok := redirect(err); ok && i < gatewayMaxTries {
+			addr = leader
+			continue
+		}
+		return nil, err
+	}
+}
+
+// readWatch reads the events of the watch of the pattern at index i, and
+// sends them until done is closed. An event that's also matched by an
+// earlier pattern is left to the watch of that pattern, so that it's sent
+// once, and so are the flushes, which every watch receives.
+func readWatch(conn redis.Conn, patterns []string, i int, events chan<- sseEvent, done <-chan struct{}) {
+	for {
+		var ev sseEvent
+		vals, err := redis.Values(conn.Receive())
+		if err == nil && len(vals) < 3 {
+			err = errSyntaxError
+		}
+		if err != nil {
+			ev.err = err
+		} else {
+			ev.op, _ = redis.String(vals[0], nil)
+			if key, err := redis.String(vals[1], nil); err == nil {
+				ev.key = &key
+			}
+			if value, err := redis.String(vals[2], nil); err == nil {
+				ev.value = &value
+			}
+			if len(vals) > 3 {
+				ev.rev, _ = redis.Int64(vals[3], nil)
+			}
+			if matchedBefore(ev.key, patterns[:i]) {
+				continue
+			}
+		}
+		select {
+		case events <- ev:
+		case <-done:
+			return
+		}
+		if ev.err != nil {
+			return
+		}
+	}
+}
+
+// matchedBefore returns true when a key matches any of the patterns, or is
+// nil and there are patterns.
+func matchedBefore(key *string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if key == nil || match.Match(*key, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSSE writes an event as a server-sent event, whose type is the
+// operation and whose data is a JSON object with the key and the value. An
+// error is sent as an "error" event.
+func writeSSE(w http.ResponseWriter, ev sseEvent) {
+	if ev.err != nil {
+		data, _ := json.Marshal(map[string]string{"error": ev.err.Error()})
+		w.Write([]byte("event: error\ndata: " + string(data) + "\n\n"))
+		return
+	}
+	data, _ := json.Marshal(struct {
+		Key   *string `json:"key"`
+		Value *string `json:"value"`
+	}{ev.key, ev.value})
+	var id string
+	if ev.rev != 0 {
+		id = "id: " + strconv.FormatInt(ev.rev, 10) + "\n"
+	}
+	w.Write([]byte("event: " + ev.op + "\n" + id + "data: " + string(data) + "\n\n"))
+}
@@ -0,0 +1,404 @@
+package kvnode
+
+import (
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// keyCountTTL is how long the number of keys is cached for INFO, since
+// counting requires a full scan.
+const keyCountTTL = time.Second * 10
+
+// infoSections are the INFO sections in the order that they're written.
+var infoSections = []string{
+	"server", "clients", "memory", "persistence", "stats", "raft",
+	"latencystats", "keyspace",
+}
+
+// serverStats are counters that are reported by INFO. They're accessed
+// atomically.
+type serverStats struct {
+	connections int64 // total accepted connections
+	rejected    int64 // connections rejected by maxclients
+	commands    int64 // total commands processed
+	throttled   int64 // commands refused by rate limits
+	busy        int64 // writes refused by MaxPendingWrites
+	diskRefused int64 // writes refused by MinFreeDiskMB
+	oomRefused  int64 // writes refused by MaxKeys and MaxBytes
+	evicted     int64 // keys evicted by the EvictionPolicy
+	coldStored  int64 // keys moved to the ColdStore
+	coldLoaded  int64 // cold keys moved back to the database
+	coldReads   int64 // values read from the ColdStore
+	// outputLimited are the clients disconnected by OutputBufferLimits.
+	outputLimited int64
+	// queued are the commands that waited for a worker of the command
+	// lane, and priority are the commands that skipped it.
+	queued   int64
+	priority int64
+	// forwarded are the writes that the node forwarded to the leader.
+	forwarded int64
+	// raftLogShrinks are the times that the raft log was shrunk by
+	// RaftLogMaxSize and RaftLogShrink.
+	raftLogShrinks int64
+}
+
+// keyspaceRanges are the ranges of the database that hold the keys of the
+// logical databases.
+var keyspaceRanges = []util.Range{
+	*util.BytesPrefix([]byte{'d'}),
+	*util.BytesPrefix([]byte{'k'}),
+}
+
+// keyCount caches the number of keys in each logical database.
+type keyCount struct {
+	mu sync.Mutex
+	n  map[int]int
+	at time.Time
+}
+
+// countKeys returns the number of keys in each logical database, which may
+// be up to keyCountTTL old. Empty databases are not included.
+func (kvm *Machine) countKeys() (map[int]int, error) {
+	kvm.keycount.mu.Lock()
+	defer kvm.keycount.mu.Unlock()
+	if time.Since(kvm.keycount.at) < keyCountTTL {
+		return kvm.keycount.n, nil
+	}
+	kvm.dbmu.RLock()
+	ss, err := kvm.db.GetSnapshot()
+	kvm.dbmu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer ss.Release()
+	n := make(map[int]int)
+	for i := range keyspaceRanges {
+		iter := ss.NewIterator(&keyspaceRanges[i], nil)
+		for ok := iter.First(); ok; ok = iter.Next() {
+			if db, _, ok := parseDBKey(iter.Key()); ok {
+				n[db]++
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+	}
+	kvm.keycount.n, kvm.keycount.at = n, time.Now()
+	return n, nil
+}
+
+// raftInfo returns the raft stats and the leader of the node. The node does
+// not expose raft directly, so the local server is asked.
+func (kvm *Machine) raftInfo() (map[string]string, string, error) {
+	conn, err := dialRaft(kvm.addr)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+	stats, err := redis.StringMap(conn.Do("RAFTSTATS"))
+	if err != nil {
+		return nil, "", err
+	}
+	leader, err := redis.String(conn.Do("RAFTLEADER"))
+	if err != nil {
+		// the leader is not known during an election.
+		leader = ""
+	}
+	return stats, leader, nil
+}
+
+// cmdInfo handles "INFO [section [section ...]]".
+func (kvm *Machine) cmdInfo(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	want := make(map[string]bool)
+	for _, arg := range cmd.Args[1:] {
+		switch section := strings.ToLower(string(arg)); section {
+		case "all", "default", "everything":
+			for _, section := range infoSections {
+				want[section] = true
+			}
+		default:
+			want[section] = true
+		}
+	}
+	if len(want) == 0 {
+		for _, section := range infoSections {
+			want[section] = true
+		}
+	}
+	var buf []byte
+	for _, section := range infoSections {
+		if !want[section] {
+			continue
+		}
+		if len(buf) > 0 {
+			buf = append(buf, "\r\n"...)
+		}
+		buf = append(buf, "# "...)
+		buf = append(buf, strings.ToUpper(section[:1])...)
+		buf = append(buf, section[1:]...)
+		buf = append(buf, "\r\n"...)
+		for _, f := range kvm.infoSection(section) {
+			buf = append(buf, f[0]...)
+			buf = append(buf, ':')
+			buf = append(buf, f[1]...)
+			buf = append(buf, "\r\n"...)
+		}
+	}
+	conn.WriteBulk(buf)
+	return nil, nil
+}
+
+// infoSection returns the fields of an INFO section.
+func (kvm *Machine) infoSection(section string) [][2]string {
+	var fields [][2]string
+	add := func(name string, value interface{}) {
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case uint64:
+			s = strconv.FormatUint(v, 10)
+		}
+		fields = append(fields, [2]string{name, s})
+	}
+	opts := kvm.options()
+	switch section {
+	case "server":
+		uptime := time.Since(kvm.started)
+		add("kvnode_version", Version)
+		add("go_version", runtime.Version())
+		add("os", runtime.GOOS+" "+runtime.GOARCH)
+		add("process_id", os.Getpid())
+		add("addr", kvm.addr)
+		add("config_file", opts.ConfigFile)
+		add("uptime_in_seconds", int64(uptime/time.Second))
+		add("uptime_in_days", int64(uptime/(time.Hour*24)))
+		if opts.TLSFiles != nil {
+			add("tls_cert_expires", opts.TLSFiles.NotAfter().Unix())
+		}
+	case "clients":
+		kvm.cmu.Lock()
+		tracked := len(kvm.clients)
+		kvm.cmu.Unlock()
+		add("connected_clients", kvm.numConns())
+		add("tracked_clients", tracked)
+		kvm.tracking.mu.Lock()
+		add("tracking_total_keys", len(kvm.tracking.keys))
+		kvm.tracking.mu.Unlock()
+		add("tracking_clients", int(atomic.LoadInt32(&kvm.tracking.n)))
+		add("maxclients", opts.MaxClients)
+		add("monitors", int(atomic.LoadInt32(&kvm.monitors.count)))
+		kvm.watches.mu.Lock()
+		add("watchers", len(kvm.watches.watchers))
+		kvm.watches.mu.Unlock()
+	case "memory":
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		add("used_memory", ms.HeapAlloc)
+		add("used_memory_human", humanBytes(ms.HeapAlloc))
+		add("used_memory_sys", ms.Sys)
+		add("used_memory_sys_human", humanBytes(ms.Sys))
+		add("mem_allocator", "go")
+		add("gc_runs", uint64(ms.NumGC))
+		if atomic.LoadInt32(&kvm.usage.counted) == 1 {
+			add("used_keys", atomic.LoadInt64(&kvm.usage.keys))
+			add("used_keys_bytes", atomic.LoadInt64(&kvm.usage.bytes))
+		}
+		add("max_keys", opts.MaxKeys)
+		add("max_bytes", opts.MaxBytes)
+		add("eviction_policy", opts.EvictionPolicy)
+		keys, size := kvm.rcache.usage()
+		add("read_cache_keys", keys)
+		add("read_cache_bytes", size)
+		add("read_cache_bytes_human", humanBytes(uint64(size)))
+		add("read_cache_max_bytes", opts.ReadCacheSize)
+	case "persistence":
+		storage := "leveldb"
+		if opts.InMemory {
+			storage = "memory"
+		}
+		add("storage", storage)
+		add("dir", kvm.dir)
+		add("loading", yesno(kvm.isLoading()))
+		if kvm.isLoading() {
+			applied := atomic.LoadUint64(&kvm.loading.applied)
+			total := atomic.LoadUint64(&kvm.loading.total)
+			add("loading_start_time", atomic.LoadInt64(&kvm.loading.start)/int64(time.Second))
+			add("loading_applied_entries", applied)
+			add("loading_total_entries", total)
+			add("loading_loaded_perc", loadingPercent(applied, total))
+			add("loading_eta_seconds", atomic.LoadInt64(&kvm.loading.eta))
+		}
+		compression := "snappy"
+		if kvm.opts.GetCompression() == opt.NoCompression {
+			compression = "none"
+		}
+		add("leveldb_write_buffer", kvm.opts.GetWriteBuffer())
+		add("leveldb_block_cache", kvm.opts.GetBlockCacheCapacity())
+		add("leveldb_table_size", kvm.opts.GetCompactionTableSize(0))
+		add("leveldb_open_files", kvm.opts.GetOpenFilesCacheCapacity())
+		add("leveldb_compression", compression)
+		add("encrypted", yesno(kvm.crypt != nil))
+		add("compaction_window", opts.CompactionWindow)
+		if w := kvm.window(); w != nil {
+			add("compaction_window_open", yesno(w.contains(time.Now())))
+		}
+		add("compaction_rate", opts.CompactionRate)
+		add("snapshot_rate", opts.SnapshotRate)
+		add("compactions_paused", yesno(kvm.compactionsPaused(time.Now())))
+		add("compaction_throttled", yesno(kvm.tableWriteRate(time.Now()) > 0))
+		add("last_window_compaction", atomic.LoadInt64(&kvm.compact.last))
+		if free := atomic.LoadInt64(&kvm.diskFree); free >= 0 {
+			add("disk_free", free)
+			add("disk_free_human", humanBytes(uint64(free)))
+		}
+		add("disk_low", int(atomic.LoadInt32(&kvm.diskLow)))
+		kvm.dbmu.RLock()
+		ranges := append(keyspaceRanges[:len(keyspaceRanges):len(keyspaceRanges)],
+			*util.BytesPrefix([]byte{'n'}))
+		if sizes, err := kvm.db.SizeOf(ranges); err == nil {
+			add("db_size", uint64(sizes.Sum()))
+			add("db_size_human", humanBytes(uint64(sizes.Sum())))
+		}
+		for i := 0; i < dbLevels; i++ {
+			v, err := kvm.db.GetProperty("leveldb.num-files-at-level" + strconv.Itoa(i))
+			if err == nil {
+				add("leveldb_files_level"+strconv.Itoa(i), v)
+			}
+		}
+		for _, prop := range []string{"openedtables", "cachedblock", "alivesnaps", "aliveiters"} {
+			if v, err := kvm.db.GetProperty("leveldb." + prop); err == nil {
+				add("leveldb_"+prop, v)
+			}
+		}
+		kvm.dbmu.RUnlock()
+	case "stats":
+		add("total_connections_received", atomic.LoadInt64(&kvm.stats.connections))
+		add("rejected_connections", atomic.LoadInt64(&kvm.stats.rejected))
+		add("total_commands_processed", atomic.LoadInt64(&kvm.stats.commands))
+		add("throttled_commands", atomic.LoadInt64(&kvm.stats.throttled))
+		add("busy_writes", atomic.LoadInt64(&kvm.stats.busy))
+		add("disk_refused_writes", atomic.LoadInt64(&kvm.stats.diskRefused))
+		add("oom_refused_writes", atomic.LoadInt64(&kvm.stats.oomRefused))
+		add("evicted_keys", atomic.LoadInt64(&kvm.stats.evicted))
+		add("cold_stored_keys", atomic.LoadInt64(&kvm.stats.coldStored))
+		add("cold_loaded_keys", atomic.LoadInt64(&kvm.stats.coldLoaded))
+		add("cold_reads", atomic.LoadInt64(&kvm.stats.coldReads))
+		add("client_output_buffer_limit_disconnections", atomic.LoadInt64(&kvm.stats.outputLimited))
+		add("read_cache_hits", atomic.LoadInt64(&kvm.rcache.hits))
+		add("read_cache_misses", atomic.LoadInt64(&kvm.rcache.misses))
+		add("pending_writes", atomic.LoadInt64(&kvm.pending))
+		add("queued_commands", atomic.LoadInt64(&kvm.stats.queued))
+		add("waiting_commands", atomic.LoadInt64(&kvm.lane.waiting))
+		add("priority_commands", atomic.LoadInt64(&kvm.stats.priority))
+		add("forwarded_writes", atomic.LoadInt64(&kvm.stats.forwarded))
+	case "raft":
+		stats, leader, err := kvm.raftInfo()
+		if err != nil {
+			add("raft_error", strings.Replace(err.Error(), "\r\n", " ", -1))
+			break
+		}
+		add("role", strings.ToLower(stats["state"]))
+		add("leader", leader)
+		names := make([]string, 0, len(stats))
+		for name := range stats {
+			if name != "state" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			add(name, stats[name])
+		}
+		if size := atomic.LoadInt64(&kvm.raftLogSize); size >= 0 {
+			add("raft_log_bytes", size)
+			add("raft_log_bytes_human", humanBytes(uint64(size)))
+		}
+		add("raft_log_entries", raftLogEntries(stats))
+		add("raft_log_trailing_entries", raftTrailingLogs)
+		add("raft_log_max_size", opts.RaftLogMaxSize)
+		add("raft_log_shrink", yesno(opts.RaftLogShrink))
+		add("raft_log_shrinks", atomic.LoadInt64(&kvm.stats.raftLogShrinks))
+		reps := kvm.replication(stats)
+		if stats["state"] == "Leader" {
+			add("followers", len(reps))
+		}
+		for i, rep := range reps {
+			add("follower"+strconv.Itoa(i), formatReplication(rep))
+		}
+	case "latencystats":
+		names, cls := kvm.latency.lookup(nil)
+		for i, cl := range cls {
+			for phase := 0; phase < numPhases; phase++ {
+				h := &cl.phases[phase]
+				if atomic.LoadInt64(&h.calls) == 0 {
+					continue
+				}
+				field := "latency_percentiles_usec_"
+				if phase != phaseTotal {
+					field = "latency_" + phaseNames[phase] + "_usec_"
+				}
+				add(field+names[i], "p50="+formatUsec(h.percentile(50))+
+					",p95="+formatUsec(h.percentile(95))+
+					",p99="+formatUsec(h.percentile(99)))
+			}
+		}
+	case "keyspace":
+		// the databases are left out when they cannot be counted.
+		counts, _ := kvm.countKeys()
+		dbs := make([]int, 0, len(counts))
+		for db := range counts {
+			dbs = append(dbs, db)
+		}
+		sort.Ints(dbs)
+		for _, db := range dbs {
+			add("db"+strconv.Itoa(db), "keys="+strconv.Itoa(counts[db]))
+		}
+		// the usage of namespaces is always known.
+		kvm.mu.RLock()
+		names := make([]string, 0, len(kvm.namespaces))
+		for name := range kvm.namespaces {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ns := kvm.namespaces[name]
+			add("ns_"+name, "keys="+strconv.FormatInt(ns.keys, 10)+
+				",bytes="+strconv.FormatInt(ns.bytes, 10))
+		}
+		kvm.mu.RUnlock()
+	}
+	return fields
+}
+
+// humanBytes returns the size in a human readable format, such as "1.50M".
+func humanBytes(n uint64) string {
+	const units = "BKMGTP"
+	v := float64(n)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return strconv.FormatUint(n, 10) + "B"
+	}
+	return strconv.FormatFloat(v, 'f', 2, 64) + units[i:i+1]
+}
@@ -0,0 +1,159 @@
+package kvnode
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// errIPDenied is written to connections that are refused by the allow and
+// deny lists.
+const errIPDenied = "-DENIED connections from this address are not allowed\r\n"
+
+// ipFilter is the compiled form of the Allow, Deny, TrustedProxies and
+// PeerNetworks options.
+type ipFilter struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	proxies []*net.IPNet
+	peers   []*net.IPNet
+}
+
+// parseCIDRs parses a list of CIDR blocks, such as "10.0.0.0/8". Single
+// addresses are accepted too.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid address '" + s + "'")
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.New("invalid CIDR '" + s + "'")
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func newIPFilter(opts *Options) (*ipFilter, error) {
+	allow, err := parseCIDRs(opts.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(opts.Deny)
+	if err != nil {
+		return nil, err
+	}
+	proxies, err := parseCIDRs(opts.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := parseCIDRs(opts.PeerNetworks)
+	if err != nil {
+		return nil, err
+	}
+	return &ipFilter{allow: allow, deny: deny, proxies: proxies, peers: peers}, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of an address, which may not have a port.
+func addrIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// allowed returns true if a connection from raddr to laddr is allowed. The
+// deny list takes precedence over the allow list, and an empty allow list
+// allows every address. Connections from the local host, which are either
+// on the loopback interface or from the same address they're made to, are
+// always allowed since the node connects to itself.
+func (f *ipFilter) allowed(raddr, laddr string) bool {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return true
+	}
+	ip := addrIP(raddr)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.Equal(addrIP(laddr)) {
+		return true
+	}
+	return f.listed(ip)
+}
+
+// proxiedAllowed returns true if a client address from a PROXY protocol
+// header is allowed. The address is only claimed by the proxy, so it's
+// never exempt as a local one.
+func (f *ipFilter) proxiedAllowed(addr string) bool {
+	ip := addrIP(addr)
+	return ip != nil && f.listed(ip)
+}
+
+// listed returns true if the allow and deny lists accept the IP.
+func (f *ipFilter) listed(ip net.IP) bool {
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// ipAllowed returns true if a connection from raddr to laddr is allowed by
+// the current options. The laddr may be empty when it's not known.
+func (kvm *Machine) ipAllowed(raddr, laddr string) bool {
+	return kvm.ipfilter.Load().(*ipFilter).allowed(raddr, laddr)
+}
+
+// proxiedAllowed returns true if a client address from a PROXY protocol
+// header is allowed by the current options.
+func (kvm *Machine) proxiedAllowed(addr string) bool {
+	return kvm.ipfilter.Load().(*ipFilter).proxiedAllowed(addr)
+}
+
+// trustedProxy returns true if PROXY protocol headers are accepted from a
+// connection from raddr, which is the address of the peer itself.
+func (kvm *Machine) trustedProxy(raddr string) bool {
+	ip := addrIP(raddr)
+	return ip != nil && containsIP(kvm.ipfilter.Load().(*ipFilter).proxies, ip)
+}
+
+// storeOptions replaces the current options and their compiled forms.
+func (kvm *Machine) storeOptions(opts *Options) error {
+	f, err := newIPFilter(opts)
+	if err != nil {
+		return err
+	}
+	level, ok := logLevels[opts.LogLevel]
+	if !ok {
+		return errLogLevel
+	}
+	w, err := parseCompactionWindow(opts.CompactionWindow)
+	if err != nil {
+		return err
+	}
+	kvm.ipfilter.Store(f)
+	kvm.cwindow.Store(w)
+	kvm.optionsv.Store(opts)
+	log.SetLevel(level)
+	return nil
+}
@@ -0,0 +1,59 @@
+package kvnode
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TestGatewayDeny checks that the HTTP and gRPC gateways refuse denied
+// addresses themselves, since their commands reach the node over the
+// loopback interface.
+func TestGatewayDeny(t *testing.T) {
+	tn := startNode(t, &Options{Deny: []string{"10.0.0.0/8"}})
+	defer tn.close()
+	for _, tc := range []struct {
+		raddr   string
+		allowed bool
+	}{
+		{"10.1.2.3:5000", false},
+		{"192.168.1.2:5000", true},
+	} {
+		g := &gateway{addr: tn.addr, m: tn.m}
+		h := g.guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		r := httptest.NewRequest("GET", "/keys/a", nil)
+		r.RemoteAddr = tc.raddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		want := http.StatusForbidden
+		if tc.allowed {
+			want = http.StatusNoContent
+		}
+		if code := w.Result().StatusCode; code != want {
+			t.Fatalf("%s: expected status %d, got %d", tc.raddr, want, code)
+		}
+
+		gg := &grpcGateway{addr: tn.addr, m: tn.m}
+		ip, _, _ := net.SplitHostPort(tc.raddr)
+		ctx := peer.NewContext(context.Background(), &peer.Peer{
+			Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 5000},
+		})
+		_, err := gg.guardUnary(ctx, nil, nil, func(context.Context, interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		if tc.allowed && err != nil {
+			t.Fatalf("%s: %v", tc.raddr, err)
+		}
+		if !tc.allowed && status.Code(err) != codes.PermissionDenied {
+			t.Fatalf("%s: expected PermissionDenied, got %v", tc.raddr, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package kvnode
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// k8sAddrFile is the file in the log directory that holds the address
+	// that the node last had, so that a pod that comes back with another IP
+	// replaces its old address in the cluster.
+	k8sAddrFile = "k8s-addr"
+	// k8sRetry is how often the members are looked up while waiting for the
+	// pod name to resolve or for a leader.
+	k8sRetry = 2 * time.Second
+	// k8sResolveTimeout is how long the name of the pod may take to appear
+	// in the headless service.
+	k8sResolveTimeout = 2 * time.Minute
+)
+
+// k8sBootstrap derives the address and the join address of a node that's a
+// pod of a StatefulSet with a headless service. The host of the address is
+// the IP that the stable name of the pod, such as kvnode-1.kvnode, resolves
+// to, and the port is the port of addr. A pod with no raft log joins the
+// leader that's found among the members of the service, except for the first
+// pod, which bootstraps the cluster when no other member is running. The old
+// address is returned when a pod with a raft log came back with another IP.
+func k8sBootstrap(service, addr, logdir string) (naddr, join, oldaddr string, err error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", "", err
+	}
+	hostname := os.Getenv("HOSTNAME")
+	if hostname == "" {
+		if hostname, err = os.Hostname(); err != nil {
+			return "", "", "", err
+		}
+	}
+	hostname = strings.SplitN(hostname, ".", 2)[0]
+	i := strings.LastIndexByte(hostname, '-')
+	ordinal, err := strconv.Atoi(hostname[i+1:])
+	if i == -1 || err != nil {
+		return "", "", "", errors.New("the hostname " + hostname +
+			" is not the name of a StatefulSet pod")
+	}
+	ip, err := k8sResolve(hostname + "." + service)
+	if err != nil {
+		return "", "", "", err
+	}
+	naddr = net.JoinHostPort(ip, port)
+	log.Noticef("kubernetes pod %s, ordinal %d, address %s", hostname, ordinal, naddr)
+	data, err := ioutil.ReadFile(filepath.Join(logdir, k8sAddrFile))
+	if err == nil {
+		if last := strings.TrimSpace(string(data)); last != naddr {
+			oldaddr = last
+		}
+		return naddr, "", oldaddr, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", "", "", err
+	}
+	if _, err := os.Stat(filepath.Join(logdir, "raft.db")); err == nil {
+		// the node ran before the kubernetes bootstrap.
+		return naddr, "", "", writeK8sAddr(logdir, naddr)
+	}
+	for start := time.Now(); ; time.Sleep(k8sRetry) {
+		leader, members := k8sLeader(service, port, naddr)
+		if leader != "" {
+			log.Noticef("joining the leader %s", leader)
+			return naddr, leader, "", nil
+		}
+		if ordinal == 0 && members == 0 && time.Since(start) > 3*k8sRetry {
+			log.Noticef("no other member of %s is running, bootstrapping the cluster", service)
+			return naddr, "", "", nil
+		}
+		log.Verbosef("waiting for a leader among the members of %s", service)
+	}
+}
+
+// k8sResolve returns the IP of the name of a pod, which is added to the
+// headless service shortly after the pod is created.
+func k8sResolve(name string) (string, error) {
+	for start := time.Now(); ; time.Sleep(k8sRetry) {
+		ips, err := net.LookupHost(name)
+		if err == nil && len(ips) > 0 {
+			return ips[0], nil
+		}
+		if time.Since(start) > k8sResolveTimeout {
+			return "", errors.New("could not resolve " + name +
+				", the service must set publishNotReadyAddresses")
+		}
+	}
+}
+
+// k8sLeader returns the leader that a member of the service knows, other
+// than this node, or an empty string, and the number of other members that
+// answered.
+func k8sLeader(service, port, self string) (leader string, members int) {
+	ips, err := net.LookupHost(service)
+	if err != nil {
+		return "", 0
+	}
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip, port)
+		if addr == self {
+			continue
+		}
+		conn, err := dialRaft(addr)
+		if err != nil {
+			continue
+		}
+		members++
+		leader, err := redis.String(conn.Do("RAFTLEADER"))
+		conn.Close()
+		if err == nil && leader != "" && leader != self {
+			return leader, members
+		}
+	}
+	return "", members
+}
+
+func writeK8sAddr(logdir, addr string) error {
+	return ioutil.WriteFile(filepath.Join(logdir, k8sAddrFile), []byte(addr+"\n"), 0600)
+}
+
+// k8sReplaceAddr makes the leader replace the old address of the node with
+// its new address, and records the new address. The new address is added
+// first, since a node that applies a configuration without itself shuts
+// down. It retries until it succeeds or the machine is closed.
+func (kvm *Machine) k8sReplaceAddr(service, logdir, oldaddr string) {
+	_, port, _ := net.SplitHostPort(kvm.addr)
+	log.Noticef("the address changed from %s, replacing it", oldaddr)
+	for {
+		if leader, _ := k8sLeader(service, port, kvm.addr); leader != "" {
+			err := raftDo(leader, "RAFTADDPEER", kvm.addr)
+			if err == nil || strings.Contains(err.Error(), "peer already known") {
+				err = raftDo(leader, "RAFTREMOVEPEER", oldaddr)
+				if err != nil && strings.Contains(err.Error(), "peer is unknown") {
+					err = nil
+				}
+			}
+			if err == nil {
+				if err := writeK8sAddr(logdir, kvm.addr); err != nil {
+					log.Warningf("could not record the address: %v", err)
+				}
+				log.Noticef("replaced the address %s with %s", oldaddr, kvm.addr)
+				return
+			}
+			log.Warningf("could not replace the address %s: %v", oldaddr, err)
+		}
+		select {
+		case <-kvm.done:
+			return
+		case <-time.After(k8sRetry):
+		}
+	}
+}
+
+// raftDo sends a raft command to a node, and to the leader when the node
+// answers with "TRY addr" or "READONLY addr".
+func raftDo(addr, cmd string, args ...interface{}) error {
+	for i := 0; ; i++ {
+		conn, err := dialRaft(addr)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Do(cmd, args...)
+		conn.Close()
+		if err == nil || i > 0 {
+			return err
+		}
+		leader, ok := redirect(err)
+		if !ok {
+			return err
+		}
+		addr = leader
+	}
+}
@@ -0,0 +1,97 @@
+package kvnode
+
+import (
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// keyMeta is the metadata of a key that's stored with its value, when the
+// KeyMetadata option is on. It's set when a write is applied, from the
+// version of the write in the raft log, so it's the same on every node.
+type keyMeta struct {
+	// created is the version of the first write of the key, or zero when
+	// the key was written before metadata was on.
+	created uint64
+	// writes is the number of writes of the key, since it was created or
+	// since metadata was on.
+	writes uint64
+}
+
+// nextMeta returns the metadata of a write of a database key that's being
+// applied, or nil when metadata is off. The metadata of the keys that were
+// written earlier in the same batch are in pending, which is updated. The
+// caller must hold the lock of the key.
+func (kvm *Machine) nextMeta(key []byte, pending map[string]*keyMeta) (*keyMeta, error) {
+	if !kvm.options().KeyMetadata || kvm.applyStamp == 0 {
+		return nil, nil
+	}
+	meta, ok := pending[string(key)]
+	if !ok {
+		stored, err := kvm.appliedValue(key)
+		switch {
+		case err == leveldb.ErrNotFound:
+			meta = &keyMeta{created: kvm.applyStamp}
+		case err != nil:
+			return nil, err
+		default:
+			if meta = valueMeta(stored); meta == nil {
+				meta = &keyMeta{}
+			}
+		}
+	}
+	meta = &keyMeta{created: meta.created, writes: meta.writes + 1}
+	if pending != nil {
+		pending[string(key)] = meta
+	}
+	return meta, nil
+}
+
+// versionMillis returns a version as unix milliseconds, or -1 for zero.
+func versionMillis(version uint64) int64 {
+	if version == 0 {
+		return -1
+	}
+	return int64(version / uint64(time.Millisecond))
+}
+
+// cmdKeyinfo handles "KEYINFO key", which returns the metadata of a key:
+// the times of its first and last writes, in unix milliseconds, its version
+// and its number of writes. The first write and the writes are -1 for keys
+// that weren't written since metadata was on, and the writes of keys that
+// existed before are counted from then. The reply is null for keys that
+// don't exist.
+func (kvm *Machine) cmdKeyinfo(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			stored, err := kvm.storedValue(m, cmd.Args[1])
+			if err != nil {
+				return nil, err
+			}
+			if stored == nil {
+				writeNull(conn)
+				return nil, nil
+			}
+			version := valueVersion(stored)
+			created, writes := int64(-1), int64(-1)
+			if meta := valueMeta(stored); meta != nil {
+				created, writes = versionMillis(meta.created), int64(meta.writes)
+			}
+			writeMap(conn, 4)
+			conn.WriteBulkString("created")
+			conn.WriteInt64(created)
+			conn.WriteBulkString("modified")
+			conn.WriteInt64(versionMillis(version))
+			conn.WriteBulkString("version")
+			conn.WriteInt64(int64(version))
+			conn.WriteBulkString("writes")
+			conn.WriteInt64(writes)
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,430 @@
+package kvnode
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+var errHotKeysDisabled = errors.New("ERR hot key sampling is disabled, " +
+	"enable it with CONFIG SET hotkeys-sampling")
+
+// hotKeysCapacity is the number of keys that are tracked by HOTKEYS. When
+// it's full, the least accessed key is replaced, which is the space-saving
+// algorithm. The counts are estimates, but the hottest keys are kept.
+const hotKeysCapacity = 1024
+
+// hotKeysDecay is how often the access counts are halved, so that HOTKEYS
+// reports the recent accesses.
+const hotKeysDecay = time.Minute
+
+// hotKeys tracks the most accessed keys from a sample of commands.
+type hotKeys struct {
+	// n is the number of commands with keys. It's accessed atomically.
+	n       uint64
+	mu      sync.Mutex
+	counts  map[string]int64
+	decayed time.Time
+}
+
+func newHotKeys() *hotKeys {
+	return &hotKeys{counts: make(map[string]int64), decayed: time.Now()}
+}
+
+// sample records the keys of a command when it's one of every rate
+// commands. The keys are the full database keys, and each access counts as
+// rate accesses, so that the counts estimate the real number of accesses.
+func (h *hotKeys) sample(rate int, keys [][]byte, ks keyspace) {
+	if rate <= 0 || len(keys) == 0 ||
+		atomic.AddUint64(&h.n, 1)%uint64(rate) != 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.decayed) > hotKeysDecay {
+		for key, count := range h.counts {
+			if count /= 2; count == 0 {
+				delete(h.counts, key)
+			} else {
+				h.counts[key] = count
+			}
+		}
+		h.decayed = time.Now()
+	}
+	for _, key := range keys {
+		skey := string(ks.key(key))
+		if _, ok := h.counts[skey]; !ok && len(h.counts) >= hotKeysCapacity {
+			// replace the least accessed key, which the new key
+			// inherits the count of.
+			var minKey string
+			var min int64 = -1
+			for key, count := range h.counts {
+				if min == -1 || count < min {
+					minKey, min = key, count
+				}
+			}
+			delete(h.counts, minKey)
+			h.counts[skey] = min
+		}
+		h.counts[skey] += int64(rate)
+	}
+}
+
+// count returns the estimated accesses of a key, with the keyspace prefix,
+// which is zero for keys that aren't tracked.
+func (h *hotKeys) count(key []byte) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.counts[string(key)]
+}
+
+// top returns the n most accessed keys in a keyspace, without the keyspace
+// prefix.
+func (h *hotKeys) top(ks keyspace, n int) ([]string, []int64) {
+	prefix := string(ks.prefix())
+	h.mu.Lock()
+	var keys []string
+	for key := range h.counts {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	counts := make(map[string]int64, len(keys))
+	for _, key := range keys {
+		counts[key] = h.counts[key]
+	}
+	h.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	vals := make([]int64, len(keys))
+	for i, key := range keys {
+		vals[i] = counts[key]
+		keys[i] = key[len(prefix):]
+	}
+	return keys, vals
+}
+
+func (h *hotKeys) reset() {
+	h.mu.Lock()
+	h.counts = make(map[string]int64)
+	h.decayed = time.Now()
+	h.mu.Unlock()
+}
+
+// bigKey is a key and the size of its value.
+type bigKey struct {
+	key  []byte
+	size int
+}
+
+// bigKeyHeap is a min-heap of the biggest keys that were found so far.
+type bigKeyHeap []bigKey
+
+func (h bigKeyHeap) Len() int            { return len(h) }
+func (h bigKeyHeap) Less(i, j int) bool  { return h[i].size < h[j].size }
+func (h bigKeyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *bigKeyHeap) Push(x interface{}) { *h = append(*h, x.(bigKey)) }
+func (h *bigKeyHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// bigKeys scans a keyspace for the n keys with the biggest values. At most
+// samples keys are scanned when it's positive. It returns the biggest keys
+// and the number of keys, and total size of the values, that were scanned.
+func (kvm *Machine) bigKeys(ks keyspace, pattern []byte, n, samples int) ([]bigKey, int, int64, error) {
+	kvm.dbmu.RLock()
+	ss, err := kvm.db.GetSnapshot()
+	kvm.dbmu.RUnlock()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer ss.Release()
+	prefix := ks.prefix()
+	spattern := string(pattern)
+	var h bigKeyHeap
+	var scanned int
+	var total int64
+	iter := ss.NewIterator(util.BytesPrefix(prefix), nil)
+	for ok := iter.First(); ok && (samples <= 0 || scanned < samples); ok = iter.Next() {
+		key := iter.Key()[len(prefix):]
+		if spattern != "*" && !match.Match(string(key), spattern) {
+			continue
+		}
+		size := len(iter.Value())
+		scanned++
+		total += int64(size)
+		if len(h) < n {
+			heap.Push(&h, bigKey{append([]byte(nil), key...), size})
+		} else if len(h) > 0 && size > h[0].size {
+			h[0] = bigKey{append([]byte(nil), key...), size}
+			heap.Fix(&h, 0)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, 0, 0, err
+	}
+	sort.Slice(h, func(i, j int) bool {
+		if h[i].size != h[j].size {
+			return h[i].size > h[j].size
+		}
+		return bytes.Compare(h[i].key, h[j].key) < 0
+	})
+	return h, scanned, total, nil
+}
+
+// parseCountArg parses the argument of COUNT and SAMPLES options.
+func parseCountArg(arg []byte) (int, error) {
+	n, err := strconv.ParseUint(string(arg), 10, 31)
+	if err != nil {
+		return 0, errSyntaxError
+	}
+	return int(n), nil
+}
+
+// cmdBigkeys handles "BIGKEYS [MATCH pattern] [COUNT count] [SAMPLES n]",
+// which scans the keyspace of the client for the keys with the biggest
+// values. SAMPLES limits the number of keys that are scanned.
+func (kvm *Machine) cmdBigkeys(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	pattern := []byte("*")
+	count, samples := 10, 0
+	for i := 1; i < len(cmd.Args); i++ {
+		if i+1 == len(cmd.Args) {
+			return nil, errSyntaxError
+		}
+		var err error
+		switch strings.ToLower(string(cmd.Args[i])) {
+		default:
+			return nil, errSyntaxError
+		case "match":
+			pattern = cmd.Args[i+1]
+		case "count":
+			count, err = parseCountArg(cmd.Args[i+1])
+		case "samples":
+			samples, err = parseCountArg(cmd.Args[i+1])
+		}
+		if err != nil {
+			return nil, err
+		}
+		i++
+	}
+	ks := keyspaceOf(m)
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			keys, scanned, total, err := kvm.bigKeys(ks, pattern, count, samples)
+			if err != nil {
+				return nil, err
+			}
+			writeMap(conn, 3)
+			conn.WriteBulkString("scanned")
+			conn.WriteInt(scanned)
+			conn.WriteBulkString("total_bytes")
+			conn.WriteInt64(total)
+			conn.WriteBulkString("keys")
+			conn.WriteArray(len(keys))
+			for _, k := range keys {
+				conn.WriteArray(2)
+				conn.WriteBulk(k.key)
+				conn.WriteInt(k.size)
+			}
+			return nil, nil
+		},
+	)
+}
+
+// cmdHotkeys handles "HOTKEYS [COUNT count]" and "HOTKEYS RESET". The
+// access counts are estimated from the sampled commands of every keyspace,
+// but only the keys in the keyspace of the client are returned.
+func (kvm *Machine) cmdHotkeys(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	count := 10
+	switch {
+	case len(cmd.Args) == 2 && strings.ToLower(string(cmd.Args[1])) == "reset":
+		kvm.hotkeys.reset()
+		conn.WriteString("OK")
+		return nil, nil
+	case len(cmd.Args) == 3 && strings.ToLower(string(cmd.Args[1])) == "count":
+		var err error
+		if count, err = parseCountArg(cmd.Args[2]); err != nil {
+			return nil, err
+		}
+	case len(cmd.Args) != 1:
+		return nil, errSyntaxError
+	}
+	if kvm.options().HotKeysSampling <= 0 {
+		return nil, errHotKeysDisabled
+	}
+	keys, counts := kvm.hotkeys.top(keyspaceOf(m), count)
+	conn.WriteArray(len(keys))
+	for i, key := range keys {
+		conn.WriteArray(2)
+		conn.WriteBulkString(key)
+		conn.WriteInt64(counts[i])
+	}
+	return nil, nil
+}
+
+// prefixStats are the number and the sizes of the keys with a prefix.
+type prefixStats struct {
+	count      int
+	keyBytes   int64
+	valueBytes int64
+	first      []byte
+	last       []byte
+	// sizes are the number of values in each power of two of the stored
+	// size, where sizes[i] counts the values of up to 1<<i bytes.
+	sizes []int
+	// cursor is the last key when the walk stopped at the limit, or nil
+	// when every key with the prefix was walked.
+	cursor []byte
+}
+
+// prefixStats walks the keys of a keyspace with a prefix, in order, starting
+// after the cursor when it's not nil, and stopping after limit keys when
+// it's positive. The keys are read from a point-in-time view of the
+// database, and the stored sizes of the values are counted.
+func (kvm *Machine) prefixStats(ks keyspace, prefix, cursor []byte, limit int) (*prefixStats, error) {
+	kvm.dbmu.RLock()
+	ss, err := kvm.db.GetSnapshot()
+	kvm.dbmu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer ss.Release()
+	ksPrefix := ks.prefix()
+	rng := util.BytesPrefix(ks.key(prefix))
+	if cursor != nil && bytes.Compare(ks.key(cursor), rng.Start) >= 0 {
+		rng.Start = append(ks.key(cursor), 0)
+	}
+	st := &prefixStats{}
+	iter := ss.NewIterator(rng, nil)
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if limit > 0 && st.count == limit {
+			st.cursor = append([]byte(nil), st.last...)
+			break
+		}
+		key := iter.Key()[len(ksPrefix):]
+		size := len(iter.Value())
+		if st.first == nil {
+			st.first = append([]byte(nil), key...)
+		}
+		st.last = append(st.last[:0], key...)
+		st.count++
+		st.keyBytes += int64(len(key))
+		st.valueBytes += int64(size)
+		i := 0
+		for 1<<uint(i) < size {
+			i++
+		}
+		for len(st.sizes) <= i {
+			st.sizes = append(st.sizes, 0)
+		}
+		st.sizes[i]++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// cmdPrefixstats handles "PREFIXSTATS prefix [CURSOR key] [LIMIT count]",
+// which walks the keys of the keyspace of the client that start with the
+// prefix. It returns their number, the bytes of the keys and of the stored
+// values, the first and the last key, and a histogram of the stored sizes,
+// as pairs of the power of two that the sizes are up to and the number of
+// values. With LIMIT, the walk stops after count keys, and the cursor is the
+// key to pass to CURSOR for the next keys, or null after the last key.
+func (kvm *Machine) cmdPrefixstats(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	prefix := cmd.Args[1]
+	var cursor []byte
+	var limit int
+	for i := 2; i < len(cmd.Args); i += 2 {
+		if i+1 == len(cmd.Args) {
+			return nil, errSyntaxError
+		}
+		switch strings.ToLower(string(cmd.Args[i])) {
+		default:
+			return nil, errSyntaxError
+		case "cursor":
+			cursor = cmd.Args[i+1]
+		case "limit":
+			var err error
+			if limit, err = parseCountArg(cmd.Args[i+1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ks := keyspaceOf(m)
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			st, err := kvm.prefixStats(ks, prefix, cursor, limit)
+			if err != nil {
+				return nil, err
+			}
+			writeMap(conn, 7)
+			conn.WriteBulkString("count")
+			conn.WriteInt(st.count)
+			conn.WriteBulkString("key_bytes")
+			conn.WriteInt64(st.keyBytes)
+			conn.WriteBulkString("value_bytes")
+			conn.WriteInt64(st.valueBytes)
+			for _, key := range []struct {
+				name string
+				key  []byte
+			}{{"first_key", st.first}, {"last_key", st.last}} {
+				conn.WriteBulkString(key.name)
+				if key.key == nil {
+					writeNull(conn)
+				} else {
+					conn.WriteBulk(key.key)
+				}
+			}
+			var buckets int
+			for _, n := range st.sizes {
+				if n > 0 {
+					buckets++
+				}
+			}
+			conn.WriteBulkString("sizes")
+			conn.WriteArray(buckets)
+			for i, n := range st.sizes {
+				if n > 0 {
+					conn.WriteArray(2)
+					conn.WriteInt64(1 << uint(i))
+					conn.WriteInt(n)
+				}
+			}
+			conn.WriteBulkString("cursor")
+			if st.cursor == nil {
+				writeNull(conn)
+			} else {
+				conn.WriteBulk(st.cursor)
+			}
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,5 @@
+// Package kvnodepb has the gRPC service and messages of the gRPC API of
+// kvnode, which is served with --grpc-addr.
+package kvnodepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kvnode.proto
@@ -0,0 +1,96 @@
+package kvnode
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tidwall/redcon"
+)
+
+// commandLane limits the commands of clients that run at once to
+// CommandWorkers. The other commands wait in the lane for a worker, so that
+// a storm of commands doesn't flood the node with running commands, while
+// the priority commands, which keep the node observable and manageable,
+// skip the lane.
+type commandLane struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running int
+	// waiting is the number of commands that wait for a worker. It's
+	// accessed atomically.
+	waiting int64
+}
+
+func newCommandLane() *commandLane {
+	l := &commandLane{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// enter waits until fewer than limit commands are running, where zero means
+// no limit, and reports whether the command had to wait. The limit is read
+// again after each wait, as it may be changed while commands wait.
+func (l *commandLane) enter(limit func() int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var waited bool
+	max := limit()
+	for max > 0 && l.running >= max {
+		if !waited {
+			waited = true
+			atomic.AddInt64(&l.waiting, 1)
+			defer atomic.AddInt64(&l.waiting, -1)
+		}
+		l.cond.Wait()
+		max = limit()
+	}
+	l.running++
+	if waited && (max == 0 || l.running < max) {
+		// the limit was raised, so the next command may run too.
+		l.cond.Signal()
+	}
+	return waited
+}
+
+// leave makes room for the next command that waits.
+func (l *commandLane) leave() {
+	l.mu.Lock()
+	l.running--
+	l.mu.Unlock()
+	l.cond.Signal()
+}
+
+// priorityCommand returns true if the command, or its subcommand, is a
+// priority command, which skips the command lane.
+func priorityCommand(cmd redcon.Command) bool {
+	if len(cmd.Args) == 0 {
+		return false
+	}
+	name := strings.ToLower(string(cmd.Args[0]))
+	if commands[name].priority {
+		return true
+	}
+	if len(cmd.Args) > 1 {
+		return commands[name+"|"+strings.ToLower(string(cmd.Args[1]))].priority
+	}
+	return false
+}
+
+// enterLane waits for a worker of the command lane, unless the command is a
+// priority command. The returned func must be called when the command is
+// done.
+func (kvm *Machine) enterLane(cmd redcon.Command) func() {
+	if priorityCommand(cmd) {
+		atomic.AddInt64(&kvm.stats.priority, 1)
+		return func() {}
+	}
+	if kvm.lane.enter(kvm.commandWorkers) {
+		atomic.AddInt64(&kvm.stats.queued, 1)
+	}
+	return kvm.lane.leave
+}
+
+func (kvm *Machine) commandWorkers() int {
+	return kvm.options().CommandWorkers
+}
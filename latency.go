@@ -0,0 +1,395 @@
+package kvnode
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// latencyBuckets is the number of buckets in a latency histogram. Bucket 0
+// holds latencies below one microsecond, and bucket i holds latencies below
+// 2^(i/4) microseconds.
+const latencyBuckets = 128
+
+// latencyHistoryLen is the number of samples kept by LATENCY HISTORY, which
+// is one per second, as with Redis.
+const latencyHistoryLen = 160
+
+// The phases of a command that are tracked separately. The total is the time
+// from receiving a command until its reply is written. The proposal is the
+// time to pass the raft level guard for reads, and to commit and apply the
+// command for writes. The storage is the time to read from, or write to,
+// the database.
+const (
+	phaseTotal = iota
+	phaseProposal
+	phaseStorage
+	numPhases
+)
+
+var phaseNames = [numPhases]string{"total", "proposal", "storage"}
+
+// histogram is a latency histogram. It's updated atomically.
+type histogram struct {
+	counts [latencyBuckets]int64
+	calls  int64
+	max    int64 // microseconds
+}
+
+func latencyBucket(usec int64) int {
+	if usec < 1 {
+		return 0
+	}
+	i := int(math.Log2(float64(usec))*4) + 1
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	return i
+}
+
+// bucketLimit returns the upper bound of a bucket in microseconds.
+func bucketLimit(i int) float64 {
+	return math.Pow(2, float64(i)/4)
+}
+
+func (h *histogram) add(d time.Duration) {
+	usec := int64(d / time.Microsecond)
+	atomic.AddInt64(&h.counts[latencyBucket(usec)], 1)
+	atomic.AddInt64(&h.calls, 1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if usec <= max || atomic.CompareAndSwapInt64(&h.max, max, usec) {
+			break
+		}
+	}
+}
+
+// percentile returns the latency in microseconds that p percent of the
+// calls are below. It's the upper bound of the bucket that holds the
+// percentile, but never more than the max latency.
+func (h *histogram) percentile(p float64) float64 {
+	calls := atomic.LoadInt64(&h.calls)
+	if calls == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(float64(calls) * p / 100))
+	var n int64
+	for i := 0; i < latencyBuckets; i++ {
+		n += atomic.LoadInt64(&h.counts[i])
+		if n >= rank {
+			return math.Min(bucketLimit(i), float64(atomic.LoadInt64(&h.max)))
+		}
+	}
+	return float64(atomic.LoadInt64(&h.max))
+}
+
+// latencySample is the highest latency of a command during a second.
+type latencySample struct {
+	time int64 // unix seconds
+	ms   int64
+}
+
+// commandLatency is the latency of a single command.
+type commandLatency struct {
+	phases [numPhases]histogram
+
+	// hmu guards the history, which is a ring of samples.
+	hmu     sync.Mutex
+	history [latencyHistoryLen]latencySample
+	hlen    int
+	hpos    int // the position of the next sample
+	latest  latencySample
+	maxMS   int64
+}
+
+func (cl *commandLatency) addHistory(now time.Time, d time.Duration) {
+	ms := int64(d / time.Millisecond)
+	sec := now.Unix()
+	cl.hmu.Lock()
+	defer cl.hmu.Unlock()
+	cl.latest = latencySample{sec, ms}
+	if ms > cl.maxMS {
+		cl.maxMS = ms
+	}
+	if cl.hlen > 0 {
+		last := &cl.history[(cl.hpos+latencyHistoryLen-1)%latencyHistoryLen]
+		if last.time == sec {
+			if ms > last.ms {
+				last.ms = ms
+			}
+			return
+		}
+	}
+	cl.history[cl.hpos] = latencySample{sec, ms}
+	cl.hpos = (cl.hpos + 1) % latencyHistoryLen
+	if cl.hlen < latencyHistoryLen {
+		cl.hlen++
+	}
+}
+
+// samples returns the history from the oldest to the newest sample.
+func (cl *commandLatency) samples() []latencySample {
+	cl.hmu.Lock()
+	defer cl.hmu.Unlock()
+	samples := make([]latencySample, 0, cl.hlen)
+	for i := 0; i < cl.hlen; i++ {
+		samples = append(samples,
+			cl.history[(cl.hpos-cl.hlen+i+latencyHistoryLen)%latencyHistoryLen])
+	}
+	return samples
+}
+
+// latencyTracker tracks the latency of every command.
+type latencyTracker struct {
+	mu       sync.RWMutex
+	commands map[string]*commandLatency
+	// observe, when set, is called with every duration that's recorded.
+	observe func(name string, phase int, d time.Duration)
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{commands: make(map[string]*commandLatency)}
+}
+
+// get returns the latency of a command, or nil if it's not a known command.
+func (t *latencyTracker) get(name string) *commandLatency {
+	t.mu.RLock()
+	cl := t.commands[name]
+	t.mu.RUnlock()
+	if cl != nil {
+		return cl
+	}
+	if _, ok := commands[name]; !ok {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cl = t.commands[name]; cl == nil {
+		cl = &commandLatency{}
+		t.commands[name] = cl
+	}
+	return cl
+}
+
+// record adds the duration of a phase of the command.
+func (t *latencyTracker) record(name string, phase int, d time.Duration) {
+	cl := t.get(name)
+	if cl == nil {
+		return
+	}
+	cl.phases[phase].add(d)
+	if t.observe != nil {
+		t.observe(name, phase, d)
+	}
+	if phase == phaseTotal {
+		cl.addHistory(time.Now(), d)
+	}
+}
+
+// lookup returns the latency of the commands, or of all commands that have
+// been called when names is empty, ordered by name.
+func (t *latencyTracker) lookup(names []string) ([]string, []*commandLatency) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(names) == 0 {
+		for name := range t.commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var found []string
+	var cls []*commandLatency
+	for _, name := range names {
+		if cl := t.commands[name]; cl != nil {
+			found = append(found, name)
+			cls = append(cls, cl)
+		}
+	}
+	return found, cls
+}
+
+// reset clears the latency of the commands, or of all commands when names is
+// empty, and returns the number of commands that were cleared.
+func (t *latencyTracker) reset(names []string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(names) == 0 {
+		n := len(t.commands)
+		t.commands = make(map[string]*commandLatency)
+		return n
+	}
+	var n int
+	for _, name := range names {
+		if _, ok := t.commands[name]; ok {
+			delete(t.commands, name)
+			n++
+		}
+	}
+	return n
+}
+
+// latencyApplier records the proposal and storage latency of the commands
+// that pass through it.
+type latencyApplier struct {
+	finn.Applier
+	tracker *latencyTracker
+	name    string
+}
+
+func (m latencyApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	start := time.Now()
+	read := mutate == nil
+	if !read {
+		// mutate runs when the command is applied, which may be on
+		// another call to the machine.
+		fn := mutate
+		mutate = func() (interface{}, error) {
+			start := time.Now()
+			v, err := fn()
+			m.tracker.record(m.name, phaseStorage, time.Since(start))
+			return v, err
+		}
+	}
+	return m.Applier.Apply(conn, cmd, mutate,
+		func(v interface{}) (interface{}, error) {
+			rstart := time.Now()
+			m.tracker.record(m.name, phaseProposal, rstart.Sub(start))
+			v, err := respond(v)
+			if read {
+				m.tracker.record(m.name, phaseStorage, time.Since(rstart))
+			}
+			return v, err
+		},
+	)
+}
+
+// latencyNames returns the lowercase command names of the arguments.
+func latencyNames(args [][]byte) []string {
+	var names []string
+	for _, arg := range args {
+		names = append(names, strings.ToLower(string(arg)))
+	}
+	return names
+}
+
+// cmdLatency handles the LATENCY subcommands:
+//
+//	LATENCY LATEST
+//	LATENCY HISTORY command
+//	LATENCY RESET [command ...]
+//	LATENCY HISTOGRAM [command ...]
+//	LATENCY PERCENTILES [command ...]
+func (kvm *Machine) cmdLatency(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errors.New("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	case "latest":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		names, cls := kvm.latency.lookup(nil)
+		conn.WriteArray(len(names))
+		for i, cl := range cls {
+			cl.hmu.Lock()
+			latest, max := cl.latest, cl.maxMS
+			cl.hmu.Unlock()
+			conn.WriteArray(4)
+			conn.WriteBulkString(names[i])
+			conn.WriteInt64(latest.time)
+			conn.WriteInt64(latest.ms)
+			conn.WriteInt64(max)
+		}
+	case "history":
+		if len(cmd.Args) != 3 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		_, cls := kvm.latency.lookup(latencyNames(cmd.Args[2:]))
+		if len(cls) == 0 {
+			conn.WriteArray(0)
+			break
+		}
+		samples := cls[0].samples()
+		conn.WriteArray(len(samples))
+		for _, s := range samples {
+			conn.WriteArray(2)
+			conn.WriteInt64(s.time)
+			conn.WriteInt64(s.ms)
+		}
+	case "reset":
+		conn.WriteInt(kvm.latency.reset(latencyNames(cmd.Args[2:])))
+	case "histogram":
+		names, cls := kvm.latency.lookup(latencyNames(cmd.Args[2:]))
+		writeMap(conn, len(names))
+		for i, cl := range cls {
+			conn.WriteBulkString(names[i])
+			writeHistogram(conn, &cl.phases[phaseTotal])
+		}
+	case "percentiles":
+		names, cls := kvm.latency.lookup(latencyNames(cmd.Args[2:]))
+		writeMap(conn, len(names))
+		for i, cl := range cls {
+			conn.WriteBulkString(names[i])
+			writeMap(conn, numPhases)
+			for phase := 0; phase < numPhases; phase++ {
+				h := &cl.phases[phase]
+				conn.WriteBulkString(phaseNames[phase])
+				writeMap(conn, 5)
+				conn.WriteBulkString("calls")
+				conn.WriteInt64(atomic.LoadInt64(&h.calls))
+				conn.WriteBulkString("p50")
+				writeDouble(conn, h.percentile(50), 3)
+				conn.WriteBulkString("p95")
+				writeDouble(conn, h.percentile(95), 3)
+				conn.WriteBulkString("p99")
+				writeDouble(conn, h.percentile(99), 3)
+				conn.WriteBulkString("max")
+				conn.WriteInt64(atomic.LoadInt64(&h.max))
+			}
+		}
+	}
+	return nil, nil
+}
+
+// writeHistogram writes the histogram in the LATENCY HISTOGRAM format, which
+// has the cumulative number of calls for power of two buckets.
+func writeHistogram(conn redcon.Conn, h *histogram) {
+	calls := atomic.LoadInt64(&h.calls)
+	var buckets [][2]int64
+	var n, last int64
+	for i := 0; i < latencyBuckets && last < calls; i++ {
+		n += atomic.LoadInt64(&h.counts[i])
+		if i%4 == 0 && n > last {
+			buckets = append(buckets, [2]int64{int64(bucketLimit(i)), n})
+			last = n
+		}
+	}
+	writeMap(conn, 2)
+	conn.WriteBulkString("calls")
+	conn.WriteInt64(calls)
+	conn.WriteBulkString("histogram_usec")
+	writeMap(conn, len(buckets))
+	for _, b := range buckets {
+		conn.WriteInt64(b[0])
+		conn.WriteInt64(b[1])
+	}
+}
+
+// formatUsec formats a latency in microseconds as in the Redis latencystats.
+func formatUsec(usec float64) string {
+	return strconv.FormatFloat(usec, 'f', 3, 64)
+}
@@ -0,0 +1,51 @@
+package kvnode
+
+// writeValues returns the values that a write command stores.
+func writeValues(name string, args [][]byte) [][]byte {
+	switch name {
+	case "set":
+		if len(args) > 2 {
+			return args[2:3]
+		}
+	case "mset":
+		var values [][]byte
+		for i := 2; i < len(args); i += 2 {
+			values = append(values, args[i])
+		}
+		return values
+	case "msetif":
+		return msetifValues(args)
+	case "mappend":
+		return mappendValues(args)
+	}
+	return nil
+}
+
+// checkSizes refuses writes with keys longer than MaxKeySize or values
+// larger than MaxValueSize, before they're proposed to the raft log.
+func (kvm *Machine) checkSizes(name string, args [][]byte) error {
+	info, ok := commands[name]
+	if !ok || !info.hasCategory("write") {
+		return nil
+	}
+	opts := kvm.options()
+	if max := opts.MaxKeySize; max > 0 {
+		for _, key := range commandKeys(info, args) {
+			if len(key) > max {
+				return sizeError("key", len(key), max)
+			}
+		}
+	}
+	if max := opts.MaxValueSize; max > 0 {
+		for _, value := range writeValues(name, args) {
+			if len(value) > max {
+				return sizeError("value", len(value), max)
+			}
+		}
+	}
+	return nil
+}
+
+func sizeError(what string, size, max int) error {
+	return &TooLargeError{What: what, Size: size, Limit: max}
+}
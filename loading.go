@@ -0,0 +1,121 @@
+package kvnode
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// loadingLogInterval is how often the progress of the startup recovery is
+// logged.
+const loadingLogInterval = time.Second * 5
+
+var errLoading = errors.New("LOADING kvnode is loading the dataset")
+
+// loadingState is the progress of the startup recovery, while the node
+// restores its snapshot and applies its raft log. Its fields are accessed
+// atomically.
+type loadingState struct {
+	// active is 1 while the node is loading.
+	active int32
+	// start is the time that loading started, in nanoseconds.
+	start int64
+	// applied and total are the raft entries that were applied, and that
+	// must be applied for the node to be caught up.
+	applied, total uint64
+	// eta is the estimated seconds left, or -1 when it's not known yet.
+	eta int64
+}
+
+// isLoading returns true while the node is recovering at startup.
+func (kvm *Machine) isLoading() bool {
+	return atomic.LoadInt32(&kvm.loading.active) == 1
+}
+
+// checkLoading refuses the commands that aren't allowed while the node is
+// loading, since their replies would be stale or missing keys.
+func (kvm *Machine) checkLoading(name string) error {
+	if kvm.isLoading() && !commands[name].hasFlag("loading") {
+		return errLoading
+	}
+	return nil
+}
+
+// beginLoading marks the node as loading, before the snapshot is restored
+// and the raft log is replayed.
+func (kvm *Machine) beginLoading() {
+	atomic.StoreInt64(&kvm.loading.start, time.Now().UnixNano())
+	atomic.StoreInt64(&kvm.loading.eta, -1)
+	atomic.StoreInt32(&kvm.loading.active, 1)
+}
+
+// watchLoading follows the raft log replay and clears the loading state
+// once the node has applied every entry of its log at startup and, when a
+// leader is known, every entry that the leader had committed, logging the
+// progress until then.
+func (kvm *Machine) watchLoading() {
+	start := time.Unix(0, atomic.LoadInt64(&kvm.loading.start))
+	var first, total uint64
+	var known, leaderKnown bool
+	lastLog := time.Now()
+	for ; ; time.Sleep(time.Millisecond * 100) {
+		select {
+		case <-kvm.done:
+			return
+		default:
+		}
+		stats, leader, err := kvm.raftInfo()
+		if err != nil {
+			continue
+		}
+		applied := statUint(stats, "applied_index")
+		if !known {
+			first = applied
+			total = statUint(stats, "last_log_index")
+			known = true
+		}
+		if leader != "" && !leaderKnown {
+			if commit := statUint(stats, "commit_index"); commit > total {
+				total = commit
+			}
+			leaderKnown = true
+		}
+		atomic.StoreUint64(&kvm.loading.applied, applied)
+		atomic.StoreUint64(&kvm.loading.total, total)
+		if applied >= total {
+			break
+		}
+		eta := int64(-1)
+		if elapsed := time.Since(start); applied > first {
+			eta = int64(elapsed.Seconds() * float64(total-applied) /
+				float64(applied-first))
+		}
+		atomic.StoreInt64(&kvm.loading.eta, eta)
+		if time.Since(lastLog) >= loadingLogInterval {
+			lastLog = time.Now()
+			log.Noticef("loading: applied %d of %d raft entries (%s%%), eta %s",
+				applied, total, loadingPercent(applied, total), etaString(eta))
+		}
+	}
+	atomic.StoreInt64(&kvm.loading.eta, 0)
+	atomic.StoreInt32(&kvm.loading.active, 0)
+	log.Noticef("loading: done in %s, applied %d raft entries",
+		time.Since(start).Round(time.Millisecond), atomic.LoadUint64(&kvm.loading.applied))
+}
+
+// loadingPercent returns the applied entries as a percentage of the total.
+func loadingPercent(applied, total uint64) string {
+	if total == 0 {
+		return "100.00"
+	}
+	return strconv.FormatFloat(float64(applied)*100/float64(total), 'f', 2, 64)
+}
+
+// etaString returns the estimated seconds left as a duration, or "unknown".
+func etaString(eta int64) string {
+	if eta < 0 {
+		return "unknown"
+	}
+	return (time.Duration(eta) * time.Second).String()
+}
@@ -0,0 +1,209 @@
+package kvnode
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/raft"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/raft-redcon"
+	"github.com/tidwall/redcon"
+)
+
+var errNotReady = errors.New("node is not ready")
+
+// setApplier stores the applier that the node passes to Command. It's the
+// only way for the machine to propose commands to the raft log.
+func (kvm *Machine) setApplier(m finn.Applier) {
+	if v := kvm.applier.Load(); v == nil || v.(applierBox).Applier == nil {
+		kvm.applier.Store(applierBox{m})
+	}
+}
+
+// resetApplier forgets the applier, when the node is reopened.
+func (kvm *Machine) resetApplier() {
+	kvm.applier.Store(applierBox{})
+}
+
+// applierBox allows for storing an interface in an atomic.Value.
+type applierBox struct {
+	finn.Applier
+}
+
+// getApplier returns the applier for the node. The applier is not known
+// until the node has processed a command, in which case a command is sent
+// to the node.
+func (kvm *Machine) getApplier() (finn.Applier, error) {
+	if v := kvm.applier.Load(); v != nil && v.(applierBox).Applier != nil {
+		return v.(applierBox).Applier, nil
+	}
+	raftredcon.Do(kvm.addr, nil, []byte("echo"), nil)
+	if v := kvm.applier.Load(); v != nil && v.(applierBox).Applier != nil {
+		return v.(applierBox).Applier, nil
+	}
+	return nil, errNotReady
+}
+
+// exec runs a command in-process. Writes are proposed to the raft log by the
+// node, with the appliers of the writes of clients, and the reply is
+// returned.
+func (kvm *Machine) exec(args ...[]byte) (interface{}, error) {
+	m, err := kvm.getApplier()
+	if err != nil {
+		return nil, err
+	}
+	m = kvm.sealEntries(m)
+	// the limits of the writes of clients apply to the writes in-process.
+	name := strings.ToLower(string(args[0]))
+	if err := kvm.checkSizes(name, args); err != nil {
+		return nil, err
+	}
+	if err := kvm.checkDisk(name); err != nil {
+		return nil, err
+	}
+	if err := kvm.checkCapacity(name); err != nil {
+		return nil, err
+	}
+	cmd, err := redcon.Parse(buildCommand(args...))
+	if err != nil {
+		return nil, err
+	}
+	conn := &localConn{}
+	if _, err := kvm.command(m, conn, cmd); err != nil {
+		if err.Error() == raft.ErrNotLeader.Error() {
+			return nil, kvm.notLeader()
+		}
+		return nil, err
+	}
+	if len(conn.replies) == 0 {
+		return nil, nil
+	}
+	if err, ok := conn.replies[0].(error); ok {
+		return nil, err
+	}
+	return conn.replies[0], nil
+}
+
+// buildCommand returns the RESP encoding of a command.
+func buildCommand(args ...[]byte) []byte {
+	buf := []byte{'*'}
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// Get returns the value for a key, or ErrNotFound. The value is read from
+// the local store, which may be stale on a follower.
+func (kvm *Machine) Get(key []byte) ([]byte, error) {
+	buf := getKeyBuf()
+	defer putKeyBuf(buf)
+	*buf = keyspace{}.appendKey(*buf, key)
+	kvm.dbmu.RLock()
+	defer kvm.dbmu.RUnlock()
+	value, err := kvm.db.Get(*buf, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return kvm.loadValue(*buf, value)
+}
+
+// Set sets the value for a key. The write is proposed to the raft log, and
+// must happen on the leader.
+func (kvm *Machine) Set(key, value []byte) error {
+	_, err := kvm.exec([]byte("set"), key, value)
+	return err
+}
+
+// Delete deletes the keys and returns the number of keys that existed. The
+// write is proposed to the raft log, and must happen on the leader.
+func (kvm *Machine) Delete(keys ...[]byte) (int, error) {
+	args := append([][]byte{[]byte("del")}, keys...)
+	v, err := kvm.exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := v.(int)
+	return n, nil
+}
+
+// Range iterates over the keys that match the pattern, in order. When pivot
+// is not nil, iteration starts after the pivot. The limit is the maximum
+// number of keys, where zero means no limit. Return false from iter to stop.
+// The keys are read from the local store, which may be stale on a follower.
+func (kvm *Machine) Range(pattern string, pivot []byte, limit int, desc bool,
+	iter func(key, value []byte) bool,
+) error {
+	if limit <= 0 {
+		limit = -1
+	}
+	kvm.dbmu.RLock()
+	keys, values, err := kvm.scan([]byte(pattern), scanOptions{
+		pivot:      pivot,
+		usingPivot: pivot != nil,
+		desc:       desc,
+		limit:      limit,
+		withValues: true,
+		load:       kvm.scanValue,
+	})
+	kvm.dbmu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		if !iter(keys[i], values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// localConn is a redcon.Conn that records the replies of an in-process
+// command.
+type localConn struct {
+	mu      sync.Mutex
+	replies []interface{}
+	ctx     interface{}
+}
+
+func (c *localConn) reply(v interface{}) {
+	c.mu.Lock()
+	c.replies = append(c.replies, v)
+	c.mu.Unlock()
+}
+
+func (c *localConn) RemoteAddr() string          { return "local" }
+func (c *localConn) Close() error                { return nil }
+func (c *localConn) WriteError(msg string)       { c.reply(errors.New(msg)) }
+func (c *localConn) WriteString(str string)      { c.reply(str) }
+func (c *localConn) WriteBulk(bulk []byte)       { c.reply(bcopy(bulk)) }
+func (c *localConn) WriteBulkString(bulk string) { c.reply([]byte(bulk)) }
+func (c *localConn) WriteInt(num int)            { c.reply(num) }
+func (c *localConn) WriteInt64(num int64)        { c.reply(int(num)) }
+func (c *localConn) WriteArray(count int)        { c.reply(count) }
+func (c *localConn) WriteNull()                  { c.reply(nil) }
+func (c *localConn) WriteRaw(data []byte)        { c.reply(bcopy(data)) }
+func (c *localConn) Context() interface{}        { return c.ctx }
+func (c *localConn) SetContext(v interface{})    { c.ctx = v }
+func (c *localConn) SetReadBuffer(bytes int)     {}
+func (c *localConn) Detach() redcon.DetachedConn { return nil }
+func (c *localConn) ReadPipeline() []redcon.Command {
+	return nil
+}
+func (c *localConn) PeekPipeline() []redcon.Command {
+	return nil
+}
+func (c *localConn) NetConn() net.Conn { return nil }
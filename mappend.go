@@ -0,0 +1,101 @@
+package kvnode
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// mappendValues returns the suffixes of "MAPPEND key suffix [key suffix ...]".
+func mappendValues(args [][]byte) [][]byte {
+	var values [][]byte
+	for i := 2; i < len(args); i += 2 {
+		values = append(values, args[i])
+	}
+	return values
+}
+
+// cmdMappend handles "MAPPEND key suffix [key suffix ...]", which appends
+// the suffixes to the values of the keys in a single raft entry, where a
+// missing key is set to its suffix. A key may be given more than once, and
+// its suffixes are appended in order. It replies with the length of each
+// value after its append.
+func (kvm *Machine) cmdMappend(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 3 || (len(cmd.Args)-1)%2 == 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	ks := keyspaceOf(m)
+	if conn != nil {
+		var keys [][]byte
+		for i := 1; i < len(cmd.Args); i += 2 {
+			keys = append(keys, cmd.Args[i])
+		}
+		kvm.warmKeys(ks, keys)
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			buf := getKeyBuf()
+			defer putKeyBuf(buf)
+			keys := ks.appendKeys(buf, cmd.Args[1:], 2)
+			defer kvm.lockKeys(ks, keys)()
+			// values are the values of the keys after the appends so far,
+			// and last is the index of the last append of each key, which
+			// is the one that's written.
+			values := make(map[string][]byte, len(keys))
+			last := make(map[string]int, len(keys))
+			lens := make([]int, len(keys))
+			for i, key := range keys {
+				value, ok := values[string(key)]
+				if !ok {
+					stored, err := kvm.db.Get(key, nil)
+					if err == nil {
+						value, err = decodeValue(stored)
+					} else if err == leveldb.ErrNotFound {
+						err = nil
+					}
+					if err != nil {
+						return nil, err
+					}
+				}
+				value = append(value[:len(value):len(value)], cmd.Args[i*2+2]...)
+				values[string(key)] = value
+				last[string(key)] = i
+				lens[i] = len(value)
+			}
+			threshold := kvm.options().CompressionThreshold
+			var batch leveldb.Batch
+			pending := make(map[string]*keyMeta)
+			for i, key := range keys {
+				if last[string(key)] != i {
+					continue
+				}
+				meta, err := kvm.nextMeta(key, pending)
+				if err != nil {
+					return nil, err
+				}
+				batch.Put(key, encodeValue(values[string(key)], threshold, kvm.applyStamp, meta))
+			}
+			if err := kvm.writeBatch(ks, &batch); err != nil {
+				return nil, err
+			}
+			for i, key := range keys {
+				if last[string(key)] == i {
+					kvm.watches.publish(ks, kvm.applyStamp, "set", cmd.Args[i*2+1], values[string(key)])
+				}
+			}
+			return lens, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			lens, ok := v.([]int)
+			if !ok {
+				// a retry of a request whose result wasn't stored.
+				return nil, errBadResult
+			}
+			conn.WriteArray(len(lens))
+			for _, n := range lens {
+				conn.WriteInt(n)
+			}
+			return nil, nil
+		},
+	)
+}
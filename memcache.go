@@ -0,0 +1,571 @@
+package kvnode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// memcacheMaxLine is the longest command line, which leaves room for
+	// many keys of a get.
+	memcacheMaxLine = 64 * 1024
+	// memcacheMaxKey is the longest key that memcached accepts.
+	memcacheMaxKey = 250
+	// memcacheRetries is how many times a read-modify-write command, such
+	// as incr, is retried when the key changes concurrently.
+	memcacheRetries = 10
+)
+
+var (
+	errMemcacheFormat  = errors.New("CLIENT_ERROR bad command line format")
+	errMemcacheChunk   = errors.New("CLIENT_ERROR bad data chunk")
+	errMemcacheFlags   = errors.New("CLIENT_ERROR flags are not supported")
+	errMemcacheExpire  = errors.New("CLIENT_ERROR expiration is not supported")
+	errMemcacheNumber  = errors.New("CLIENT_ERROR cannot increment or decrement non-numeric value")
+	errMemcacheDelta   = errors.New("CLIENT_ERROR invalid numeric delta argument")
+	errMemcacheTooBig  = errors.New("SERVER_ERROR object too large for cache")
+	errMemcacheContend = errors.New("SERVER_ERROR the key is changing too often")
+)
+
+// memcacheGateway serves the memcached text protocol. Each connection has a
+// connection to the node, which its commands are translated into, and which
+// follows the "TRY" and "READONLY" replies to the leader like the HTTP
+// gateway.
+type memcacheGateway struct {
+	ln   net.Listener
+	addr string
+	m    *Machine
+}
+
+// listenMemcache binds the memcached listener and starts serving in the
+// background. The addr param is the node address that commands are sent to.
+func listenMemcache(laddr, addr string, m *Machine) (*memcacheGateway, error) {
+	ln, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	g := &memcacheGateway{ln: ln, addr: addr, m: m}
+	go g.serve()
+	return g, nil
+}
+
+// Close stops the memcached listener from accepting new connections.
+func (g *memcacheGateway) Close() error {
+	return g.ln.Close()
+}
+
+func (g *memcacheGateway) serve() {
+	for {
+		conn, err := g.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(time.Millisecond * 10)
+				continue
+			}
+			return
+		}
+		go g.handle(conn)
+	}
+}
+
+// memcacheConn is a memcached client connection.
+type memcacheConn struct {
+	g    *memcacheGateway
+	conn net.Conn
+	rd   *bufio.Reader
+	wr   *bufio.Writer
+	// up is the connection to the node at upaddr, which is the local node
+	// until a command is redirected to the leader.
+	up     redis.Conn
+	upaddr string
+	// relayKey is the address that the node sees the connection to the
+	// local node from, which is registered as a relay.
+	relayKey string
+}
+
+func (g *memcacheGateway) handle(conn net.Conn) {
+	defer conn.Close()
+	raddr := conn.RemoteAddr().String()
+	if !g.m.ipAllowed(raddr, conn.LocalAddr().String()) {
+		atomic.AddInt64(&g.m.stats.rejected, 1)
+		conn.Write([]byte("SERVER_ERROR address not allowed\r\n"))
+		log.Warningf("address not allowed, rejected %s", raddr)
+		return
+	}
+	// the protocol has no passwords, so protected mode applies whenever
+	// the listener binds all interfaces.
+	if g.m.options().ProtectedMode && isWildcardAddr(g.ln.Addr().String()) &&
+		!isLoopbackAddr(raddr) {
+		atomic.AddInt64(&g.m.stats.rejected, 1)
+		conn.Write([]byte("SERVER_ERROR protected mode, bind a specific interface with --memcache-addr\r\n"))
+		log.Warningf("protected mode, rejected %s", raddr)
+		return
+	}
+	// the connections to the node come from the local host, so the client
+	// is counted towards MaxClients here.
+	if !g.m.admitClient() {
+		atomic.AddInt64(&g.m.stats.rejected, 1)
+		conn.Write([]byte("SERVER_ERROR max number of clients reached\r\n"))
+		log.Warningf("max number of clients reached, rejected %s", raddr)
+		return
+	}
+	defer g.m.releaseClient()
+	c := &memcacheConn{
+		g:      g,
+		conn:   conn,
+		rd:     bufio.NewReaderSize(conn, memcacheMaxLine),
+		wr:     bufio.NewWriter(conn),
+		upaddr: g.addr,
+	}
+	defer c.closeUp()
+	for {
+		line, err := c.rd.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			c.wr.WriteString("CLIENT_ERROR line is too long\r\n")
+			c.wr.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		args := strings.Fields(string(line))
+		if len(args) == 0 {
+			c.wr.WriteString("ERROR\r\n")
+		} else if !c.command(args) {
+			c.wr.Flush()
+			return
+		}
+		if c.rd.Buffered() == 0 {
+			if c.wr.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// dialUp connects to the node at upaddr, and authenticates with the
+// password of the default user when there is one.
+func (c *memcacheConn) dialUp() error {
+	nc, err := net.DialTimeout("tcp", c.upaddr, gatewayTimeout)
+	if err != nil {
+		return err
+	}
+	if c.upaddr == c.g.addr {
+		c.relayKey = nc.LocalAddr().String()
+		c.g.m.setRelay(c.relayKey, &relayInfo{remoteAddr: c.conn.RemoteAddr().String()})
+	}
+	c.up = redis.NewConn(nc, gatewayTimeout, gatewayTimeout)
+	if pass := c.g.m.options().Password; pass != "" {
+		if _, err := c.up.Do("AUTH", pass); err != nil {
+			c.closeUp()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *memcacheConn) closeUp() {
+	if c.up != nil {
+		c.up.Close()
+		c.up = nil
+	}
+	if c.relayKey != "" {
+		c.g.m.setRelay(c.relayKey, nil)
+		c.relayKey = ""
+	}
+}
+
+// do executes a command on the node. A "TRY" or "READONLY" reply is
+// followed to the leader, which the connection then stays with.
+func (c *memcacheConn) do(cmd string, args ...interface{}) (interface{}, error) {
+	for i := 0; ; i++ {
+		if c.up == nil {
+			if err := c.dialUp(); err != nil {
+				c.upaddr = c.g.addr
+				return nil, err
+			}
+		}
+		reply, err := c.up.Do(cmd, args...)
+		if err != nil && i < gatewayMaxTries {
+			if leader, ok := redirect(err); ok {
+				c.closeUp()
+				c.upaddr = leader
+				continue
+			}
+		}
+		if _, ok := err.(redis.Error); err != nil && !ok {
+			// the connection is broken, start over with the local node.
+			c.closeUp()
+			c.upaddr = c.g.addr
+		}
+		return reply, err
+	}
+}
+
+// reply writes a reply line, unless the client asked for none.
+func (c *memcacheConn) reply(noreply bool, line string) {
+	if !noreply {
+		c.wr.WriteString(line + "\r\n")
+	}
+}
+
+// replyErr writes the reply for an error, which is a server error when it
+// came from the node.
+func (c *memcacheConn) replyErr(noreply bool, err error) {
+	msg := strings.Replace(err.Error(), "\r\n", " ", -1)
+	if !strings.HasPrefix(msg, "CLIENT_ERROR") && !strings.HasPrefix(msg, "SERVER_ERROR") {
+		msg = "SERVER_ERROR " + msg
+	}
+	c.reply(noreply, msg)
+}
+
+// validKey returns true for the keys that memcached accepts, which have no
+// control characters.
+func validKey(key string) bool {
+	if len(key) > memcacheMaxKey {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// command executes a command, and returns false when the connection is to
+// be closed.
+func (c *memcacheConn) command(args []string) bool {
+	noreply := len(args) > 1 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	switch args[0] {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		// the key is checked after the data block was read.
+		return c.store(args, noreply)
+	}
+	for _, key := range args[1:] {
+		if !validKey(key) {
+			c.replyErr(noreply, errMemcacheFormat)
+			return true
+		}
+	}
+	switch args[0] {
+	default:
+		c.wr.WriteString("ERROR\r\n")
+	case "get", "gets":
+		c.get(args[1:], args[0] == "gets")
+	case "delete":
+		if len(args) != 2 && (len(args) != 3 || args[2] != "0") {
+			c.replyErr(noreply, errMemcacheFormat)
+			break
+		}
+		n, err := redis.Int(c.do("DEL", args[1]))
+		switch {
+		case err != nil:
+			c.replyErr(noreply, err)
+		case n == 0:
+			c.reply(noreply, "NOT_FOUND")
+		default:
+			c.reply(noreply, "DELETED")
+		}
+	case "incr", "decr":
+		c.incr(args, noreply)
+	case "touch":
+		if len(args) != 3 {
+			c.replyErr(noreply, errMemcacheFormat)
+			break
+		}
+		if args[2] != "0" {
+			c.replyErr(noreply, errMemcacheExpire)
+			break
+		}
+		reply, err := c.do("GETVER", args[1])
+		switch {
+		case err != nil:
+			c.replyErr(noreply, err)
+		case reply == nil:
+			c.reply(noreply, "NOT_FOUND")
+		default:
+			c.reply(noreply, "TOUCHED")
+		}
+	case "flush_all":
+		if len(args) > 2 || (len(args) == 2 && args[1] != "0") {
+			c.replyErr(noreply, errMemcacheExpire)
+			break
+		}
+		if _, err := c.do("FLUSHDB"); err != nil {
+			c.replyErr(noreply, err)
+			break
+		}
+		c.reply(noreply, "OK")
+	case "version":
+		c.reply(false, "VERSION "+Version)
+	case "verbosity":
+		c.reply(noreply, "OK")
+	case "stats":
+		if len(args) > 1 {
+			c.wr.WriteString("ERROR\r\n")
+			break
+		}
+		now := time.Now()
+		c.reply(false, "STAT pid "+strconv.Itoa(os.Getpid()))
+		c.reply(false, "STAT uptime "+strconv.FormatInt(int64(now.Sub(c.g.m.started)/time.Second), 10))
+		c.reply(false, "STAT time "+strconv.FormatInt(now.Unix(), 10))
+		c.reply(false, "STAT version "+Version)
+		c.reply(false, "END")
+	case "quit":
+		return false
+	}
+	return true
+}
+
+// get handles "get key [key ...]" and "gets key [key ...]". The cas unique
+// of gets is the version of the key, which is read before and after the
+// value, so that it belongs to the value.
+func (c *memcacheConn) get(keys []string, cas bool) {
+	if len(keys) == 0 {
+		c.wr.WriteString("ERROR\r\n")
+		return
+	}
+	if !cas {
+		args := make([]interface{}, len(keys))
+		for i, key := range keys {
+			args[i] = key
+		}
+		values, err := redis.ByteSlices(c.do("MGET", args...))
+		if err != nil {
+			c.replyErr(false, err)
+			return
+		}
+		for i, value := range values {
+			if value != nil {
+				c.writeValue(keys[i], value, "")
+			}
+		}
+		c.wr.WriteString("END\r\n")
+		return
+	}
+	for _, key := range keys {
+		value, ver, err := c.getVersioned(key)
+		if err != nil {
+			c.replyErr(false, err)
+			return
+		}
+		if value != nil {
+			c.writeValue(key, value, " "+strconv.FormatUint(ver, 10))
+		}
+	}
+	c.wr.WriteString("END\r\n")
+}
+
+func (c *memcacheConn) writeValue(key string, value []byte, cas string) {
+	c.wr.WriteString("VALUE " + key + " 0 " + strconv.Itoa(len(value)) + cas + "\r\n")
+	c.wr.Write(value)
+	c.wr.WriteString("\r\n")
+}
+
+// getVersioned returns the value of a key and its version, or a nil value
+// when the key doesn't exist.
+func (c *memcacheConn) getVersioned(key string) ([]byte, uint64, error) {
+	for i := 0; i < memcacheRetries; i++ {
+		ver, err := redis.Uint64(c.do("GETVER", key))
+		if err == redis.ErrNil {
+			return nil, 0, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		value, err := redis.Bytes(c.do("GET", key))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		after, err := redis.Uint64(c.do("GETVER", key))
+		if err != nil && err != redis.ErrNil {
+			return nil, 0, err
+		}
+		if err == nil && after == ver {
+			return value, ver, nil
+		}
+	}
+	return nil, 0, errMemcacheContend
+}
+
+// setVersioned sets a key when its version matches, and returns false when
+// it doesn't.
+func (c *memcacheConn) setVersioned(key string, value []byte, ver uint64) (bool, error) {
+	reply, err := c.do("SET", key, value, "IFVERSION", ver)
+	return reply != nil, err
+}
+
+// store handles the storage commands, which are followed by a data block:
+//
+//	set|add|replace|append|prepend key flags exptime bytes [noreply]
+//	cas key flags exptime bytes cas-unique [noreply]
+//
+// The data block is read even when the command is refused, so that the
+// connection stays in step with the client.
+func (c *memcacheConn) store(args []string, noreply bool) bool {
+	n := 5
+	if args[0] == "cas" {
+		n = 6
+	}
+	if len(args) != n {
+		c.replyErr(noreply, errMemcacheFormat)
+		return true
+	}
+	size, err := strconv.ParseUint(args[4], 10, 31)
+	if err != nil {
+		c.replyErr(noreply, errMemcacheFormat)
+		return true
+	}
+	if max := c.g.m.options().MaxValueSize; max > 0 && size > uint64(max) {
+		if _, err := io.CopyN(ioutil.Discard, c.rd, int64(size)+2); err != nil {
+			return false
+		}
+		c.replyErr(noreply, errMemcacheTooBig)
+		return true
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.rd, data); err != nil {
+		return false
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		c.replyErr(noreply, errMemcacheChunk)
+		return false
+	}
+	value := data[:size]
+	key := args[1]
+	switch {
+	case !validKey(key):
+		c.replyErr(noreply, errMemcacheFormat)
+		return true
+	case args[2] != "0":
+		c.replyErr(noreply, errMemcacheFlags)
+		return true
+	case args[3] != "0":
+		c.replyErr(noreply, errMemcacheExpire)
+		return true
+	}
+	var stored bool
+	switch args[0] {
+	case "set":
+		_, err = c.do("SET", key, value)
+		stored = err == nil
+	case "add":
+		stored, err = c.setVersioned(key, value, 0)
+	case "cas":
+		unique, perr := strconv.ParseUint(args[5], 10, 64)
+		if perr != nil {
+			c.replyErr(noreply, errMemcacheFormat)
+			return true
+		}
+		reply, err := c.do("GETVER", key)
+		if err == nil && reply == nil {
+			c.reply(noreply, "NOT_FOUND")
+			return true
+		}
+		if err == nil {
+			stored, err = c.setVersioned(key, value, unique)
+		}
+		if err == nil && !stored {
+			c.reply(noreply, "EXISTS")
+			return true
+		}
+	default:
+		// replace, append and prepend only change a key that exists.
+		stored, err = c.update(key, func(old []byte) ([]byte, error) {
+			switch args[0] {
+			case "append":
+				return append(old, value...), nil
+			case "prepend":
+				return append(value, old...), nil
+			}
+			return value, nil
+		})
+	}
+	switch {
+	case err != nil:
+		c.replyErr(noreply, err)
+	case stored:
+		c.reply(noreply, "STORED")
+	default:
+		c.reply(noreply, "NOT_STORED")
+	}
+	return true
+}
+
+// update changes the value of a key that exists, and returns false when it
+// doesn't. It's retried when the key changes concurrently.
+func (c *memcacheConn) update(key string, fn func(old []byte) ([]byte, error)) (bool, error) {
+	for i := 0; i < memcacheRetries; i++ {
+		old, ver, err := c.getVersioned(key)
+		if err != nil || old == nil {
+			return false, err
+		}
+		value, err := fn(old)
+		if err != nil {
+			return false, err
+		}
+		ok, err := c.setVersioned(key, value, ver)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, errMemcacheContend
+}
+
+// incr handles "incr key delta" and "decr key delta", which change a
+// decimal value. Incrementing wraps around at 64 bits, and decrementing
+// stops at zero.
+func (c *memcacheConn) incr(args []string, noreply bool) {
+	if len(args) != 3 {
+		c.replyErr(noreply, errMemcacheFormat)
+		return
+	}
+	delta, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		c.replyErr(noreply, errMemcacheDelta)
+		return
+	}
+	var n uint64
+	ok, err := c.update(args[1], func(old []byte) ([]byte, error) {
+		var err error
+		n, err = strconv.ParseUint(string(old), 10, 64)
+		if err != nil {
+			return nil, errMemcacheNumber
+		}
+		switch {
+		case args[0] == "incr":
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		return strconv.AppendUint(nil, n, 10), nil
+	})
+	switch {
+	case err != nil:
+		c.replyErr(noreply, err)
+	case !ok:
+		c.reply(noreply, "NOT_FOUND")
+	default:
+		c.reply(noreply, strconv.FormatUint(n, 10))
+	}
+}
@@ -0,0 +1,167 @@
+package kvnode
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// entryOverhead is the size that LevelDB adds to each entry, for the
+// sequence number and the type of the entry.
+const entryOverhead = 8
+
+// keyUsage returns the approximate size that a database key takes in the
+// database, which is the key and its stored value, with the encoding header
+// and the metadata, and the previous values that are kept for reads at
+// earlier revisions. It returns -1 when the key doesn't exist. The caller
+// holds dbmu.
+func (kvm *Machine) keyUsage(key []byte) (int64, error) {
+	stored, err := kvm.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	size := int64(len(key) + len(stored) + entryOverhead)
+	prefix := historyPrefix(key)
+	iter := kvm.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if len(iter.Key()) != len(prefix)+8 {
+			continue
+		}
+		// the history entry, and its index entry.
+		size += int64(len(iter.Key()) + len(iter.Value()) + entryOverhead)
+		size += int64(9 + len(key) + entryOverhead)
+	}
+	return size, iter.Error()
+}
+
+// cmdMemory handles the MEMORY subcommands:
+//
+//	MEMORY USAGE key [SAMPLES count]
+//	MEMORY STATS
+//
+// USAGE returns the approximate bytes that a key takes in the database, or
+// null when it doesn't exist. The values are whole strings, so SAMPLES is
+// accepted for compatibility and ignored. STATS returns a map of the memory
+// of the process, and of the sizes of the storage, the caches and the
+// buffers of the node.
+func (kvm *Machine) cmdMemory(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "usage":
+		return kvm.cmdMemoryUsage(m, conn, cmd)
+	case "stats":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		return kvm.writeMemoryStats(conn)
+	}
+	return nil, errors.New("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+}
+
+func (kvm *Machine) cmdMemoryUsage(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	switch {
+	case len(cmd.Args) == 3:
+	case len(cmd.Args) == 5 && strings.ToLower(string(cmd.Args[3])) == "samples":
+		if _, err := strconv.ParseUint(string(cmd.Args[4]), 10, 63); err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+	case len(cmd.Args) < 3:
+		return nil, finn.ErrWrongNumberOfArguments
+	default:
+		return nil, errSyntaxError
+	}
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			buf := getKeyBuf()
+			defer putKeyBuf(buf)
+			*buf = keyspaceOf(m).appendKey(*buf, cmd.Args[2])
+			kvm.dbmu.RLock()
+			size, err := kvm.keyUsage(*buf)
+			kvm.dbmu.RUnlock()
+			if err != nil {
+				return nil, err
+			}
+			if size < 0 {
+				writeNull(conn)
+				return nil, nil
+			}
+			conn.WriteInt64(size)
+			return nil, nil
+		},
+	)
+}
+
+// writeMemoryStats writes the reply of MEMORY STATS. The keys are only
+// known while they're counted for MaxKeys and MaxBytes.
+func (kvm *Machine) writeMemoryStats(conn redcon.Conn) (interface{}, error) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	kvm.dbmu.RLock()
+	st, err := kvm.dbStats()
+	kvm.dbmu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	var tables int64
+	for _, l := range st.levels {
+		tables += l.size
+	}
+	cacheKeys, cacheBytes := kvm.rcache.usage()
+	var monitors, watchers int64
+	kvm.monitors.mu.Lock()
+	for mon := range kvm.monitors.monitors {
+		monitors += atomic.LoadInt64(&mon.out.size)
+	}
+	kvm.monitors.mu.Unlock()
+	kvm.watches.mu.Lock()
+	for w := range kvm.watches.watchers {
+		watchers += atomic.LoadInt64(&w.out.size)
+	}
+	kvm.watches.mu.Unlock()
+	type field struct {
+		name  string
+		value int64
+	}
+	fields := []field{
+		{"total.allocated", int64(ms.HeapAlloc)},
+		{"total.system", int64(ms.Sys)},
+		{"heap.objects", int64(ms.HeapObjects)},
+		{"gc.runs", int64(ms.NumGC)},
+		{"storage.tables.bytes", tables},
+		{"storage.tables.open", st.openTables},
+		{"storage.block-cache.bytes", st.cachedBlock},
+		{"storage.iterators", st.aliveIters},
+		{"storage.snapshots", st.aliveSnaps},
+		{"read-cache.keys", int64(cacheKeys)},
+		{"read-cache.bytes", int64(cacheBytes)},
+		{"buffers.monitors.bytes", monitors},
+		{"buffers.watchers.bytes", watchers},
+		{"buffers.pending-writes", atomic.LoadInt64(&kvm.pending)},
+	}
+	if atomic.LoadInt32(&kvm.usage.counted) == 1 {
+		keys := atomic.LoadInt64(&kvm.usage.keys)
+		bytes := atomic.LoadInt64(&kvm.usage.bytes)
+		fields = append(fields, field{"keys.count", keys}, field{"dataset.bytes", bytes})
+		if keys > 0 {
+			fields = append(fields, field{"keys.bytes-per-key", bytes / keys})
+		}
+	}
+	writeMap(conn, len(fields))
+	for _, f := range fields {
+		conn.WriteBulkString(f.name)
+		conn.WriteInt64(f.value)
+	}
+	return nil, nil
+}
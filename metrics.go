@@ -0,0 +1,265 @@
+package kvnode
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metricsInterval is how often the metrics are reported to Options.Metrics.
+const metricsInterval = 10 * time.Second
+
+// Metrics receives the instrumentation of the machine. It's the extension
+// point for telemetry systems, such as a Prometheus registry or a StatsD
+// client, in place of the "/metrics" endpoint of the HTTP gateway.
+//
+// The metrics of "/metrics" are reported every ten seconds, where the
+// gauges are set and the counters are incremented by their change since the
+// last report. The latency of each phase of each command is observed as it
+// happens, in seconds, as "kvnode_command_duration_seconds" with the labels
+// "command" and "phase", which is "total", "proposal" or "storage".
+type Metrics interface {
+	// IncrCounter adds a delta to a counter.
+	IncrCounter(name string, labels map[string]string, delta float64)
+	// SetGauge sets the value of a gauge.
+	SetGauge(name string, labels map[string]string, value float64)
+	// Observe adds a value to a histogram.
+	Observe(name string, labels map[string]string, value float64)
+}
+
+// metricSample is a value of a metric.
+type metricSample struct {
+	name, help string
+	counter    bool
+	labels     map[string]string
+	value      float64
+}
+
+// key identifies the metric and its labels.
+func (s *metricSample) key() string {
+	return s.name + "{" + s.labelString() + "}"
+}
+
+// labelString returns the labels in the Prometheus format, ordered by name.
+func (s *metricSample) labelString() string {
+	names := make([]string, 0, len(s.labels))
+	for name := range s.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + `="` + s.labels[name] + `"`
+	}
+	return strings.Join(names, ",")
+}
+
+// metricSamples returns the metrics of the node, where the samples of a
+// metric are next to each other.
+func (kvm *Machine) metricSamples() ([]metricSample, error) {
+	stats, _, err := kvm.raftInfo()
+	if err != nil {
+		return nil, err
+	}
+	var samples []metricSample
+	add := func(name, help string, counter bool, labels map[string]string, v float64) {
+		samples = append(samples, metricSample{name, help, counter, labels, v})
+	}
+	var leader float64
+	if stats["state"] == "Leader" {
+		leader = 1
+	}
+	add("kvnode_raft_leader", "Whether the node is the raft leader.", false, nil, leader)
+	for _, name := range []string{"term", "last_log_index", "commit_index",
+		"applied_index", "last_snapshot_index"} {
+		add("kvnode_raft_"+name, "The raft "+strings.Replace(name, "_", " ", -1)+".",
+			false, nil, float64(statUint(stats, name)))
+	}
+	add("kvnode_raft_log_entries", "Entries in the raft log.", false, nil,
+		float64(raftLogEntries(stats)))
+	if size := atomic.LoadInt64(&kvm.raftLogSize); size >= 0 {
+		add("kvnode_raft_log_bytes", "Size of the raft log on disk.", false, nil, float64(size))
+	}
+	reps := kvm.replication(stats)
+	peerMetrics := []struct {
+		name, help string
+		counter    bool
+		value      func(rep peerReplication) float64
+	}{
+		{"kvnode_raft_peer_up", "Whether the follower responds.", false,
+			func(rep peerReplication) float64 {
+				if rep.state == "unreachable" {
+					return 0
+				}
+				return 1
+			}},
+		{"kvnode_raft_peer_lag_entries", "Leader log entries that the follower doesn't have.", false,
+			func(rep peerReplication) float64 { return float64(rep.lag) }},
+		{"kvnode_raft_peer_applied_lag_entries", "Leader log entries that the follower hasn't applied.", false,
+			func(rep peerReplication) float64 { return float64(rep.appliedLag) }},
+		{"kvnode_raft_peer_last_contact_seconds", "Time since the leader last heard from the follower, or -1.", false,
+			func(rep peerReplication) float64 {
+				if rep.lastContact < 0 {
+					return -1
+				}
+				return rep.lastContact.Seconds()
+			}},
+		{"kvnode_raft_peer_snapshot_in_flight", "Whether the follower is being sent a snapshot.", false,
+			func(rep peerReplication) float64 {
+				if rep.snapshotInFlight {
+					return 1
+				}
+				return 0
+			}},
+		{"kvnode_raft_peer_snapshots_installed_total", "Snapshots installed on the follower by this leader.", true,
+			func(rep peerReplication) float64 { return float64(rep.contact.snapshots) }},
+	}
+	for _, pm := range peerMetrics {
+		for _, rep := range reps {
+			add(pm.name, pm.help, pm.counter, map[string]string{"peer": rep.addr}, pm.value(rep))
+		}
+	}
+	kvm.dbmu.RLock()
+	st, err := kvm.dbStats()
+	kvm.dbmu.RUnlock()
+	if err == nil {
+		levelMetrics := []struct {
+			name, help string
+			counter    bool
+			value      func(l levelStats) float64
+		}{
+			{"kvnode_leveldb_level_tables", "Tables in the LevelDB level.", false,
+				func(l levelStats) float64 { return float64(l.tables) }},
+			{"kvnode_leveldb_level_bytes", "Size of the tables in the LevelDB level.", false,
+				func(l levelStats) float64 { return float64(l.size) }},
+			{"kvnode_leveldb_compaction_seconds_total", "Time spent compacting into the LevelDB level.", true,
+				func(l levelStats) float64 { return l.compactionTime.Seconds() }},
+			{"kvnode_leveldb_compaction_read_bytes_total", "Bytes read by the compactions into the LevelDB level.", true,
+				func(l levelStats) float64 { return float64(l.compactionRead) }},
+			{"kvnode_leveldb_compaction_written_bytes_total", "Bytes written by the compactions into the LevelDB level.", true,
+				func(l levelStats) float64 { return float64(l.compactionSize) }},
+		}
+		for _, lm := range levelMetrics {
+			for _, l := range st.levels {
+				add(lm.name, lm.help, lm.counter, map[string]string{"level": strconv.Itoa(l.level)}, lm.value(l))
+			}
+		}
+		for _, m := range []struct {
+			name, help string
+			counter    bool
+			value      float64
+		}{
+			{"kvnode_leveldb_journal_written_bytes_total", "Bytes written to the LevelDB journal.", true,
+				float64(st.journalWritten)},
+			{"kvnode_leveldb_table_written_bytes_total", "Bytes written to LevelDB tables by flushes and compactions.", true,
+				float64(st.tableWritten)},
+			{"kvnode_leveldb_table_read_bytes_total", "Bytes read from LevelDB tables.", true,
+				float64(st.tableRead)},
+			{"kvnode_leveldb_write_amplification", "Bytes written to disk for each byte written to the journal.", false,
+				st.writeAmplification()},
+			{"kvnode_leveldb_read_amplification", "Most tables that a read looks up.", false,
+				float64(st.readAmplification())},
+			{"kvnode_leveldb_open_tables", "Open LevelDB tables.", false, float64(st.openTables)},
+			{"kvnode_leveldb_cached_block_bytes", "Size of the LevelDB block cache.", false, float64(st.cachedBlock)},
+			{"kvnode_leveldb_open_iterators", "Open LevelDB iterators.", false, float64(st.aliveIters)},
+			{"kvnode_leveldb_open_snapshots", "Open LevelDB snapshots.", false, float64(st.aliveSnaps)},
+		} {
+			add(m.name, m.help, m.counter, nil, m.value)
+		}
+	}
+	add("kvnode_connected_clients", "Open client connections.", false, nil, float64(kvm.numConns()))
+	add("kvnode_waiting_commands", "Commands that wait for a worker.", false, nil,
+		float64(atomic.LoadInt64(&kvm.lane.waiting)))
+	for _, m := range []struct {
+		name, help string
+		n          *int64
+	}{
+		{"kvnode_connections_total", "Accepted client connections.", &kvm.stats.connections},
+		{"kvnode_rejected_connections_total", "Client connections that were refused.", &kvm.stats.rejected},
+		{"kvnode_commands_total", "Commands of clients.", &kvm.stats.commands},
+		{"kvnode_throttled_commands_total", "Commands refused by rate limits.", &kvm.stats.throttled},
+		{"kvnode_busy_writes_total", "Writes refused by max-pending-writes.", &kvm.stats.busy},
+		{"kvnode_disk_refused_writes_total", "Writes refused by min-free-disk.", &kvm.stats.diskRefused},
+		{"kvnode_oom_refused_writes_total", "Writes refused by max-keys and max-bytes.", &kvm.stats.oomRefused},
+		{"kvnode_evicted_keys_total", "Keys evicted by the eviction policy.", &kvm.stats.evicted},
+		{"kvnode_cold_stored_keys_total", "Keys moved to the cold store.", &kvm.stats.coldStored},
+		{"kvnode_cold_loaded_keys_total", "Cold keys moved back to the database.", &kvm.stats.coldLoaded},
+		{"kvnode_cold_reads_total", "Values read from the cold store.", &kvm.stats.coldReads},
+		{"kvnode_output_buffer_disconnections_total", "Clients disconnected by output buffer limits.", &kvm.stats.outputLimited},
+		{"kvnode_queued_commands_total", "Commands that waited for a worker.", &kvm.stats.queued},
+		{"kvnode_priority_commands_total", "Commands that skipped the command lane.", &kvm.stats.priority},
+		{"kvnode_forwarded_writes_total", "Writes forwarded to the leader.", &kvm.stats.forwarded},
+		{"kvnode_raft_log_shrinks_total", "Times the raft log was shrunk.", &kvm.stats.raftLogShrinks},
+	} {
+		add(m.name, m.help, true, nil, float64(atomic.LoadInt64(m.n)))
+	}
+	return samples, nil
+}
+
+// writePrometheus returns the samples in the Prometheus text format.
+func writePrometheus(samples []metricSample) []byte {
+	var buf []byte
+	for i, s := range samples {
+		if i == 0 || samples[i-1].name != s.name {
+			typ := "gauge"
+			if s.counter {
+				typ = "counter"
+			}
+			buf = append(buf, "# HELP "+s.name+" "+s.help+"\n"...)
+			buf = append(buf, "# TYPE "+s.name+" "+typ+"\n"...)
+		}
+		buf = append(buf, s.name...)
+		if len(s.labels) > 0 {
+			buf = append(buf, "{"+s.labelString()+"}"...)
+		}
+		buf = append(buf, ' ')
+		buf = strconv.AppendFloat(buf, s.value, 'g', -1, 64)
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+// reportMetrics reports the metrics to Options.Metrics every
+// metricsInterval, until the machine is closed. The counters are
+// incremented by their change since the last report.
+func (kvm *Machine) reportMetrics() {
+	t := time.NewTicker(metricsInterval)
+	defer t.Stop()
+	last := make(map[string]float64)
+	for {
+		select {
+		case <-kvm.done:
+			return
+		case <-t.C:
+		}
+		metrics := kvm.options().Metrics
+		if metrics == nil {
+			continue
+		}
+		samples, err := kvm.metricSamples()
+		if err != nil {
+			continue
+		}
+		for _, s := range samples {
+			if !s.counter {
+				metrics.SetGauge(s.name, s.labels, s.value)
+				continue
+			}
+			key := s.key()
+			if delta := s.value - last[key]; delta > 0 {
+				metrics.IncrCounter(s.name, s.labels, delta)
+			}
+			last[key] = s.value
+		}
+	}
+}
+
+// observeLatency reports the latency of a phase of a command to
+// Options.Metrics.
+func (kvm *Machine) observeLatency(name string, phase int, d time.Duration) {
+	if metrics := kvm.options().Metrics; metrics != nil {
+		metrics.Observe("kvnode_command_duration_seconds",
+			map[string]string{"command": name, "phase": phaseNames[phase]}, d.Seconds())
+	}
+}
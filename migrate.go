@@ -0,0 +1,335 @@
+package kvnode
+
+import (
+	"crypto/cipher"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// dbFormat is the layout of the database that this release reads and
+// writes. It's stored in the formatFile of the database directory, and a
+// database without the file has format 0, which was written by a release
+// before the file and has the same layout as format 1.
+const dbFormat = 1
+
+const formatFile = "FORMAT"
+
+// migrateBatch is the number of keys that a migration copies in each write.
+const migrateBatch = 1000
+
+var errNoDatabase = errors.New("no database found")
+
+// migration upgrades the layout of a database from a format to the next.
+type migration struct {
+	from        int
+	description string
+	// apply changes the database, which is nil when only the format is
+	// recorded.
+	apply func(db *leveldb.DB) error
+}
+
+// migrations are the upgrades of the layout, in order.
+var migrations = []migration{
+	{0, "record the format of the layout, which is unchanged", nil},
+}
+
+// readFormat returns the format of the database in a directory.
+func readFormat(path string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, formatFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	format, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, errors.New("invalid " + formatFile + " file")
+	}
+	return format, nil
+}
+
+func writeFormat(path string) error {
+	return ioutil.WriteFile(filepath.Join(path, formatFile),
+		[]byte(strconv.Itoa(dbFormat)+"\n"), 0600)
+}
+
+// checkFormat checks that the database in a directory was written by a
+// release that has the same layout, and records the format of a new
+// database. A database of format 0 has the layout of format 1, so it's
+// upgraded by recording the format.
+func checkFormat(path string) error {
+	format, err := readFormat(path)
+	if err != nil {
+		return err
+	}
+	if format > dbFormat {
+		return errors.New("the database has format " + strconv.Itoa(format) +
+			", which is newer than the format " + strconv.Itoa(dbFormat) +
+			" of this release")
+	}
+	if format < dbFormat {
+		if _, err := os.Stat(filepath.Join(path, "CURRENT")); err == nil {
+			// only the layouts that are the same are upgraded in place,
+			// the others require kvnode-migrate.
+			for _, m := range migrations[format:] {
+				if m.apply != nil {
+					return errors.New("the database has format " + strconv.Itoa(format) +
+						", upgrade it with kvnode-migrate")
+				}
+			}
+		}
+		return writeFormat(path)
+	}
+	return nil
+}
+
+// MigrateOptions are the changes that Migrate makes to a database.
+type MigrateOptions struct {
+	// DryRun reports the changes without making them.
+	DryRun bool
+	// EncryptionKey is the key that the database is encrypted with, or nil
+	// when it's not encrypted.
+	EncryptionKey KeyProvider
+	// Rekey encrypts the database with NewEncryptionKey, or decrypts it
+	// when NewEncryptionKey is nil.
+	Rekey            bool
+	NewEncryptionKey KeyProvider
+	// Recompress encodes the values again with CompressionThreshold, which
+	// is zero to store them uncompressed.
+	Recompress           bool
+	CompressionThreshold int
+}
+
+// MigrateReport is the outcome of Migrate.
+type MigrateReport struct {
+	// Format is the format of the database before the migration.
+	Format int
+	// Changes describes the changes that were made, or would be made by a
+	// dry run.
+	Changes []string
+	// Keys are the number of keys in the database, by their kind.
+	Keys map[string]int64
+}
+
+// keyKind returns the kind of a key of the database, for MigrateReport.
+func keyKind(key []byte) string {
+	if _, _, ok := parseDBKey(key); ok {
+		return "keys"
+	}
+	if _, _, ok := parseNSKey(key); ok {
+		return "namespace keys"
+	}
+	if len(key) == 0 {
+		return "unknown"
+	}
+	switch key[0] {
+	case 'm':
+		return "namespaces"
+	case 'u':
+		return "users"
+	case 'c':
+		return "config"
+	case 'r', 'R':
+		return "request ids"
+	case 'S':
+		return "stamps"
+	case 'v':
+		return "revision"
+	case 'h', 'H':
+		return "history"
+	}
+	return "unknown"
+}
+
+// Migrate upgrades the database in the data directory of a node to the
+// layout of this release, and changes its encryption or the compression of
+// its values. The node must be stopped. Changes other than upgrades that
+// only record the format copy the database, which then replaces the
+// original, so there must be room for a second copy.
+func Migrate(dir string, opts *MigrateOptions) (*MigrateReport, error) {
+	path := filepath.Join(dir, "node.db")
+	if _, err := os.Stat(filepath.Join(path, "CURRENT")); err != nil {
+		return nil, errors.New(errNoDatabase.Error() + " in " + path)
+	}
+	var block, nblock cipher.Block
+	var err error
+	if opts.EncryptionKey != nil {
+		if block, err = storageCipher(opts.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Rekey && opts.NewEncryptionKey != nil {
+		if nblock, err = storageCipher(opts.NewEncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+	rep := &MigrateReport{Keys: make(map[string]int64)}
+	if rep.Format, err = readFormat(path); err != nil {
+		return nil, err
+	}
+	if rep.Format > dbFormat {
+		return nil, errors.New("the database has format " + strconv.Itoa(rep.Format) +
+			", which is newer than the format " + strconv.Itoa(dbFormat) +
+			" of this release")
+	}
+	var upgrades []migration
+	for _, m := range migrations[rep.Format:] {
+		upgrades = append(upgrades, m)
+		rep.Changes = append(rep.Changes, "upgrade from format "+
+			strconv.Itoa(m.from)+" to "+strconv.Itoa(m.from+1)+": "+m.description)
+	}
+	if opts.Rekey {
+		switch {
+		case block == nil && nblock == nil:
+			return nil, errPlaintextDB
+		case block == nil:
+			rep.Changes = append(rep.Changes, "encrypt the database")
+		case nblock == nil:
+			rep.Changes = append(rep.Changes, "decrypt the database")
+		default:
+			rep.Changes = append(rep.Changes, "encrypt the database with the new key")
+		}
+	}
+	if opts.Recompress {
+		if opts.CompressionThreshold > 0 {
+			rep.Changes = append(rep.Changes, "compress the values of at least "+
+				strconv.Itoa(opts.CompressionThreshold)+" bytes")
+		} else {
+			rep.Changes = append(rep.Changes, "store the values uncompressed")
+		}
+	}
+	stor, err := storage.OpenFile(path, opts.DryRun)
+	if err != nil {
+		return nil, errors.New("could not open the database, the node must be stopped: " + err.Error())
+	}
+	if err := checkEncryption(path, block); err != nil {
+		stor.Close()
+		return nil, err
+	}
+	if block != nil {
+		stor = &cryptStorage{Storage: stor, block: block}
+	}
+	db, err := leveldb.Open(stor, &opt.Options{ReadOnly: opts.DryRun})
+	if err != nil {
+		stor.Close()
+		return nil, err
+	}
+	closeDB := func() error {
+		err := db.Close()
+		if serr := stor.Close(); err == nil {
+			err = serr
+		}
+		return err
+	}
+	iter := db.NewIterator(nil, nil)
+	for ok := iter.First(); ok; ok = iter.Next() {
+		rep.Keys[keyKind(iter.Key())]++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		closeDB()
+		return nil, err
+	}
+	if opts.DryRun {
+		return rep, closeDB()
+	}
+	for _, m := range upgrades {
+		if m.apply != nil {
+			if err := m.apply(db); err != nil {
+				closeDB()
+				return nil, err
+			}
+		}
+	}
+	if !opts.Rekey && !opts.Recompress {
+		if err := closeDB(); err != nil {
+			return nil, err
+		}
+		return rep, writeFormat(path)
+	}
+	if !opts.Rekey {
+		nblock = block
+	}
+	npath := path + ".migrate"
+	if err := os.RemoveAll(npath); err != nil {
+		closeDB()
+		return nil, err
+	}
+	err = copyDB(db, npath, nblock, opts)
+	if cerr := closeDB(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.RemoveAll(npath)
+		return nil, err
+	}
+	// the original is kept until the copy replaced it.
+	opath := path + ".old"
+	if err := os.Rename(path, opath); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(npath, path); err != nil {
+		os.Rename(opath, path)
+		return nil, err
+	}
+	return rep, os.RemoveAll(opath)
+}
+
+// copyDB copies a database to a new database in a directory, which is
+// encrypted with a cipher when it's not nil.
+func copyDB(db *leveldb.DB, path string, block cipher.Block, opts *MigrateOptions) error {
+	stor, err := openStorage(path, block)
+	if err != nil {
+		return err
+	}
+	ndb, err := leveldb.Open(stor, nil)
+	if err != nil {
+		stor.Close()
+		return err
+	}
+	err = func() error {
+		var batch leveldb.Batch
+		iter := db.NewIterator(nil, nil)
+		defer iter.Release()
+		for ok := iter.First(); ok; ok = iter.Next() {
+			value := iter.Value()
+			// the stubs of cold values are copied as they are.
+			if kind := keyKind(iter.Key()); opts.Recompress &&
+				(kind == "keys" || kind == "namespace keys") && coldObject(value) == "" {
+				raw, err := decodeValue(value)
+				if err != nil {
+					return err
+				}
+				value = encodeValue(raw, opts.CompressionThreshold,
+					valueVersion(value), valueMeta(value))
+			}
+			batch.Put(iter.Key(), value)
+			if batch.Len() == migrateBatch {
+				if err := ndb.Write(&batch, nil); err != nil {
+					return err
+				}
+				batch.Reset()
+			}
+		}
+		if err := iter.Error(); err != nil {
+			return err
+		}
+		return ndb.Write(&batch, &opt.WriteOptions{Sync: true})
+	}()
+	if cerr := ndb.Close(); err == nil {
+		err = cerr
+	}
+	if serr := stor.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+package kvnode
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// monitorBuffer is the number of lines that may be queued for a monitor
+// before it's considered too slow and is disconnected.
+const monitorBuffer = 4096
+
+// monitor receives a line for every command that's processed.
+type monitor struct {
+	ch chan string
+	// out is the size of the queued lines.
+	out outputQueue
+	// overflow is closed when the monitor falls too far behind.
+	overflow chan struct{}
+}
+
+// monitorHub distributes processed commands to the MONITOR connections.
+type monitorHub struct {
+	// count is the number of monitors. It's accessed atomically, so that
+	// commands are not formatted when nobody is listening.
+	count    int32
+	mu       sync.Mutex
+	monitors map[*monitor]bool
+	// limit returns the output buffer limit of the monitors.
+	limit func() OutputBufferLimit
+}
+
+func newMonitorHub(limit func() OutputBufferLimit) *monitorHub {
+	return &monitorHub{monitors: make(map[*monitor]bool), limit: limit}
+}
+
+// add registers a new monitor.
+func (h *monitorHub) add() *monitor {
+	mon := &monitor{
+		ch:       make(chan string, monitorBuffer),
+		overflow: make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.monitors[mon] = true
+	atomic.StoreInt32(&h.count, int32(len(h.monitors)))
+	h.mu.Unlock()
+	return mon
+}
+
+// remove unregisters the monitor.
+func (h *monitorHub) remove(mon *monitor) {
+	h.mu.Lock()
+	delete(h.monitors, mon)
+	atomic.StoreInt32(&h.count, int32(len(h.monitors)))
+	h.mu.Unlock()
+}
+
+// publish sends a command to every monitor. It never blocks, monitors that
+// cannot keep up, or exceed the output buffer limit, are dropped.
+func (h *monitorHub) publish(c *client, args [][]byte) {
+	if atomic.LoadInt32(&h.count) == 0 {
+		return
+	}
+	line := formatMonitor(time.Now(), keyspace{db: c.db, ns: c.ns}.String(), c.addr, args)
+	limit := h.limit()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for mon := range h.monitors {
+		if !mon.out.add(int64(len(line)), limit) {
+			select {
+			case mon.ch <- line:
+				continue
+			default:
+			}
+		}
+		delete(h.monitors, mon)
+		close(mon.overflow)
+	}
+	atomic.StoreInt32(&h.count, int32(len(h.monitors)))
+}
+
+// formatMonitor returns a MONITOR line, such as
+// `1339518083.107412 [0 127.0.0.1:60866] "keys" "*"`, where ks is the
+// database index or namespace of the client.
+func formatMonitor(now time.Time, ks string, addr string, args [][]byte) string {
+	buf := strconv.AppendInt(nil, now.Unix(), 10)
+	buf = append(buf, '.')
+	usec := strconv.AppendInt(nil, int64(now.Nanosecond()/1000), 10)
+	for i := len(usec); i < 6; i++ {
+		buf = append(buf, '0')
+	}
+	buf = append(buf, usec...)
+	buf = append(buf, " ["...)
+	buf = append(buf, ks...)
+	buf = append(buf, ' ')
+	buf = append(buf, addr...)
+	buf = append(buf, ']')
+	for _, arg := range args {
+		buf = append(buf, ' ')
+		buf = appendQuoted(buf, arg)
+	}
+	return string(buf)
+}
+
+// appendQuoted appends the argument as a quoted string, where special and
+// non-printable characters are escaped.
+func appendQuoted(buf, arg []byte) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	for _, b := range arg {
+		switch b {
+		case '\\', '"':
+			buf = append(buf, '\\', b)
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		default:
+			if b < ' ' || b > '~' {
+				buf = append(buf, '\\', 'x', hex[b>>4], hex[b&0xF])
+			} else {
+				buf = append(buf, b)
+			}
+		}
+	}
+	return append(buf, '"')
+}
+
+// cmdMonitor handles "MONITOR". The connection is detached and receives a
+// line for every command that's processed by the node. Sending any command
+// ends the stream.
+func (kvm *Machine) cmdMonitor(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	mon := kvm.monitors.add()
+	c := kvm.client(conn)
+	kvm.stopTracking(c)
+	dconn := conn.Detach()
+	go kvm.streamMonitor(dconn, c, mon)
+	return nil, nil
+}
+
+func (kvm *Machine) streamMonitor(dconn redcon.DetachedConn, c *client, mon *monitor) {
+	defer kvm.detachedClosed(c)
+	defer dconn.Close()
+	defer kvm.monitors.remove(mon)
+	dconn.WriteString("OK")
+	if err := dconn.Flush(); err != nil {
+		return
+	}
+	// any input from the client ends the stream.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dconn.ReadCommand()
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-mon.overflow:
+			kvm.slowConsumer(c, "monitor")
+			dconn.WriteError("ERR monitor is too slow, commands were dropped")
+			dconn.Flush()
+			return
+		case line := <-mon.ch:
+			dconn.WriteString(line)
+			n := len(line)
+			// write the pending lines together.
+			for len(mon.ch) > 0 {
+				line = <-mon.ch
+				dconn.WriteString(line)
+				n += len(line)
+			}
+			if err := dconn.Flush(); err != nil {
+				return
+			}
+			mon.out.add(-int64(n), OutputBufferLimit{})
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package kvnode
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// The guards of the pairs of MSETIF.
+const (
+	guardAny     = iota // always passes
+	guardNX             // the key must not exist
+	guardXX             // the key must exist
+	guardEQ             // the key must have the value
+	guardVersion        // the key must have the version
+)
+
+// msetifPair is a key and value of MSETIF with its guard.
+type msetifPair struct {
+	key, value []byte
+	guard      int
+	expect     []byte // the value of EQ
+	version    uint64 // the version of VERSION
+}
+
+// parseMsetif parses "MSETIF key value guard [key value guard ...]", where a
+// guard is ANY, NX, XX, EQ value or VERSION version.
+func parseMsetif(args [][]byte) ([]msetifPair, error) {
+	if len(args) < 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var pairs []msetifPair
+	for i := 1; i < len(args); {
+		if i+2 >= len(args) {
+			return nil, errSyntaxError
+		}
+		p := msetifPair{key: args[i], value: args[i+1]}
+		switch strings.ToLower(string(args[i+2])) {
+		default:
+			return nil, errSyntaxError
+		case "any":
+			p.guard = guardAny
+		case "nx":
+			p.guard = guardNX
+		case "xx":
+			p.guard = guardXX
+		case "eq", "version":
+			if i+3 == len(args) {
+				return nil, errSyntaxError
+			}
+			if strings.ToLower(string(args[i+2])) == "eq" {
+				p.guard, p.expect = guardEQ, args[i+3]
+			} else {
+				n, err := strconv.ParseUint(string(args[i+3]), 10, 64)
+				if err != nil {
+					return nil, errVersion
+				}
+				p.guard, p.version = guardVersion, n
+			}
+			i++
+		}
+		pairs = append(pairs, p)
+		i += 3
+	}
+	return pairs, nil
+}
+
+// msetifKeys returns the keys of a MSETIF command.
+func msetifKeys(args [][]byte) [][]byte {
+	pairs, err := parseMsetif(args)
+	if err != nil {
+		return nil
+	}
+	keys := make([][]byte, len(pairs))
+	for i, p := range pairs {
+		keys[i] = p.key
+	}
+	return keys
+}
+
+// msetifValues returns the values that a MSETIF command stores.
+func msetifValues(args [][]byte) [][]byte {
+	pairs, err := parseMsetif(args)
+	if err != nil {
+		return nil
+	}
+	values := make([][]byte, len(pairs))
+	for i, p := range pairs {
+		values[i] = p.value
+	}
+	return values
+}
+
+// guardFailure returns the reason that the guard of a pair fails for the
+// stored value of its key, which is nil when the key doesn't exist, or ""
+// when the guard passes.
+func (p msetifPair) guardFailure(stored []byte) (string, error) {
+	switch p.guard {
+	case guardNX:
+		if stored != nil {
+			return "exists", nil
+		}
+	case guardXX:
+		if stored == nil {
+			return "missing", nil
+		}
+	case guardEQ:
+		if stored == nil {
+			return "missing", nil
+		}
+		value, err := decodeValue(stored)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(value, p.expect) {
+			return "mismatch", nil
+		}
+	case guardVersion:
+		// a missing key has version zero.
+		if valueVersion(stored) != p.version {
+			return "version", nil
+		}
+	}
+	return "", nil
+}
+
+// msetifFailure is the pair of MSETIF whose guard failed.
+type msetifFailure struct {
+	key    []byte
+	reason string
+}
+
+// cmdMsetif handles "MSETIF key value guard [key value guard ...]", which sets
+// the keys only when the guards of every pair pass, atomically. A guard is
+// ANY, which always passes, NX, for a key that doesn't exist, XX, for a key
+// that exists, EQ value, for a key that has the value, or VERSION version,
+// for a key that has the version, where a missing key has version zero. The
+// guards are checked against the values before the command. It replies OK,
+// or the key of the first pair whose guard failed and the reason, which is
+// "exists", "missing", "mismatch" or "version", and sets none of the keys.
+func (kvm *Machine) cmdMsetif(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	pairs, err := parseMsetif(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	ks := keyspaceOf(m)
+	if conn != nil {
+		var compared [][]byte
+		for _, p := range pairs {
+			if p.guard == guardEQ {
+				compared = append(compared, p.key)
+			}
+		}
+		kvm.warmKeys(ks, compared)
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			buf := getKeyBuf()
+			defer putKeyBuf(buf)
+			keys := ks.appendKeys(buf, msetifKeys(cmd.Args), 1)
+			defer kvm.lockKeys(ks, keys)()
+			for i, p := range pairs {
+				stored, err := kvm.db.Get(keys[i], nil)
+				if err == leveldb.ErrNotFound {
+					stored, err = nil, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				reason, err := p.guardFailure(stored)
+				if err != nil {
+					return nil, err
+				}
+				if reason != "" {
+					return msetifFailure{key: append([]byte(nil), p.key...), reason: reason}, nil
+				}
+			}
+			threshold := kvm.options().CompressionThreshold
+			var batch leveldb.Batch
+			pending := make(map[string]*keyMeta)
+			for i, p := range pairs {
+				meta, err := kvm.nextMeta(keys[i], pending)
+				if err != nil {
+					return nil, err
+				}
+				batch.Put(keys[i], encodeValue(p.value, threshold, kvm.applyStamp, meta))
+			}
+			if err := kvm.writeBatch(ks, &batch); err != nil {
+				return nil, err
+			}
+			for _, p := range pairs {
+				kvm.watches.publish(ks, kvm.applyStamp, "set", p.key, p.value)
+			}
+			return nil, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			if f, ok := v.(msetifFailure); ok {
+				conn.WriteArray(2)
+				conn.WriteBulk(f.key)
+				conn.WriteBulkString(f.reason)
+				return nil, nil
+			}
+			conn.WriteString("OK")
+			return nil, nil
+		},
+	)
+}
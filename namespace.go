@@ -0,0 +1,463 @@
+package kvnode
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errNoNamespace     = errors.New("ERR no such namespace")
+	errNamespaceExists = errors.New("ERR namespace already exists")
+	errNamespaceName   = errors.New("ERR invalid namespace name")
+	errQuotaKeys       = errors.New("ERR namespace key quota exceeded")
+	errQuotaBytes      = errors.New("ERR namespace size quota exceeded")
+)
+
+// maxNamespaceLen is the maximum length of a namespace name.
+const maxNamespaceLen = 64
+
+// namespace is a named keyspace with optional quotas. The quotas are stored
+// in the database with the 'm' prefix, and the keys use the "n{name}:"
+// prefix.
+type namespace struct {
+	name     string
+	maxKeys  int64 // zero means no limit
+	maxBytes int64 // zero means no limit
+	// keys and bytes are the usage of the namespace, where bytes is the
+	// total size of the keys and values.
+	keys  int64
+	bytes int64
+}
+
+// encode returns the quotas of the namespace as stored in the database.
+func (ns *namespace) encode() []byte {
+	return []byte(strconv.FormatInt(ns.maxKeys, 10) + " " +
+		strconv.FormatInt(ns.maxBytes, 10))
+}
+
+// parseNamespace parses the quotas that were returned by encode.
+func parseNamespace(name, value string) (*namespace, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return nil, errors.New("invalid namespace '" + name + "'")
+	}
+	ns := &namespace{name: name}
+	var err error
+	if ns.maxKeys, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return nil, err
+	}
+	if ns.maxBytes, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// validNamespace returns true if the name may be used as a namespace. Names
+// never contain pattern characters or the ':' that ends the key prefix.
+func validNamespace(name string) bool {
+	if len(name) == 0 || len(name) > maxNamespaceLen {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') &&
+			!(c >= '0' && c <= '9') && c != '_' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// nsPrefix returns the key prefix of a namespace.
+func nsPrefix(name string) []byte {
+	prefix := append([]byte{'n'}, name...)
+	return append(prefix, ':')
+}
+
+// parseNSKey returns the namespace and the key of a database key. False is
+// returned when the key is not in a namespace.
+func parseNSKey(key []byte) (string, []byte, bool) {
+	if len(key) == 0 || key[0] != 'n' {
+		return "", nil, false
+	}
+	i := bytes.IndexByte(key, ':')
+	if i < 2 {
+		return "", nil, false
+	}
+	return string(key[1:i]), key[i+1:], true
+}
+
+// loadNamespaces reads the namespaces from the database and counts their
+// usage. The caller must hold the machine lock.
+func (kvm *Machine) loadNamespaces() error {
+	namespaces := make(map[string]*namespace)
+	iter := kvm.db.NewIterator(util.BytesPrefix([]byte{'m'}), nil)
+	for ok := iter.First(); ok; ok = iter.Next() {
+		ns, err := parseNamespace(string(iter.Key()[1:]), string(iter.Value()))
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		namespaces[ns.name] = ns
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	// the usage is not stored, it's counted from the keys.
+	for _, ns := range namespaces {
+		prefix := nsPrefix(ns.name)
+		iter := kvm.db.NewIterator(util.BytesPrefix(prefix), nil)
+		for ok := iter.First(); ok; ok = iter.Next() {
+			ns.keys++
+			ns.bytes += int64(len(iter.Key()) - len(prefix) + len(iter.Value()))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+	kvm.namespaces = namespaces
+	return nil
+}
+
+// storeNamespaces writes all namespaces to the database and clears their
+// usage, which is used after the database is reset. The caller must hold the
+// machine lock.
+func (kvm *Machine) storeNamespaces() error {
+	var batch leveldb.Batch
+	for name, ns := range kvm.namespaces {
+		batch.Put(makeKey('m', []byte(name)), ns.encode())
+		ns.keys, ns.bytes = 0, 0
+	}
+	return kvm.db.Write(&batch, nil)
+}
+
+// usageDelta computes the change in the usage of a namespace from a batch.
+type usageDelta struct {
+	// get reads the stored value of a key, see appliedValue.
+	get    func(key []byte) ([]byte, error)
+	prefix int
+	// sizes are the sizes of the keys that are changed by the batch, or -1
+	// for deleted keys.
+	sizes map[string]int
+	keys  int64
+	bytes int64
+	err   error
+}
+
+// size returns the current size of the key, or -1 if it does not exist.
+func (d *usageDelta) size(key []byte) int {
+	if n, ok := d.sizes[string(key)]; ok {
+		return n
+	}
+	value, err := d.get(key)
+	if err != nil {
+		if err != leveldb.ErrNotFound {
+			d.err = err
+		}
+		return -1
+	}
+	return len(key) - d.prefix + len(value)
+}
+
+func (d *usageDelta) Put(key, value []byte) {
+	old := d.size(key)
+	n := len(key) - d.prefix + len(value)
+	if old < 0 {
+		d.keys++
+	} else {
+		d.bytes -= int64(old)
+	}
+	d.bytes += int64(n)
+	d.sizes[string(key)] = n
+}
+
+func (d *usageDelta) Delete(key []byte) {
+	if old := d.size(key); old >= 0 {
+		d.keys--
+		d.bytes -= int64(old)
+	}
+	d.sizes[string(key)] = -1
+}
+
+// writeBatch writes the batch of changes to the keyspace. Changes to a
+// namespace that would grow it beyond its quotas are rejected as a whole.
+// The caller must hold the machine lock.
+func (kvm *Machine) writeBatch(ks keyspace, batch *leveldb.Batch) error {
+	if ks.ns == "" {
+		added, err := kvm.trackUsage(batch)
+		if err != nil {
+			return err
+		}
+		if err := kvm.recordHistory(batch); err != nil {
+			return err
+		}
+		if kvm.gbatch.active {
+			// the write is part of a group that's written at once.
+			kvm.gbatch.sync = kvm.gbatch.sync || kvm.syncing
+			if err := batch.Replay(&kvm.gbatch); err != nil {
+				return err
+			}
+			added()
+			return nil
+		}
+		if err := kvm.writeDB(batch); err != nil {
+			return err
+		}
+		added()
+		return nil
+	}
+	ns := kvm.namespaces[ks.ns]
+	if ns == nil {
+		return errNoNamespace
+	}
+	d := &usageDelta{
+		get:    kvm.appliedValue,
+		prefix: len(nsPrefix(ns.name)),
+		sizes:  make(map[string]int),
+	}
+	if err := batch.Replay(d); err != nil {
+		return err
+	}
+	if d.err != nil {
+		return d.err
+	}
+	nkeys, nbytes := ns.keys+d.keys, ns.bytes+d.bytes
+	if d.keys > 0 && ns.maxKeys > 0 && nkeys > ns.maxKeys {
+		return errQuotaKeys
+	}
+	if d.bytes > 0 && ns.maxBytes > 0 && nbytes > ns.maxBytes {
+		return errQuotaBytes
+	}
+	if err := kvm.recordHistory(batch); err != nil {
+		return err
+	}
+	if err := kvm.writeDB(batch); err != nil {
+		return err
+	}
+	ns.keys, ns.bytes = nkeys, nbytes
+	// the usage of all keys counts the prefixes too.
+	kvm.addUsage(d.keys, d.bytes+d.keys*int64(d.prefix))
+	return nil
+}
+
+// cmdNamespace handles the NAMESPACE subcommands:
+//
+//	NAMESPACE CREATE name [MAXKEYS count] [MAXBYTES size]
+//	NAMESPACE QUOTA name [MAXKEYS count] [MAXBYTES size]
+//	NAMESPACE DROP name
+//	NAMESPACE USE name
+//	NAMESPACE LIST
+//	NAMESPACE INFO [name]
+func (kvm *Machine) cmdNamespace(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errors.New("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	case "create":
+		return kvm.cmdNamespaceCreate(m, conn, cmd, true)
+	case "quota":
+		return kvm.cmdNamespaceCreate(m, conn, cmd, false)
+	case "drop":
+		return kvm.cmdNamespaceDrop(m, conn, cmd)
+	case "use":
+		return kvm.cmdNamespaceUse(m, conn, cmd)
+	case "list":
+		return kvm.cmdNamespaceList(m, conn, cmd)
+	case "info":
+		return kvm.cmdNamespaceInfo(m, conn, cmd)
+	}
+}
+
+// cmdNamespaceCreate creates a namespace, or changes the quotas of an
+// existing namespace when create is false. Quotas that are not provided are
+// unlimited for new namespaces and unchanged for existing ones.
+func (kvm *Machine) cmdNamespaceCreate(m finn.Applier, conn redcon.Conn, cmd redcon.Command, create bool) (interface{}, error) {
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name := string(cmd.Args[2])
+	if !validNamespace(name) {
+		return nil, errNamespaceName
+	}
+	maxKeys, maxBytes := int64(-1), int64(-1)
+	for i := 3; i < len(cmd.Args); i++ {
+		var field *int64
+		switch strings.ToLower(string(cmd.Args[i])) {
+		default:
+			return nil, errSyntaxError
+		case "maxkeys":
+			field = &maxKeys
+		case "maxbytes":
+			field = &maxBytes
+		}
+		i++
+		if i == len(cmd.Args) {
+			return nil, errSyntaxError
+		}
+		n, err := strconv.ParseInt(string(cmd.Args[i]), 10, 64)
+		if err != nil || n < 0 {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+		*field = n
+	}
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			ns := kvm.namespaces[name]
+			if create {
+				if ns != nil {
+					return nil, errNamespaceExists
+				}
+				ns = &namespace{name: name}
+			} else {
+				if ns == nil {
+					return nil, errNoNamespace
+				}
+				nns := *ns
+				ns = &nns
+			}
+			if maxKeys >= 0 {
+				ns.maxKeys = maxKeys
+			}
+			if maxBytes >= 0 {
+				ns.maxBytes = maxBytes
+			}
+			if err := kvm.db.Put(makeKey('m', []byte(name)), ns.encode(), nil); err != nil {
+				return nil, err
+			}
+			kvm.namespaces[name] = ns
+			return nil, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteString("OK")
+			return nil, nil
+		},
+	)
+}
+
+// cmdNamespaceDrop deletes a namespace and all of its keys.
+func (kvm *Machine) cmdNamespaceDrop(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name := string(cmd.Args[2])
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			kvm.mu.Lock()
+			defer kvm.mu.Unlock()
+			if kvm.namespaces[name] == nil {
+				return nil, errNoNamespace
+			}
+			ks := keyspace{ns: name}
+			if err := kvm.deleteKeyspace(ks); err != nil {
+				return nil, err
+			}
+			if err := kvm.db.Delete(makeKey('m', []byte(name)), nil); err != nil {
+				return nil, err
+			}
+			delete(kvm.namespaces, name)
+			kvm.watches.publish(ks, kvm.applyStamp, "flushdb", nil, nil)
+			return nil, nil
+		},
+		func(v interface{}) (interface{}, error) {
+			conn.WriteString("OK")
+			return nil, nil
+		},
+	)
+}
+
+// cmdNamespaceUse switches the connection to a namespace. SELECT switches
+// back to a numbered database.
+func (kvm *Machine) cmdNamespaceUse(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name := string(cmd.Args[2])
+	c := kvm.client(conn)
+	if u := kvm.user(c.userName()); u == nil || !u.canUseNamespace(name) {
+		return nil, errNoPermNamespace
+	}
+	kvm.mu.RLock()
+	ns := kvm.namespaces[name]
+	kvm.mu.RUnlock()
+	if ns == nil {
+		return nil, errNoNamespace
+	}
+	c.mu.Lock()
+	c.ns = name
+	c.mu.Unlock()
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+func (kvm *Machine) cmdNamespaceList(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	u := kvm.user(kvm.client(conn).userName())
+	var names []string
+	kvm.mu.RLock()
+	for name := range kvm.namespaces {
+		if u != nil && u.canUseNamespace(name) {
+			names = append(names, name)
+		}
+	}
+	kvm.mu.RUnlock()
+	sort.Strings(names)
+	conn.WriteArray(len(names))
+	for _, name := range names {
+		conn.WriteBulkString(name)
+	}
+	return nil, nil
+}
+
+// cmdNamespaceInfo returns the quotas and usage of a namespace, which is the
+// namespace of the connection when no name is provided.
+func (kvm *Machine) cmdNamespaceInfo(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) > 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	c := kvm.client(conn)
+	name := keyspaceOf(m).ns
+	if len(cmd.Args) == 3 {
+		name = string(cmd.Args[2])
+	}
+	if u := kvm.user(c.userName()); u == nil || !u.canUseNamespace(name) {
+		return nil, errNoPermNamespace
+	}
+	var info namespace
+	kvm.mu.RLock()
+	ns := kvm.namespaces[name]
+	if ns != nil {
+		info = *ns
+	}
+	kvm.mu.RUnlock()
+	if ns == nil {
+		return nil, errNoNamespace
+	}
+	writeMap(conn, 5)
+	conn.WriteBulkString("name")
+	conn.WriteBulkString(info.name)
+	conn.WriteBulkString("keys")
+	conn.WriteInt64(info.keys)
+	conn.WriteBulkString("bytes")
+	conn.WriteInt64(info.bytes)
+	conn.WriteBulkString("maxkeys")
+	conn.WriteInt64(info.maxKeys)
+	conn.WriteBulkString("maxbytes")
+	conn.WriteInt64(info.maxBytes)
+	return nil, nil
+}
@@ -0,0 +1,132 @@
+package kvnode
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var errNoSuchKey = errors.New("ERR no such key")
+
+// storedValue returns the stored form of a key of the keyspace of the
+// command, or nil when the key doesn't exist. It's called from the respond
+// function of a read.
+func (kvm *Machine) storedValue(m finn.Applier, key []byte) ([]byte, error) {
+	buf := getKeyBuf()
+	defer putKeyBuf(buf)
+	*buf = keyspaceOf(m).appendKey(*buf, key)
+	kvm.dbmu.RLock()
+	defer kvm.dbmu.RUnlock()
+	value, err := kvm.reader(m).Get(*buf, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return value, err
+}
+
+// idleSeconds returns the seconds since a key was last written or, for the
+// LRU policy, accessed, or -1 for values that were written before they had
+// a version.
+func (kvm *Machine) idleSeconds(m finn.Applier, key, stored []byte) int64 {
+	buf := getKeyBuf()
+	defer putKeyBuf(buf)
+	*buf = keyspaceOf(m).appendKey(*buf, key)
+	last := kvm.lastUse(kvm.options().EvictionPolicy, *buf, stored)
+	if last == 0 {
+		return -1
+	}
+	idle := time.Now().UnixNano() - int64(last)
+	if idle < 0 {
+		return 0
+	}
+	return idle / int64(time.Second)
+}
+
+// cmdObject handles the OBJECT subcommands, which describe how a key is
+// stored:
+//
+//	OBJECT ENCODING key
+//	OBJECT IDLETIME key
+//	OBJECT FREQ key
+//
+// The encoding is "raw" or "snappy". The idle time is the seconds since the
+// key was written or, with the allkeys-lru eviction policy, accessed. The
+// frequency is the estimated accesses of HOTKEYS, and needs
+// hotkeys-sampling. They're null for keys that don't exist.
+func (kvm *Machine) cmdObject(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	sub := strings.ToLower(string(cmd.Args[1]))
+	switch sub {
+	default:
+		return nil, errors.New("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	case "encoding", "idletime", "freq":
+	}
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if sub == "freq" && kvm.options().HotKeysSampling <= 0 {
+		return nil, errHotKeysDisabled
+	}
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			stored, err := kvm.storedValue(m, cmd.Args[2])
+			if err != nil {
+				return nil, err
+			}
+			if stored == nil {
+				writeNull(conn)
+				return nil, nil
+			}
+			switch sub {
+			case "encoding":
+				conn.WriteBulkString(valueEncoding(stored))
+			case "idletime":
+				conn.WriteInt64(kvm.idleSeconds(m, cmd.Args[2], stored))
+			case "freq":
+				conn.WriteInt64(kvm.hotkeys.count(keyspaceOf(m).key(cmd.Args[2])))
+			}
+			return nil, nil
+		},
+	)
+}
+
+// cmdDebugObject handles "DEBUG OBJECT key", which reports what is stored
+// for a key, as a status reply of fields. The size is the length of the
+// value, and the stored size is its length in the database, with the
+// encoding header. Since there are no expirations and every value is a
+// string, the ttl is always -1 and the type is always string.
+func (kvm *Machine) cmdDebugObject(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			stored, err := kvm.storedValue(m, cmd.Args[2])
+			if err != nil {
+				return nil, err
+			}
+			if stored == nil {
+				return nil, errNoSuchKey
+			}
+			value, err := kvm.loadValue(nil, stored)
+			if err != nil {
+				return nil, err
+			}
+			conn.WriteString("type:string" +
+				" encoding:" + valueEncoding(stored) +
+				" size:" + strconv.Itoa(len(value)) +
+				" stored_size:" + strconv.Itoa(len(stored)) +
+				" version:" + strconv.FormatUint(valueVersion(stored), 10) +
+				" ttl:-1" +
+				" idle_seconds:" + strconv.FormatInt(kvm.idleSeconds(m, cmd.Args[2], stored), 10))
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,143 @@
+package kvnode
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+var errOutputBufferLimit = errors.New("argument must be a class, 'normal', " +
+	"'pubsub' or 'monitor', followed by the hard limit, the soft limit " +
+	"and the soft seconds")
+
+// OutputBufferLimit limits the output that's queued for a client that
+// doesn't read it fast enough. The client is disconnected when its queued
+// output exceeds Hard bytes, or exceeds Soft bytes for SoftSeconds. Zero
+// means no limit.
+type OutputBufferLimit struct {
+	Hard, Soft  int64
+	SoftSeconds int
+}
+
+// OutputBufferLimits are the output buffer limits of the classes of
+// clients. Normal clients are limited by the replies of their commands,
+// Pubsub clients by the events of WATCHKEYS, and Monitor clients by the
+// lines of MONITOR.
+type OutputBufferLimits struct {
+	Normal, Pubsub, Monitor OutputBufferLimit
+}
+
+// class returns the limit of a class by its name.
+func (l *OutputBufferLimits) class(name string) *OutputBufferLimit {
+	switch strings.ToLower(name) {
+	case "normal":
+		return &l.Normal
+	case "pubsub":
+		return &l.Pubsub
+	case "monitor":
+		return &l.Monitor
+	}
+	return nil
+}
+
+// String returns the limits in the format of the
+// client-output-buffer-limit parameter, such as
+// "normal 0 0 0 pubsub 33554432 8388608 60 monitor 0 0 0".
+func (l OutputBufferLimits) String() string {
+	var parts []string
+	for _, name := range []string{"normal", "pubsub", "monitor"} {
+		c := l.class(name)
+		parts = append(parts, name,
+			strconv.FormatInt(c.Hard, 10),
+			strconv.FormatInt(c.Soft, 10),
+			strconv.Itoa(c.SoftSeconds))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Set changes the limits of the classes in a client-output-buffer-limit
+// parameter, such as "pubsub 33554432 8388608 60". The classes that aren't
+// in the parameter keep their limits. It makes the limits a flag.Value.
+func (l *OutputBufferLimits) Set(s string) error {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return errOutputBufferLimit
+	}
+	nl := *l
+	for i := 0; i < len(fields); i += 4 {
+		c := nl.class(fields[i])
+		if c == nil {
+			return errOutputBufferLimit
+		}
+		hard, err1 := strconv.ParseUint(fields[i+1], 10, 63)
+		soft, err2 := strconv.ParseUint(fields[i+2], 10, 63)
+		secs, err3 := strconv.ParseUint(fields[i+3], 10, 31)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return errOutputBufferLimit
+		}
+		*c = OutputBufferLimit{Hard: int64(hard), Soft: int64(soft), SoftSeconds: int(secs)}
+	}
+	*l = nl
+	return nil
+}
+
+// outputQueue is the size of the output that's queued for a client, and
+// when it went over the soft limit.
+type outputQueue struct {
+	// size and softSince, which is the time in nanoseconds, or zero when
+	// the size is below the soft limit, are accessed atomically.
+	size      int64
+	softSince int64
+}
+
+// add adds n bytes to the queue, which may be negative once they're
+// written, and returns true when the queue exceeds the limit.
+func (q *outputQueue) add(n int64, limit OutputBufferLimit) bool {
+	return q.over(atomic.AddInt64(&q.size, n), limit)
+}
+
+// over returns true when a size of the queue exceeds the limit.
+func (q *outputQueue) over(size int64, limit OutputBufferLimit) bool {
+	if limit.Hard > 0 && size > limit.Hard {
+		return true
+	}
+	if limit.Soft <= 0 || size <= limit.Soft {
+		atomic.StoreInt64(&q.softSince, 0)
+		return false
+	}
+	now := time.Now().UnixNano()
+	if atomic.CompareAndSwapInt64(&q.softSince, 0, now) {
+		return false
+	}
+	since := atomic.LoadInt64(&q.softSince)
+	return time.Duration(now-since) >= time.Duration(limit.SoftSeconds)*time.Second
+}
+
+// slowConsumer counts and logs a client that's disconnected for exceeding
+// its output buffer limit, or for falling too far behind a stream.
+func (kvm *Machine) slowConsumer(c *client, class string) {
+	atomic.AddInt64(&kvm.stats.outputLimited, 1)
+	log.Warningf("client %s exceeded the %s output buffer limit, disconnecting",
+		c.addr, class)
+}
+
+// checkOutput disconnects a normal client whose replies exceed the output
+// buffer limit, before they're written. The replies are discarded.
+func (kvm *Machine) checkOutput(c *client, conn redcon.Conn) {
+	limit := kvm.options().OutputBufferLimits.Normal
+	if limit == (OutputBufferLimit{}) {
+		return
+	}
+	wr := redcon.BaseWriter(conn)
+	if wr == nil {
+		return
+	}
+	if c.out.over(int64(len(wr.Buffer())), limit) {
+		kvm.slowConsumer(c, "normal")
+		conn.Close()
+	}
+}
@@ -0,0 +1,105 @@
+package kvnode
+
+import (
+	"net"
+	"time"
+)
+
+// peersReloadInterval is how often the addresses of the raft peers are read.
+const peersReloadInterval = 10 * time.Second
+
+// errPeersOnly is written to the connections that the primary listener
+// refuses while peersOnly is true.
+const errPeersOnly = "-DENIED the primary address only accepts the nodes of " +
+	"the cluster while TLS, authentication or the admin listener is on, " +
+	"connect to a bind or the TLS address\r\n"
+
+// peersOnly returns true if the primary listener only accepts the nodes of
+// the cluster. The raft layer handles the raft commands before AUTH and the
+// admin listener, and the raft transport is plain text, so it's true while
+// clients must authenticate, while there's an admin listener, or while TLS
+// is on.
+func (kvm *Machine) peersOnly() bool {
+	if kvm.options().AdminAddr != "" || kvm.tlsOn() {
+		return true
+	}
+	u := kvm.user(defaultUser)
+	return !u.enabled || !u.nopass
+}
+
+// peerAllowed returns true if the primary listener, which is bound to laddr,
+// accepts a connection from raddr. While peersOnly is true, the listener only
+// accepts the local host, the raft peers and PeerNetworks, and clients
+// connect to a bind or the TLS listener, which check the raft commands like
+// the other commands.
+func (kvm *Machine) peerAllowed(raddr, laddr string) bool {
+	return !kvm.peersOnly() || kvm.isPeer(raddr, laddr)
+}
+
+// isPeer returns true if a connection from raddr to the primary listener,
+// which is bound to laddr, is from the local host, a raft peer or
+// PeerNetworks.
+func (kvm *Machine) isPeer(raddr, laddr string) bool {
+	ip := addrIP(raddr)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.Equal(addrIP(laddr)) {
+		return true
+	}
+	if containsIP(kvm.ipfilter.Load().(*ipFilter).peers, ip) {
+		return true
+	}
+	peers, _ := kvm.peerIPs.Load().([]net.IP)
+	for _, peer := range peers {
+		if peer.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchPeers reads the addresses of the raft peers for peerAllowed, until
+// the machine is closed. They're read every second until raft answers.
+func (kvm *Machine) watchPeers() {
+	wait := time.Second
+	for {
+		select {
+		case <-kvm.done:
+			return
+		case <-time.After(wait):
+		}
+		wait = peersReloadInterval
+		if err := kvm.loadPeers(); err != nil {
+			wait = time.Second
+		}
+	}
+}
+
+// loadPeers reads the addresses of the raft peers, and resolves the peers
+// that have host names.
+func (kvm *Machine) loadPeers() error {
+	peers, err := raftPeers(kvm.addr)
+	if err != nil {
+		return err
+	}
+	var ips []net.IP
+	for _, peer := range peers {
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			log.Warningf("could not resolve the raft peer %s: %v", peer, err)
+			continue
+		}
+		ips = append(ips, addrs...)
+	}
+	kvm.peerIPs.Store(ips)
+	return nil
+}
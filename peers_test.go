@@ -0,0 +1,136 @@
+package kvnode
+
+import (
+	"net"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestPeerAllowed(t *testing.T) {
+	m, closeMachine := openMachine(t, &Options{PeerNetworks: []string{"10.0.1.0/24"}})
+	defer closeMachine()
+	const laddr = "192.168.1.5:4920"
+	// without TLS, authentication and an admin listener, the primary
+	// listener serves the clients too.
+	if !m.peerAllowed("192.168.1.9:50000", laddr) {
+		t.Fatal("expected every address to be allowed")
+	}
+	base := *m.options()
+	for _, set := range []func(*Options){
+		func(opts *Options) { opts.TLSAddr = ":4921" },
+		func(opts *Options) { opts.Password = "secret" },
+		func(opts *Options) { opts.AdminAddr = "127.0.0.1:4930" },
+	} {
+		opts := base
+		set(&opts)
+		if err := m.storeOptions(&opts); err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			raddr   string
+			allowed bool
+		}{
+			{"127.0.0.1:50000", true},
+			{"[::1]:50000", true},
+			{"192.168.1.5:50000", true},
+			{"10.0.1.7:50000", true},
+			{"10.0.2.7:50000", false},
+			{"192.168.1.9:50000", false},
+		} {
+			if allowed := m.peerAllowed(test.raddr, laddr); allowed != test.allowed {
+				t.Fatalf("%s: expected %v, got %v", test.raddr, test.allowed, allowed)
+			}
+		}
+		m.peerIPs.Store([]net.IP{net.ParseIP("192.168.1.9")})
+		if !m.peerAllowed("192.168.1.9:50000", laddr) {
+			t.Fatal("expected the raft peers to be allowed")
+		}
+		m.peerIPs.Store([]net.IP(nil))
+		opts = base
+		if err := m.storeOptions(&opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRelayRaftCommands(t *testing.T) {
+	tn := startNode(t, nil)
+	defer tn.close()
+	r, err := listenRelay(Bind{Addr: "127.0.0.1:0"}, tn.addr, nil, tn.m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	conn := tn.dial()
+	defer conn.Close()
+	if _, err := conn.Do("CONFIG", "SET", "requirepass", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	client, err := redis.Dial("tcp", r.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, cmd := range []string{"RAFTADDPEER", "raftremovepeer", "RAFTSNAPSHOT", "RAFTSHRINKLOG"} {
+		_, err := client.Do(cmd, "127.0.0.1:1")
+		expectError(t, err, "NOAUTH")
+	}
+	if _, err := client.Do("AUTH", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	leader, err := redis.String(client.Do("RAFTLEADER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader != tn.addr {
+		t.Fatalf("expected %s, got %s", tn.addr, leader)
+	}
+	if _, err := client.Do("SET", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do("RAFT", "SNAPSHOT"); err != nil {
+		t.Fatal(err)
+	}
+	// the RPCs of the raft transport aren't RAFT subcommands.
+	_, err = client.Do("RAFTREQUESTVOTE", "x")
+	expectError(t, err, "unknown subcommand")
+}
+
+func TestRaftMembershipAdmin(t *testing.T) {
+	tn := startNode(t, &Options{AdminAddr: "127.0.0.1:0"})
+	defer tn.close()
+	public, err := listenRelay(Bind{Addr: "127.0.0.1:0"}, tn.addr, nil, tn.m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	admin, err := listenRelay(Bind{Addr: "127.0.0.1:0", Admin: true}, tn.addr, nil, tn.m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	client, err := redis.Dial("tcp", public.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, args := range [][]interface{}{
+		{"RAFTADDPEER", "127.0.0.1:1"},
+		{"RAFT", "REMOVEPEER", tn.addr},
+	} {
+		_, err := client.Do(args[0].(string), args[1:]...)
+		expectError(t, err, "admin listener")
+	}
+	if _, err := redis.String(client.Do("RAFT", "LEADER")); err != nil {
+		t.Fatal(err)
+	}
+	aconn, err := redis.Dial("tcp", admin.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aconn.Close()
+	// the node is the only peer, so adding it again is refused by raft.
+	_, err = aconn.Do("RAFTADDPEER", tn.addr)
+	expectError(t, err, "peer already known")
+}
@@ -0,0 +1,118 @@
+package kvnode
+
+import (
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// pipelineSlot is a pipelined write that's waiting for its batch to be
+// proposed.
+type pipelineSlot struct {
+	name    string
+	raw     []byte // the proposed command, when queued
+	respond func(interface{}) (interface{}, error)
+	err     error // the error of the command, when it wasn't queued
+	// fwd is the write that's forwarded to the leader when the node is a
+	// follower, with ReplicaReads.
+	fwd *forwardedWrite
+}
+
+// pipelineBatch is a run of writes that a client pipelined, which are
+// proposed to the raft log as a single GROUPEXEC entry.
+type pipelineBatch struct {
+	slots []*pipelineSlot
+	cur   *pipelineSlot // the command that's running
+}
+
+// pipelinedWrite returns true if the command is a write that's batched
+// when it's pipelined.
+func pipelinedWrite(cmd redcon.Command) bool {
+	if len(cmd.Args) == 0 {
+		return false
+	}
+	switch strings.ToLower(string(cmd.Args[0])) {
+	case "set", "mset", "del", "delif":
+		return true
+	}
+	return false
+}
+
+// nextPipelinedWrite returns true if the next command that the client
+// pipelined is a write that joins the batch.
+func nextPipelinedWrite(conn redcon.Conn) bool {
+	next := conn.PeekPipeline()
+	return len(next) > 0 && pipelinedWrite(next[0])
+}
+
+// pipelineCommand runs a pipelined write. The writes are queued by the
+// groupApplier until the last write of the run, which proposes them and
+// writes the replies in order.
+func (kvm *Machine) pipelineCommand(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	c := kvm.client(conn)
+	if c.pipe == nil {
+		c.pipe = &pipelineBatch{}
+	}
+	slot := &pipelineSlot{name: string(cmd.Args[0])}
+	c.pipe.slots = append(c.pipe.slots, slot)
+	c.pipe.cur = slot
+	_, slot.err = kvm.command(m, conn, cmd)
+	c.pipe.cur = nil
+	if nextPipelinedWrite(conn) &&
+		len(c.pipe.slots) < kvm.options().GroupCommitMax {
+		return nil, nil
+	}
+	pipe := c.pipe
+	c.pipe = nil
+	kvm.flushPipeline(m, conn, pipe)
+	return nil, nil
+}
+
+// flushPipeline proposes the queued writes of a batch, and writes the reply
+// of every command in the batch.
+func (kvm *Machine) flushPipeline(m finn.Applier, conn redcon.Conn, pipe *pipelineBatch) {
+	var group []*groupWrite
+	writes := make(map[*pipelineSlot]*groupWrite)
+	for _, slot := range pipe.slots {
+		if slot.respond != nil {
+			w := &groupWrite{raw: slot.raw, done: make(chan struct{})}
+			group = append(group, w)
+			writes[slot] = w
+		}
+	}
+	if len(group) > 0 {
+		kvm.addPending(len(group))
+		kvm.group.propose(m, group)
+		kvm.addPending(-len(group))
+	}
+	for _, slot := range pipe.slots {
+		err := slot.err
+		if w := writes[slot]; w != nil {
+			err = w.err
+			if err == nil {
+				_, err = slot.respond(w.val)
+			} else if slot.fwd != nil && notLeaderError(err) {
+				err = kvm.forward(kvm.client(conn), conn, slot.fwd)
+			}
+		}
+		if err != nil {
+			conn.WriteError(kvm.errorReply(err, slot.name))
+		}
+	}
+}
+
+// errorReply returns the error reply for a command, in the same way that
+// the raft layer replies with the errors that commands return.
+func (kvm *Machine) errorReply(err error, name string) string {
+	switch err.Error() {
+	case finn.ErrDisabled.Error(), finn.ErrUnknownCommand.Error():
+		return "ERR unknown command '" + name + "'"
+	case finn.ErrWrongNumberOfArguments.Error():
+		return "ERR wrong number of arguments for '" + name + "' command"
+	case raft.ErrNotLeader.Error():
+		return kvm.notLeader().Error()
+	}
+	return strings.TrimSpace(strings.Split(err.Error(), "\n")[0])
+}
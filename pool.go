@@ -0,0 +1,54 @@
+package kvnode
+
+import "sync"
+
+// maxPooledKey is the capacity above which key buffers are not returned to
+// the pool, so that a few big keys don't pin memory.
+const maxPooledKey = 64 * 1024
+
+// keyPool holds the buffers of database keys that are only needed while a
+// command runs, such as the keys of GET.
+var keyPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 64)
+		return &b
+	},
+}
+
+// getKeyBuf returns an empty key buffer from the pool.
+func getKeyBuf() *[]byte {
+	b := keyPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// putKeyBuf returns a key buffer to the pool. The keys in the buffer must
+// not be used after.
+func putKeyBuf(b *[]byte) {
+	if cap(*b) <= maxPooledKey {
+		keyPool.Put(b)
+	}
+}
+
+// arenaChunk is the minimum size of the chunks of a byteArena.
+const arenaChunk = 4096
+
+// byteArena copies byte slices into shared chunks, rather than allocating
+// each copy, for commands that return many keys or values.
+type byteArena struct {
+	buf []byte
+}
+
+// copy returns a copy of b, which is only valid as long as the arena is.
+func (a *byteArena) copy(b []byte) []byte {
+	if cap(a.buf)-len(a.buf) < len(b) {
+		n := arenaChunk
+		if len(b) > n {
+			n = len(b)
+		}
+		a.buf = make([]byte, 0, n)
+	}
+	start := len(a.buf)
+	a.buf = append(a.buf, b...)
+	return a.buf[start:len(a.buf):len(a.buf)]
+}
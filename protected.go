@@ -0,0 +1,63 @@
+package kvnode
+
+import (
+	"net"
+)
+
+// errProtectedMode is written to connections that are refused by protected
+// mode.
+const errProtectedMode = "-DENIED kvnode is running in protected mode because " +
+	"protected mode is enabled, the server is bound to all interfaces, and no " +
+	"password is set for the default user. In this mode connections are only " +
+	"accepted from the loopback interface. To accept connections from other " +
+	"hosts, either set a password with --requirepass or ACL SETUSER, bind " +
+	"specific interfaces with --addr and --bind, or disable protected mode " +
+	"with CONFIG SET protected-mode no.\r\n"
+
+// errGatewayProtected is the error of the requests that protected mode
+// refuses on the HTTP and gRPC gateways, followed by the flag of the
+// listener.
+const errGatewayProtected = "DENIED protected mode, set a password or bind " +
+	"a specific interface with "
+
+// isWildcardAddr returns true if the listener address binds all interfaces,
+// such as ":4920" or "0.0.0.0:4920".
+func isWildcardAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// isLoopbackAddr returns true if the address is on the loopback interface.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// protectedDenied returns true if protected mode refuses a connection from
+// raddr to the listener that's bound to laddr.
+func (kvm *Machine) protectedDenied(laddr, raddr string) bool {
+	return kvm.protected(laddr) && !isLoopbackAddr(raddr)
+}
+
+// protected returns true if protected mode applies to the listener that's
+// bound to laddr, which only accepts loopback connections then. Protected
+// mode only applies while the listener binds all interfaces and the default
+// user may connect without a password.
+func (kvm *Machine) protected(laddr string) bool {
+	if !kvm.options().ProtectedMode || !isWildcardAddr(laddr) {
+		return false
+	}
+	u := kvm.user(defaultUser)
+	return u != nil && u.enabled && u.nopass
+}
@@ -0,0 +1,78 @@
+package kvnode
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TestGatewayProtected checks that the HTTP and gRPC gateways refuse other
+// hosts in protected mode while they're bound to all interfaces.
+func TestGatewayProtected(t *testing.T) {
+	tn := startNode(t, &Options{ProtectedMode: true})
+	defer tn.close()
+	allowed := func(laddr, raddr string) (httpOK, grpcOK bool) {
+		g := &gateway{addr: tn.addr, laddr: laddr, m: tn.m}
+		h := g.guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		r := httptest.NewRequest("GET", "/keys/a", nil)
+		r.RemoteAddr = raddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		switch code := w.Result().StatusCode; code {
+		case http.StatusNoContent:
+			httpOK = true
+		case http.StatusForbidden:
+		default:
+			t.Fatalf("%s: unexpected status %d", raddr, code)
+		}
+
+		gg := &grpcGateway{addr: tn.addr, laddr: laddr, m: tn.m}
+		addr, err := net.ResolveTCPAddr("tcp", raddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+		_, err = gg.guardUnary(ctx, nil, nil, func(context.Context, interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		switch status.Code(err) {
+		case codes.OK:
+			grpcOK = true
+		case codes.PermissionDenied:
+		default:
+			t.Fatalf("%s: unexpected error %v", raddr, err)
+		}
+		return httpOK, grpcOK
+	}
+	for _, tc := range []struct {
+		laddr, raddr string
+		allowed      bool
+	}{
+		{"0.0.0.0:4950", "192.168.1.2:5000", false},
+		{"0.0.0.0:4950", "127.0.0.1:5000", true},
+		{"192.168.1.1:4950", "192.168.1.2:5000", true},
+	} {
+		httpOK, grpcOK := allowed(tc.laddr, tc.raddr)
+		if httpOK != tc.allowed || grpcOK != tc.allowed {
+			t.Fatalf("%s to %s: expected allowed %v, got http %v, grpc %v",
+				tc.raddr, tc.laddr, tc.allowed, httpOK, grpcOK)
+		}
+	}
+	// a password for the default user ends protected mode.
+	conn := tn.dial()
+	defer conn.Close()
+	if _, err := conn.Do("ACL", "SETUSER", "default", "resetpass", ">admin"); err != nil {
+		t.Fatal(err)
+	}
+	if httpOK, grpcOK := allowed("0.0.0.0:4950", "192.168.1.2:5000"); !httpOK || !grpcOK {
+		t.Fatalf("expected allowed with a password, got http %v, grpc %v", httpOK, grpcOK)
+	}
+}
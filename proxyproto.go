@@ -0,0 +1,147 @@
+package kvnode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// errUntrustedProxy is written to connections that may only send PROXY
+// protocol headers, from addresses that aren't trusted proxies.
+const errUntrustedProxy = "-DENIED proxy protocol is not accepted from this address\r\n"
+
+var (
+	errProxyHeader = errors.New("invalid proxy protocol header")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns the
+// source address of the client. An empty address is returned for the LOCAL
+// and UNKNOWN commands, which are used by health checks.
+func readProxyHeader(rd *bufio.Reader) (string, error) {
+	b, err := rd.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	switch b[0] {
+	case 'P':
+		line, err := rd.ReadSlice('\n')
+		if err != nil || len(line) > 107 {
+			return "", errProxyHeader
+		}
+		return parseProxyV1(strings.Fields(strings.TrimRight(string(line), "\r\n")))
+	case '\r':
+		hdr := make([]byte, 16)
+		if _, err := io.ReadFull(rd, hdr); err != nil {
+			return "", err
+		}
+		if !bytes.Equal(hdr[:12], proxyV2Sig) || hdr[12]>>4 != 2 {
+			return "", errProxyHeader
+		}
+		data := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return "", err
+		}
+		if hdr[12]&0xF == 0 {
+			// LOCAL
+			return "", nil
+		}
+		switch hdr[13] >> 4 {
+		case 1:
+			if len(data) < 12 {
+				return "", errProxyHeader
+			}
+			port := binary.BigEndian.Uint16(data[8:])
+			return net.JoinHostPort(net.IP(data[:4]).String(),
+				strconv.Itoa(int(port))), nil
+		case 2:
+			if len(data) < 36 {
+				return "", errProxyHeader
+			}
+			port := binary.BigEndian.Uint16(data[32:])
+			return net.JoinHostPort(net.IP(data[:16]).String(),
+				strconv.Itoa(int(port))), nil
+		}
+		return "", nil
+	}
+	return "", errProxyHeader
+}
+
+// parseProxyV1 parses the fields of a v1 header, such as
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 4920".
+func parseProxyV1(fields []string) (string, error) {
+	if len(fields) < 2 || !strings.EqualFold(fields[0], "proxy") {
+		return "", errProxyHeader
+	}
+	switch strings.ToUpper(fields[1]) {
+	case "UNKNOWN":
+		return "", nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 || net.ParseIP(fields[2]) == nil {
+			return "", errProxyHeader
+		}
+		if _, err := strconv.ParseUint(fields[4], 10, 16); err != nil {
+			return "", errProxyHeader
+		}
+		return net.JoinHostPort(fields[2], fields[4]), nil
+	}
+	return "", errProxyHeader
+}
+
+// cmdProxy handles a PROXY protocol v1 header that arrives on the primary
+// listener, where it's parsed as an inline command. It must be the first
+// command on the connection, which must be from a trusted proxy, and no
+// reply is written. Relayed connections had their headers read by the relay.
+func (kvm *Machine) cmdProxy(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	c := kvm.client(conn)
+	if !kvm.options().ProxyProtocol || c.lastCmd != "" ||
+		kvm.relay(conn.RemoteAddr()) != nil {
+		return nil, finn.ErrUnknownCommand
+	}
+	if !kvm.trustedProxy(conn.RemoteAddr()) {
+		kvm.rejectProxied(conn, errUntrustedProxy, "untrusted proxy", conn.RemoteAddr())
+		return nil, nil
+	}
+	fields := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		fields[i] = string(arg)
+	}
+	addr, err := parseProxyV1(fields)
+	if err != nil {
+		conn.Close()
+		return nil, nil
+	}
+	if addr != "" {
+		if !kvm.proxiedAllowed(addr) {
+			kvm.rejectProxied(conn, errIPDenied, "address not allowed", addr)
+			return nil, nil
+		}
+		if kvm.protected(kvm.addr) {
+			kvm.rejectProxied(conn, errProtectedMode, "protected mode", addr)
+			return nil, nil
+		}
+		c.mu.Lock()
+		c.addr = addr
+		c.mu.Unlock()
+	}
+	return nil, nil
+}
+
+// rejectProxied refuses a connection with an error reply. Closing the
+// connection discards the buffered replies, so the error is written
+// directly.
+func (kvm *Machine) rejectProxied(conn redcon.Conn, reply, reason, addr string) {
+	atomic.AddInt64(&kvm.stats.rejected, 1)
+	log.Warningf("%s, rejected %s", reason, addr)
+	conn.NetConn().Write([]byte(reply))
+	conn.Close()
+}
@@ -0,0 +1,94 @@
+package kvnode
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// raftCommands are the commands that the raft layer and the raft transport
+// handle before the machine, so they skip AUTH, the ACLs and the admin
+// listener. The relays forward them as RAFT subcommands, which are checked
+// like the other commands, and the transport RPCs aren't subcommands, so
+// they fail.
+var raftCommands = map[string]bool{
+	"raftaddpeer":         true,
+	"raftremovepeer":      true,
+	"raftleader":          true,
+	"raftsnapshot":        true,
+	"raftshrinklog":       true,
+	"raftstate":           true,
+	"raftstats":           true,
+	"raftpeers":           true,
+	"raftappendentries":   true,
+	"raftrequestvote":     true,
+	"raftinstallsnapshot": true,
+}
+
+// relayCommand returns the command that a relay forwards for a command of a
+// client, which is "RAFT ADDPEER addr" for "RAFTADDPEER addr".
+func relayCommand(cmd redcon.Command) []byte {
+	name := strings.ToLower(string(cmd.Args[0]))
+	if !raftCommands[name] {
+		return append([]byte(nil), cmd.Raw...)
+	}
+	args := append([][]byte{[]byte("raft"), []byte(name[4:])}, cmd.Args[1:]...)
+	return buildCommand(args...)
+}
+
+// cmdRaft handles the RAFT subcommands, which run the commands of the raft
+// layer on the node:
+//
+//	RAFT ADDPEER addr
+//	RAFT REMOVEPEER addr
+//	RAFT SNAPSHOT
+//	RAFT SHRINKLOG
+//	RAFT LEADER
+//	RAFT STATE
+//	RAFT STATS
+//	RAFT PEERS
+func (kvm *Machine) cmdRaft(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	sub := strings.ToLower(string(cmd.Args[1]))
+	switch sub {
+	default:
+		return nil, errors.New("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+	case "addpeer", "removepeer":
+		if len(cmd.Args) != 3 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+	case "snapshot", "shrinklog", "leader", "state", "stats", "peers":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+	}
+	// the client was checked, so the command is sent to the raft layer
+	// through the local server. Snapshots of big databases take a while, so
+	// there's no read timeout.
+	rconn, err := redis.Dial("tcp", kvm.addr,
+		redis.DialConnectTimeout(time.Second),
+		redis.DialWriteTimeout(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	defer rconn.Close()
+	args := make([]interface{}, len(cmd.Args)-2)
+	for i, arg := range cmd.Args[2:] {
+		args[i] = arg
+	}
+	reply, err := rconn.Do("raft"+sub, args...)
+	if rerr, ok := err.(redis.Error); ok {
+		reply, err = rerr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	writeForwarded(conn, reply)
+	return nil, nil
+}
@@ -0,0 +1,116 @@
+package kvnode
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// raftLogCheck is how often the size of the raft log is checked.
+	raftLogCheck = 10 * time.Second
+	// raftLogMaxWait is the least time between the snapshots that are taken
+	// because the raft log is over RaftLogMaxSize, so that a log that
+	// doesn't shrink below it, such as with large trailing entries, doesn't
+	// make the node take snapshots all the time.
+	raftLogMaxWait = time.Minute
+)
+
+// guardRaftLog checks the size of the raft log on disk, for INFO, and
+// applies RaftLogMaxSize and RaftLogShrink. A snapshot makes raft delete the
+// entries that it holds, except for the trailing entries, but the fastlog
+// backend only gives their space back when the log file is shrunk.
+func (kvm *Machine) guardRaftLog(logdir string) {
+	t := time.NewTicker(raftLogCheck)
+	defer t.Stop()
+	var lastSnap uint64
+	seen := false // whether lastSnap is known
+	var lastForced time.Time
+	shrinkable := true
+	atomic.StoreInt64(&kvm.raftLogSize, pathSize(filepath.Join(logdir, "raft.db")))
+	for {
+		select {
+		case <-kvm.done:
+			return
+		case <-t.C:
+		}
+		size := pathSize(filepath.Join(logdir, "raft.db"))
+		atomic.StoreInt64(&kvm.raftLogSize, size)
+		opts := kvm.options()
+		stats, _, err := kvm.raftInfo()
+		if err != nil {
+			continue
+		}
+		snap := statUint(stats, "last_snapshot_index")
+		shrink := opts.RaftLogShrink && seen && snap > lastSnap
+		if opts.RaftLogMaxSize > 0 && size > int64(opts.RaftLogMaxSize) &&
+			time.Since(lastForced) >= raftLogMaxWait {
+			lastForced = time.Now()
+			log.Noticef("raft log is %s, taking a snapshot", humanBytes(uint64(size)))
+			if err := raftDo(kvm.addr, "RAFTSNAPSHOT"); err != nil {
+				log.Warningf("raft log snapshot: %v", err)
+			} else if stats, _, err := kvm.raftInfo(); err == nil {
+				snap = statUint(stats, "last_snapshot_index")
+			}
+			shrink = true
+		}
+		lastSnap, seen = snap, true
+		if !shrink || !shrinkable {
+			continue
+		}
+		if err := raftDo(kvm.addr, "RAFTSHRINKLOG"); err != nil {
+			if strings.Contains(err.Error(), "not shrinkable") {
+				// the leveldb backend frees the space of the deleted
+				// entries by itself.
+				shrinkable = false
+				continue
+			}
+			log.Warningf("raft log shrink: %v", err)
+			continue
+		}
+		atomic.AddInt64(&kvm.stats.raftLogShrinks, 1)
+		atomic.StoreInt64(&kvm.raftLogSize, pathSize(filepath.Join(logdir, "raft.db")))
+	}
+}
+
+// raftLogEntries returns the number of entries that the raft log holds,
+// which are the entries since the last snapshot and the trailing entries
+// before it.
+func raftLogEntries(stats map[string]string) uint64 {
+	last := statUint(stats, "last_log_index")
+	first := statUint(stats, "last_snapshot_index")
+	if first > raftTrailingLogs {
+		first -= raftTrailingLogs
+	} else {
+		first = 0
+	}
+	if last < first {
+		return 0
+	}
+	return last - first
+}
+
+// pathSize returns the size of a file, or of the files in a directory, or -1
+// when it's unknown.
+func pathSize(path string) int64 {
+	var size int64
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// files are removed while the log is compacted.
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return -1
+	}
+	return size
+}
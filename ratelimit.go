@@ -0,0 +1,100 @@
+package kvnode
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errThrottledCommands = errors.New("THROTTLED command rate limit exceeded")
+	errThrottledBytes    = errors.New("THROTTLED bandwidth limit exceeded")
+)
+
+// rateLimiter is a token bucket, which holds up to one second of its rate.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+// allow takes n tokens at a rate per second. It returns false, and takes
+// nothing, when there aren't enough tokens. A full bucket allows anything,
+// so that a command that's larger than the rate isn't refused forever, and
+// the bucket goes into debt. A rate of zero allows everything.
+func (l *rateLimiter) allow(rate, n int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate != rate {
+		// a new or changed rate starts with a full bucket.
+		l.rate, l.tokens, l.last = rate, float64(rate), now
+	}
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.last = now
+	if l.tokens < float64(n) && l.tokens < float64(rate) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// rateLimits are the command and bandwidth limiters of a connection or a
+// user.
+type rateLimits struct {
+	commands rateLimiter
+	bytes    rateLimiter
+}
+
+// allow checks a command against the command rate and the bandwidth, which
+// is in bytes per second. The command counts against the command rate even
+// when the bandwidth refuses it.
+func (l *rateLimits) allow(rate, bandwidth int, cmd redcon.Command, now time.Time) error {
+	if !l.commands.allow(rate, 1, now) {
+		return errThrottledCommands
+	}
+	if !l.bytes.allow(bandwidth, len(cmd.Raw), now) {
+		return errThrottledBytes
+	}
+	return nil
+}
+
+// userLimits returns the limiters that are shared by the connections of a
+// user.
+func (kvm *Machine) userLimits(name string) *rateLimits {
+	kvm.lmu.Lock()
+	defer kvm.lmu.Unlock()
+	l := kvm.ulimits[name]
+	if l == nil {
+		l = &rateLimits{}
+		kvm.ulimits[name] = l
+	}
+	return l
+}
+
+// throttle returns a THROTTLED error when a command of the client exceeds
+// the limits of its connection or of its user.
+func (kvm *Machine) throttle(c *client, cmd redcon.Command) error {
+	opts := kvm.options()
+	now := time.Now()
+	err := c.limits.allow(opts.ClientRateLimit, opts.ClientBandwidthLimit, cmd, now)
+	if err == nil {
+		if u := kvm.user(c.userName()); u != nil &&
+			(u.rateLimit > 0 || u.bandwidthLimit > 0) {
+			err = kvm.userLimits(u.name).allow(u.rateLimit, u.bandwidthLimit, cmd, now)
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&kvm.stats.throttled, 1)
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package kvnode
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// readCacheShards is the number of shards of the read cache, which have
+// their own locks.
+const readCacheShards = 16
+
+// readCacheMaxValue is the size of the largest value that's cached, so that
+// a few large values don't push out the many small ones.
+const readCacheMaxValue = 16 * 1024
+
+// readCache is a read-through LRU cache of the decoded values of keys, for
+// GET. Every change to a key invalidates it once the change is written.
+type readCache struct {
+	shards [readCacheShards]cacheShard
+	hits   int64
+	misses int64
+}
+
+// cacheShard is a shard of the read cache. Its seq is incremented by every
+// invalidation, so that a value that was read before a change isn't added
+// after the change invalidated the key.
+type cacheShard struct {
+	mu    sync.Mutex
+	seq   uint64
+	items map[string]*list.Element
+	lru   list.List
+	size  int
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+}
+
+func (c *readCache) shard(key []byte) *cacheShard {
+	h := fnv.New32a()
+	h.Write(key)
+	return &c.shards[h.Sum32()%readCacheShards]
+}
+
+// get returns the value of a key. On a miss, it returns the sequence that
+// the value read from the database is added with.
+func (c *readCache) get(key []byte) ([]byte, uint64, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[string(key)]; ok {
+		s.lru.MoveToFront(e)
+		atomic.AddInt64(&c.hits, 1)
+		return e.Value.(*cacheEntry).value, 0, true
+	}
+	atomic.AddInt64(&c.misses, 1)
+	return nil, s.seq, false
+}
+
+// put adds the value of a key that was read at a sequence from get, unless
+// the shard was invalidated since. The least recently used values are
+// evicted to keep the cache within capacity bytes.
+func (c *readCache) put(key, value []byte, seq uint64, capacity int) {
+	if len(value) > readCacheMaxValue {
+		return
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seq != seq {
+		return
+	}
+	if s.items == nil {
+		s.items = make(map[string]*list.Element)
+	}
+	if e, ok := s.items[string(key)]; ok {
+		s.remove(e)
+	}
+	entry := &cacheEntry{key: string(key), value: append([]byte(nil), value...)}
+	s.items[entry.key] = s.lru.PushFront(entry)
+	s.size += entrySize(entry)
+	for s.size > capacity/readCacheShards && s.lru.Len() > 0 {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *cacheShard) remove(e *list.Element) {
+	entry := s.lru.Remove(e).(*cacheEntry)
+	delete(s.items, entry.key)
+	s.size -= entrySize(entry)
+}
+
+func entrySize(e *cacheEntry) int {
+	return len(e.key) + len(e.value)
+}
+
+// invalidate removes a key that was changed.
+func (c *readCache) invalidate(key []byte) {
+	s := c.shard(key)
+	s.mu.Lock()
+	s.seq++
+	if e, ok := s.items[string(key)]; ok {
+		s.remove(e)
+	}
+	s.mu.Unlock()
+}
+
+// clear removes every key, after the database was flushed or replaced.
+func (c *readCache) clear() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		s.seq++
+		s.items = nil
+		s.lru.Init()
+		s.size = 0
+		s.mu.Unlock()
+	}
+}
+
+// usage returns the number of keys and the bytes in the cache.
+func (c *readCache) usage() (keys, size int) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		keys += len(s.items)
+		size += s.size
+		s.mu.Unlock()
+	}
+	return keys, size
+}
+
+// Put and Delete implement leveldb.BatchReplay, so that the keys of a
+// written batch are invalidated.
+func (c *readCache) Put(key, value []byte) { c.invalidate(key) }
+func (c *readCache) Delete(key []byte)     { c.invalidate(key) }
+
+// writeDB writes a batch of changes to keys, and invalidates the keys in the
+// read cache. The caller must hold the machine lock.
+func (kvm *Machine) writeDB(batch *leveldb.Batch) error {
+	if err := kvm.db.Write(batch, kvm.writeOptions()); err != nil {
+		return err
+	}
+	return batch.Replay(&kvm.rcache)
+}
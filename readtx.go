@@ -0,0 +1,195 @@
+package kvnode
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errMultiReadOnly  = errors.New("ERR only read-only transactions are supported, use MULTI READONLY")
+	errMultiNested    = errors.New("ERR MULTI calls can not be nested")
+	errExecNoMulti    = errors.New("ERR EXEC without MULTI")
+	errDiscardNoMulti = errors.New("ERR DISCARD without MULTI")
+	errExecAbort      = errors.New("EXECABORT Transaction discarded because of previous errors.")
+	errTxCommand      = errors.New("ERR only GET, MGET, GETVER, KEYINFO and KEYS can run in a read-only transaction")
+)
+
+// txCommands are the commands that a read-only transaction may queue, which
+// read through reader or snapshot.
+var txCommands = map[string]func(kvm *Machine, m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error){
+	"get":     (*Machine).cmdGet,
+	"mget":    (*Machine).cmdMget,
+	"getver":  (*Machine).cmdGetver,
+	"keyinfo": (*Machine).cmdKeyinfo,
+	"keys":    (*Machine).cmdKeys,
+}
+
+// readTx is a read-only transaction of a client, which is queued between
+// MULTI READONLY and EXEC.
+type readTx struct {
+	cmds []redcon.Command
+	// aborted is true when a command failed to queue, which discards the
+	// transaction on EXEC.
+	aborted bool
+}
+
+// txControl returns true for the commands that aren't queued in a
+// transaction, which includes MINREV, for the reads of EXEC.
+func txControl(name string) bool {
+	return name == "multi" || name == "exec" || name == "discard" || name == "minrev"
+}
+
+// dbReader is the database, or a snapshot of it, that a read reads from.
+type dbReader interface {
+	iterable
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+}
+
+// txApplier runs the queued reads of a read-only transaction on the
+// snapshot of EXEC, as soon as they're applied.
+type txApplier struct {
+	finn.Applier
+	ss Snapshot
+}
+
+func (m txApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if mutate != nil {
+		return nil, errTxCommand
+	}
+	return respond(nil)
+}
+
+// txSnapshot returns the snapshot of the transaction that a command runs
+// in, or nil.
+func txSnapshot(m finn.Applier) Snapshot {
+	if km, ok := m.(keyspaceApplier); ok {
+		m = km.Applier
+	}
+	if tm, ok := m.(txApplier); ok {
+		return tm.ss
+	}
+	return nil
+}
+
+// reader returns what the reads of a command read from, which is the
+// snapshot of its transaction, or the database. The caller holds the
+// database read lock.
+func (kvm *Machine) reader(m finn.Applier) dbReader {
+	if ss := txSnapshot(m); ss != nil {
+		return ss
+	}
+	return kvm.db
+}
+
+// snapshot returns a point-in-time view for the reads of a command, which
+// is the snapshot of its transaction, or a new snapshot, and the function
+// that releases it. The caller holds the database read lock.
+func (kvm *Machine) snapshot(m finn.Applier) (Snapshot, func(), error) {
+	if ss := txSnapshot(m); ss != nil {
+		return ss, func() {}, nil
+	}
+	ss, err := kvm.db.GetSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ss, ss.Release, nil
+}
+
+// cmdMulti handles "MULTI READONLY", which queues the reads that follow
+// until EXEC.
+func (kvm *Machine) cmdMulti(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		if len(cmd.Args) == 1 {
+			return nil, errMultiReadOnly
+		}
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if strings.ToLower(string(cmd.Args[1])) != "readonly" {
+		return nil, errSyntaxError
+	}
+	c := kvm.client(conn)
+	if c.tx != nil {
+		return nil, errMultiNested
+	}
+	c.tx = &readTx{}
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// queueTx queues a command of a read-only transaction.
+func (kvm *Machine) queueTx(c *client, conn redcon.Conn, name string, cmd redcon.Command) (interface{}, error) {
+	if txCommands[name] == nil {
+		return nil, errTxCommand
+	}
+	c.tx.cmds = append(c.tx.cmds, redcon.Command{
+		Raw:  append([]byte(nil), cmd.Raw...),
+		Args: copyArgs(cmd.Args),
+	})
+	conn.WriteString("QUEUED")
+	return nil, nil
+}
+
+// cmdExec handles "EXEC", which runs the queued reads of a read-only
+// transaction on a single snapshot of the database, so that they see the
+// same writes, and replies with an array of their replies. EXEC is served
+// like a read, so the snapshot is as consistent as any read of the node.
+func (kvm *Machine) cmdExec(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	c := kvm.client(conn)
+	tx := c.tx
+	if tx == nil {
+		return nil, errExecNoMulti
+	}
+	c.tx = nil
+	if tx.aborted {
+		return nil, errExecAbort
+	}
+	ks := keyspaceOf(m)
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			kvm.dbmu.RLock()
+			ss, err := kvm.db.GetSnapshot()
+			kvm.dbmu.RUnlock()
+			if err != nil {
+				return nil, err
+			}
+			defer ss.Release()
+			var tm finn.Applier = txApplier{m, ss}
+			if ks != (keyspace{}) {
+				tm = keyspaceApplier{tm, ks}
+			}
+			conn.WriteArray(len(tx.cmds))
+			for _, qcmd := range tx.cmds {
+				name := strings.ToLower(string(qcmd.Args[0]))
+				if _, err := txCommands[name](kvm, tm, conn, qcmd); err != nil {
+					conn.WriteError(err.Error())
+				}
+			}
+			return nil, nil
+		},
+	)
+}
+
+// cmdDiscard handles "DISCARD", which drops a read-only transaction.
+func (kvm *Machine) cmdDiscard(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	c := kvm.client(conn)
+	if c.tx == nil {
+		return nil, errDiscardNoMulti
+	}
+	c.tx = nil
+	conn.WriteString("OK")
+	return nil, nil
+}
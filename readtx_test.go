@@ -0,0 +1,70 @@
+package kvnode
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestMultiReadonly(t *testing.T) {
+	tn := startNode(t, nil)
+	defer tn.close()
+	conn := tn.dial()
+	defer conn.Close()
+	other := tn.dial()
+	defer other.Close()
+	if _, err := conn.Do("MSET", "a", "70", "b", "30"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := conn.Do("MULTI")
+	expectError(t, err, "MULTI READONLY")
+	if _, err := conn.Do("MULTI", "READONLY"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Do("MULTI", "READONLY")
+	expectError(t, err, "nested")
+	for _, args := range [][]interface{}{{"a"}, {"b"}} {
+		if reply, err := redis.String(conn.Do("GET", args...)); err != nil || reply != "QUEUED" {
+			t.Fatalf("expected QUEUED, got %q %v", reply, err)
+		}
+	}
+	if _, err := conn.Do("MGET", "a", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	// the reads run when EXEC is served, and see the writes before it.
+	if _, err := other.Do("SET", "a", "60"); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := redis.String(reply[0], nil)
+	b, _ := redis.String(reply[1], nil)
+	mget, _ := redis.Strings(reply[2], nil)
+	if a != "60" || b != "30" || !reflect.DeepEqual(mget, []string{"60", "30", ""}) {
+		t.Fatalf("unexpected EXEC reply %q %q %q", a, b, mget)
+	}
+	// the writes can't be queued, and abort the transaction.
+	if _, err := conn.Do("MULTI", "READONLY"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Do("SET", "a", "0")
+	expectError(t, err, "read-only transaction")
+	_, err = conn.Do("EXEC")
+	expectError(t, err, "EXECABORT")
+	if value, err := redis.String(conn.Do("GET", "a")); err != nil || value != "60" {
+		t.Fatalf("expected 60, got %q %v", value, err)
+	}
+	if _, err := conn.Do("MULTI", "READONLY"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("DISCARD"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Do("EXEC")
+	expectError(t, err, "EXEC without MULTI")
+	_, err = conn.Do("DISCARD")
+	expectError(t, err, "DISCARD without MULTI")
+}
@@ -0,0 +1,265 @@
+package kvnode
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// rejoinMinBackoff and rejoinMaxBackoff are the bounds of the wait
+	// between the attempts to join or rejoin the cluster, which doubles
+	// after each failed attempt.
+	rejoinMinBackoff = 500 * time.Millisecond
+	rejoinMaxBackoff = 30 * time.Second
+	// rejoinCheck is how often a node checks that it has a leader.
+	rejoinCheck = time.Second
+	// rejoinAfter is how long a node must be without a leader before it
+	// tries to rejoin the cluster.
+	rejoinAfter = 10 * time.Second
+)
+
+var errNoLeaderFound = errors.New("no leader was found among the known nodes")
+
+// backoff is an exponential backoff with jitter.
+type backoff struct {
+	next time.Duration
+}
+
+// wait returns the time until the next attempt, which is between half and
+// all of the backoff, and doubles the backoff.
+func (b *backoff) wait() time.Duration {
+	if b.next == 0 {
+		b.next = rejoinMinBackoff
+	}
+	d := b.next/2 + time.Duration(rand.Int63n(int64(b.next/2)+1))
+	if b.next *= 2; b.next > rejoinMaxBackoff {
+		b.next = rejoinMaxBackoff
+	}
+	return d
+}
+
+// reset returns the backoff to its minimum, after an attempt succeeded.
+func (b *backoff) reset() {
+	b.next = 0
+}
+
+// ParseJoin returns the addresses of a comma separated list of join
+// addresses, such as "10.0.1.5:4920,10.0.1.6:4920".
+func ParseJoin(join string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(join, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// findLeader asks the nodes, starting with the node at the offset, which is
+// advanced past the nodes that were asked, for the leader of their cluster.
+// It returns the leader, which isn't self.
+func findLeader(addrs []string, offset *int, self string) (string, error) {
+	for range addrs {
+		addr := addrs[*offset%len(addrs)]
+		*offset++
+		if addr == self {
+			continue
+		}
+		conn, err := dialRaft(addr)
+		if err != nil {
+			log.Verbosef("join: %s is unreachable: %v", addr, err)
+			continue
+		}
+		leader, err := redis.String(conn.Do("RAFTLEADER"))
+		conn.Close()
+		if err == nil && leader != "" && leader != self {
+			return leader, nil
+		}
+		log.Verbosef("join: %s doesn't know a leader", addr)
+	}
+	return "", errNoLeaderFound
+}
+
+// joinLeader returns the leader of the cluster of the join addresses, for a
+// node that has no raft log yet. The addresses are tried in turn, with a
+// backoff between rounds, until one of them knows the leader, so that the
+// node doesn't fail to start while the cluster is unreachable or electing
+// a leader. A node with a raft log already knows its peers, and returns the
+// first join address, which raft ignores.
+func joinLeader(addrs []string, self, logdir string) string {
+	if _, err := os.Stat(filepath.Join(logdir, "raft.db")); err == nil {
+		return addrs[0]
+	}
+	var b backoff
+	var offset int
+	for start := time.Now(); ; {
+		leader, err := findLeader(addrs, &offset, self)
+		if err == nil {
+			log.Noticef("joining the leader %s", leader)
+			return leader
+		}
+		wait := b.wait()
+		log.Warningf("join: %v, retrying in %s (waiting for %s)", err,
+			wait.Round(time.Millisecond), time.Since(start).Round(time.Second))
+		time.Sleep(wait)
+	}
+}
+
+// rejoinCluster keeps the node in its cluster, while AutoRejoin is on. When
+// the node has had no leader for rejoinAfter, or its raft stopped because it
+// applied its own removal, it asks the join addresses and the peers that it
+// knows for the leader, in turn. A node that the leader has as a peer waits
+// for the leader to reach it. Otherwise, since the raft log of the node
+// holds its removal, the node discards its raft log and joins the leader
+// again, like a new node, and receives the data from the leader. The
+// attempts back off exponentially, with jitter, until the node has a leader.
+func (kvm *Machine) rejoinCluster(joins []string) {
+	var b backoff
+	var lost, next time.Time
+	var offset int
+	for {
+		select {
+		case <-kvm.done:
+			return
+		case <-time.After(rejoinCheck):
+		}
+		if !kvm.options().AutoRejoin {
+			lost = time.Time{}
+			continue
+		}
+		stats, leader, err := kvm.raftInfo()
+		shutdown := err == nil && stats["state"] == "Shutdown"
+		switch {
+		case err != nil:
+			continue
+		case leader != "" || stats["state"] == "Leader":
+			if !next.IsZero() {
+				log.Noticef("rejoin: the leader is %s", leader)
+			}
+			lost, next = time.Time{}, time.Time{}
+			b.reset()
+			continue
+		case lost.IsZero() && !shutdown:
+			lost = time.Now()
+			continue
+		case (!shutdown && time.Since(lost) < rejoinAfter) || time.Now().Before(next):
+			continue
+		}
+		err = kvm.rejoin(joins, &offset, shutdown)
+		wait := b.wait()
+		next = time.Now().Add(wait)
+		if err != nil {
+			log.Warningf("rejoin: %v, retrying in %s", err, wait.Round(time.Millisecond))
+		}
+	}
+}
+
+// rejoin finds the leader of the cluster, and makes the node join it again
+// when the leader doesn't have the node as a peer, or the raft of the node
+// was shut down.
+func (kvm *Machine) rejoin(joins []string, offset *int, shutdown bool) error {
+	addrs := append([]string(nil), joins...)
+	if peers, err := raftPeers(kvm.addr); err == nil {
+		for _, peer := range peers {
+			if !containsString(addrs, peer) {
+				addrs = append(addrs, peer)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return errNoLeaderFound
+	}
+	leader, err := findLeader(addrs, offset, kvm.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := dialRaft(leader)
+	if err != nil {
+		return err
+	}
+	peers, err := redis.StringMap(conn.Do("RAFTPEERS"))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	stats, err := redis.StringMap(conn.Do("RAFTSTATS"))
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	_, known := peers[kvm.addr]
+	if known && !shutdown {
+		log.Verbosef("rejoin: the leader %s has the node, waiting for its contact", leader)
+		return nil
+	}
+	// a node that replays its own removal from the log of the leader shuts
+	// down again, so it must receive a snapshot of the leader that's taken
+	// after its removal, which the leader only sends once its log was
+	// compacted.
+	if statUint(stats, "last_log_index") <= raftTrailingLogs {
+		return errors.New("the log of the leader " + leader +
+			" isn't compacted yet, so the node would replay its removal")
+	}
+	// the cluster must keep its quorum without the node, in case the node
+	// doesn't come up.
+	delete(peers, kvm.addr)
+	var up int
+	for _, state := range peers {
+		if state == "Leader" || state == "Follower" {
+			up++
+		}
+	}
+	if up < (len(peers)+1)/2+1 {
+		return errors.New("the cluster of the leader " + leader +
+			" would lose its quorum if the node failed to join")
+	}
+	if known {
+		// the node joins as a new node, which the leader must not know.
+		err := raftDo(leader, "RAFTREMOVEPEER", kvm.addr)
+		if err != nil && !strings.Contains(err.Error(), "peer is unknown") {
+			return err
+		}
+	}
+	// changes of the peers aren't applied to the machine, so a snapshot that
+	// follows the removal needs a write that follows it, which "HLC UPDATE 0"
+	// is, without changing the clock.
+	if err := raftDo(leader, "HLC", "UPDATE", 0); err != nil {
+		return err
+	}
+	if err := raftDo(leader, "RAFTSNAPSHOT"); err != nil {
+		return err
+	}
+	log.Noticef("rejoin: the node isn't a peer of the leader %s, joining it again", leader)
+	select {
+	case kvm.rejoinc <- leader:
+	default:
+	}
+	return nil
+}
+
+// resetRaft removes the raft log and the raft snapshots of a node that
+// joins its cluster again. The data of the node is kept, and replaced by
+// the snapshot or the log of the leader.
+func resetRaft(logdir string) error {
+	for _, name := range []string{"raft.db", "snapshots"} {
+		if err := os.RemoveAll(filepath.Join(logdir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package kvnode
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+const relayHandshakeTimeout = time.Second * 10
+
+// relayBatch is how many commands of a client a relay reads ahead of the
+// upstream connection.
+const relayBatch = 128
+
+// relayInfo describes a client connection that arrived through a relay.
+type relayInfo struct {
+	// remoteAddr is the address of the actual client.
+	remoteAddr string
+	// certName is the common name of the verified client certificate.
+	certName string
+	// admin is true for connections from the admin listener.
+	admin bool
+	// user is the user that the listener authenticates connections as.
+	user string
+}
+
+// relay accepts client connections on a secondary listener and forwards
+// them to the primary node address. The raft transport owns the primary
+// listener, so features such as TLS are layered on by relaying through
+// the local node.
+type relay struct {
+	ln        net.Listener
+	bind      Bind
+	target    string
+	tlsConfig *tls.Config
+	m         *Machine
+}
+
+// bufferedConn is a net.Conn that reads through a buffered reader. It's used
+// to continue reading after a PROXY protocol header was peeked.
+type bufferedConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.rd.Read(p)
+}
+
+// listenRelay binds a new relay listener and starts accepting connections
+// in the background. The tlsConfig is used when the bind accepts TLS.
+func listenRelay(b Bind, target string, tlsConfig *tls.Config, m *Machine) (*relay, error) {
+	ln, err := b.listen()
+	if err != nil {
+		return nil, err
+	}
+	if !b.TLS {
+		tlsConfig = nil
+	}
+	r := &relay{ln: ln, bind: b, target: target, tlsConfig: tlsConfig, m: m}
+	go r.serve()
+	return r, nil
+}
+
+// Close stops the relay from accepting new connections.
+func (r *relay) Close() error {
+	return r.ln.Close()
+}
+
+func (r *relay) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(time.Millisecond * 10)
+				continue
+			}
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+// reject refuses a connection with an error reply.
+func (r *relay) reject(conn net.Conn, reply, reason, addr string) {
+	atomic.AddInt64(&r.m.stats.rejected, 1)
+	conn.Write([]byte(reply))
+	log.Warningf("%s, rejected %s", reason, addr)
+}
+
+func (r *relay) handle(conn net.Conn) {
+	defer conn.Close()
+	info := &relayInfo{
+		remoteAddr: conn.RemoteAddr().String(),
+		admin:      r.bind.Admin,
+		user:       r.bind.User,
+	}
+	if r.bind.Unix {
+		// Unix clients have no address, so they're known by the socket,
+		// and they're local, so the address filters don't apply.
+		info.remoteAddr = r.bind.Addr + ":0"
+	} else {
+		// the peer, which is the proxy itself when there is one, is
+		// checked before any PROXY header is read.
+		if !r.m.ipAllowed(info.remoteAddr, conn.LocalAddr().String()) {
+			r.reject(conn, errIPDenied, "address not allowed", info.remoteAddr)
+			return
+		}
+		if r.m.protectedDenied(r.ln.Addr().String(), info.remoteAddr) {
+			r.reject(conn, errProtectedMode, "protected mode", info.remoteAddr)
+			return
+		}
+		if r.m.options().ProxyProtocol {
+			if !r.m.trustedProxy(info.remoteAddr) {
+				r.reject(conn, errUntrustedProxy, "untrusted proxy", info.remoteAddr)
+				return
+			}
+			// the header is sent by the proxy prior to any TLS handshake.
+			conn.SetDeadline(time.Now().Add(relayHandshakeTimeout))
+			rd := bufio.NewReader(conn)
+			addr, err := readProxyHeader(rd)
+			if err != nil {
+				log.Verbosef("proxy protocol failed: %s: %v", info.remoteAddr, err)
+				return
+			}
+			if addr != "" {
+				if !r.m.proxiedAllowed(addr) {
+					r.reject(conn, errIPDenied, "address not allowed", addr)
+					return
+				}
+				if r.m.protected(r.ln.Addr().String()) {
+					r.reject(conn, errProtectedMode, "protected mode", addr)
+					return
+				}
+				info.remoteAddr = addr
+			}
+			conn.SetDeadline(time.Time{})
+			conn = &bufferedConn{Conn: conn, rd: rd}
+		}
+	}
+	// the relayed connection comes from the local host, so the client is
+	// counted towards MaxClients here.
+	if !r.m.admitClient() {
+		r.reject(conn, errMaxClients, "max number of clients reached", info.remoteAddr)
+		return
+	}
+	defer r.m.releaseClient()
+	if r.tlsConfig != nil {
+		tconn := tls.Server(conn, r.tlsConfig)
+		conn = tconn
+		tconn.SetDeadline(time.Now().Add(relayHandshakeTimeout))
+		if err := tconn.Handshake(); err != nil {
+			log.Verbosef("tls handshake failed: %s: %v", info.remoteAddr, err)
+			return
+		}
+		tconn.SetDeadline(time.Time{})
+		state := tconn.ConnectionState()
+		if len(state.VerifiedChains) > 0 {
+			info.certName = state.VerifiedChains[0][0].Subject.CommonName
+		}
+	}
+	upstream, err := net.Dial("tcp", r.target)
+	if err != nil {
+		log.Warningf("could not relay connection: %v", err)
+		return
+	}
+	defer upstream.Close()
+
+	// register the upstream connection prior to forwarding any client
+	// data, so the first command can be matched to the relay.
+	key := upstream.LocalAddr().String()
+	r.m.setRelay(key, info)
+	defer r.m.setRelay(key, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}()
+	relayCommands(upstream, conn)
+	upstream.Close()
+	wg.Wait()
+}
+
+// relayCommands forwards the commands of a client to the upstream connection
+// until the client is gone, and writes them in batches as they're read. The
+// commands go through relayCommand, so the raft commands are checked like
+// the others.
+func relayCommands(upstream, conn net.Conn) {
+	cmds := make(chan []byte, relayBatch)
+	go func() {
+		defer close(cmds)
+		rd := redcon.NewReader(conn)
+		for {
+			cmd, err := rd.ReadCommand()
+			if err != nil {
+				if err != io.EOF {
+					log.Verbosef("could not relay command: %v", err)
+				}
+				return
+			}
+			cmds <- relayCommand(cmd)
+		}
+	}()
+	wr := bufio.NewWriter(upstream)
+	for raw := range cmds {
+		_, err := wr.Write(raw)
+		if err == nil && len(cmds) == 0 {
+			err = wr.Flush()
+		}
+		if err != nil {
+			// the reader stops once the client is closed.
+			conn.Close()
+			for range cmds {
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package kvnode
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/hashicorp/raft"
+)
+
+var errLogLevel = errors.New("invalid log level, expected debug, verbose, notice or warning")
+
+// logLevels are the levels of LogLevel.
+var logLevels = map[string]int{"debug": 0, "verbose": 1, "notice": 2, "warning": 3}
+
+// reloadConfig loads the config file again, and applies the settings that
+// changed in the file since it was last loaded, like CONFIG SET does. The
+// settings that were changed with CONFIG SET and not in the file are kept.
+// Every change is logged, as are the changes that require a restart.
+func (kvm *Machine) reloadConfig() {
+	reload := kvm.options().Reload
+	if reload == nil {
+		return
+	}
+	nopts, err := reload()
+	if err != nil {
+		log.Warningf("could not reload the config: %v", err)
+		return
+	}
+	nopts = fillOptions(nopts)
+	var names []string
+	for name := range configParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	kvm.cfgmu.Lock()
+	loaded := kvm.loaded
+	kvm.cfgmu.Unlock()
+	cur := kvm.options()
+	var changed int
+	for _, name := range names {
+		p := configParams[name]
+		val := p.get(nopts)
+		if val == p.get(loaded) {
+			continue
+		}
+		changed++
+		switch {
+		case p.set == nil:
+			log.Warningf("config: %s changed to '%s', which requires a restart",
+				name, shownConfig(name, val))
+			continue
+		case p.replicated:
+			_, err = kvm.exec([]byte("config"), []byte("set"),
+				[]byte(name), []byte(val))
+		default:
+			err = kvm.setConfig(map[string]string{name: val})
+		}
+		if err != nil && err.Error() == raft.ErrNotLeader.Error() {
+			log.Noticef("config: %s is cluster-wide, it's changed by the config file of the leader", name)
+			continue
+		}
+		if err != nil {
+			log.Warningf("config: could not change %s to '%s': %v", name, shownConfig(name, val), err)
+			continue
+		}
+		log.Noticef("config: %s changed from '%s' to '%s'", name,
+			shownConfig(name, p.get(cur)), shownConfig(name, val))
+	}
+	kvm.cfgmu.Lock()
+	kvm.loaded = nopts
+	kvm.cfgmu.Unlock()
+	if changed == 0 {
+		log.Noticef("config: reloaded, nothing changed")
+	}
+}
+
+// shownConfig returns the value of a setting for the log, which hides the
+// password.
+func shownConfig(name, val string) string {
+	if name == "requirepass" && val != "" {
+		return "(hidden)"
+	}
+	return val
+}
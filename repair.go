@@ -0,0 +1,263 @@
+package kvnode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/table"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// openCorrupted handles the error of opening a database that's corrupted.
+// With RecoverDB, the tables are salvaged and the manifest is rebuilt from
+// them. Otherwise the error tells how to recover it.
+func (kvm *Machine) openCorrupted(stor storage.Storage, err error) (*leveldb.DB, error) {
+	if !lerrors.IsCorrupted(err) {
+		return nil, err
+	}
+	if !kvm.options().RecoverDB {
+		return nil, errors.New(err.Error() +
+			", start the node with --recover-db to salvage the database, or remove it to resync from the cluster")
+	}
+	log.Warningf("the database is corrupted: %v", err)
+	log.Warningf("recovering the database, the keys of damaged blocks are lost")
+	start := time.Now()
+	if err := salvageTables(stor, kvm.opts); err != nil {
+		return nil, errors.New("could not recover the database: " + err.Error())
+	}
+	db, rerr := leveldb.Recover(stor, kvm.opts)
+	if rerr != nil {
+		return nil, errors.New("could not recover the database: " + rerr.Error())
+	}
+	log.Noticef("recovered the database in %s", time.Since(start))
+	return db, nil
+}
+
+// salvageTables rewrites the tables that have blocks that fail their
+// checksums without those blocks, and removes the tables that can't be
+// read. LevelDB's recovery would rewrite the tables itself, but with index
+// keys that it then can't read.
+func salvageTables(stor storage.Storage, o *opt.Options) error {
+	fds, err := stor.List(storage.TypeTable)
+	if err != nil {
+		return err
+	}
+	// without StrictReader, the iterators skip the corrupted blocks.
+	ro := &opt.Options{Strict: opt.StrictBlockChecksum}
+	wo := &opt.Options{Comparer: internalComparer{}, Compression: o.GetCompression()}
+	for _, fd := range fds {
+		r, err := stor.Open(fd)
+		if err != nil {
+			return err
+		}
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			r.Close()
+			return err
+		}
+		tr, err := table.NewReader(r, size, fd, nil, nil, ro)
+		if err != nil {
+			r.Close()
+			if !lerrors.IsCorrupted(err) {
+				return err
+			}
+			log.Warningf("removing the table %s, which can't be read: %v", fd, err)
+			if err := stor.Remove(fd); err != nil {
+				return err
+			}
+			continue
+		}
+		blocks, entries, err := salvageTable(tr, nil)
+		if err == nil && blocks > 0 {
+			log.Warningf("rewriting the table %s without %d corrupted blocks", fd, blocks)
+			tmp := storage.FileDesc{Type: storage.TypeTemp, Num: fd.Num}
+			var w storage.Writer
+			if w, err = stor.Create(tmp); err == nil {
+				tw := table.NewWriter(w, wo)
+				if _, entries, err = salvageTable(tr, tw); err == nil {
+					err = tw.Close()
+				}
+				if serr := w.Sync(); err == nil {
+					err = serr
+				}
+				if cerr := w.Close(); err == nil {
+					err = cerr
+				}
+				if err == nil {
+					err = stor.Rename(tmp, fd)
+				} else {
+					stor.Remove(tmp)
+				}
+			}
+			log.Warningf("salvaged %d entries of the table %s", entries, fd)
+		}
+		tr.Release()
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// salvageTable reads the entries of a table, skipping the blocks that are
+// corrupted, and appends them to a table writer when it's not nil. It
+// returns the number of corrupted blocks and of entries.
+func salvageTable(tr *table.Reader, tw *table.Writer) (blocks, entries int, err error) {
+	iter := tr.NewIterator(nil, nil)
+	defer iter.Release()
+	if setter, ok := iter.(iterator.ErrorCallbackSetter); ok {
+		setter.SetErrorCallback(func(err error) {
+			if lerrors.IsCorrupted(err) {
+				blocks++
+			}
+		})
+	}
+	for iter.Next() {
+		key := iter.Key()
+		if len(key) < 8 || key[len(key)-8] > 1 {
+			// not an entry, whose type is a deletion or a value.
+			continue
+		}
+		if tw != nil {
+			if err := tw.Append(key, iter.Value()); err != nil {
+				return blocks, entries, err
+			}
+		}
+		entries++
+	}
+	return blocks, entries, iter.Error()
+}
+
+// internalComparer orders the keys of the tables of LevelDB, which are the
+// user key followed by the sequence number and the type, by the user key and
+// then newest first. The keys of the index blocks are kept whole.
+type internalComparer struct{}
+
+func (internalComparer) Name() string { return "leveldb.BytewiseComparator" }
+
+func (internalComparer) Compare(a, b []byte) int {
+	if c := bytes.Compare(a[:len(a)-8], b[:len(b)-8]); c != 0 {
+		return c
+	}
+	an := binary.LittleEndian.Uint64(a[len(a)-8:])
+	bn := binary.LittleEndian.Uint64(b[len(b)-8:])
+	switch {
+	case an > bn:
+		return -1
+	case an < bn:
+		return 1
+	}
+	return 0
+}
+
+func (internalComparer) Separator(dst, a, b []byte) []byte { return nil }
+
+func (internalComparer) Successor(dst, b []byte) []byte { return nil }
+
+// dbCheck is the outcome of checkDB.
+type dbCheck struct {
+	tables    int
+	entries   int64
+	bytes     int64
+	corrupted []string
+}
+
+// checkDB reads every table of the database and verifies the checksums of
+// its blocks. A table that fails is reported and the others are still
+// checked. Tables that compactions remove while they're read are skipped.
+// The caller holds dbmu.
+func (kvm *Machine) checkDB() (*dbCheck, error) {
+	fds, err := kvm.stor.List(storage.TypeTable)
+	if err != nil {
+		return nil, err
+	}
+	o := &opt.Options{Strict: opt.StrictAll}
+	var check dbCheck
+	for _, fd := range fds {
+		r, err := kvm.stor.Open(fd)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		size, err := r.Seek(0, io.SeekEnd)
+		if err == nil {
+			var n int64
+			n, err = checkTable(r, size, fd, o)
+			check.entries += n
+		}
+		r.Close()
+		check.tables++
+		check.bytes += size
+		if err != nil {
+			check.corrupted = append(check.corrupted, err.Error())
+		}
+	}
+	return &check, nil
+}
+
+// checkTable reads the entries of a table, and returns their number.
+func checkTable(r io.ReaderAt, size int64, fd storage.FileDesc, o *opt.Options) (int64, error) {
+	tr, err := table.NewReader(r, size, fd, nil, nil, o)
+	if err != nil {
+		return 0, lerrors.SetFd(err, fd)
+	}
+	defer tr.Release()
+	iter := tr.NewIterator(nil, nil)
+	defer iter.Release()
+	var n int64
+	for iter.Next() {
+		n++
+	}
+	return n, lerrors.SetFd(iter.Error(), fd)
+}
+
+// cmdCheckDB handles "CHECKDB", which verifies the checksums of the tables
+// of the storage of this node, and replies with the number of tables,
+// entries and bytes that were read, and the errors of the tables that are
+// corrupted. Like COMPACT, it only checks this node.
+func (kvm *Machine) cmdCheckDB(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if kvm.options().InMemory {
+		return nil, errors.New("ERR the database is in memory")
+	}
+	kvm.dbmu.RLock()
+	defer kvm.dbmu.RUnlock()
+	start := time.Now()
+	check, err := kvm.checkDB()
+	if err != nil {
+		return nil, err
+	}
+	if len(check.corrupted) > 0 {
+		log.Warningf("checkdb: %d of %d tables are corrupted", len(check.corrupted), check.tables)
+	}
+	writeMap(conn, 5)
+	conn.WriteBulkString("tables")
+	conn.WriteInt(check.tables)
+	conn.WriteBulkString("entries")
+	conn.WriteInt64(check.entries)
+	conn.WriteBulkString("bytes")
+	conn.WriteInt64(check.bytes)
+	conn.WriteBulkString("corrupted")
+	conn.WriteArray(len(check.corrupted))
+	for _, msg := range check.corrupted {
+		conn.WriteBulkString(msg)
+	}
+	conn.WriteBulkString("elapsed_ms")
+	conn.WriteInt64(int64(time.Since(start) / time.Millisecond))
+	return nil, nil
+}
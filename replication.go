@@ -0,0 +1,236 @@
+package kvnode
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/garyburd/redigo/redis"
+)
+
+// raftTrailingLogs is the number of entries that raft keeps in its log
+// after a snapshot, which is the default of the raft library. Followers
+// that are further behind the last snapshot must install a snapshot.
+const raftTrailingLogs = 10240
+
+// peerContact is what the leader knows about a follower from the
+// replication metrics of raft.
+type peerContact struct {
+	lastContact      time.Time
+	snapshots        int64         // installed snapshots
+	lastSnapshotTime time.Duration // the time to install the last one
+}
+
+// raftMetrics is a metrics sink for the raft library, which only records
+// the replication metrics of each follower. The raft library reports
+// metrics through a process wide sink, so it's shared by every machine.
+type raftMetrics struct {
+	mu    sync.Mutex
+	peers map[string]*peerContact
+}
+
+var (
+	raftMetricsOnce sync.Once
+	raftPeerMetrics = &raftMetrics{peers: make(map[string]*peerContact)}
+)
+
+// installRaftMetrics routes the raft metrics to raftPeerMetrics.
+func installRaftMetrics() {
+	raftMetricsOnce.Do(func() {
+		conf := metrics.DefaultConfig("")
+		conf.EnableHostname = false
+		conf.EnableRuntimeMetrics = false
+		metrics.NewGlobal(conf, raftPeerMetrics)
+	})
+}
+
+func (s *raftMetrics) SetGauge(key []string, val float32)    {}
+func (s *raftMetrics) EmitKey(key []string, val float32)     {}
+func (s *raftMetrics) IncrCounter(key []string, val float32) {}
+
+// AddSample receives the duration of the replication RPCs, which are
+// "raft.replication.{heartbeat,appendEntries.rpc,installSnapshot}.{peer}"
+// in milliseconds. They're only sampled when the RPC succeeded.
+func (s *raftMetrics) AddSample(key []string, val float32) {
+	if len(key) < 4 || key[0] != "raft" || key[1] != "replication" {
+		return
+	}
+	var peer string
+	switch key[2] {
+	default:
+		return
+	case "heartbeat", "installSnapshot":
+		peer = key[3]
+	case "appendEntries":
+		if len(key) < 5 || key[3] != "rpc" {
+			return
+		}
+		peer = key[4]
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pc := s.peers[peer]
+	if pc == nil {
+		pc = &peerContact{}
+		s.peers[peer] = pc
+	}
+	pc.lastContact = now
+	if key[2] == "installSnapshot" {
+		pc.snapshots++
+		pc.lastSnapshotTime = time.Duration(val * float32(time.Millisecond))
+	}
+}
+
+// contact returns what's known about the follower.
+func (s *raftMetrics) contact(peer string) peerContact {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pc := s.peers[peer]; pc != nil {
+		return *pc
+	}
+	return peerContact{}
+}
+
+// peerReplication is the replication state of a follower, as seen by the
+// leader.
+type peerReplication struct {
+	addr  string
+	state string // the raft state of the follower, or "unreachable"
+	// lag is the number of entries in the leader log that the follower
+	// doesn't have, and appliedLag is the number of entries that the
+	// follower hasn't applied.
+	lag        uint64
+	appliedLag uint64
+	// lastContact is the time since the leader last heard from the
+	// follower, or -1 when it never has.
+	lastContact time.Duration
+	// snapshotInFlight is true when the follower is too far behind to
+	// catch up from the leader log, so that a snapshot is being sent.
+	snapshotInFlight bool
+	contact          peerContact
+}
+
+// dialRaft connects to a node for the raft commands, which don't require
+// authentication.
+func dialRaft(addr string) (redis.Conn, error) {
+	return redis.Dial("tcp", addr,
+		redis.DialConnectTimeout(time.Second),
+		redis.DialReadTimeout(time.Second),
+		redis.DialWriteTimeout(time.Second))
+}
+
+// raftPeers returns the addresses of the raft peers, which includes this
+// node.
+func raftPeers(addr string) ([]string, error) {
+	conn, err := dialRaft(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	vals, err := redis.Strings(conn.Do("RAFTPEERS"))
+	if err != nil {
+		return nil, err
+	}
+	var peers []string
+	for i := 0; i+1 < len(vals); i += 2 {
+		peers = append(peers, vals[i])
+	}
+	return peers, nil
+}
+
+// raftStats returns the raft stats of a node.
+func raftStats(addr string) (map[string]string, error) {
+	conn, err := dialRaft(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return redis.StringMap(conn.Do("RAFTSTATS"))
+}
+
+func statUint(stats map[string]string, name string) uint64 {
+	n, _ := strconv.ParseUint(stats[name], 10, 64)
+	return n
+}
+
+func subUint(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return 0
+}
+
+// replication returns the replication state of the followers, which is
+// only known by the leader. The followers are asked for their raft stats
+// concurrently.
+func (kvm *Machine) replication(stats map[string]string) []peerReplication {
+	if stats["state"] != "Leader" {
+		return nil
+	}
+	peers, err := raftPeers(kvm.addr)
+	if err != nil {
+		return nil
+	}
+	lastLog := statUint(stats, "last_log_index")
+	lastSnap := statUint(stats, "last_snapshot_index")
+	var reps []peerReplication
+	for _, peer := range peers {
+		if peer != kvm.addr {
+			reps = append(reps, peerReplication{addr: peer})
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range reps {
+		wg.Add(1)
+		go func(rep *peerReplication) {
+			defer wg.Done()
+			rep.contact = raftPeerMetrics.contact(rep.addr)
+			rep.lastContact = -1
+			if !rep.contact.lastContact.IsZero() {
+				rep.lastContact = time.Since(rep.contact.lastContact)
+			}
+			pstats, err := raftStats(rep.addr)
+			if err != nil {
+				rep.state = "unreachable"
+				return
+			}
+			rep.state = strings.ToLower(pstats["state"])
+			peerLog := statUint(pstats, "last_log_index")
+			rep.lag = subUint(lastLog, peerLog)
+			rep.appliedLag = subUint(lastLog, statUint(pstats, "applied_index"))
+			rep.snapshotInFlight = lastSnap > raftTrailingLogs &&
+				peerLog < lastSnap-raftTrailingLogs
+		}(&reps[i])
+	}
+	wg.Wait()
+	return reps
+}
+
+// durationMS returns the duration in milliseconds, which is -1 for negative
+// durations.
+func durationMS(d time.Duration) int64 {
+	if d < 0 {
+		return -1
+	}
+	return int64(d / time.Millisecond)
+}
+
+// formatReplication formats the replication state of a follower for INFO,
+// in the style of the Redis replica lines.
+func formatReplication(rep peerReplication) string {
+	inFlight := 0
+	if rep.snapshotInFlight {
+		inFlight = 1
+	}
+	return "addr=" + rep.addr +
+		",state=" + rep.state +
+		",lag=" + strconv.FormatUint(rep.lag, 10) +
+		",applied_lag=" + strconv.FormatUint(rep.appliedLag, 10) +
+		",last_contact_ms=" + strconv.FormatInt(durationMS(rep.lastContact), 10) +
+		",snapshot_in_flight=" + strconv.Itoa(inFlight) +
+		",snapshots_installed=" + strconv.FormatInt(rep.contact.snapshots, 10) +
+		",last_snapshot_ms=" + strconv.FormatInt(durationMS(rep.contact.lastSnapshotTime), 10)
+}
@@ -0,0 +1,270 @@
+package kvnode
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// requestWindow is the number of request ids that are remembered. An id is
+// forgotten once this many newer ids have been applied. It's a constant,
+// rather than an option, because every node must forget the same ids.
+const requestWindow = 100000
+
+// maxRequestID is the maximum length of a request id.
+const maxRequestID = 128
+
+var (
+	errRequestID = errors.New("ERR invalid request id")
+	errBadResult = errors.New("ERR the result of the request is unknown")
+)
+
+// The results of requests are stored as 'r' + id, and the ids are stored in
+// the order that they were applied as 'R' + sequence, so that the oldest are
+// forgotten.
+func requestKey(id []byte) []byte { return makeKey('r', id) }
+
+func requestSeqKey(seq uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = 'R'
+	binary.BigEndian.PutUint64(key[1:], seq)
+	return key
+}
+
+// reqidApplier marks the first write of a command with the request id from
+// REQID. The write is wrapped as "REQEXEC id command" in the raft log, so
+// that every node applies it at most once. The applier is only used for one
+// command.
+type reqidApplier struct {
+	finn.Applier
+	id string
+}
+
+func (m *reqidApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn != nil && mutate != nil && m.id != "" {
+		args := append([][]byte{[]byte("reqexec"), []byte(m.id)}, cmd.Args...)
+		cmd = redcon.Command{Raw: buildCommand(args...), Args: args}
+		// later writes of the same command, such as the chunks of PDEL,
+		// are not deduplicated.
+		m.id = ""
+	}
+	return m.Applier.Apply(conn, cmd, mutate, respond)
+}
+
+// unwrapRequest returns the id and the command of a "REQEXEC id command"
+// entry.
+func unwrapRequest(cmd redcon.Command) ([]byte, redcon.Command, error) {
+	if len(cmd.Args) < 3 {
+		return nil, cmd, finn.ErrWrongNumberOfArguments
+	}
+	args := cmd.Args[2:]
+	return cmd.Args[1], redcon.Command{Raw: buildCommand(args...), Args: args}, nil
+}
+
+// applyRequest applies the command of a REQEXEC entry, unless a command
+// with the same id was already applied, in which case the result of that
+// command is returned instead.
+func (kvm *Machine) applyRequest(m finn.Applier, id []byte, cmd redcon.Command) (interface{}, error) {
+	stored, err := kvm.db.Get(requestKey(id), nil)
+	if err == nil {
+		return decodeResult(stored)
+	}
+	if err != leveldb.ErrNotFound {
+		return nil, err
+	}
+	v, err := kvm.command(m, nil, cmd)
+	if rerr := kvm.recordRequest(id, v, err); rerr != nil {
+		return nil, rerr
+	}
+	return v, err
+}
+
+// recordRequest stores the result of a request, and forgets the oldest
+// request when there are more than requestWindow.
+func (kvm *Machine) recordRequest(id []byte, v interface{}, err error) error {
+	kvm.mu.Lock()
+	defer kvm.mu.Unlock()
+	var batch leveldb.Batch
+	kvm.reqseq++
+	batch.Put(requestKey(id), encodeResult(v, err))
+	batch.Put(requestSeqKey(kvm.reqseq), id)
+	if kvm.reqseq > requestWindow {
+		old := requestSeqKey(kvm.reqseq - requestWindow)
+		if oldID, err := kvm.db.Get(old, nil); err == nil {
+			batch.Delete(requestKey(oldID))
+		}
+		batch.Delete(old)
+	}
+	return kvm.db.Write(&batch, kvm.writeOptions())
+}
+
+// loadRequests reads the sequence of the last request from the database.
+// The caller must hold the machine lock.
+func (kvm *Machine) loadRequests() error {
+	kvm.reqseq = 0
+	iter := kvm.db.NewIterator(util.BytesPrefix([]byte{'R'}), nil)
+	if iter.Last() && len(iter.Key()) == 9 {
+		kvm.reqseq = binary.BigEndian.Uint64(iter.Key()[1:])
+	}
+	iter.Release()
+	return iter.Error()
+}
+
+// encodeResult encodes the result of a command, which is the value that's
+// passed to its reply. Results of other types are stored as nil.
+func encodeResult(v interface{}, err error) []byte {
+	if err != nil {
+		return append([]byte{'e'}, err.Error()...)
+	}
+	switch v := v.(type) {
+	case int:
+		return strconv.AppendInt([]byte{'i'}, int64(v), 10)
+	case int64:
+		return strconv.AppendInt([]byte{'l'}, v, 10)
+	case string:
+		return append([]byte{'s'}, v...)
+	case []byte:
+		return append([]byte{'b'}, v...)
+	case bool:
+		if v {
+			return []byte{'t'}
+		}
+		return []byte{'f'}
+	case error:
+		return append([]byte{'E'}, v.Error()...)
+	case []int:
+		b := []byte{'I'}
+		for _, n := range v {
+			b = binary.AppendVarint(b, int64(n))
+		}
+		return b
+	case *popped:
+		b := appendResultField([]byte{'p'}, v.key)
+		return append(b, v.stored...)
+	case msetifFailure:
+		b := appendResultField([]byte{'m'}, v.key)
+		return append(b, v.reason...)
+	case []interface{}:
+		b := binary.AppendUvarint([]byte{'a'}, uint64(len(v)))
+		for _, v := range v {
+			b = appendResultField(b, encodeResult(v, nil))
+		}
+		return b
+	case functionReply:
+		return append([]byte{'F'}, encodeResult(v.v, nil)...)
+	}
+	return []byte{'n'}
+}
+
+// appendResultField appends a length prefixed field of a result.
+func appendResultField(b, field []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(field)))
+	return append(b, field...)
+}
+
+// readResultField reads a field from appendResultField, and returns it and
+// the rest of the result.
+func readResultField(b []byte) ([]byte, []byte, error) {
+	n, i := binary.Uvarint(b)
+	if i <= 0 || uint64(len(b)-i) < n {
+		return nil, nil, errBadResult
+	}
+	return b[i : i+int(n)], b[i+int(n):], nil
+}
+
+// decodeResult decodes a result from encodeResult.
+func decodeResult(b []byte) (interface{}, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	switch b[0] {
+	case 'e':
+		return nil, errors.New(string(b[1:]))
+	case 'i':
+		n, err := strconv.Atoi(string(b[1:]))
+		return n, err
+	case 'l':
+		return strconv.ParseInt(string(b[1:]), 10, 64)
+	case 's':
+		return string(b[1:]), nil
+	case 'b':
+		return append([]byte(nil), b[1:]...), nil
+	case 'E':
+		return errors.New(string(b[1:])), nil
+	case 't', 'f':
+		return b[0] == 't', nil
+	case 'I':
+		var ns []int
+		for b = b[1:]; len(b) > 0; {
+			n, i := binary.Varint(b)
+			if i <= 0 {
+				return nil, errBadResult
+			}
+			ns = append(ns, int(n))
+			b = b[i:]
+		}
+		return ns, nil
+	case 'p':
+		key, stored, err := readResultField(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &popped{key: append([]byte(nil), key...), stored: append([]byte(nil), stored...)}, nil
+	case 'm':
+		key, reason, err := readResultField(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		return msetifFailure{key: append([]byte(nil), key...), reason: string(reason)}, nil
+	case 'a':
+		n, i := binary.Uvarint(b[1:])
+		if i <= 0 || n > uint64(len(b)) {
+			return nil, errBadResult
+		}
+		vs := make([]interface{}, n)
+		b = b[1+i:]
+		for j := range vs {
+			var field []byte
+			var err error
+			if field, b, err = readResultField(b); err != nil {
+				return nil, err
+			}
+			if vs[j], err = decodeResult(field); err != nil {
+				return nil, err
+			}
+		}
+		return vs, nil
+	case 'F':
+		v, err := decodeResult(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		return functionReply{v}, nil
+	}
+	return nil, nil
+}
+
+// cmdReqid handles "REQID id", which sets the request id of the next
+// command on the connection. A write with a request id is applied at most
+// once, so that it's safe to retry after a timeout or a leader change. The
+// retry gets the reply of the first attempt.
+func (kvm *Machine) cmdReqid(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if len(cmd.Args[1]) == 0 || len(cmd.Args[1]) > maxRequestID {
+		return nil, errRequestID
+	}
+	kvm.client(conn).reqid = string(cmd.Args[1])
+	conn.WriteString("OK")
+	return nil, nil
+}
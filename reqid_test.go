@@ -0,0 +1,84 @@
+package kvnode
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestEncodeResult(t *testing.T) {
+	for _, v := range []interface{}{
+		nil,
+		1,
+		int64(-2),
+		"OK",
+		[]byte("value"),
+		true,
+		false,
+		errors.New("ERR failed"),
+		[]int{1, -2, 3},
+		&popped{key: []byte("key"), stored: []byte("value")},
+		msetifFailure{key: []byte("key"), reason: "exists"},
+		[]interface{}{1, "OK", []interface{}{[]byte("value")}},
+		functionReply{"OK"},
+	} {
+		got, err := decodeResult(encodeResult(v, nil))
+		if err != nil {
+			t.Fatalf("%#v: %v", v, err)
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Fatalf("expected %#v, got %#v", v, got)
+		}
+	}
+	_, err := decodeResult(encodeResult(nil, errors.New("ERR failed")))
+	expectError(t, err, "ERR failed")
+}
+
+func TestReqid(t *testing.T) {
+	tn := startNode(t, nil)
+	defer tn.close()
+	conn := tn.dial()
+	defer conn.Close()
+	if _, err := conn.Do("MSET", "key1", "1", "key2", "2"); err != nil {
+		t.Fatal(err)
+	}
+	del := func(reqid string) int {
+		t.Helper()
+		if reqid != "" {
+			if _, err := conn.Do("REQID", reqid); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n, err := redis.Int(conn.Do("DEL", "key1", "key2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := del("write-1"); n != 2 {
+		t.Fatalf("expected 2, got %d", n)
+	}
+	if _, err := conn.Do("SET", "key1", "3"); err != nil {
+		t.Fatal(err)
+	}
+	// a retry gets the reply of the first attempt, and isn't applied again.
+	if n := del("write-1"); n != 2 {
+		t.Fatalf("expected the reply of the first attempt, got %d", n)
+	}
+	value, err := redis.String(conn.Do("GET", "key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "3" {
+		t.Fatalf("expected the retry not to be applied, got %q", value)
+	}
+	if n := del("write-2"); n != 1 {
+		t.Fatalf("expected 1, got %d", n)
+	}
+	// the request id only applies to the next command.
+	if n := del(""); n != 0 {
+		t.Fatalf("expected 0, got %d", n)
+	}
+}
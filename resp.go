@@ -0,0 +1,70 @@
+package kvnode
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/tidwall/redcon"
+)
+
+// resp3 returns true when the client negotiated RESP3 using HELLO.
+func resp3(conn redcon.Conn) bool {
+	c, ok := conn.Context().(*client)
+	return ok && c.proto == 3
+}
+
+// writeNull writes a null, which is "_" in RESP3.
+func writeNull(conn redcon.Conn) {
+	if resp3(conn) {
+		conn.WriteRaw([]byte("_\r\n"))
+	} else {
+		conn.WriteNull()
+	}
+}
+
+// writeMap writes a map header for n key/value pairs. RESP2 clients receive
+// a flat array of twice the size.
+func writeMap(conn redcon.Conn, n int) {
+	if resp3(conn) {
+		conn.WriteRaw(appendHeader(nil, '%', n))
+	} else {
+		conn.WriteArray(n * 2)
+	}
+}
+
+// writePush writes a push header for n elements. RESP2 clients receive an
+// array.
+func writePush(conn redcon.Conn, n int) {
+	if resp3(conn) {
+		conn.WriteRaw(appendHeader(nil, '>', n))
+	} else {
+		conn.WriteArray(n)
+	}
+}
+
+// writeDouble writes a floating point number, which is "," in RESP3. RESP2
+// clients receive a bulk string with prec digits after the point.
+func writeDouble(conn redcon.Conn, f float64, prec int) {
+	if !resp3(conn) {
+		conn.WriteBulkString(strconv.FormatFloat(f, 'f', prec, 64))
+		return
+	}
+	b := []byte{','}
+	switch {
+	case math.IsInf(f, 1):
+		b = append(b, "inf"...)
+	case math.IsInf(f, -1):
+		b = append(b, "-inf"...)
+	case math.IsNaN(f):
+		b = append(b, "nan"...)
+	default:
+		b = strconv.AppendFloat(b, f, 'f', prec, 64)
+	}
+	conn.WriteRaw(append(b, '\r', '\n'))
+}
+
+func appendHeader(b []byte, kind byte, n int) []byte {
+	b = append(b, kind)
+	b = strconv.AppendInt(b, int64(n), 10)
+	return append(b, '\r', '\n')
+}
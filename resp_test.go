@@ -0,0 +1,50 @@
+package kvnode
+
+import (
+	"bufio"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRESP3Double(t *testing.T) {
+	tn := startNode(t, nil)
+	defer tn.close()
+	// amplification returns the raw value that follows the
+	// write_amplification field of DBSTATS.
+	amplification := func(cmds string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", tn.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(cmds)); err != nil {
+			t.Fatal(err)
+		}
+		rd := bufio.NewReader(conn)
+		readLine := func() string {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			return strings.TrimSuffix(line, "\r\n")
+		}
+		for readLine() != "write_amplification" {
+		}
+		line := readLine()
+		if strings.HasPrefix(line, "$") {
+			line = readLine()
+		}
+		return line
+	}
+	if v := amplification("DBSTATS\r\n"); !regexp.MustCompile(`^\d+\.\d\d$`).MatchString(v) {
+		t.Fatalf("expected a bulk string number, got %q", v)
+	}
+	if v := amplification("HELLO 3\r\nDBSTATS\r\n"); !regexp.MustCompile(`^,\d+\.\d\d$`).MatchString(v) {
+		t.Fatalf("expected a double, got %q", v)
+	}
+}
@@ -0,0 +1,266 @@
+package kvnode
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// historyPrune is the most history entries that a write prunes, so that
+// a write after a long pause isn't slowed down by pruning all of them.
+const historyPrune = 256
+
+var (
+	errRevision          = errors.New("ERR revision is not an integer or out of range")
+	errRevisionCompacted = errors.New("ERR revision is older than the retained history")
+	errRevisionFuture    = errors.New("ERR revision is newer than the node, try again later")
+	errRevisionNewer     = errors.New("ERR revision is newer than the database")
+)
+
+// The revision of the database is the version of the last write, which is
+// assigned by the leader, so it's the same on every node. While
+// RevisionRetention is set, the previous values of the keys that a write
+// changes are kept as 'h' + key length + key + revision, and indexed as
+// 'H' + revision + key for pruning, so that keys can be read at earlier
+// revisions. The revision and the oldest revision that can be read are
+// stored as 'v'.
+var revisionKey = []byte{'v'}
+
+func historyPrefix(key []byte) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(key)+8)
+	buf[0] = 'h'
+	n := binary.PutUvarint(buf[1:], uint64(len(key)))
+	return append(buf[:1+n], key...)
+}
+
+func historyKey(key []byte, rev uint64) []byte {
+	buf := historyPrefix(key)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], rev)
+	return append(buf, b[:]...)
+}
+
+func historyIndexKey(rev uint64, key []byte) []byte {
+	buf := make([]byte, 9, 9+len(key))
+	buf[0] = 'H'
+	binary.BigEndian.PutUint64(buf[1:], rev)
+	return append(buf, key...)
+}
+
+// batchKeys collects the keys that a batch changes.
+type batchKeys [][]byte
+
+func (b *batchKeys) Put(key, value []byte) { *b = append(*b, key) }
+func (b *batchKeys) Delete(key []byte)     { *b = append(*b, key) }
+
+// recordHistory adds the previous values of the keys of a batch, which is
+// the write that's being applied, to the batch. Writes without a revision,
+// which were proposed by older releases, are not recorded.
+func (kvm *Machine) recordHistory(batch *leveldb.Batch) error {
+	rev := kvm.applyStamp
+	if rev == 0 {
+		return nil
+	}
+	retention := uint64(kvm.options().RevisionRetention)
+	if retention > 0 {
+		var keys batchKeys
+		if err := batch.Replay(&keys); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			prev := []byte{0}
+			value, err := kvm.appliedValue(key)
+			if err == nil {
+				prev = append([]byte{1}, value...)
+			} else if err != leveldb.ErrNotFound {
+				return err
+			}
+			batch.Put(historyKey(key, rev), prev)
+			batch.Put(historyIndexKey(rev, key), nil)
+		}
+	}
+	if retention < rev {
+		if _, err := kvm.pruneHistory(batch, rev-retention); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneHistory adds the deletes of up to historyPrune history entries that
+// are older than a revision to a batch, and returns the number of entries.
+// The revisions before the entries can't be read anymore.
+func (kvm *Machine) pruneHistory(batch *leveldb.Batch, before uint64) (int, error) {
+	var n int
+	iter := kvm.db.NewIterator(&util.Range{
+		Start: []byte{'H'}, Limit: historyIndexKey(before, nil),
+	}, nil)
+	for ok := iter.First(); ok && n < historyPrune; ok = iter.Next() {
+		ikey := iter.Key()
+		if len(ikey) < 9 {
+			continue
+		}
+		rev := binary.BigEndian.Uint64(ikey[1:9])
+		batch.Delete(historyKey(ikey[9:], rev))
+		batch.Delete(ikey)
+		kvm.raiseFloor(rev)
+		n++
+	}
+	iter.Release()
+	return n, iter.Error()
+}
+
+// raiseFloor makes the revisions before a revision unreadable.
+func (kvm *Machine) raiseFloor(rev uint64) {
+	if rev > atomic.LoadUint64(&kvm.revfloor) {
+		atomic.StoreUint64(&kvm.revfloor, rev)
+	}
+}
+
+// truncateHistory makes the history unreadable, for writes that don't
+// record it, such as FLUSHDB. The entries are pruned later.
+func (kvm *Machine) truncateHistory(batch *leveldb.Batch) {
+	rev := kvm.applyStamp
+	if current := atomic.LoadUint64(&kvm.revision); rev < current {
+		rev = current
+	}
+	kvm.putRevision(batch, rev, rev)
+}
+
+// putRevision adds the revision to a batch. The in-memory revision is
+// changed right away, since the batch is written by the same command.
+func (kvm *Machine) putRevision(batch *leveldb.Batch, rev, floor uint64) {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], rev)
+	binary.BigEndian.PutUint64(b[8:], floor)
+	batch.Put(revisionKey, b[:])
+	atomic.StoreUint64(&kvm.revision, rev)
+	atomic.StoreUint64(&kvm.revfloor, floor)
+}
+
+// readRevision returns the revision and the oldest revision that can be
+// read from a snapshot of the database.
+func readRevision(ss Snapshot) (rev, floor uint64, err error) {
+	b, err := ss.Get(revisionKey, nil)
+	if err != nil {
+		if err == leveldb.ErrNotFound {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	if len(b) != 16 {
+		return 0, 0, errors.New("invalid revision")
+	}
+	return binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:]), nil
+}
+
+// loadRevision reads the revision from the database. The caller must hold
+// the machine lock.
+func (kvm *Machine) loadRevision() error {
+	ss, err := kvm.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer ss.Release()
+	rev, floor, err := readRevision(ss)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint64(&kvm.revision, rev)
+	atomic.StoreUint64(&kvm.revfloor, floor)
+	kvm.observeStamp(rev)
+	return nil
+}
+
+// getAt returns the stored value of a key at a revision from a snapshot of
+// the database, which is nil when the key didn't exist. The revision must be
+// readable.
+func getAt(ss Snapshot, key []byte, at uint64) ([]byte, error) {
+	rev, floor, err := readRevision(ss)
+	if err != nil {
+		return nil, err
+	}
+	if at > rev {
+		return nil, errRevisionFuture
+	}
+	if at < floor {
+		return nil, errRevisionCompacted
+	}
+	return valueAt(ss, key, at)
+}
+
+// valueAt returns the stored value of a key at a revision, which is nil when
+// the key didn't exist, without checking that the revision is readable.
+func valueAt(ss Snapshot, key []byte, at uint64) ([]byte, error) {
+	// the first change after the revision holds the value at the revision.
+	prefix := historyPrefix(key)
+	iter := ss.NewIterator(&util.Range{
+		Start: historyKey(key, at+1), Limit: util.BytesPrefix(prefix).Limit,
+	}, nil)
+	defer iter.Release()
+	if iter.First() && len(iter.Key()) == len(prefix)+8 {
+		prev := iter.Value()
+		if len(prev) == 0 || prev[0] == 0 {
+			return nil, nil
+		}
+		return append([]byte(nil), prev[1:]...), nil
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	value, err := ss.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return value, err
+}
+
+// parseAt parses the "AT revision" option of reads, which returns zero
+// without the option.
+func parseAt(args [][]byte) (uint64, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+	if len(args) != 2 || strings.ToLower(string(args[0])) != "at" {
+		return 0, errSyntaxError
+	}
+	n, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil || n == 0 {
+		return 0, errRevision
+	}
+	return n, nil
+}
+
+// cmdRevision handles "REVISION", which returns the revision of the
+// database and the oldest revision that can be read with AT.
+func (kvm *Machine) cmdRevision(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			kvm.dbmu.RLock()
+			defer kvm.dbmu.RUnlock()
+			ss, err := kvm.db.GetSnapshot()
+			if err != nil {
+				return nil, err
+			}
+			defer ss.Release()
+			rev, floor, err := readRevision(ss)
+			if err != nil {
+				return nil, err
+			}
+			conn.WriteArray(2)
+			conn.WriteInt64(int64(rev))
+			conn.WriteInt64(int64(floor))
+			return nil, nil
+		},
+	)
+}
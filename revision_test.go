@@ -0,0 +1,69 @@
+package kvnode
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestGetAt(t *testing.T) {
+	tn := startNode(t, &Options{RevisionRetention: time.Minute})
+	defer tn.close()
+	conn := tn.dial()
+	defer conn.Close()
+	write := func(args ...interface{}) int64 {
+		t.Helper()
+		if _, err := conn.Do(args[0].(string), args[1:]...); err != nil {
+			t.Fatal(err)
+		}
+		revs, err := redis.Values(conn.Do("REVISION"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rev, _ := redis.Int64(revs[0], nil)
+		return rev
+	}
+	rev1 := write("SET", "key", "1")
+	rev2 := write("SET", "key", "2")
+	rev3 := write("DEL", "key")
+	rev4 := write("SET", "key", "4")
+	for _, test := range []struct {
+		rev   int64
+		value interface{}
+	}{
+		{rev1, "1"},
+		{rev2, "2"},
+		{rev3, nil},
+		{rev4, "4"},
+	} {
+		reply, err := conn.Do("GET", "key", "AT", test.rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.value == nil {
+			if reply != nil {
+				t.Fatalf("at %d: expected nil, got %q", test.rev, reply)
+			}
+			continue
+		}
+		if value, _ := redis.String(reply, nil); value != test.value {
+			t.Fatalf("at %d: expected %q, got %q", test.rev, test.value, value)
+		}
+	}
+	revs, err := redis.Values(conn.Do("REVISION"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := redis.Int64(revs[0], nil)
+	oldest, _ := redis.Int64(revs[1], nil)
+	if current != rev4 || oldest > rev1 {
+		t.Fatalf("unexpected REVISION %d %d", current, oldest)
+	}
+	_, err = conn.Do("GET", "key", "AT", rev4+1)
+	expectError(t, err, "revision")
+	_, err = conn.Do("GET", "key", "AT", oldest-1)
+	expectError(t, err, "revision")
+	_, err = conn.Do("GET", "key", "AT", "x")
+	expectError(t, err, "revision")
+}
@@ -1,37 +1,363 @@
 package kvnode
 
 import (
-	"bufio"
 	"bytes"
-	"compress/gzip"
-	"encoding/binary"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"github.com/tidwall/finn"
+	"github.com/tidwall/kvnode/snapshot"
 	"github.com/tidwall/match"
+	"github.com/tidwall/raft-redcon"
 	"github.com/tidwall/redcon"
 	"github.com/tidwall/redlog"
 )
 
+// Version is the version of kvnode.
+const Version = "0.1.0"
+
 const defaultTCPKeepAlive = time.Minute * 5
 
+// defaultPdelChunkSize is the default number of keys that PDEL deletes in
+// each raft entry.
+const defaultPdelChunkSize = 1000
+
 var (
 	errSyntaxError = errors.New("syntax error")
+	errNotAdmin    = errors.New("ERR command is only allowed on the admin listener")
 	log            = redlog.New(os.Stderr)
 )
 
-func ListenAndServe(addr, join, dir, logdir string, fastlog bool, consistency, durability finn.Level) error {
+// Options are used to provide optional server functionality.
+type Options struct {
+	// ConfigFile is the config file that the options were loaded from, see
+	// LoadConfig.
+	ConfigFile string
+	// Reload returns the options of the config file, when it's loaded again
+	// on SIGHUP. The settings that changed since the last load are applied,
+	// and the settings that can't change are reported.
+	Reload func() (*Options, error)
+	// LogLevel is debug, verbose, notice or warning. The default is notice.
+	LogLevel string
+	// TLSAddr is an optional address for accepting TLS client connections.
+	// These connections are relayed to the primary address.
+	TLSAddr string
+	// TLSConfig is the TLS configuration for TLSAddr. Set ClientAuth and
+	// ClientCAs to require mutual TLS.
+	TLSConfig *tls.Config
+	// TLSFiles, when set, provides the TLS configuration instead of
+	// TLSConfig, and is reloaded when its files change or on SIGHUP.
+	TLSFiles *TLSFiles
+	// PeerNetworks is a list of CIDR blocks, or single addresses, of the
+	// nodes that may join the cluster. While a TLS or an admin listener is
+	// on, or a password is required, the primary listener only accepts
+	// connections from the local host, the raft peers and these addresses.
+	PeerNetworks []string
+	// K8sService is the headless service of a StatefulSet that the node is
+	// a pod of. When set, the address of the node is the IP of its pod, and
+	// the node bootstraps or joins the cluster of the other pods.
+	K8sService string
+	// TLSCertUsers assigns the common name of a verified client certificate
+	// as the user of the connection.
+	TLSCertUsers bool
+	// AdminAddr is an optional address for a listener that permits
+	// privileged commands, such as SHUTDOWN and FLUSHDB. When set, these
+	// commands are rejected on all other listeners.
+	AdminAddr string
+	// ProxyProtocol accepts PROXY protocol headers from load balancers, so
+	// the address of the actual client is known. Version 1 and 2 headers
+	// are required on the TLS and admin listeners. On the primary listener,
+	// which is shared with raft peers, only an optional version 1 header is
+	// accepted.
+	ProxyProtocol bool
+	// TrustedProxies is a list of CIDR blocks, or single addresses, of the
+	// load balancers that PROXY protocol headers are accepted from. Headers
+	// from other addresses are refused.
+	TrustedProxies []string
+	// HTTPAddr is an optional address for the JSON HTTP gateway.
+	HTTPAddr string
+	// GRPCAddr is an optional address for the gRPC API of kvnodepb, which
+	// is served over TLS with TLSConfig when it's set.
+	GRPCAddr string
+	// MemcacheAddr is an optional address for a listener that speaks the
+	// memcached text protocol. Its clients act as the default user.
+	MemcacheAddr string
+	// AdminHTTPAddr is an optional address for an HTTP listener that serves
+	// the pprof profiles and expvar variables of the process.
+	AdminHTTPAddr string
+	// DebugEndpoints enables the endpoints of the admin HTTP listener.
+	DebugEndpoints bool
+	// AutoRejoin makes a node that has had no leader for a while ask the
+	// join addresses and its known peers for the leader, and ask the leader
+	// to add it again when it was removed from the cluster, such as while
+	// it was down. The attempts back off exponentially.
+	AutoRejoin bool
+	// ReadyMaxLag is the number of committed raft entries that the node may
+	// have left to apply while "/readyz" reports it as ready.
+	ReadyMaxLag int
+	// InMemory keeps the data in memory rather than on disk. The data is
+	// rebuilt from the raft log and snapshots when the node restarts.
+	InMemory bool
+	// OpenStore, when set, opens the store that the data is kept in at the
+	// path instead of LevelDB, which is how other storage engines are used.
+	// InMemory, the encryption of the database and RecoverDB only apply to
+	// LevelDB.
+	OpenStore func(path string) (Store, error)
+	// MaxClients is the maximum number of concurrent client connections,
+	// including relayed ones. The raft peers and the connections from the
+	// local host, such as those of the gateways, aren't limited. Zero means
+	// no limit.
+	MaxClients int
+	// IdleTimeout closes client connections that have not sent a command
+	// for the duration. Zero means no timeout.
+	IdleTimeout time.Duration
+	// MaxLifetime closes client connections that have been open for longer
+	// than the duration. Zero means no limit.
+	MaxLifetime time.Duration
+	// ClientRateLimit is the number of commands per second that each
+	// connection may send, and ClientBandwidthLimit is the number of bytes
+	// of commands per second. Commands over the limits are refused with a
+	// THROTTLED error. Zero means no limit.
+	ClientRateLimit      int
+	ClientBandwidthLimit int
+	// OutputBufferLimits disconnect the clients that don't read their
+	// replies or streams fast enough. Zero means no limit.
+	OutputBufferLimits OutputBufferLimits
+	// Password, when set, requires that clients authenticate with the AUTH
+	// command before issuing other commands.
+	Password string
+	// Databases is the number of logical databases that may be selected
+	// with SELECT. The default is 16.
+	Databases int
+	// Binds are additional addresses for accepting client connections,
+	// such as specific interfaces, IPv6 addresses and Unix sockets, each
+	// with its own TLS and authentication settings. These connections are
+	// relayed to the primary address.
+	Binds []Bind
+	// ProtectedMode refuses connections from other hosts to listeners that
+	// bind all interfaces, such as ":4920", while the default user has no
+	// password.
+	ProtectedMode bool
+	// Allow and Deny are lists of CIDR blocks, or single addresses, that
+	// connections are accepted from. Deny takes precedence, and an empty
+	// Allow accepts all addresses. Loopback connections are always accepted,
+	// but loopback addresses from PROXY protocol headers are not.
+	Allow []string
+	Deny  []string
+	// StaleReads serves the reads of every client from the local store of
+	// the node, regardless of the consistency level. Clients may enable it
+	// for themselves with CLIENT STALEREADS ON.
+	StaleReads bool
+	// ReplicaReads makes followers serve the reads of every client from
+	// their local store, like StaleReads, and answer writes with
+	// "READONLY leader" rather than "TRY leader".
+	ReplicaReads bool
+	// ForwardWrites is the largest write, in bytes, that a follower with
+	// ReplicaReads forwards to the leader rather than refusing it. Zero
+	// forwards none.
+	ForwardWrites int
+	// HotKeysSampling is the rate that commands are sampled at for HOTKEYS,
+	// which is one of every HotKeysSampling commands. Zero disables it.
+	HotKeysSampling int
+	// GroupCommitWindow is how long a write waits for other writes, which
+	// are proposed to the raft log and applied together. Zero disables the
+	// group commit.
+	GroupCommitWindow time.Duration
+	// GroupCommitMax is the maximum number of writes in a group, which is
+	// proposed as soon as it's full.
+	GroupCommitMax int
+	// FlushRequireForce requires that clients pass FORCE to FLUSHDB and
+	// FLUSHALL.
+	FlushRequireForce bool
+	// MaxPendingWrites is the number of writes that may be waiting to be
+	// applied on the node, after which writes are refused with a BUSY error.
+	// Zero means no limit.
+	MaxPendingWrites int
+	// CommandWorkers is the number of commands of clients that may run at
+	// once, after which the commands wait for a worker in the order that
+	// they arrive. The priority commands, such as INFO, CONFIG, CLIENT KILL
+	// and SHUTDOWN, never wait. Zero means no limit.
+	CommandWorkers int
+	// PdelChunkSize is the number of keys that PDEL deletes in each raft
+	// entry. Zero deletes every key in a single entry.
+	PdelChunkSize int
+	// CompressionThreshold is the size, in bytes, from which values are
+	// compressed with snappy when they're written. Zero disables it.
+	CompressionThreshold int
+	// MinFreeDiskMB is the free disk space, in MiB, of the data and raft log
+	// directories below which the writes of clients are refused. Zero
+	// disables it.
+	MinFreeDiskMB int
+	// MaxKeySize and MaxValueSize are the largest keys and values, in bytes,
+	// that clients may write. Zero means no limit.
+	MaxKeySize   int
+	MaxValueSize int
+	// MaxKeys and MaxBytes are the most keys, and their size in bytes, that
+	// the databases and namespaces may hold. Zero means no limit.
+	MaxKeys  int
+	MaxBytes int
+	// EvictionPolicy is what happens when the keys are over MaxKeys or
+	// MaxBytes, which is "noeviction", the default, to refuse writes,
+	// "allkeys-lru" to evict the least recently used keys, or
+	// "allkeys-oldest" to evict the least recently written keys.
+	EvictionPolicy string
+	// ReadCacheSize is the size, in bytes, of the cache of the values that
+	// GET reads, which holds the most recently read small values. Zero
+	// disables it.
+	ReadCacheSize int
+	// RevisionRetention is how long the previous values of keys are kept
+	// for reads at earlier revisions. Zero keeps none.
+	RevisionRetention time.Duration
+	// ColdStore is the object storage that the keys that weren't used for
+	// ColdAfter are moved to, leaving stubs in the database. Cold keys are
+	// read from the store, and moved back to the database when they're
+	// accessed. It's nil when there's no cold tier.
+	ColdStore ColdStore
+	// ColdAfter is how long a key must go without being written or read,
+	// on the leader, before it's moved to the ColdStore. Zero never moves
+	// keys, but cold keys are still read from the store.
+	ColdAfter time.Duration
+	// KeyMetadata stores the time of the first write and the number of
+	// writes of each key with its value, for KEYINFO. Since the stored
+	// values must be the same on every node, it's changed with CONFIG SET
+	// on the leader, which changes it at the same point of the raft log on
+	// every node.
+	KeyMetadata bool
+	// LevelDBWriteBuffer, LevelDBBlockCache and LevelDBTableSize are the
+	// sizes, in bytes, of the memtable, the block cache and the tables
+	// that compactions write. LevelDBOpenFiles is the maximum number of
+	// open table files. Zero uses the LevelDB default.
+	LevelDBWriteBuffer int
+	LevelDBBlockCache  int
+	LevelDBTableSize   int
+	LevelDBOpenFiles   int
+	// LevelDBCompression is the compression of the tables, which is
+	// "snappy", the default, or "none".
+	LevelDBCompression string
+	// EncryptionKey provides the key that the LevelDB files are encrypted
+	// with. The files are not encrypted when it's nil. A database can't
+	// switch between encrypted and not encrypted.
+	EncryptionKey KeyProvider
+	// CompactionWindow is the time of day, such as "01:00-05:00" in local
+	// time, when the whole storage is compacted. Outside the window, the
+	// compactions are limited to CompactionRate.
+	CompactionWindow string
+	// CompactionRate is the bytes per second that LevelDB may write to its
+	// tables outside the compaction window, and while snapshots are written
+	// or COMPACT PAUSE is in effect. Zero is unlimited.
+	CompactionRate int
+	// SnapshotRate is the bytes per second that the node writes its
+	// snapshots at, which are sent to the followers that are too far behind
+	// to catch up from the raft log. Zero is unlimited.
+	SnapshotRate int
+	// RaftLogMaxSize is the size, in bytes, of the raft log on disk over
+	// which the node takes a snapshot and shrinks the log, at most once a
+	// minute. Zero means no limit.
+	RaftLogMaxSize int
+	// RaftLogShrink shrinks the raft log after every snapshot, so that the
+	// entries that the snapshot deleted don't take space on disk until the
+	// next RAFTSHRINKLOG. Only the fastlog backend, the default, is shrunk.
+	RaftLogShrink bool
+	// RecoverDB recovers a database that's corrupted when the node starts,
+	// rather than failing. The keys of the damaged blocks are lost.
+	RecoverDB bool
+	// AuditLog is an optional file that administrative and write commands
+	// are appended to, along with the identity of the client.
+	AuditLog string
+	// Tracer starts the spans of commands. Commands are not traced when
+	// it's nil.
+	Tracer Tracer
+	// Hooks intercept the commands of clients and observe the writes that
+	// are applied, when they're not nil.
+	Hooks *Hooks
+	// Metrics receives the metrics of the node when it's not nil.
+	Metrics Metrics
+	// Functions are the functions that FCALL calls, by their names in
+	// lower case. Every node must have the same functions.
+	Functions map[string]Function
+}
+
+// fillOptions fills in default options
+func fillOptions(opts *Options) *Options {
+	if opts == nil {
+		opts = &Options{}
+	}
+	// copy and reassign the options
+	nopts := *opts
+	if nopts.Databases <= 0 {
+		nopts.Databases = defaultDatabases
+	}
+	if nopts.PdelChunkSize == 0 {
+		nopts.PdelChunkSize = defaultPdelChunkSize
+	}
+	if nopts.GroupCommitMax <= 0 {
+		nopts.GroupCommitMax = defaultGroupCommitMax
+	}
+	if nopts.ReadyMaxLag <= 0 {
+		nopts.ReadyMaxLag = defaultReadyMaxLag
+	}
+	if nopts.EvictionPolicy == "" {
+		nopts.EvictionPolicy = policyNoEviction
+	}
+	if nopts.LogLevel == "" {
+		nopts.LogLevel = "notice"
+	}
+	return &nopts
+}
+
+func ListenAndServe(addr, join, dir, logdir string, fastlog bool, consistency, durability finn.Level, sopts *Options) error {
+	sopts = fillOptions(sopts)
+	var oldaddr string
+	joins := ParseJoin(join)
+	if sopts.K8sService != "" {
+		var err error
+		addr, join, oldaddr, err = k8sBootstrap(sopts.K8sService, addr, logdir)
+		if err != nil {
+			return err
+		}
+	} else if len(joins) > 0 {
+		join = joinLeader(joins, addr, logdir)
+	}
+	if sopts.TLSFiles != nil {
+		sopts.TLSConfig = sopts.TLSFiles.Config()
+	}
+	if sopts.TLSAddr != "" && sopts.TLSConfig == nil {
+		return errors.New("tls config is required")
+	}
+	for _, b := range sopts.Binds {
+		if b.TLS && sopts.TLSConfig == nil {
+			return errors.New("tls config is required for " + b.Addr)
+		}
+	}
+	m, err := NewMachine(dir, addr, sopts)
+	if err != nil {
+		return err
+	}
+	installRaftMetrics()
+	go m.guardDisk(dir, logdir)
+	go m.guardRaftLog(logdir)
+	if sopts.TLSFiles != nil {
+		go m.watchTLS(sopts.TLSFiles)
+	}
+	go m.watchPeers()
 	var opts finn.Options
 	if fastlog {
 		opts.Backend = finn.LevelDB
@@ -41,6 +367,9 @@ func ListenAndServe(addr, join, dir, logdir string, fastlog bool, consistency, d
 	opts.Consistency = consistency
 	opts.Durability = durability
 	opts.ConnAccept = func(conn redcon.Conn) bool {
+		if !m.acceptConn(conn) {
+			return false
+		}
 		if tcp, ok := conn.NetConn().(*net.TCPConn); ok {
 			if err := tcp.SetKeepAlive(true); err != nil {
 				log.Warningf("could not set keepalive: %s",
@@ -55,195 +384,1124 @@ func ListenAndServe(addr, join, dir, logdir string, fastlog bool, consistency, d
 		}
 		return true
 	}
-	m, err := NewMachine(dir, addr)
-	if err != nil {
-		return err
-	}
+	opts.ConnClosed = m.connClosed
+	m.beginLoading()
 	n, err := finn.Open(logdir, addr, join, m, &opts)
 	if err != nil {
+		m.Close()
 		return err
 	}
-	defer n.Close()
+	go m.watchLoading()
+	go m.rejoinCluster(joins)
+	if sopts.K8sService != "" {
+		if oldaddr != "" {
+			go m.k8sReplaceAddr(sopts.K8sService, logdir, oldaddr)
+		} else if err := writeK8sAddr(logdir, addr); err != nil {
+			log.Warningf("could not record the address: %v", err)
+		}
+	}
+	// start the secondary listeners
+	var listeners []io.Closer
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		n.Close()
+		m.Close()
+	}
+	if sopts.TLSAddr != "" {
+		r, err := listenRelay(Bind{Addr: sopts.TLSAddr, TLS: true}, addr, sopts.TLSConfig, m)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, r)
+	}
+	if sopts.AdminAddr != "" {
+		r, err := listenRelay(Bind{Addr: sopts.AdminAddr, Admin: true}, addr, nil, m)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, r)
+	}
+	for _, bind := range sopts.Binds {
+		r, err := listenRelay(bind, addr, sopts.TLSConfig, m)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, r)
+	}
+	if sopts.HTTPAddr != "" {
+		g, err := listenGateway(sopts.HTTPAddr, addr, m)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, g)
+	}
+	if sopts.GRPCAddr != "" {
+		g, err := listenGRPC(sopts.GRPCAddr, addr, sopts.TLSConfig, m)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, g)
+	}
+	if sopts.MemcacheAddr != "" {
+		g, err := listenMemcache(sopts.MemcacheAddr, addr, m)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, g)
+	}
+	if sopts.AdminHTTPAddr != "" {
+		a, err := listenAdminHTTP(sopts.AdminHTTPAddr, m)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, a)
+	}
 
-	select {
-	// blocking, there's no way out
+	sdNotify("READY=1")
+	if interval := watchdogInterval(); interval > 0 {
+		go m.watchdog(interval)
 	}
+
+	// wait for a SHUTDOWN command or a termination signal. SIGHUP reloads
+	// the config file and the TLS certificate.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigc)
+	var save bool
+	for done := false; !done; {
+		select {
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				sdNotify("RELOADING=1")
+				m.reloadConfig()
+				if sopts.TLSFiles != nil {
+					reloadTLS(sopts.TLSFiles)
+				}
+				sdNotify("READY=1")
+				continue
+			}
+			log.Warningf("received %s, shutting down", sig)
+		case leader := <-m.rejoinc:
+			// the raft of the node is reopened without its raft log, and
+			// joins the leader like a new node.
+			n.Close()
+			if err := resetRaft(logdir); err != nil {
+				log.Warningf("rejoin: %v", err)
+			}
+			m.resetApplier()
+			m.beginLoading()
+			if n, err = finn.Open(logdir, addr, leader, m, &opts); err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				m.Close()
+				return err
+			}
+			go m.watchLoading()
+			log.Noticef("rejoin: joined the leader %s", leader)
+			continue
+		case save = <-m.shutdownc:
+			log.Warningf("shutting down")
+		}
+		done = true
+	}
+	return shutdown(n, m, listeners, addr, save)
+}
+
+// shutdown gracefully stops the node. When save is true a raft snapshot is
+// taken prior to closing the raft log and the storage.
+func shutdown(n *finn.Node, m *Machine, listeners []io.Closer, addr string, save bool) error {
+	sdNotify("STOPPING=1")
+	for _, l := range listeners {
+		l.Close()
+	}
+	if save {
+		// the node does not expose the raft snapshot directly, so ask
+		// the local server for one.
+		if _, _, err := raftredcon.Do(addr, nil, []byte("raftsnapshot")); err != nil {
+			log.Warningf("could not snapshot: %v", err)
+		}
+	}
+	// closing the node stops accepting connections and leaves raft.
+	if err := n.Close(); err != nil {
+		m.Close()
+		return err
+	}
+	return m.Close()
 }
 
 type Machine struct {
-	mu     sync.RWMutex
+	mu sync.RWMutex
+	// dbmu guards replacing db, which only Restore, FLUSHALL and Close do
+	// while also holding mu. Reads hold dbmu rather than mu, so that they
+	// never wait for writes. LevelDB is safe for concurrent use.
+	dbmu sync.RWMutex
+	// keylocks are the striped locks of writes to keys.
+	keylocks keyLocks
+
 	dir    string
-	db     *leveldb.DB
+	db     Store
 	opts   *opt.Options
 	dbPath string
 	addr   string
 	closed bool
+	// stor is the storage of db, and crypt is the cipher that it's
+	// encrypted with, or nil.
+	stor  storage.Storage
+	crypt cipher.Block
+	// key is the encryption key, which the snapshots are encrypted with,
+	// and entries is the cipher that the raft log entries are sealed with,
+	// or nil.
+	key     []byte
+	entries cipher.AEAD
+	// iostats counts the reads and writes of LevelDB.
+	iostats *ioStats
+	// compact schedules the compactions, in the window held by cwindow.
+	compact *compactionCtl
+	cwindow atomic.Value
+	// dbLost holds the error of a database that couldn't be reopened after
+	// a reset, which makes the node unhealthy until it's restarted.
+	dbLost atomic.Value
+
+	// optionsv holds the current *Options, which may be replaced at
+	// runtime with CONFIG SET.
+	optionsv atomic.Value
+	// ipfilter holds the *ipFilter that's compiled from the options.
+	ipfilter atomic.Value
+	// peerIPs holds the []net.IP of the raft peers, for the primary
+	// listener while TLS is on.
+	peerIPs atomic.Value
+	// cfgmu serializes changes to the options.
+	cfgmu sync.Mutex
+	// loaded is the options that the config file was last loaded with,
+	// which a reload is compared with.
+	loaded *Options
+
+	// rmu guards relays, which maps the upstream address of relayed
+	// connections to the details of the actual client.
+	rmu    sync.Mutex
+	relays map[string]*relayInfo
+
+	// nconns is the number of open connections.
+	nconns int32
+	// nclients is the number of clients that MaxClients limits, which
+	// leaves out the raft peers and the local host, and includes the
+	// clients of the relays and the memcached gateway.
+	nclients int32
+
+	// tmu guards lastTime, which is the last time returned by TIME.
+	tmu      sync.Mutex
+	lastTime time.Time
+
+	// started is the time that the machine was created.
+	started time.Time
+	// stats are counters for INFO.
+	stats *serverStats
+	// keycount caches the number of keys for INFO.
+	keycount keyCount
+
+	// cmu guards clients, which maps the clients that have issued a
+	// command to their connections.
+	cmu     sync.Mutex
+	clients map[*client]redcon.Conn
+	// conns are all of the open connections, which include the connections
+	// of the raft transport that never issue a command to the machine, and
+	// whether they count towards MaxClients. It's guarded by cmu.
+	conns map[redcon.Conn]bool
+
+	// stallUntil and dropUntil are the times, in nanoseconds, until which
+	// DEBUG SLEEP stalls the apply of the raft log and DEBUG DROP-FOLLOWER
+	// refuses connections. They're accessed atomically.
+	stallUntil int64
+	dropUntil  int64
+
+	// loading is the progress of the startup recovery.
+	loading loadingState
+
+	// done is closed when the machine is closed.
+	done chan struct{}
+
+	// applier is the node's applier, which is captured from Command.
+	applier atomic.Value
+
+	// watches receives all changes to the keyspace.
+	watches *watchHub
+
+	// monitors receives all commands from clients.
+	monitors *monitorHub
+
+	// latency tracks the latency of commands.
+	latency *latencyTracker
+
+	// group coalesces the writes of clients into groups, and gbatch is the
+	// batch that a group is applied with, which is guarded by the machine
+	// lock.
+	group  *groupCommit
+	gbatch groupBatch
+
+	// hotkeys tracks the most accessed keys.
+	hotkeys *hotKeys
+	// tracking is the keys that clients with CLIENT TRACKING read.
+	tracking *trackingTable
+
+	// rcache caches the values that GET reads.
+	rcache readCache
+
+	// usage is the usage of the keys for MaxKeys and MaxBytes, and access
+	// holds the access times of keys for the LRU eviction policy and the
+	// cold tier.
+	usage  keyspaceUsage
+	access accessClock
+
+	// cold is the state of the cold tier.
+	cold coldState
+
+	// audit records the administrative and write commands of clients. It's
+	// nil when there's no audit log.
+	audit *auditLog
+
+	// namespaces are the named keyspaces, which are guarded by the
+	// machine lock.
+	namespaces map[string]*namespace
+
+	// amu guards users, which are the ACL users stored in the database.
+	amu   sync.RWMutex
+	users map[string]*aclUser
+
+	// lmu guards ulimits, which are the rate limiters that are shared by
+	// the connections of each user.
+	lmu     sync.Mutex
+	ulimits map[string]*rateLimits
+
+	// lane holds the commands of clients that wait for a worker.
+	lane *commandLane
+	// fwd has the connections to the leader that the writes of clients
+	// are forwarded through, with ReplicaReads and ForwardWrites.
+	fwd *forwarder
+
+	// pending is the number of writes of clients that are proposed but
+	// not yet applied. It's accessed atomically.
+	pending int64
+
+	// stamp is the last version that was assigned to a write or applied.
+	// It's accessed atomically.
+	stamp uint64
+	// applyStamp is the version of the write that's being applied. It's
+	// only used by the goroutine that applies the raft log.
+	applyStamp uint64
+	// diskFree is the free space of the data and raft log directories, or
+	// -1 when it's unknown, and diskLow is 1 while it's below MinFreeDiskMB.
+	// They're accessed atomically.
+	diskFree int64
+	diskLow  int32
+	// raftLogSize is the size of the raft log on disk, or -1 when it's
+	// unknown. It's accessed atomically.
+	raftLogSize int64
+	// revision is the version of the last applied write, and revfloor is
+	// the oldest revision that can be read. They're accessed atomically.
+	revision uint64
+	revfloor uint64
+
+	// reqseq is the sequence of the last request id that was applied. It's
+	// only used by the goroutine that applies the raft log.
+	reqseq uint64
+
+	// syncing is true while a command from a client with CLIENT SYNCWRITES
+	// on is applied. It's only used by the goroutine that applies the raft
+	// log.
+	syncing bool
+
+	// rejoinc receives the leader that the node joins again, after it
+	// was removed from the cluster, when AutoRejoin is on.
+	rejoinc chan string
+	// shutdownc receives a value when a SHUTDOWN command is processed.
+	// The value indicates if a snapshot should be taken first.
+	shutdownc chan bool
 }
 
-func NewMachine(dir, addr string) (*Machine, error) {
+func NewMachine(dir, addr string, opts *Options) (*Machine, error) {
 	kvm := &Machine{
-		dir:  dir,
-		addr: addr,
+		dir:         dir,
+		addr:        addr,
+		relays:      make(map[string]*relayInfo),
+		latency:     newLatencyTracker(),
+		hotkeys:     newHotKeys(),
+		tracking:    newTrackingTable(),
+		group:       &groupCommit{},
+		lane:        newCommandLane(),
+		fwd:         &forwarder{},
+		shutdownc:   make(chan bool, 1),
+		rejoinc:     make(chan string, 1),
+		clients:     make(map[*client]redcon.Conn),
+		conns:       make(map[redcon.Conn]bool),
+		ulimits:     make(map[string]*rateLimits),
+		started:     time.Now(),
+		stats:       &serverStats{},
+		iostats:     &ioStats{},
+		compact:     &compactionCtl{},
+		diskFree:    -1,
+		raftLogSize: -1,
+		done:        make(chan struct{}),
 	}
-	var err error
-	kvm.dbPath = filepath.Join(dir, "node.db")
-	kvm.opts = &opt.Options{
-		NoSync: true,
-		Filter: filter.NewBloomFilter(10),
+	kvm.cold.warm = make(chan coldKey, coldWarmQueue)
+	if err := kvm.storeOptions(fillOptions(opts)); err != nil {
+		return nil, err
 	}
-	kvm.db, err = leveldb.OpenFile(kvm.dbPath, kvm.opts)
+	kvm.loaded = kvm.options()
+	kvm.watches = newWatchHub(func() OutputBufferLimit {
+		return kvm.options().OutputBufferLimits.Pubsub
+	})
+	kvm.monitors = newMonitorHub(func() OutputBufferLimit {
+		return kvm.options().OutputBufferLimits.Monitor
+	})
+	kvm.iostats.throttle = kvm.throttleTables
+	kvm.latency.observe = kvm.observeLatency
+	if err := checkEvictionPolicy(kvm.options().EvictionPolicy); err != nil {
+		return nil, err
+	}
+	kvm.dbPath = filepath.Join(dir, "node.db")
+	lopts, err := leveldbOptions(kvm.options())
 	if err != nil {
 		return nil, err
 	}
+	kvm.opts = lopts
+	if provider := kvm.options().EncryptionKey; provider != nil {
+		if kvm.key, err = loadKey(provider); err != nil {
+			return nil, err
+		}
+		if kvm.entries, err = entryCipher(kvm.key); err != nil {
+			return nil, err
+		}
+		// the raft log and the snapshots are on disk without a database.
+		if !kvm.options().InMemory {
+			if kvm.crypt, err = aes.NewCipher(kvm.key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := kvm.openDB(); err != nil {
+		return nil, err
+	}
+	if err := kvm.loadUsers(); err != nil {
+		kvm.closeDB()
+		return nil, err
+	}
+	if err := kvm.loadConfig(); err != nil {
+		kvm.closeDB()
+		return nil, err
+	}
+	if err := kvm.loadNamespaces(); err != nil {
+		kvm.closeDB()
+		return nil, err
+	}
+	if err := kvm.loadRequests(); err != nil {
+		kvm.closeDB()
+		return nil, err
+	}
+	if err := kvm.loadRevision(); err != nil {
+		kvm.closeDB()
+		return nil, err
+	}
+	if path := kvm.options().AuditLog; path != "" {
+		audit, err := openAuditLog(path)
+		if err != nil {
+			kvm.closeDB()
+			return nil, err
+		}
+		kvm.audit = audit
+	}
+	go kvm.reapClients()
+	go kvm.evictKeys()
+	go kvm.tierKeys()
+	go kvm.compactInWindows()
+	go kvm.reportMetrics()
 	return kvm, nil
 }
 
+// options returns the current options. The returned options must not be
+// modified.
+func (kvm *Machine) options() *Options {
+	return kvm.optionsv.Load().(*Options)
+}
+
+// openDB opens the database, which is either on disk or in memory, or the
+// store of OpenStore. The handle is only replaced when the database opens.
+func (kvm *Machine) openDB() error {
+	if open := kvm.options().OpenStore; open != nil {
+		store, err := open(kvm.dbPath)
+		if err != nil {
+			return err
+		}
+		kvm.db = store
+		return nil
+	}
+	var db *leveldb.DB
+	var err error
+	if kvm.options().InMemory {
+		db, err = leveldb.Open(kvm.iostats.wrap(storage.NewMemStorage()), kvm.opts)
+	} else {
+		var stor storage.Storage
+		if stor, err = openStorage(kvm.dbPath, kvm.crypt); err != nil {
+			return err
+		}
+		lstor := kvm.iostats.wrap(stor)
+		if db, err = leveldb.Open(lstor, kvm.opts); err != nil {
+			if db, err = kvm.openCorrupted(lstor, err); err != nil {
+				stor.Close()
+				return err
+			}
+		}
+		kvm.stor = stor
+	}
+	if err != nil {
+		return err
+	}
+	kvm.db = levelStore{db}
+	return nil
+}
+
+// closeDB closes the database and its storage.
+func (kvm *Machine) closeDB() error {
+	err := kvm.db.Close()
+	if kvm.stor != nil {
+		if serr := kvm.stor.Close(); err == nil {
+			err = serr
+		}
+		kvm.stor = nil
+	}
+	return err
+}
+
+// resetDB replaces the database with an empty one. The caller must hold the
+// machine lock. When it fails, the database is reopened with its data where
+// possible, and otherwise the closed handle is kept, so that readers get
+// errors rather than a nil handle, and the node is marked unhealthy.
+func (kvm *Machine) resetDB() error {
+	kvm.dbmu.Lock()
+	defer kvm.dbmu.Unlock()
+	if err := kvm.closeDB(); err != nil {
+		kvm.reopenDB()
+		return err
+	}
+	if !kvm.options().InMemory {
+		if err := os.RemoveAll(kvm.dbPath); err != nil {
+			kvm.reopenDB()
+			return err
+		}
+	}
+	if err := kvm.openDB(); err != nil {
+		kvm.loseDB(err)
+		return err
+	}
+	return nil
+}
+
+// reopenDB opens the database again after a reset failed.
+func (kvm *Machine) reopenDB() {
+	if err := kvm.openDB(); err != nil {
+		kvm.loseDB(err)
+	}
+}
+
+// loseDB marks the database as lost, after it couldn't be opened again. The
+// node keeps the closed handle, and reports that it's unhealthy so that it's
+// taken out of service and restarted.
+func (kvm *Machine) loseDB(err error) {
+	log.Warningf("the database could not be reopened: %v", err)
+	kvm.dbLost.Store(err)
+}
+
+// lostDB returns the error of a database that couldn't be reopened, or nil.
+func (kvm *Machine) lostDB() error {
+	err, _ := kvm.dbLost.Load().(error)
+	return err
+}
+
 func (kvm *Machine) Close() error {
 	kvm.mu.Lock()
 	defer kvm.mu.Unlock()
-	kvm.db.Close()
+	if kvm.closed {
+		return nil
+	}
 	kvm.closed = true
-	return nil
+	close(kvm.done)
+	kvm.fwd.reset()
+	if kvm.audit != nil {
+		kvm.audit.Close()
+	}
+	kvm.dbmu.Lock()
+	defer kvm.dbmu.Unlock()
+	return kvm.closeDB()
 }
 
 func (kvm *Machine) Command(
 	m finn.Applier, conn redcon.Conn, cmd redcon.Command,
 ) (interface{}, error) {
-	switch strings.ToLower(string(cmd.Args[0])) {
+	if conn != nil {
+		m = kvm.sealEntries(m)
+		c := kvm.client(conn)
+		if c.refused != nil {
+			// closing the connection discards the buffered replies, so the
+			// error is written directly.
+			msg := strings.TrimSpace(strings.Split(c.refused.Error(), "\n")[0])
+			conn.NetConn().Write([]byte("-" + msg + "\r\n"))
+			conn.Close()
+			return nil, nil
+		}
+		if t := c.track; t != nil {
+			t.begin()
+			defer func() {
+				// the command may have turned tracking off, or detached
+				// the connection.
+				if c.track == t {
+					t.end(conn)
+				}
+			}()
+		}
+		// the replies are checked before tracking writes them.
+		defer kvm.checkOutput(c, conn)
+		defer kvm.enterLane(cmd)()
+		if c.pipe != nil || (pipelinedWrite(cmd) && nextPipelinedWrite(conn)) {
+			return kvm.pipelineCommand(m, conn, cmd)
+		}
+	} else {
+		kvm.waitStall()
+	}
+	return kvm.command(m, conn, cmd)
+}
+
+func (kvm *Machine) command(
+	m finn.Applier, conn redcon.Conn, cmd redcon.Command,
+) (v interface{}, err error) {
+	kvm.setApplier(m)
+	name := strings.ToLower(string(cmd.Args[0]))
+	if name == "cryptexec" {
+		// the sealed entries of a node with an encryption key, which wrap
+		// the other entries.
+		if conn != nil {
+			return nil, finn.ErrUnknownCommand
+		}
+		if cmd, err = kvm.unwrapEntry(cmd); err != nil {
+			log.Warningf("raft log: %v", err)
+			return nil, err
+		}
+		return kvm.command(m, nil, cmd)
+	}
+	if name == "groupexec" {
+		// a group of writes from the group commit.
+		if conn != nil {
+			return nil, finn.ErrUnknownCommand
+		}
+		return kvm.cmdGroupexec(m, cmd)
+	}
+	if name == "verexec" {
+		// writes that are stamped with the version of their values, which
+		// wraps the other wrappers of a write.
+		if conn != nil {
+			return nil, finn.ErrUnknownCommand
+		}
+		var stamp, rev uint64
+		if stamp, cmd, err = unwrapVersion(cmd); err != nil {
+			return nil, err
+		}
+		if rev, err = kvm.admitStamp(stamp); rev == 0 {
+			return nil, err
+		}
+		kvm.observeStamp(rev)
+		kvm.applyStamp = rev
+		defer func() {
+			kvm.applyStamp = 0
+			if rerr := kvm.recordStamp(stamp, rev); rerr != nil && err == nil {
+				err = rerr
+			}
+		}()
+		name = strings.ToLower(string(cmd.Args[0]))
+	}
+	if name == "syncexec" {
+		// writes of clients with CLIENT SYNCWRITES on.
+		if conn != nil {
+			return nil, finn.ErrUnknownCommand
+		}
+		if cmd, err = unwrapSync(cmd); err != nil {
+			return nil, err
+		}
+		kvm.syncing = true
+		defer func() { kvm.syncing = false }()
+		name = strings.ToLower(string(cmd.Args[0]))
+	}
+	if name == "reqexec" {
+		// writes with a request id, which are applied at most once.
+		if conn != nil {
+			return nil, finn.ErrUnknownCommand
+		}
+		id, cmd, err := unwrapRequest(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return kvm.applyRequest(m, id, cmd)
+	}
+	var traceparent, reqid string
+	var minrev uint64
+	if name == "traceexec" {
+		// traced commands carry their trace context in the raft log.
+		if conn != nil {
+			return nil, finn.ErrUnknownCommand
+		}
+		cmd, traceparent, err = unwrapTrace(cmd)
+		if err != nil {
+			return nil, err
+		}
+		name = strings.ToLower(string(cmd.Args[0]))
+	}
+	// in-process commands of the node, such as Set and the evictions of the
+	// leader, skip the checks of clients, but are proposed like their writes.
+	_, local := conn.(*localConn)
+	var ks keyspace
+	if name == "dbexec" || name == "nsexec" {
+		// commands on keyspaces other than database 0 are wrapped in the
+		// raft log.
+		if conn != nil {
+			return nil, finn.ErrUnknownCommand
+		}
+		cmd, ks, err = unwrapKeyspace(cmd)
+		if err != nil {
+			return nil, err
+		}
+		name = strings.ToLower(string(cmd.Args[0]))
+	}
+	if conn != nil && !local {
+		if name == "proxy" {
+			return kvm.cmdProxy(m, conn, cmd)
+		}
+		if hooks := kvm.options().Hooks; hooks != nil && hooks.OnCommand != nil {
+			if cmd, name, err = kvm.hookCommand(kvm.client(conn), cmd); err != nil {
+				return nil, err
+			}
+		}
+		kvm.client(conn).touch()
+		defer kvm.client(conn).setLastCmd(name)
+		if kvm.audit != nil && audited(name, cmd.Args) {
+			c := kvm.client(conn)
+			ks := keyspace{db: c.db, ns: c.ns}
+			defer func() { kvm.audit.record(c, ks, cmd, err) }()
+		}
+	}
+	if conn != nil && !local && name != "auth" && name != "hello" {
+		c := kvm.client(conn)
+		if c.tx != nil && !txControl(name) {
+			// a command that fails to queue discards the transaction.
+			defer func() {
+				if err != nil && c.tx != nil {
+					c.tx.aborted = true
+				}
+			}()
+		}
+		if !kvm.authorized(c) {
+			return nil, errNoAuth
+		}
+		if err := kvm.checkCommand(c, name, cmd); err != nil {
+			return nil, err
+		}
+		if len(cmd.Args) > 1 {
+			// subcommands, such as "client|kill", may be restricted
+			// further than their command.
+			sub := name + "|" + strings.ToLower(string(cmd.Args[1]))
+			if err := kvm.checkCommand(c, sub, cmd); err != nil {
+				return nil, err
+			}
+		}
+		if err := kvm.checkLoading(name); err != nil {
+			return nil, err
+		}
+		if err := kvm.throttle(c, cmd); err != nil {
+			return nil, err
+		}
+		if err := kvm.checkSizes(name, cmd.Args); err != nil {
+			return nil, err
+		}
+		if err := kvm.checkDisk(name); err != nil {
+			return nil, err
+		}
+		if err := kvm.checkCapacity(name); err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&kvm.stats.commands, 1)
+		if name != "acl" {
+			// commands with passwords are not monitored.
+			kvm.monitors.publish(c, cmd.Args)
+		}
+		ks = kvm.clientKeyspace(c)
+		// OBJECT reports the accesses of a key, without being one.
+		if rate := kvm.options().HotKeysSampling; rate > 0 && name != "object" {
+			kvm.hotkeys.sample(rate, commandKeys(commands[name], cmd.Args), ks)
+		}
+		if opts := kvm.options(); (opts.EvictionPolicy == policyLRU || opts.ColdAfter > 0) &&
+			name != "object" {
+			kvm.touchKeys(ks, commandKeys(commands[name], cmd.Args))
+		}
+		if c.track != nil && commands[name].hasCategory("read") {
+			kvm.tracking.record(c.track, ks, commandKeys(commands[name], cmd.Args))
+		}
+		start := time.Now()
+		defer func() {
+			kvm.latency.record(name, phaseTotal, time.Since(start))
+		}()
+		if c.tx != nil && !txControl(name) {
+			return kvm.queueTx(c, conn, name, cmd)
+		}
+		if name != "traceparent" {
+			traceparent, c.traceparent = c.traceparent, ""
+		}
+		if name != "reqid" {
+			reqid, c.reqid = c.reqid, ""
+		}
+		if name != "minrev" {
+			minrev, c.minrev = c.minrev, 0
+		}
+		if kvm.options().ReplicaReads {
+			// followers answer writes with READONLY, or forward them.
+			fw := kvm.forwarded(c, name, cmd, ks, reqid)
+			if pipe := c.pipe; pipe != nil && pipe.cur != nil {
+				if fw != nil {
+					fw.args = copyArgs(fw.args)
+				}
+				pipe.cur.fwd = fw
+			} else {
+				defer func() {
+					switch {
+					case !notLeaderError(err):
+					case fw != nil:
+						v, err = nil, kvm.forward(c, conn, fw)
+					default:
+						err = kvm.notLeader()
+					}
+				}()
+			}
+		}
+	}
+	if minrev > 0 {
+		m = minrevApplier{m, kvm, minrev}
+	} else if conn != nil && kvm.staleReads(kvm.client(conn)) {
+		m = staleApplier{m}
+	}
+	m = groupApplier{m, kvm}
+	m = versionApplier{m, kvm}
+	m = backpressureApplier{m, kvm}
+	if reqid != "" {
+		m = &reqidApplier{m, reqid}
+	}
+	if conn != nil && kvm.client(conn).syncing() {
+		m = syncApplier{m}
+	}
+	if conn != nil {
+		m = lastrevApplier{m, kvm, kvm.client(conn)}
+	}
+	m = latencyApplier{m, kvm.latency, name}
+	if tracer := kvm.options().Tracer; tracer != nil {
+		attrs := map[string]string{"command": name, "node": kvm.addr}
+		spanName := "kvnode.command"
+		if conn == nil {
+			spanName = "kvnode.apply"
+		}
+		span := startSpan(tracer, traceparent, spanName, attrs)
+		if span != nil {
+			defer func() { endSpan(span, err) }()
+			m = traceApplier{m, tracer, span.TraceParent(), attrs}
+		}
+	}
+	if ks != (keyspace{}) {
+		m = keyspaceApplier{m, ks}
+	}
+	if hooks := kvm.options().Hooks; conn == nil && hooks != nil && hooks.OnApply != nil &&
+		commands[name].hasCategory("write") {
+		defer func() {
+			if err == nil {
+				hooks.OnApply(ks.db, ks.ns, cmd.Args)
+			}
+		}()
+	}
+	if conn == nil && kvm.tracking.active() && (commands[name].hasCategory("write") ||
+		name == "evict" || name == "pdelchunk" || name == "namespace") {
+		defer func() {
+			if err == nil {
+				kvm.invalidateWrite(ks, name, cmd.Args)
+			}
+		}()
+	}
+	switch name {
 	default:
 		log.Warningf("unknown command: %s\n", cmd.Args[0])
 		return nil, finn.ErrUnknownCommand
+	case "auth":
+		return kvm.cmdAuth(m, conn, cmd)
+	case "hello":
+		return kvm.cmdHello(m, conn, cmd)
+	case "acl":
+		return kvm.cmdACL(m, conn, cmd)
+	case "client":
+		return kvm.cmdClient(m, conn, cmd)
+	case "monitor":
+		return kvm.cmdMonitor(m, conn, cmd)
+	case "config":
+		return kvm.cmdConfig(m, conn, cmd)
+	case "info":
+		return kvm.cmdInfo(m, conn, cmd)
+	case "command":
+		return kvm.cmdCommand(m, conn, cmd)
 	case "echo":
 		return kvm.cmdEcho(m, conn, cmd)
+	case "traceparent":
+		return kvm.cmdTraceparent(m, conn, cmd)
+	case "reqid":
+		return kvm.cmdReqid(m, conn, cmd)
+	case "minrev":
+		return kvm.cmdMinrev(m, conn, cmd)
+	case "multi":
+		return kvm.cmdMulti(m, conn, cmd)
+	case "exec":
+		return kvm.cmdExec(m, conn, cmd)
+	case "discard":
+		return kvm.cmdDiscard(m, conn, cmd)
+	case "lastrev":
+		return kvm.cmdLastrev(m, conn, cmd)
+	case "select":
+		return kvm.cmdSelect(m, conn, cmd)
+	case "time":
+		return kvm.cmdTime(m, conn, cmd)
+	case "hlc":
+		return kvm.cmdHLC(m, conn, cmd)
 	case "set":
 		return kvm.cmdSet(m, conn, cmd)
 	case "mset":
 		return kvm.cmdMset(m, conn, cmd)
+	case "msetif":
+		return kvm.cmdMsetif(m, conn, cmd)
+	case "mappend":
+		return kvm.cmdMappend(m, conn, cmd)
+	case "fcall":
+		return kvm.cmdFcall(m, conn, cmd, false)
+	case "fcall_ro":
+		return kvm.cmdFcall(m, conn, cmd, true)
 	case "get":
 		return kvm.cmdGet(m, conn, cmd)
+	case "evict":
+		// keys that the leader evicted.
+		if conn != nil && !local {
+			return nil, finn.ErrUnknownCommand
+		}
+		return kvm.cmdEvict(m, conn, cmd)
+	case "tier", "untier":
+		// keys that the leader moved to or from the cold store.
+		if conn != nil && !local {
+			return nil, finn.ErrUnknownCommand
+		}
+		if name == "tier" {
+			return kvm.cmdTier(m, conn, cmd)
+		}
+		return kvm.cmdUntier(m, conn, cmd)
+	case "revision":
+		return kvm.cmdRevision(m, conn, cmd)
+	case "keyinfo":
+		return kvm.cmdKeyinfo(m, conn, cmd)
+	case "getver":
+		return kvm.cmdGetver(m, conn, cmd)
 	case "mget":
 		return kvm.cmdMget(m, conn, cmd)
 	case "del":
 		return kvm.cmdDel(m, conn, cmd, false)
 	case "pdel":
 		return kvm.cmdPdel(m, conn, cmd, false)
+	case "pdelchunk":
+		return kvm.cmdPdelchunk(m, conn, cmd)
+	case "popmatch":
+		return kvm.cmdPopmatch(m, conn, cmd)
 	case "delif":
 		return kvm.cmdDel(m, conn, cmd, true)
 	case "keys":
 		return kvm.cmdKeys(m, conn, cmd)
 	case "flushdb":
 		return kvm.cmdFlushdb(m, conn, cmd)
+	case "flushall":
+		return kvm.cmdFlushall(m, conn, cmd)
+	case "namespace":
+		return kvm.cmdNamespace(m, conn, cmd)
+	case "latency":
+		return kvm.cmdLatency(m, conn, cmd)
+	case "bigkeys":
+		return kvm.cmdBigkeys(m, conn, cmd)
+	case "prefixstats":
+		return kvm.cmdPrefixstats(m, conn, cmd)
+	case "hotkeys":
+		return kvm.cmdHotkeys(m, conn, cmd)
+	case "object":
+		return kvm.cmdObject(m, conn, cmd)
+	case "memory":
+		return kvm.cmdMemory(m, conn, cmd)
+	case "debug":
+		return kvm.cmdDebug(m, conn, cmd)
+	case "raft":
+		return kvm.cmdRaft(m, conn, cmd)
+	case "compact":
+		return kvm.cmdCompact(m, conn, cmd)
+	case "checkdb":
+		return kvm.cmdCheckDB(m, conn, cmd)
+	case "dbstats":
+		return kvm.cmdDBStats(m, conn, cmd)
+	case "watchkeys":
+		return kvm.cmdWatchkeys(m, conn, cmd)
 	case "shutdown":
-		log.Warningf("shutting down")
-		conn.WriteString("OK")
-		conn.Close()
-		os.Exit(0)
-		return nil, nil
+		return kvm.cmdShutdown(m, conn, cmd)
 	}
 }
 
 func (kvm *Machine) Restore(rd io.Reader) error {
 	kvm.mu.Lock()
 	defer kvm.mu.Unlock()
-	var err error
-	if err := kvm.db.Close(); err != nil {
-		return err
-	}
-	if err := os.RemoveAll(kvm.dbPath); err != nil {
-		return err
-	}
-	kvm.db = nil
-	kvm.db, err = leveldb.OpenFile(kvm.dbPath, kvm.opts)
-	if err != nil {
+	if err := kvm.resetDB(); err != nil {
 		return err
 	}
+	defer kvm.rcache.clear()
+	defer kvm.resetUsage()
+	defer kvm.tracking.invalidateAll()
 	var read int
+	var entries, total int64
+	start, lastLog := time.Now(), time.Now()
 	batch := new(leveldb.Batch)
-	num := make([]byte, 8)
-	gzr, err := gzip.NewReader(rd)
+	if kvm.key != nil {
+		var err error
+		if rd, err = snapshot.Decrypt(rd, kvm.key); err != nil {
+			return err
+		}
+	}
+	dec, err := snapshot.NewDecoder(rd)
 	if err != nil {
 		return err
 	}
-	r := bufio.NewReader(gzr)
-	for {
+	// the batch copies the entries, so the buffer of the decoder is reused.
+	for dec.Next() {
 		if read > 4*1024*1024 {
 			if err := kvm.db.Write(batch, nil); err != nil {
 				return err
 			}
+			batch.Reset()
 			read = 0
-		}
-		if _, err := io.ReadFull(r, num); err != nil {
-			if err == io.EOF {
-				break
+			if time.Since(lastLog) >= loadingLogInterval {
+				lastLog = time.Now()
+				log.Noticef("loading: restored %d entries (%s) of the snapshot",
+					entries, humanBytes(uint64(total)))
 			}
-			return err
-		}
-		key := make([]byte, int(binary.LittleEndian.Uint64(num)))
-		if _, err := io.ReadFull(r, key); err != nil {
-			return err
-		}
-		if _, err := io.ReadFull(r, num); err != nil {
-			return err
-		}
-		value := make([]byte, int(binary.LittleEndian.Uint64(num)))
-		if _, err := io.ReadFull(r, value); err != nil {
-			return err
 		}
+		key, value := dec.Key(), dec.Value()
 		batch.Put(key, value)
 		read += (len(key) + len(value))
+		entries++
+		total += int64(len(key) + len(value))
+	}
+	if err := dec.Err(); err != nil {
+		return err
 	}
 	if err := kvm.db.Write(batch, nil); err != nil {
 		return err
 	}
-	return gzr.Close()
+	log.Noticef("loading: restored the snapshot in %s, %d entries (%s)",
+		time.Since(start).Round(time.Millisecond), entries, humanBytes(uint64(total)))
+	if err := kvm.loadUsers(); err != nil {
+		return err
+	}
+	if err := kvm.loadConfig(); err != nil {
+		return err
+	}
+	if err := kvm.loadNamespaces(); err != nil {
+		return err
+	}
+	if err := kvm.loadRequests(); err != nil {
+		return err
+	}
+	if err := kvm.loadRevision(); err != nil {
+		return err
+	}
+	kvm.watches.publish(allKeyspaces, atomic.LoadUint64(&kvm.revision), "restore", nil, nil)
+	return nil
 }
 
 // WriteRedisCommandsFromSnapshot will read a snapshot and write all the
-// Redis SET commands needed to rebuild the entire database.
+// Redis SET commands needed to rebuild the entire database. SELECT and
+// NAMESPACE commands create and switch between the keyspaces.
 // The commands are written to wr.
 func WriteRedisCommandsFromSnapshot(wr io.Writer, snapshotPath string) error {
+	return WriteRedisCommandsFromEncryptedSnapshot(wr, snapshotPath, nil)
+}
+
+// WriteRedisCommandsFromEncryptedSnapshot is WriteRedisCommandsFromSnapshot
+// for the snapshots of nodes that have an encryption key, which is the key
+// of the provider. A nil provider reads snapshots that aren't encrypted.
+func WriteRedisCommandsFromEncryptedSnapshot(wr io.Writer, snapshotPath string, provider KeyProvider) error {
 	f, err := os.Open(snapshotPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	var rd io.Reader = f
+	if provider != nil {
+		key, err := loadKey(provider)
+		if err != nil {
+			return err
+		}
+		if rd, err = snapshot.Decrypt(f, key); err != nil {
+			return err
+		}
+	}
 	var cmd []byte
-	num := make([]byte, 8)
-	var gzclosed bool
-	gzr, err := gzip.NewReader(f)
+	var selected keyspace
+	dec, err := snapshot.NewDecoder(rd)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if !gzclosed {
-			gzr.Close()
-		}
-	}()
-	r := bufio.NewReader(gzr)
-	for {
-		if _, err := io.ReadFull(r, num); err != nil {
-			if err == io.EOF {
-				break
+	for dec.Next() {
+		key, value := dec.Key(), dec.Value()
+		var ks keyspace
+		if db, dkey, ok := parseDBKey(key); ok {
+			ks, key = keyspace{db: db}, dkey
+		} else if name, nkey, ok := parseNSKey(key); ok {
+			ks, key = keyspace{ns: name}, nkey
+		} else if len(key) > 0 && key[0] == 'm' {
+			ns, err := parseNamespace(string(key[1:]), string(value))
+			if err != nil {
+				return err
 			}
-			return err
-		}
-		key := make([]byte, int(binary.LittleEndian.Uint64(num)))
-		if _, err := io.ReadFull(r, key); err != nil {
-			return err
-		}
-		if _, err := io.ReadFull(r, num); err != nil {
-			return err
+			if _, err := wr.Write(buildCommand([]byte("NAMESPACE"),
+				[]byte("CREATE"), []byte(ns.name),
+				[]byte("MAXKEYS"), []byte(strconv.FormatInt(ns.maxKeys, 10)),
+				[]byte("MAXBYTES"), []byte(strconv.FormatInt(ns.maxBytes, 10)),
+			)); err != nil {
+				return err
+			}
+			continue
+		} else {
+			// do not accept keys that are not in a keyspace
+			continue
 		}
-		value := make([]byte, int(binary.LittleEndian.Uint64(num)))
-		if _, err := io.ReadFull(r, value); err != nil {
+		if value, err = decodeValue(value); err != nil {
 			return err
 		}
-		if len(key) == 0 || key[0] != 'k' {
-			// do not accept keys that do not start with 'k'
-			continue
-		}
-		key = key[1:]
 		cmd = cmd[:0]
+		if ks != selected {
+			if ks.ns != "" {
+				cmd = append(cmd, buildCommand([]byte("NAMESPACE"), []byte("USE"), []byte(ks.ns))...)
+			} else {
+				cmd = append(cmd, buildCommand([]byte("SELECT"), []byte(ks.String()))...)
+			}
+			selected = ks
+		}
 		cmd = append(cmd, "*3\r\n$3\r\nSET\r\n$"...)
 		cmd = strconv.AppendInt(cmd, int64(len(key)), 10)
 		cmd = append(cmd, '\r', '\n')
@@ -257,15 +1515,26 @@ func WriteRedisCommandsFromSnapshot(wr io.Writer, snapshotPath string) error {
 			return err
 		}
 	}
-	err = gzr.Close()
-	gzclosed = true
-	return err
+	return dec.Err()
 }
 
 func (kvm *Machine) Snapshot(wr io.Writer) error {
 	kvm.mu.RLock()
 	defer kvm.mu.RUnlock()
-	gzw := gzip.NewWriter(wr)
+	atomic.AddInt32(&kvm.compact.snapshots, 1)
+	defer atomic.AddInt32(&kvm.compact.snapshots, -1)
+	wr = snapshot.Throttle(wr, kvm.options().SnapshotRate)
+	var ew io.WriteCloser
+	if kvm.key != nil {
+		// the snapshots are sent to the other nodes, and are on their disks
+		// too.
+		var err error
+		if ew, err = snapshot.Encrypt(wr, kvm.key); err != nil {
+			return err
+		}
+		wr = ew
+	}
+	enc := snapshot.NewEncoder(wr)
 	ss, err := kvm.db.GetSnapshot()
 	if err != nil {
 		return err
@@ -273,25 +1542,19 @@ func (kvm *Machine) Snapshot(wr io.Writer) error {
 	defer ss.Release()
 	iter := ss.NewIterator(nil, nil)
 	defer iter.Release()
-	var buf []byte
-	num := make([]byte, 8)
 	for ok := iter.First(); ok; ok = iter.Next() {
-		buf = buf[:0]
-		key := iter.Key()
-		value := iter.Value()
-		binary.LittleEndian.PutUint64(num, uint64(len(key)))
-		buf = append(buf, num...)
-		buf = append(buf, key...)
-		binary.LittleEndian.PutUint64(num, uint64(len(value)))
-		buf = append(buf, num...)
-		buf = append(buf, value...)
-		if _, err := gzw.Write(buf); err != nil {
+		if err := enc.Encode(iter.Key(), iter.Value()); err != nil {
 			return err
 		}
 	}
-	if err := gzw.Close(); err != nil {
+	if err := enc.Close(); err != nil {
 		return err
 	}
+	if ew != nil {
+		if err := ew.Close(); err != nil {
+			return err
+		}
+	}
 	iter.Release()
 	return iter.Error()
 }
@@ -299,16 +1562,66 @@ func (kvm *Machine) Snapshot(wr io.Writer) error {
 func (kvm *Machine) cmdSet(
 	m finn.Applier, conn redcon.Conn, cmd redcon.Command,
 ) (interface{}, error) {
-	if len(cmd.Args) != 3 {
+	if len(cmd.Args) < 3 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
+	ifVersion, lww, err := parseSetOptions(cmd.Args[3:])
+	if err != nil {
+		return nil, err
+	}
+	if conn != nil && lww > 0 {
+		if err := checkOffset(lww); err != nil {
+			return nil, err
+		}
+	}
+	ks := keyspaceOf(m)
 	return m.Apply(conn, cmd,
 		func() (interface{}, error) {
-			kvm.mu.Lock()
-			defer kvm.mu.Unlock()
-			return nil, kvm.db.Put(makeKey('k', cmd.Args[1]), cmd.Args[2], nil)
+			buf := getKeyBuf()
+			defer putKeyBuf(buf)
+			key := ks.appendKey(*buf, cmd.Args[1])
+			*buf = key
+			defer kvm.lockKeys(ks, [][]byte{key})()
+			version := kvm.applyStamp
+			if ifVersion >= 0 || lww > 0 {
+				// the value is only set when the key has the
+				// version, where a missing key has version zero, or
+				// when the timestamp is newer than its version.
+				var cur uint64
+				value, err := kvm.db.Get(key, nil)
+				if err == nil {
+					cur = valueVersion(value)
+				} else if err != leveldb.ErrNotFound {
+					return nil, err
+				}
+				if (ifVersion >= 0 && cur != uint64(ifVersion)) || (lww > 0 && lww <= cur) {
+					return false, nil
+				}
+			}
+			if lww > 0 && version > 0 {
+				// the value keeps the timestamp of the write that it was
+				// replicated from, so that clusters converge.
+				kvm.observeStamp(lww)
+				version = lww
+			}
+			meta, err := kvm.nextMeta(key, nil)
+			if err != nil {
+				return nil, err
+			}
+			threshold := kvm.options().CompressionThreshold
+			var batch leveldb.Batch
+			batch.Put(key, encodeValue(cmd.Args[2], threshold, version, meta))
+			if err := kvm.writeBatch(ks, &batch); err != nil {
+				return nil, err
+			}
+			kvm.watches.publish(ks, kvm.applyStamp, "set", cmd.Args[1], cmd.Args[2])
+			return nil, nil
 		},
 		func(v interface{}) (interface{}, error) {
+			if ok, isBool := v.(bool); isBool && !ok {
+				writeNull(conn)
+				return nil, nil
+			}
 			conn.WriteString("OK")
 			return nil, nil
 		},
@@ -321,15 +1634,30 @@ func (kvm *Machine) cmdMset(
 	if len(cmd.Args) < 3 || (len(cmd.Args)-1)%2 == 1 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
+	ks := keyspaceOf(m)
 	return m.Apply(conn, cmd,
 		func() (interface{}, error) {
-			kvm.mu.Lock()
-			defer kvm.mu.Unlock()
+			buf := getKeyBuf()
+			defer putKeyBuf(buf)
+			keys := ks.appendKeys(buf, cmd.Args[1:], 2)
+			defer kvm.lockKeys(ks, keys)()
+			threshold := kvm.options().CompressionThreshold
 			var batch leveldb.Batch
+			pending := make(map[string]*keyMeta)
+			for i, key := range keys {
+				meta, err := kvm.nextMeta(key, pending)
+				if err != nil {
+					return nil, err
+				}
+				batch.Put(key, encodeValue(cmd.Args[i*2+2], threshold, kvm.applyStamp, meta))
+			}
+			if err := kvm.writeBatch(ks, &batch); err != nil {
+				return nil, err
+			}
 			for i := 1; i < len(cmd.Args); i += 2 {
-				batch.Put(makeKey('k', cmd.Args[i]), cmd.Args[i+1])
+				kvm.watches.publish(ks, kvm.applyStamp, "set", cmd.Args[i], cmd.Args[i+1])
 			}
-			return nil, kvm.db.Write(&batch, nil)
+			return nil, nil
 		},
 		func(v interface{}) (interface{}, error) {
 			conn.WriteString("OK")
@@ -345,23 +1673,87 @@ func (kvm *Machine) cmdEcho(m finn.Applier, conn redcon.Conn, cmd redcon.Command
 	conn.WriteBulk(cmd.Args[1])
 	return nil, nil
 }
+
+// cmdTime handles "TIME". Like reads, it's served by the leader when the
+// consistency level requires, so all clients observe the same clock. The
+// time never goes backwards on a node.
+func (kvm *Machine) cmdTime(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			kvm.tmu.Lock()
+			now := time.Now()
+			if !now.After(kvm.lastTime) {
+				now = kvm.lastTime.Add(time.Microsecond)
+			}
+			kvm.lastTime = now
+			kvm.tmu.Unlock()
+			conn.WriteArray(2)
+			conn.WriteBulkString(strconv.FormatInt(now.Unix(), 10))
+			conn.WriteBulkString(strconv.FormatInt(int64(now.Nanosecond()/1000), 10))
+			return nil, nil
+		},
+	)
+}
+
 func (kvm *Machine) cmdGet(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
-	if len(cmd.Args) != 2 {
+	if len(cmd.Args) != 2 && len(cmd.Args) != 4 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
-	key := makeKey('k', cmd.Args[1])
+	at, err := parseAt(cmd.Args[2:])
+	if err != nil {
+		return nil, err
+	}
+	ks := keyspaceOf(m)
 	return m.Apply(conn, cmd, nil,
 		func(interface{}) (interface{}, error) {
-			kvm.mu.RLock()
-			defer kvm.mu.RUnlock()
-			value, err := kvm.db.Get(key, nil)
+			buf := getKeyBuf()
+			defer putKeyBuf(buf)
+			*buf = ks.appendKey(*buf, cmd.Args[1])
+			kvm.dbmu.RLock()
+			defer kvm.dbmu.RUnlock()
+			var value []byte
+			var err error
+			if at > 0 {
+				var ss Snapshot
+				var release func()
+				if ss, release, err = kvm.snapshot(m); err != nil {
+					return nil, err
+				}
+				value, err = getAt(ss, *buf, at)
+				release()
+				if err == nil && value == nil {
+					err = leveldb.ErrNotFound
+				}
+			} else if cacheSize := kvm.options().ReadCacheSize; cacheSize > 0 && txSnapshot(m) == nil {
+				cached, seq, ok := kvm.rcache.get(*buf)
+				if ok {
+					conn.WriteBulk(cached)
+					return nil, nil
+				}
+				if value, err = kvm.db.Get(*buf, nil); err == nil {
+					if value, err = kvm.loadValue(*buf, value); err != nil {
+						return nil, err
+					}
+					kvm.rcache.put(*buf, value, seq, cacheSize)
+					conn.WriteBulk(value)
+					return nil, nil
+				}
+			} else {
+				value, err = kvm.reader(m).Get(*buf, nil)
+			}
 			if err != nil {
 				if err == leveldb.ErrNotFound {
-					conn.WriteNull()
+					writeNull(conn)
 					return nil, nil
 				}
 				return nil, err
 			}
+			if value, err = kvm.loadValue(*buf, value); err != nil {
+				return nil, err
+			}
 			conn.WriteBulk(value)
 			return nil, nil
 		},
@@ -372,14 +1764,24 @@ func (kvm *Machine) cmdMget(m finn.Applier, conn redcon.Conn, cmd redcon.Command
 	if len(cmd.Args) < 2 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
+	ks := keyspaceOf(m)
 	return m.Apply(conn, cmd, nil,
 		func(interface{}) (interface{}, error) {
-			kvm.mu.RLock()
-			defer kvm.mu.RUnlock()
+			buf := getKeyBuf()
+			defer putKeyBuf(buf)
+			kvm.dbmu.RLock()
+			defer kvm.dbmu.RUnlock()
+			// the keys are read from a point-in-time view, so that writes
+			// that happen during the reads are not partially seen.
+			ss, release, err := kvm.snapshot(m)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
 			var values [][]byte
 			for i := 1; i < len(cmd.Args); i++ {
-				key := makeKey('k', cmd.Args[i])
-				value, err := kvm.db.Get(key, nil)
+				*buf = ks.appendKey((*buf)[:0], cmd.Args[i])
+				value, err := ss.Get(*buf, nil)
 				if err != nil {
 					if err == leveldb.ErrNotFound {
 						values = append(values, nil)
@@ -387,13 +1789,17 @@ func (kvm *Machine) cmdMget(m finn.Applier, conn redcon.Conn, cmd redcon.Command
 						return nil, err
 					}
 				} else {
-					values = append(values, bcopy(value))
+					// the value is a copy that's owned by the caller.
+					if value, err = kvm.loadValue(*buf, value); err != nil {
+						return nil, err
+					}
+					values = append(values, value)
 				}
 			}
 			conn.WriteArray(len(values))
 			for _, v := range values {
 				if v == nil {
-					conn.WriteNull()
+					writeNull(conn)
 				} else {
 					conn.WriteBulk(v)
 				}
@@ -402,31 +1808,78 @@ func (kvm *Machine) cmdMget(m finn.Applier, conn redcon.Conn, cmd redcon.Command
 		},
 	)
 }
+
+// delifModes are the ways that DELIF matches values.
+var delifModes = map[string]func(value, pattern []byte) bool{
+	"contains": bytes.Contains,
+	"eq":       bytes.Equal,
+	"prefix":   bytes.HasPrefix,
+	"glob": func(value, pattern []byte) bool {
+		return match.Match(string(value), string(pattern))
+	},
+}
+
+// parseDelif parses "DELIF [MODE mode] value key [key ...]". It returns the
+// match function, the value, and the position of the first key.
+func parseDelif(args [][]byte) (func(value, pattern []byte) bool, []byte, int, error) {
+	if len(args) > 4 && strings.ToLower(string(args[1])) == "mode" {
+		fn := delifModes[strings.ToLower(string(args[2]))]
+		if fn == nil {
+			return nil, nil, 0, errSyntaxError
+		}
+		return fn, args[3], 4, nil
+	}
+	if len(args) < 3 {
+		return nil, nil, 0, finn.ErrWrongNumberOfArguments
+	}
+	return bytes.Contains, args[1], 2, nil
+}
+
+// delifKeys returns the keys of a DELIF command.
+func delifKeys(args [][]byte) [][]byte {
+	_, _, start, err := parseDelif(args)
+	if err != nil {
+		return nil
+	}
+	return args[start:]
+}
+
 func (kvm *Machine) cmdDel(m finn.Applier, conn redcon.Conn, cmd redcon.Command, delif bool) (interface{}, error) {
 	if (delif && len(cmd.Args) < 3) || len(cmd.Args) < 2 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
 	var valueif []byte
+	var matches func(value, pattern []byte) bool
 	var startIdx = 1
 	if delif {
-		valueif = cmd.Args[1]
-		startIdx = 2
+		var err error
+		matches, valueif, startIdx, err = parseDelif(cmd.Args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ks := keyspaceOf(m)
+	if delif && conn != nil {
+		kvm.warmKeys(ks, cmd.Args[startIdx:])
 	}
 	return m.Apply(conn, cmd,
 		func() (interface{}, error) {
-			kvm.mu.Lock()
-			defer kvm.mu.Unlock()
+			buf := getKeyBuf()
+			defer putKeyBuf(buf)
+			keys := ks.appendKeys(buf, cmd.Args[startIdx:], 1)
+			defer kvm.lockKeys(ks, keys)()
 			var batch leveldb.Batch
-			var n int
+			var deleted [][]byte
 			for i := startIdx; i < len(cmd.Args); i++ {
-				key := makeKey('k', cmd.Args[i])
+				key := keys[i-startIdx]
 				var has bool
 				var err error
 				var val []byte
 				if delif {
 					val, err = kvm.db.Get(key, nil)
 					if err == nil {
-						has = bytes.Contains(val, valueif)
+						val, err = decodeValue(val)
+						has = err == nil && matches(val, valueif)
 					}
 				} else {
 					has, err = kvm.db.Has(key, nil)
@@ -434,14 +1887,17 @@ func (kvm *Machine) cmdDel(m finn.Applier, conn redcon.Conn, cmd redcon.Command,
 				if err != nil && err != leveldb.ErrNotFound {
 					return 0, err
 				} else if has {
-					n++
+					deleted = append(deleted, cmd.Args[i])
 					batch.Delete(key)
 				}
 			}
-			if err := kvm.db.Write(&batch, nil); err != nil {
+			if err := kvm.writeBatch(ks, &batch); err != nil {
 				return nil, err
 			}
-			return n, nil
+			for _, key := range deleted {
+				kvm.watches.publish(ks, kvm.applyStamp, "del", key, nil)
+			}
+			return len(deleted), nil
 		},
 		func(v interface{}) (interface{}, error) {
 			n := v.(int)
@@ -452,79 +1908,387 @@ func (kvm *Machine) cmdDel(m finn.Applier, conn redcon.Conn, cmd redcon.Command,
 }
 
 func (kvm *Machine) cmdPdel(m finn.Applier, conn redcon.Conn, cmd redcon.Command, delif bool) (interface{}, error) {
-	if len(cmd.Args) != 2 {
+	if len(cmd.Args) != 2 && (conn == nil || len(cmd.Args) != 3) {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	ks := keyspaceOf(m)
+	if conn == nil {
+		// entries from before PDEL was chunked delete every key at once.
+		return kvm.pdelChunk(ks, cmd.Args[1], 0)
+	}
+	if len(cmd.Args) == 3 {
+		// "PDEL pattern DRYRUN" counts the keys that would be deleted.
+		if strings.ToLower(string(cmd.Args[2])) != "dryrun" {
+			return nil, errSyntaxError
+		}
+		return m.Apply(conn, cmd, nil,
+			func(interface{}) (interface{}, error) {
+				kvm.dbmu.RLock()
+				defer kvm.dbmu.RUnlock()
+				var n int
+				err := scanEach(kvm.db, cmd.Args[1], scanOptions{ks: ks, limit: -1},
+					func(key, value []byte) bool {
+						n++
+						return true
+					},
+				)
+				if err != nil {
+					return nil, err
+				}
+				conn.WriteInt(n)
+				return nil, nil
+			},
+		)
+	}
+	// the keys are deleted in chunks, which are separate raft entries, so
+	// that other writes are applied in between.
+	size := kvm.options().PdelChunkSize
+	args := [][]byte{[]byte("pdelchunk"), cmd.Args[1], []byte(strconv.Itoa(size))}
+	chunk := redcon.Command{Raw: buildCommand(args...), Args: args}
+	var total int
+	for {
+		v, err := m.Apply(conn, chunk,
+			func() (interface{}, error) {
+				return kvm.pdelChunk(ks, cmd.Args[1], size)
+			},
+			func(v interface{}) (interface{}, error) {
+				return v, nil
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := v.(int)
+		total += n
+		if size <= 0 || n < size {
+			break
+		}
+	}
+	conn.WriteInt(total)
+	return nil, nil
+}
+
+// cmdPdelchunk handles "PDELCHUNK pattern count" from the raft log, which
+// deletes up to count keys of a PDEL.
+func (kvm *Machine) cmdPdelchunk(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if conn != nil {
+		return nil, finn.ErrUnknownCommand
+	}
+	if len(cmd.Args) != 3 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
-	pattern := makeKey('k', cmd.Args[1])
-	spattern := string(pattern)
+	n, err := strconv.Atoi(string(cmd.Args[2]))
+	if err != nil {
+		return nil, errSyntaxError
+	}
+	ks := keyspaceOf(m)
+	return m.Apply(conn, cmd,
+		func() (interface{}, error) {
+			return kvm.pdelChunk(ks, cmd.Args[1], n)
+		}, nil,
+	)
+}
+
+// pdelChunk deletes the first n keys, in order, that match the pattern,
+// and returns the number of deleted keys. Every key is deleted when n is
+// not positive. The replicas have the same keys when they apply a chunk, so
+// they delete the same keys.
+func (kvm *Machine) pdelChunk(ks keyspace, pattern []byte, n int) (interface{}, error) {
+	prefix := ks.prefix()
+	spattern := string(ks.key(pattern))
 	min, max := match.Allowable(spattern)
 	bmin := []byte(min)
 	bmax := []byte(max)
 
+	kvm.mu.Lock()
+	defer kvm.mu.Unlock()
+
+	var keys [][]byte
+	var arena byteArena
+	iter := kvm.db.NewIterator(nil, nil)
+	for ok := iter.Seek(bmin); ok && (n <= 0 || len(keys) < n); ok = iter.Next() {
+		rkey := iter.Key()
+		if bytes.Compare(rkey, bmax) >= 0 {
+			break
+		}
+		skey := string(rkey)
+		if !match.Match(skey, spattern) {
+			continue
+		}
+		keys = append(keys, arena.copy(rkey))
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return nil, err
+	}
+
+	var batch leveldb.Batch
+	for _, key := range keys {
+		batch.Delete(key)
+	}
+	if err := kvm.writeBatch(ks, &batch); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		kvm.watches.publish(ks, kvm.applyStamp, "del", key[len(prefix):], nil)
+	}
+	return len(keys), nil
+}
+
+// popped is the key and the stored value that POPMATCH deleted.
+type popped struct {
+	key, stored []byte
+}
+
+// cmdPopmatch handles "POPMATCH pattern", which deletes the first key, in
+// order, that matches the pattern, and replies with the key and its value,
+// or null when no key matches. The key is found and deleted when the write
+// is applied, so that concurrent clients never claim the same key.
+func (kvm *Machine) cmdPopmatch(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	ks := keyspaceOf(m)
 	return m.Apply(conn, cmd,
 		func() (interface{}, error) {
-			kvm.mu.Lock()
-			defer kvm.mu.Unlock()
+			return kvm.popMatch(ks, cmd.Args[1])
+		},
+		func(v interface{}) (interface{}, error) {
+			p, ok := v.(*popped)
+			if !ok {
+				writeNull(conn)
+				return nil, nil
+			}
+			// the object of a cold value outlives its stub.
+			value, err := kvm.scanValue(p.stored)
+			if err != nil {
+				return nil, err
+			}
+			conn.WriteArray(2)
+			conn.WriteBulk(p.key)
+			conn.WriteBulk(value)
+			return nil, nil
+		},
+	)
+}
+
+// popMatch deletes the first key that matches the pattern, and returns it
+// and its stored value, or nil when no key matches.
+func (kvm *Machine) popMatch(ks keyspace, pattern []byte) (interface{}, error) {
+	prefix := ks.prefix()
+	spattern := string(ks.key(pattern))
+	min, max := match.Allowable(spattern)
+	bmax := []byte(max)
+
+	kvm.mu.Lock()
+	defer kvm.mu.Unlock()
+
+	var key, stored []byte
+	iter := kvm.db.NewIterator(nil, nil)
+	for ok := iter.Seek([]byte(min)); ok; ok = iter.Next() {
+		rkey := iter.Key()
+		if bytes.Compare(rkey, bmax) >= 0 {
+			break
+		}
+		if match.Match(string(rkey), spattern) {
+			key = append([]byte(nil), rkey...)
+			stored = append([]byte(nil), iter.Value()...)
+			break
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, nil
+	}
+	var batch leveldb.Batch
+	batch.Delete(key)
+	if err := kvm.writeBatch(ks, &batch); err != nil {
+		return nil, err
+	}
+	kvm.watches.publish(ks, kvm.applyStamp, "del", key[len(prefix):], nil)
+	return &popped{key: key[len(prefix):], stored: stored}, nil
+}
+
+// scanOptions are the options for scanning the keyspace.
+type scanOptions struct {
+	ks         keyspace
+	pivot      []byte // the pivot key, without the prefix
+	usingPivot bool
+	desc       bool
+	limit      int
+	withValues bool
+	// load returns the values of the stored values, which is decodeValue
+	// when it's nil.
+	load func(stored []byte) ([]byte, error)
+}
 
-			var keys [][]byte
-			iter := kvm.db.NewIterator(nil, nil)
-			for ok := iter.Seek(bmin); ok; ok = iter.Next() {
-				rkey := iter.Key()
+// iterable is a store or a snapshot.
+type iterable interface {
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+// scanEach calls fn with the keys, and optionally values, matching the
+// pattern until it returns false. The key, without the prefix, and the
+// value are only valid until fn returns. The caller must hold the database
+// read lock.
+func scanEach(db iterable, pattern []byte, opts scanOptions,
+	fn func(key, value []byte) bool,
+) error {
+	prefix := opts.ks.prefix()
+	spattern := string(opts.ks.key(pattern))
+	min, max := match.Allowable(spattern)
+	bmin := []byte(min)
+	bmax := []byte(max)
+	var pivot []byte
+	if opts.usingPivot {
+		pivot = opts.ks.key(opts.pivot)
+	}
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	var ok bool
+	if opts.desc {
+		if opts.usingPivot && bytes.Compare(pivot, bmax) < 0 {
+			bmax = pivot
+		}
+		ok = iter.Seek(bmax)
+		if !ok {
+			ok = iter.Last()
+		}
+	} else {
+		if opts.usingPivot && bytes.Compare(pivot, bmin) > 0 {
+			bmin = pivot
+		}
+		ok = iter.Seek(bmin)
+	}
+	step := func() bool {
+		if opts.desc {
+			return iter.Prev()
+		} else {
+			return iter.Next()
+		}
+	}
+	var inRange bool
+	var n int
+	for ; ok; ok = step() {
+		if n == opts.limit {
+			break
+		}
+		rkey := iter.Key()
+		if opts.desc {
+			if !inRange {
 				if bytes.Compare(rkey, bmax) >= 0 {
-					break
-				}
-				skey := string(rkey)
-				if !match.Match(skey, spattern) {
 					continue
 				}
-				keys = append(keys, bcopy(rkey))
+				inRange = true
 			}
-			iter.Release()
-			err := iter.Error()
-			if err != nil {
-				return nil, err
+			if bytes.Compare(rkey, bmin) < 0 {
+				break
 			}
-
-			var batch leveldb.Batch
-			for _, key := range keys {
-				batch.Delete(key)
+		} else {
+			if !inRange {
+				if opts.usingPivot {
+					if bytes.Compare(rkey, bmin) <= 0 {
+						continue
+					}
+				}
+				inRange = true
 			}
-			if err := kvm.db.Write(&batch, nil); err != nil {
-				return nil, err
+			if bytes.Compare(rkey, bmax) >= 0 {
+				break
 			}
-			return len(keys), nil
-		},
-		func(v interface{}) (interface{}, error) {
-			n := v.(int)
-			conn.WriteInt(n)
-			return nil, nil
-		},
-	)
+		}
+		skey := string(rkey)
+		if !match.Match(skey, spattern) {
+			continue
+		}
+		n++
+		var value []byte
+		if opts.withValues {
+			load := opts.load
+			if load == nil {
+				load = decodeValue
+			}
+			var err error
+			if value, err = load(iter.Value()); err != nil {
+				return err
+			}
+		}
+		if !fn(rkey[len(prefix):], value) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// scan returns the keys, and optionally values, matching the pattern. The
+// iterator reads a point-in-time view of the database, so the keys and
+// values are consistent with each other. The caller must hold the database
+// read lock.
+func (kvm *Machine) scan(pattern []byte, opts scanOptions) (keys, values [][]byte, err error) {
+	var arena byteArena
+	err = scanEach(kvm.db, pattern, opts, func(key, value []byte) bool {
+		keys = append(keys, arena.copy(key))
+		if opts.withValues {
+			values = append(values, arena.copy(value))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, values, nil
+}
+
+// streamFlushSize is the size of the buffered reply at which a streamed
+// reply is written to the connection.
+const streamFlushSize = 64 * 1024
+
+// streamWriter flushes a large reply to the connection while it's being
+// written, rather than buffering all of it.
+type streamWriter struct {
+	wr *redcon.Writer // nil for connections that are not buffered
+}
+
+func newStreamWriter(conn redcon.Conn) streamWriter {
+	return streamWriter{redcon.BaseWriter(conn)}
+}
+
+// flush writes the buffered reply when it's large.
+func (w streamWriter) flush() error {
+	if w.wr == nil || len(w.wr.Buffer()) < streamFlushSize {
+		return nil
+	}
+	return w.wr.Flush()
 }
+
 func (kvm *Machine) cmdKeys(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
 	if len(cmd.Args) < 2 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
-	var withvalues bool
-	var pivot []byte
-	var usingPivot bool
-	var desc bool
-	limit := 500
+	opts := scanOptions{ks: keyspaceOf(m), limit: 500}
+	var count, limited bool
 	for i := 2; i < len(cmd.Args); i++ {
 		switch strings.ToLower(string(cmd.Args[i])) {
 		default:
 			return nil, errSyntaxError
+		case "count":
+			count = true
 		case "withvalues":
-			withvalues = true
+			opts.withValues = true
+			opts.load = kvm.scanValue
 		case "desc":
-			desc = true
+			opts.desc = true
 		case "pivot":
 			i++
 			if i == len(cmd.Args) {
 				return nil, errSyntaxError
 			}
-			pivot = makeKey('k', cmd.Args[i])
-			usingPivot = true
+			opts.pivot = cmd.Args[i]
+			opts.usingPivot = true
 		case "limit":
 			i++
 			if i == len(cmd.Args) {
@@ -534,128 +2298,93 @@ func (kvm *Machine) cmdKeys(m finn.Applier, conn redcon.Conn, cmd redcon.Command
 			if err != nil || n < 0 {
 				return nil, errSyntaxError
 			}
-			limit = int(n)
+			opts.limit = int(n)
+			limited = true
 		}
 	}
-	pattern := makeKey('k', cmd.Args[1])
-	spattern := string(pattern)
-	min, max := match.Allowable(spattern)
-	bmin := []byte(min)
-	bmax := []byte(max)
+	if count && !limited {
+		// every match is counted, unless a limit is requested.
+		opts.limit = -1
+	}
 	return m.Apply(conn, cmd, nil,
 		func(interface{}) (interface{}, error) {
-			kvm.mu.RLock()
-			defer kvm.mu.RUnlock()
-			var keys [][]byte
-			var values [][]byte
-			iter := kvm.db.NewIterator(nil, nil)
-			var ok bool
-			if desc {
-				if usingPivot && bytes.Compare(pivot, bmax) < 0 {
-					bmax = pivot
-				}
-				ok = iter.Seek(bmax)
-				if !ok {
-					ok = iter.Last()
-				}
-			} else {
-				if usingPivot && bytes.Compare(pivot, bmin) > 0 {
-					bmin = pivot
-				}
-				ok = iter.Seek(bmin)
-			}
-			step := func() bool {
-				if desc {
-					return iter.Prev()
-				} else {
-					return iter.Next()
-				}
-			}
-			var inRange bool
-			for ; ok; ok = step() {
-				if len(keys) == limit {
-					break
-				}
-				rkey := iter.Key()
-				if desc {
-					if !inRange {
-						if bytes.Compare(rkey, bmax) >= 0 {
-							continue
-						}
-						inRange = true
-					}
-					if bytes.Compare(rkey, bmin) < 0 {
-						break
-					}
-				} else {
-					if !inRange {
-						if usingPivot {
-							if bytes.Compare(rkey, bmin) <= 0 {
-								continue
-							}
-						}
-						inRange = true
-					}
-					if bytes.Compare(rkey, bmax) >= 0 {
-						break
-					}
-				}
-				skey := string(rkey)
-				if !match.Match(skey, spattern) {
-					continue
-				}
-				keys = append(keys, bcopy(rkey[1:]))
-				if withvalues {
-					values = append(values, bcopy(iter.Value()))
-				}
+			kvm.dbmu.RLock()
+			ss, release, err := kvm.snapshot(m)
+			kvm.dbmu.RUnlock()
+			if err != nil {
+				return nil, err
 			}
-			iter.Release()
-			err := iter.Error()
+			defer release()
+			// the keys are counted first, so that the reply is streamed
+			// to the client rather than held in memory. Both passes read
+			// the same snapshot.
+			counting := opts
+			counting.withValues = false
+			var n int
+			err = scanEach(ss, cmd.Args[1], counting, func(key, value []byte) bool {
+				n++
+				return true
+			})
 			if err != nil {
 				return nil, err
 			}
-			if withvalues {
-				conn.WriteArray(len(keys) * 2)
+			if count {
+				conn.WriteInt(n)
+				return nil, nil
+			}
+			if opts.withValues {
+				conn.WriteArray(n * 2)
 			} else {
-				conn.WriteArray(len(keys))
+				conn.WriteArray(n)
 			}
-			for i := 0; i < len(keys); i++ {
-				conn.WriteBulk(keys[i])
-				if withvalues {
-					conn.WriteBulk(values[i])
+			w := newStreamWriter(conn)
+			var werr error
+			err = scanEach(ss, cmd.Args[1], opts, func(key, value []byte) bool {
+				conn.WriteBulk(key)
+				if opts.withValues {
+					conn.WriteBulk(value)
 				}
+				werr = w.flush()
+				return werr == nil
+			})
+			if err == nil {
+				err = werr
+			}
+			if err != nil {
+				// the reply has started, so the error can't be returned,
+				// and the client would read the replies that follow as
+				// part of the array, so the connection is closed.
+				log.Warningf("keys: %v", err)
+				conn.Close()
 			}
 			return nil, nil
 		},
 	)
 }
 
-func (kvm *Machine) cmdFlushdb(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
-	if len(cmd.Args) != 1 {
+func (kvm *Machine) cmdShutdown(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	var save bool
+	switch len(cmd.Args) {
+	default:
 		return nil, finn.ErrWrongNumberOfArguments
+	case 1:
+	case 2:
+		switch strings.ToLower(string(cmd.Args[1])) {
+		default:
+			return nil, errSyntaxError
+		case "save":
+			save = true
+		case "nosave":
+		}
 	}
-	return m.Apply(conn, cmd,
-		func() (interface{}, error) {
-			kvm.mu.Lock()
-			defer kvm.mu.Unlock()
-			if err := kvm.db.Close(); err != nil {
-				panic(err.Error())
-			}
-			if err := os.RemoveAll(kvm.dbPath); err != nil {
-				panic(err.Error())
-			}
-			var err error
-			kvm.db, err = leveldb.OpenFile(kvm.dbPath, kvm.opts)
-			if err != nil {
-				panic(err.Error())
-			}
-			return nil, nil
-		},
-		func(v interface{}) (interface{}, error) {
-			conn.WriteString("OK")
-			return nil, nil
-		},
-	)
+	select {
+	case kvm.shutdownc <- save:
+	default:
+		// a shutdown is already in progress
+	}
+	conn.WriteString("OK")
+	conn.Close()
+	return nil, nil
 }
 
 func makeKey(prefix byte, b []byte) []byte {
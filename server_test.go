@@ -0,0 +1,172 @@
+package kvnode
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// testNode is a single node cluster with its database in memory.
+type testNode struct {
+	t    *testing.T
+	m    *Machine
+	n    *finn.Node
+	addr string
+	dir  string
+}
+
+// startNode starts a single node cluster with the options, and waits until
+// it's the leader.
+func startNode(t *testing.T, opts *Options) *testNode {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kvnode-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if opts == nil {
+		opts = &Options{}
+	}
+	opts.InMemory = true
+	if opts.LogLevel == "" {
+		opts.LogLevel = "warning"
+	}
+	m, err := NewMachine(dir, addr, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	var fopts finn.Options
+	fopts.Backend = finn.InMem
+	fopts.Consistency = finn.High
+	fopts.Durability = finn.Low
+	fopts.LogOutput = ioutil.Discard
+	fopts.ConnAccept = m.acceptConn
+	fopts.ConnClosed = m.connClosed
+	n, err := finn.Open(dir, addr, "", m, &fopts)
+	if err != nil {
+		m.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	tn := &testNode{t: t, m: m, n: n, addr: addr, dir: dir}
+	conn := tn.dial()
+	defer conn.Close()
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		_, err := conn.Do("SET", "kvnode-test:ready", "1")
+		if err == nil {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			tn.close()
+			t.Fatalf("the node didn't become the leader: %v", err)
+		}
+	}
+	return tn
+}
+
+// openMachine opens a machine with its database in memory, without raft,
+// whose commands are applied with applyApplier.
+func openMachine(t *testing.T, opts *Options) (*Machine, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kvnode-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	opts.InMemory = true
+	if opts.LogLevel == "" {
+		opts.LogLevel = "warning"
+	}
+	m, err := NewMachine(dir, "127.0.0.1:0", opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return m, func() {
+		m.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// applyApplier applies commands the way that the raft log applies them on
+// every node.
+type applyApplier struct{}
+
+func (applyApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if mutate == nil {
+		return nil, errors.New("reads aren't applied")
+	}
+	return mutate()
+}
+
+func (applyApplier) Log() finn.Logger { return log }
+
+// applyCommand applies a command of the raft log to a machine.
+func applyCommand(m *Machine, args ...string) (interface{}, error) {
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	cmd, err := redcon.Parse(buildCommand(bargs...))
+	if err != nil {
+		return nil, err
+	}
+	return m.Command(applyApplier{}, nil, cmd)
+}
+
+// dial opens a connection to the node.
+func (tn *testNode) dial() redis.Conn {
+	tn.t.Helper()
+	conn, err := redis.Dial("tcp", tn.addr)
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	return conn
+}
+
+func (tn *testNode) close() {
+	tn.n.Close()
+	tn.m.Close()
+	os.RemoveAll(tn.dir)
+}
+
+// lastIndex returns the index of the last entry of the raft log.
+func (tn *testNode) lastIndex() uint64 {
+	tn.t.Helper()
+	stats, _, err := tn.m.raftInfo()
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	return statUint(stats, "last_log_index")
+}
+
+// expectError checks that a reply is an error that contains want.
+func expectError(t *testing.T, err error, want string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected an error with %q", want)
+	}
+	if !strings.Contains(err.Error(), want) {
+		t.Fatalf("expected an error with %q, got %q", want, err)
+	}
+}
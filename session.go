@@ -0,0 +1,112 @@
+package kvnode
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	// minrevWait is how long a read waits for the node to apply the revision
+	// from MINREV, before it fails.
+	minrevWait = time.Second
+	// minrevPoll is how often the waiting read checks the revision.
+	minrevPoll = time.Millisecond
+)
+
+// lastrevApplier records the revision of the database after each write of a
+// client, which is at least the revision of the write, for LASTREV.
+type lastrevApplier struct {
+	finn.Applier
+	kvm *Machine
+	c   *client
+}
+
+func (m lastrevApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn == nil || mutate == nil {
+		return m.Applier.Apply(conn, cmd, mutate, respond)
+	}
+	return m.Applier.Apply(conn, cmd, mutate,
+		func(v interface{}) (interface{}, error) {
+			// the write was applied on this node, the leader.
+			m.c.lastrev = atomic.LoadUint64(&m.kvm.revision)
+			return respond(v)
+		},
+	)
+}
+
+// minrevApplier serves the reads of a command that follows MINREV from the
+// local store, once the node has applied the revision, so that a client that
+// reads from a follower sees its own writes without a read through the
+// leader. Writes are proposed as usual.
+type minrevApplier struct {
+	finn.Applier
+	kvm *Machine
+	rev uint64
+}
+
+func (m minrevApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn == nil || mutate != nil {
+		return m.Applier.Apply(conn, cmd, mutate, respond)
+	}
+	if !m.kvm.waitRevision(m.rev, minrevWait) {
+		return nil, errRevisionFuture
+	}
+	return respond(nil)
+}
+
+// waitRevision waits until the node has applied a revision, and returns
+// false if it hasn't within the timeout.
+func (kvm *Machine) waitRevision(rev uint64, timeout time.Duration) bool {
+	if atomic.LoadUint64(&kvm.revision) >= rev {
+		return true
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-kvm.done:
+			return false
+		case <-time.After(minrevPoll):
+		}
+		if atomic.LoadUint64(&kvm.revision) >= rev {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdMinrev handles "MINREV revision", which makes the reads of the next
+// command wait for the node to apply the revision.
+func (kvm *Machine) cmdMinrev(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	rev, err := strconv.ParseUint(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		return nil, errRevision
+	}
+	kvm.client(conn).minrev = rev
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// cmdLastrev handles "LASTREV", which returns the revision of the last write
+// of the connection, or 0 when it hasn't written.
+func (kvm *Machine) cmdLastrev(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	conn.WriteInt64(int64(kvm.client(conn).lastrev))
+	return nil, nil
+}
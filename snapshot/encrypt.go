@@ -0,0 +1,211 @@
+package snapshot
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrEncrypted is returned by NewDecoder for a snapshot that's
+	// encrypted, which is read through Decrypt.
+	ErrEncrypted = errors.New("snapshot: the snapshot is encrypted, a key is required")
+	// ErrWrongKey is returned for a snapshot that's encrypted with another
+	// key, or that was changed after it was written.
+	ErrWrongKey = errors.New("snapshot: the snapshot can't be decrypted with the key")
+	errKeySize  = errors.New("snapshot: the key must be 16, 24 or 32 bytes")
+	errClosed   = errors.New("snapshot: the writer is closed")
+)
+
+const (
+	// encryptedMagic starts an encrypted snapshot.
+	encryptedMagic = "KVNSENC1"
+	// chunkSize is the most bytes of a snapshot that a chunk holds.
+	chunkSize = 64 * 1024
+	// chunkHeader is the size of the flags and the length of a chunk.
+	chunkHeader = 5
+	// lastChunk flags the last chunk, so that a snapshot that's cut short
+	// is detected.
+	lastChunk = 1
+)
+
+// Encrypt returns a writer that encrypts a snapshot to w with a key of 16,
+// 24 or 32 bytes, which is the encryption key of the nodes. The snapshot is
+// split in chunks that are sealed with AES-GCM, so that changes are detected
+// when it's read. Close writes the last chunk, and doesn't close w.
+//
+//	ew, err := snapshot.Encrypt(w, key)
+//	enc := snapshot.NewEncoder(ew)
+//	...
+//	err = enc.Close()
+//	err = ew.Close()
+func Encrypt(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := snapshotCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, encryptedMagic); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+// Decrypt returns a reader of the snapshot that r reads, which decrypts it
+// with the key that it was encrypted with. Snapshots that aren't encrypted,
+// which were written before the nodes had a key, are read as they are.
+func Decrypt(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := snapshotCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	if !encrypted(br) {
+		return br, nil
+	}
+	br.Discard(len(encryptedMagic))
+	return &decryptReader{r: br, aead: aead}, nil
+}
+
+// encrypted returns true if the snapshot that's read by r is encrypted.
+func encrypted(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(encryptedMagic))
+	return string(magic) == encryptedMagic
+}
+
+// snapshotCipher returns the cipher of the snapshots of a key, whose key is
+// derived from it, so that it's not the key that the nodes encrypt their
+// databases with.
+func snapshotCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, errKeySize
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kvnode snapshot"))
+	block, err := aes.NewCipher(mac.Sum(nil)[:len(key)])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkData returns the additional data of a chunk, which authenticates its
+// position and its flags.
+func chunkData(index uint64, flags byte) []byte {
+	var data [9]byte
+	binary.BigEndian.PutUint64(data[:], index)
+	data[8] = flags
+	return data[:]
+}
+
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+	err   error
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 && w.err == nil {
+		if len(w.buf) == chunkSize {
+			w.err = w.seal(0)
+			continue
+		}
+		m := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, w.err
+}
+
+// Close writes the last chunk.
+func (w *encryptWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	err := w.seal(lastChunk)
+	if w.err = err; err == nil {
+		w.err = errClosed
+	}
+	return err
+}
+
+// seal writes the buffered bytes as a chunk, which is the flags, the length
+// of the rest of the chunk, the nonce and the sealed bytes.
+func (w *encryptWriter) seal(flags byte) error {
+	size := w.aead.NonceSize() + len(w.buf) + w.aead.Overhead()
+	chunk := make([]byte, chunkHeader+w.aead.NonceSize(), chunkHeader+size)
+	chunk[0] = flags
+	binary.BigEndian.PutUint32(chunk[1:], uint32(size))
+	nonce := chunk[chunkHeader:]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	chunk = w.aead.Seal(chunk, nonce, w.buf, chunkData(w.index, flags))
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(chunk)
+	return err
+}
+
+type decryptReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	buf   []byte // the bytes of the chunk that weren't read
+	chunk []byte
+	index uint64
+	done  bool // the last chunk was read
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// open reads and opens the next chunk.
+func (r *decryptReader) open() error {
+	var hdr [chunkHeader]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return truncated(err)
+	}
+	flags := hdr[0]
+	size := int(binary.BigEndian.Uint32(hdr[1:]))
+	min := r.aead.NonceSize() + r.aead.Overhead()
+	if flags&^lastChunk != 0 || size < min || size > min+chunkSize {
+		return ErrWrongKey
+	}
+	if cap(r.chunk) < size {
+		r.chunk = make([]byte, size)
+	}
+	chunk := r.chunk[:size]
+	if _, err := io.ReadFull(r.r, chunk); err != nil {
+		return truncated(err)
+	}
+	nonce := chunk[:r.aead.NonceSize()]
+	plain, err := r.aead.Open(chunk[len(nonce):len(nonce)], nonce, chunk[len(nonce):],
+		chunkData(r.index, flags))
+	if err != nil {
+		return ErrWrongKey
+	}
+	r.index++
+	r.buf = plain
+	r.done = flags&lastChunk != 0
+	return nil
+}
@@ -0,0 +1,213 @@
+// Package snapshot reads and writes the snapshots of kvnode, which are the
+// state.bin files of the Raft snapshots, so that tools can inspect, filter or
+// transform them.
+//
+// A snapshot is a gzip stream of the entries of the database of a node, in
+// the order of their keys. Each entry is the length of the key as a
+// little-endian uint64, the key, the length of the value, and the value. The
+// keys and values are those of the database, where the keys of database 0
+// start with "k", the keys of other databases with "d<index>:", and the keys
+// of namespaces with "n<name>:". The other entries are the users, the config,
+// the namespaces and the other state of the node, which are restored along
+// with the keys.
+//
+// The snapshots of nodes that have an encryption key are encrypted, and are
+// read through Decrypt with the key.
+package snapshot
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrTruncated is returned for a snapshot that ends in the middle of an
+// entry.
+var ErrTruncated = errors.New("snapshot: truncated entry")
+
+// Encoder writes the entries of a snapshot.
+type Encoder struct {
+	gzw *gzip.Writer
+	buf []byte
+}
+
+// NewEncoder returns an encoder that writes a snapshot to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{gzw: gzip.NewWriter(w)}
+}
+
+// Encode writes an entry. The entries must be written in the order of their
+// keys.
+func (e *Encoder) Encode(key, value []byte) error {
+	var num [8]byte
+	e.buf = e.buf[:0]
+	binary.LittleEndian.PutUint64(num[:], uint64(len(key)))
+	e.buf = append(e.buf, num[:]...)
+	e.buf = append(e.buf, key...)
+	binary.LittleEndian.PutUint64(num[:], uint64(len(value)))
+	e.buf = append(e.buf, num[:]...)
+	e.buf = append(e.buf, value...)
+	_, err := e.gzw.Write(e.buf)
+	return err
+}
+
+// Close writes the end of the snapshot. It doesn't close the underlying
+// writer.
+func (e *Encoder) Close() error {
+	return e.gzw.Close()
+}
+
+// throttleChunk is the most bytes that a throttled writer writes at once,
+// so that the writes are spread over each second.
+const throttleChunk = 64 << 10
+
+// Throttle returns a writer that writes to w at no more than rate bytes per
+// second, such as the snapshot of NewEncoder, so that writing a snapshot
+// doesn't starve the other traffic of the disk or the network. A rate of
+// zero or less returns w.
+func Throttle(w io.Writer, rate int) io.Writer {
+	if rate <= 0 {
+		return w
+	}
+	return &throttledWriter{w: w, rate: float64(rate), start: time.Now()}
+}
+
+type throttledWriter struct {
+	w     io.Writer
+	rate  float64
+	start time.Time
+	n     int64
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		n, err := t.w.Write(chunk)
+		written += n
+		t.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		// wait until the bytes so far are within the rate.
+		due := time.Duration(float64(t.n) / t.rate * float64(time.Second))
+		if d := due - time.Since(t.start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	return written, nil
+}
+
+// Decoder reads the entries of a snapshot, like an iterator.
+//
+//	dec, err := snapshot.NewDecoder(f)
+//	for dec.Next() {
+//		key, value := dec.Key(), dec.Value()
+//	}
+//	err = dec.Err()
+type Decoder struct {
+	gzr *gzip.Reader
+	r   *bufio.Reader
+	buf []byte
+	// klen is the length of the key of the current entry, which is followed
+	// by its value in buf.
+	klen int
+	err  error
+}
+
+// NewDecoder returns a decoder that reads a snapshot from r. An encrypted
+// snapshot returns ErrEncrypted, and is read through Decrypt.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	if encrypted(br) {
+		return nil, ErrEncrypted
+	}
+	gzr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &Decoder{gzr: gzr, r: bufio.NewReader(gzr)}, nil
+}
+
+// Next reads the next entry, and returns false at the end of the snapshot
+// or on an error, which is returned by Err.
+func (d *Decoder) Next() bool {
+	if d.err != nil {
+		return false
+	}
+	var num [8]byte
+	if _, err := io.ReadFull(d.r, num[:]); err != nil {
+		if err != io.EOF {
+			d.err = truncated(err)
+		} else {
+			// the checksum of the stream is verified at its end.
+			d.err = d.gzr.Close()
+			if d.err == nil {
+				d.err = io.EOF
+			}
+		}
+		return false
+	}
+	d.klen = int(binary.LittleEndian.Uint64(num[:]))
+	d.buf = grow(d.buf, d.klen)
+	if _, err := io.ReadFull(d.r, d.buf); err != nil {
+		d.err = truncated(err)
+		return false
+	}
+	if _, err := io.ReadFull(d.r, num[:]); err != nil {
+		d.err = truncated(err)
+		return false
+	}
+	d.buf = grow(d.buf, d.klen+int(binary.LittleEndian.Uint64(num[:])))
+	if _, err := io.ReadFull(d.r, d.buf[d.klen:]); err != nil {
+		d.err = truncated(err)
+		return false
+	}
+	return true
+}
+
+// Key returns the key of the current entry. It's only valid until the next
+// call to Next.
+func (d *Decoder) Key() []byte {
+	return d.buf[:d.klen:d.klen]
+}
+
+// Value returns the value of the current entry. It's only valid until the
+// next call to Next.
+func (d *Decoder) Value() []byte {
+	return d.buf[d.klen:]
+}
+
+// Err returns the error that stopped Next, or nil at the end of the
+// snapshot.
+func (d *Decoder) Err() error {
+	if d.err == io.EOF {
+		return nil
+	}
+	return d.err
+}
+
+// grow returns a buffer of length n, reusing the capacity of buf.
+func grow(buf []byte, n int) []byte {
+	if cap(buf) < n {
+		return append(buf[:cap(buf)], make([]byte, n-cap(buf))...)
+	}
+	return buf[:n]
+}
+
+func truncated(err error) error {
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return ErrTruncated
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+package kvnode
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// countingWriter counts the bytes of a snapshot.
+type countingWriter int
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func TestSnapshotRate(t *testing.T) {
+	m, closeMachine := openMachine(t, nil)
+	defer closeMachine()
+	for i := 0; i < 1000; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if _, err := applyCommand(m, "SET", key, strconv.Itoa(i*7919)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var size countingWriter
+	if err := m.Snapshot(&size); err != nil {
+		t.Fatal(err)
+	}
+	// four times the size per second takes a quarter second.
+	opts := *m.options()
+	opts.SnapshotRate = int(size) * 4
+	m.optionsv.Store(&opts)
+	start := time.Now()
+	var n countingWriter
+	if err := m.Snapshot(&n); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("expected the snapshot of %d bytes to take a quarter second, took %s", n, elapsed)
+	}
+}
@@ -0,0 +1,59 @@
+package kvnode
+
+import (
+	"strings"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// staleApplier serves reads from the local store of the node, skipping the
+// consistency guard of the raft layer. The reads may return stale data on
+// any node, including a leader that lost its leadership, but they're
+// served by followers too. Writes are proposed as usual.
+type staleApplier struct {
+	finn.Applier
+}
+
+func (m staleApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn == nil || mutate != nil {
+		return m.Applier.Apply(conn, cmd, mutate, respond)
+	}
+	return respond(nil)
+}
+
+// staleReads returns true if the reads of the client are served from the
+// local store, which is enabled for every client with the StaleReads or
+// ReplicaReads options, or for a connection with CLIENT STALEREADS ON.
+func (kvm *Machine) staleReads(c *client) bool {
+	if opts := kvm.options(); opts.StaleReads || opts.ReplicaReads {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.staleReads
+}
+
+// cmdClientStaleReads handles "CLIENT STALEREADS ON|OFF".
+func (kvm *Machine) cmdClientStaleReads(c *client, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var on bool
+	switch strings.ToLower(string(cmd.Args[2])) {
+	default:
+		return nil, errSyntaxError
+	case "on":
+		on = true
+	case "off":
+	}
+	c.mu.Lock()
+	c.staleReads = on
+	c.mu.Unlock()
+	conn.WriteString("OK")
+	return nil, nil
+}
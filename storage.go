@@ -0,0 +1,34 @@
+package kvnode
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var errCompression = errors.New("invalid LevelDB compression, " +
+	"expected snappy or none")
+
+// leveldbOptions returns the LevelDB options for the storage options. The
+// options that are zero use the defaults of LevelDB.
+func leveldbOptions(opts *Options) (*opt.Options, error) {
+	o := &opt.Options{
+		NoSync:                 true,
+		Filter:                 filter.NewBloomFilter(10),
+		WriteBuffer:            opts.LevelDBWriteBuffer,
+		BlockCacheCapacity:     opts.LevelDBBlockCache,
+		CompactionTableSize:    opts.LevelDBTableSize,
+		OpenFilesCacheCapacity: opts.LevelDBOpenFiles,
+	}
+	switch strings.ToLower(opts.LevelDBCompression) {
+	default:
+		return nil, errCompression
+	case "", "snappy":
+		o.Compression = opt.SnappyCompression
+	case "none":
+		o.Compression = opt.NoCompression
+	}
+	return o, nil
+}
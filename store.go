@@ -0,0 +1,58 @@
+package kvnode
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Reader reads the keys of a store or of a snapshot of it. Get returns
+// leveldb.ErrNotFound for a missing key, and iterators are ordered by key.
+type Reader interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	Has(key []byte, ro *opt.ReadOptions) (bool, error)
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+// Snapshot is a consistent view of a store, which must be released.
+type Snapshot interface {
+	Reader
+	Release()
+}
+
+// Store is the storage engine that the data of a node is kept in, which is
+// LevelDB unless Options.OpenStore is set. A store is used concurrently, and
+// the writes of a batch are applied atomically. The batches, ranges and
+// options are the types of goleveldb, so a batch is applied by another
+// engine with its Replay method.
+type Store interface {
+	Reader
+	Put(key, value []byte, wo *opt.WriteOptions) error
+	Delete(key []byte, wo *opt.WriteOptions) error
+	Write(batch *leveldb.Batch, wo *opt.WriteOptions) error
+	GetSnapshot() (Snapshot, error)
+	// GetProperty returns a "leveldb." property, which is used for the
+	// statistics of INFO and DBSTATS. An engine without the property
+	// returns an error, and the statistic is left out.
+	GetProperty(name string) (string, error)
+	// SizeOf returns the approximate sizes on disk of the ranges.
+	SizeOf(ranges []util.Range) (leveldb.Sizes, error)
+	// CompactRange compacts the keys of the range, or every key for a zero
+	// range.
+	CompactRange(r util.Range) error
+	Close() error
+}
+
+// levelStore is the Store of a LevelDB database.
+type levelStore struct {
+	*leveldb.DB
+}
+
+func (s levelStore) GetSnapshot() (Snapshot, error) {
+	ss, err := s.DB.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
@@ -0,0 +1,56 @@
+package kvnode
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// countingStore is a Store of another engine, which counts its writes.
+type countingStore struct {
+	Store
+	writes *int64
+}
+
+func (s countingStore) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	atomic.AddInt64(s.writes, 1)
+	return s.Store.Write(batch, wo)
+}
+
+func TestOpenStore(t *testing.T) {
+	var writes int64
+	var paths []string
+	tn := startNode(t, &Options{OpenStore: func(path string) (Store, error) {
+		paths = append(paths, path)
+		db, err := leveldb.Open(storage.NewMemStorage(), nil)
+		if err != nil {
+			return nil, err
+		}
+		return countingStore{levelStore{db}, &writes}, nil
+	}})
+	defer tn.close()
+	conn := tn.dial()
+	defer conn.Close()
+	if _, err := conn.Do("SET", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&writes) == 0 {
+		t.Fatal("expected the writes to go to the store")
+	}
+	if value, err := redis.String(conn.Do("GET", "key")); err != nil || value != "value" {
+		t.Fatalf("expected %q, got %q, %v", "value", value, err)
+	}
+	if _, err := conn.Do("FLUSHALL"); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("expected the store to be opened again by FLUSHALL, got %d opens", len(paths))
+	}
+	if reply, err := conn.Do("GET", "key"); err != nil || reply != nil {
+		t.Fatalf("expected the key to be flushed, got %q, %v", reply, err)
+	}
+}
@@ -0,0 +1,57 @@
+package kvnode
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// keyStripes is the number of locks that the keys of the databases are
+// hashed to.
+const keyStripes = 256
+
+// keyLocks are striped locks for the keys of writes, so that writes to
+// disjoint keys may be applied concurrently. They're held with the read
+// side of the machine lock, and commands that write more than a few keys,
+// such as PDEL and FLUSHDB, hold the machine lock instead.
+type keyLocks [keyStripes]sync.Mutex
+
+// stripes returns the sorted and distinct stripes of the keys. They're
+// locked in order, so that writes don't deadlock.
+func (l *keyLocks) stripes(keys [][]byte) []int {
+	idxs := make([]int, 0, len(keys))
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write(key)
+		i := int(h.Sum32() % keyStripes)
+		if !seen[i] {
+			seen[i] = true
+			idxs = append(idxs, i)
+		}
+	}
+	sort.Ints(idxs)
+	return idxs
+}
+
+// lockKeys locks the keys of a write in a keyspace, and returns the unlock
+// function. Writes to namespaces, and writes that are part of a group
+// commit, share state with every other write, so they hold the machine
+// lock.
+func (kvm *Machine) lockKeys(ks keyspace, keys [][]byte) func() {
+	if ks.ns != "" || kvm.gbatch.active {
+		kvm.mu.Lock()
+		return kvm.mu.Unlock
+	}
+	kvm.mu.RLock()
+	idxs := kvm.keylocks.stripes(keys)
+	for _, i := range idxs {
+		kvm.keylocks[i].Lock()
+	}
+	return func() {
+		for i := len(idxs) - 1; i >= 0; i-- {
+			kvm.keylocks[idxs[i]].Unlock()
+		}
+		kvm.mu.RUnlock()
+	}
+}
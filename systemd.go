@@ -0,0 +1,105 @@
+package kvnode
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sdNotify sends a state to systemd, such as "READY=1", when the node was
+// started by a unit of Type=notify. It does nothing otherwise.
+func sdNotify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		log.Warningf("could not notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Warningf("could not notify systemd: %v", err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping, which
+// is half of WatchdogSec, or zero when the watchdog is off.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdog pings the systemd watchdog while the node is healthy, until the
+// machine is closed. A node whose raft or storage is wedged misses its pings
+// and is restarted by systemd. A node without a leader is still pinged, as a
+// restart doesn't bring back a lost quorum.
+func (kvm *Machine) watchdog(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var probing int32
+	for {
+		select {
+		case <-kvm.done:
+			return
+		case <-t.C:
+		}
+		if !atomic.CompareAndSwapInt32(&probing, 0, 1) {
+			// the last probe is stuck.
+			continue
+		}
+		res := make(chan error, 1)
+		var status string
+		go func() {
+			defer atomic.StoreInt32(&probing, 0)
+			var err error
+			status, err = kvm.probeHealth()
+			res <- err
+		}()
+		select {
+		case err := <-res:
+			if err != nil {
+				log.Warningf("watchdog: %v", err)
+				sdNotify("STATUS=" + err.Error())
+				continue
+			}
+			sdNotify("WATCHDOG=1\nSTATUS=" + status)
+		case <-time.After(interval):
+			log.Warningf("watchdog: the node is not responding")
+		}
+	}
+}
+
+// probeHealth checks that raft answers, that the machine isn't stuck
+// holding its lock, and that the data directory is writable. It returns
+// the status that's shown by systemctl.
+func (kvm *Machine) probeHealth() (string, error) {
+	stats, leader, err := kvm.raftInfo()
+	if err != nil {
+		return "", errors.New("raft is not responding: " + err.Error())
+	}
+	kvm.mu.RLock()
+	kvm.mu.RUnlock()
+	if err := kvm.lostDB(); err != nil {
+		return "", errors.New("database lost: " + err.Error())
+	}
+	if err := kvm.checkWritable(); err != nil {
+		return "", errors.New("storage not writable: " + err.Error())
+	}
+	status := strings.ToLower(stats["state"])
+	if leader == "" {
+		status += ", no leader"
+	}
+	return status, nil
+}
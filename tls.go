@@ -0,0 +1,175 @@
+package kvnode
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval is how often the files of a TLSFiles are checked for
+// changes.
+const tlsReloadInterval = 10 * time.Second
+
+// LoadTLSConfig returns a server TLS configuration from PEM encoded files.
+// When clientCAFile is provided, clients must present a certificate that is
+// signed by one of the authorities in the file.
+func LoadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		data, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// TLSFiles is a server TLS configuration that's loaded from PEM encoded
+// files, like LoadTLSConfig, and loaded again when the files change, so that
+// short-lived certificates are renewed without a restart. Connections that
+// are open keep the certificate they were established with.
+type TLSFiles struct {
+	certFile, keyFile, clientCAFile string
+
+	mu     sync.Mutex
+	config *tls.Config
+	leaf   *x509.Certificate
+	stamp  string // the sizes and modification times of the files
+}
+
+// LoadTLSFiles loads a TLS configuration that's reloaded from the files.
+func LoadTLSFiles(certFile, keyFile, clientCAFile string) (*TLSFiles, error) {
+	f := &TLSFiles{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Config returns the TLS configuration for a listener, which uses the last
+// configuration that was loaded for every handshake.
+func (f *TLSFiles) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			return f.config, nil
+		},
+	}
+}
+
+// Reload loads the files. The last configuration is kept when the files are
+// invalid, such as when a new certificate was written but its key not yet.
+func (f *TLSFiles) Reload() error {
+	stamp := f.fileStamp()
+	config, err := LoadTLSConfig(f.certFile, f.keyFile, f.clientCAFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.config = config
+	f.leaf = leaf
+	f.stamp = stamp
+	f.mu.Unlock()
+	return nil
+}
+
+// NotAfter returns the time that the certificate expires.
+func (f *TLSFiles) NotAfter() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.leaf.NotAfter
+}
+
+// changed returns true when the files changed since they were loaded.
+func (f *TLSFiles) changed() bool {
+	stamp := f.fileStamp()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return stamp != f.stamp
+}
+
+func (f *TLSFiles) fileStamp() string {
+	var stamp []byte
+	for _, name := range []string{f.certFile, f.keyFile, f.clientCAFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			stamp = append(stamp, '-')
+			continue
+		}
+		stamp = strconv.AppendInt(stamp, fi.Size(), 10)
+		stamp = append(stamp, ':')
+		stamp = strconv.AppendInt(stamp, fi.ModTime().UnixNano(), 10)
+		stamp = append(stamp, ' ')
+	}
+	return string(stamp)
+}
+
+// reloadTLS loads the files of the TLS configuration again, and logs the
+// outcome.
+func reloadTLS(f *TLSFiles) {
+	if err := f.Reload(); err != nil {
+		log.Warningf("could not reload tls certificate: %v", err)
+		return
+	}
+	log.Noticef("reloaded tls certificate, expires %s",
+		f.NotAfter().UTC().Format(time.RFC3339))
+}
+
+// watchTLS reloads the TLS configuration when its files change, until the
+// machine is closed. A change that fails to load is retried at every check,
+// until the files are fixed.
+func (kvm *Machine) watchTLS(f *TLSFiles) {
+	t := time.NewTicker(tlsReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-kvm.done:
+			return
+		case <-t.C:
+		}
+		if f.changed() {
+			reloadTLS(f)
+		}
+	}
+}
+
+// tlsOn returns true if the node has a TLS listener.
+func (kvm *Machine) tlsOn() bool {
+	opts := kvm.options()
+	if opts.TLSAddr != "" {
+		return true
+	}
+	for _, b := range opts.Binds {
+		if b.TLS {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package kvnode
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var errTraceparent = errors.New("ERR invalid traceparent")
+
+// Span is a span that was started by a Tracer.
+type Span interface {
+	// TraceParent returns the W3C traceparent of the span, which is the
+	// parent of its child spans.
+	TraceParent() string
+	// End ends the span. The error is nil when the phase succeeded.
+	End(err error)
+}
+
+// Tracer starts the spans of commands. It's the extension point for tracing
+// systems such as OpenTelemetry, where the traceparent is extracted with the
+// W3C trace context propagator.
+//
+// The spans of a command are "kvnode.command", from dispatch until the reply
+// is written, with the children "kvnode.propose", "kvnode.storage" and
+// "kvnode.reply". Writes are also traced with "kvnode.apply" on every node
+// that applies them, along with its child "kvnode.storage".
+type Tracer interface {
+	// StartSpan starts a span with the traceparent as its parent. The
+	// parent is empty for commands that have no trace context. A nil span
+	// means that the command is not traced.
+	StartSpan(parent, name string, attrs map[string]string) Span
+}
+
+// startSpan starts a span, which is nil when the command is not traced.
+func startSpan(t Tracer, parent, name string, attrs map[string]string) Span {
+	if t == nil {
+		return nil
+	}
+	return t.StartSpan(parent, name, attrs)
+}
+
+func endSpan(span Span, err error) {
+	if span != nil {
+		span.End(err)
+	}
+}
+
+// parseTraceparent returns the trace id, parent id and flags of a W3C
+// traceparent, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(s string) (traceID, parentID, flags string, ok bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", "", false
+	}
+	for _, part := range parts[:4] {
+		if _, err := hex.DecodeString(part); err != nil || part != strings.ToLower(part) {
+			return "", "", "", false
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", "", false
+	}
+	return parts[1], parts[2], parts[3], true
+}
+
+// traceApplier traces the phases of the commands that pass through it.
+type traceApplier struct {
+	finn.Applier
+	tracer Tracer
+	parent string // the traceparent of the command or apply span
+	attrs  map[string]string
+}
+
+func (m traceApplier) start(name string) Span {
+	return startSpan(m.tracer, m.parent, name, m.attrs)
+}
+
+func (m traceApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	read := mutate == nil
+	if !read {
+		fn := mutate
+		mutate = func() (interface{}, error) {
+			span := m.start("kvnode.storage")
+			v, err := fn()
+			endSpan(span, err)
+			return v, err
+		}
+	}
+	var propose Span
+	if conn != nil {
+		propose = m.start("kvnode.propose")
+		if !read && propose != nil {
+			// the trace context is carried through the raft log, so
+			// that the nodes applying the command join the trace.
+			args := append([][]byte{[]byte("traceexec"),
+				[]byte(propose.TraceParent())}, cmd.Args...)
+			cmd = redcon.Command{Raw: buildCommand(args...), Args: args}
+		}
+	}
+	var responded bool
+	v, err := m.Applier.Apply(conn, cmd, mutate,
+		func(v interface{}) (interface{}, error) {
+			responded = true
+			endSpan(propose, nil)
+			name := "kvnode.reply"
+			if read {
+				name = "kvnode.storage"
+			}
+			span := m.start(name)
+			v, err := respond(v)
+			endSpan(span, err)
+			return v, err
+		},
+	)
+	if !responded {
+		endSpan(propose, err)
+	}
+	return v, err
+}
+
+// unwrapTrace returns the command and the traceparent of a "TRACEEXEC"
+// command from the raft log.
+func unwrapTrace(cmd redcon.Command) (redcon.Command, string, error) {
+	if len(cmd.Args) < 3 {
+		return cmd, "", finn.ErrWrongNumberOfArguments
+	}
+	args := cmd.Args[2:]
+	return redcon.Command{Raw: buildCommand(args...), Args: args},
+		string(cmd.Args[1]), nil
+}
+
+// cmdTraceparent handles "TRACEPARENT traceparent", which sets the W3C
+// trace context of the next command on the connection.
+func (kvm *Machine) cmdTraceparent(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if _, _, _, ok := parseTraceparent(string(cmd.Args[1])); !ok {
+		return nil, errTraceparent
+	}
+	kvm.client(conn).traceparent = string(cmd.Args[1])
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// logTracer is a Tracer that writes spans to the log.
+type logTracer struct{}
+
+// NewLogTracer returns a Tracer that writes the spans of sampled commands to
+// the log. Only commands with a sampled trace context from TRACEPARENT, and
+// the nodes that apply them, are traced.
+func NewLogTracer() Tracer {
+	return logTracer{}
+}
+
+func (logTracer) StartSpan(parent, name string, attrs map[string]string) Span {
+	traceID, parentID, flags, ok := parseTraceparent(parent)
+	if !ok || flags != "01" {
+		return nil
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	return &logSpan{
+		traceID:  traceID,
+		spanID:   hex.EncodeToString(id[:]),
+		parentID: parentID,
+		name:     name,
+		attrs:    attrs,
+		start:    time.Now(),
+	}
+}
+
+type logSpan struct {
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	attrs    map[string]string
+	start    time.Time
+}
+
+func (s *logSpan) TraceParent() string {
+	return "00-" + s.traceID + "-" + s.spanID + "-01"
+}
+
+func (s *logSpan) End(err error) {
+	elapsed := time.Since(s.start)
+	keys := make([]string, 0, len(s.attrs))
+	for key := range s.attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var attrs string
+	for _, key := range keys {
+		attrs += " " + key + "=" + s.attrs[key]
+	}
+	status := "ok"
+	if err != nil {
+		status = strings.Replace(err.Error(), " ", "_", -1)
+	}
+	log.Printf("trace=%s span=%s parent=%s name=%s duration=%s status=%s%s",
+		s.traceID, s.spanID, s.parentID, s.name, elapsed, status, attrs)
+}
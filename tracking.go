@@ -0,0 +1,365 @@
+package kvnode
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// trackingMaxKeys is the most keys that are tracked for the clients with
+// CLIENT TRACKING. When the table is full, a tracked key is invalidated to
+// make room for a new one.
+const trackingMaxKeys = 1 << 20
+
+// trackingMaxPending is the most invalidations that wait to be written to
+// a client. Beyond it, they're replaced by one that invalidates every key,
+// so that a slow client drops its cache rather than holding memory.
+const trackingMaxPending = 10000
+
+var (
+	errTrackingRESP3  = errors.New("ERR CLIENT TRACKING requires RESP3, switch with HELLO 3")
+	errTrackingPrefix = errors.New("ERR PREFIX requires BCAST")
+)
+
+// tracking is the state of a client with CLIENT TRACKING on.
+type tracking struct {
+	conn net.Conn
+	// bcast clients are sent the invalidations of the keys that start with
+	// one of the prefixes, or of every key, in the keyspace of the prefix
+	// ksPrefix, rather than the invalidations of the keys that they read.
+	bcast    bool
+	ksPrefix []byte
+	prefixes [][]byte
+
+	// mu orders the invalidations with the replies of the client. While a
+	// command of the client runs, its invalidations are pending, and they're
+	// written after its reply, so that the reply of a read never follows
+	// the invalidation of the value that it read.
+	mu      sync.Mutex
+	busy    bool
+	pending [][]byte
+	notify  chan struct{}
+	quit    chan struct{}
+}
+
+// trackedKey is a key that was read by clients with tracking on.
+type trackedKey struct {
+	key     []byte // without the keyspace prefix
+	clients map[*tracking]struct{}
+}
+
+// trackingTable is the keys that clients read with tracking on, keyed on
+// their database keys. A key is forgotten once it's invalidated, until it's
+// read again.
+type trackingTable struct {
+	// n is the number of clients with tracking on. It's accessed
+	// atomically.
+	n       int32
+	mu      sync.Mutex
+	keys    map[string]*trackedKey
+	clients map[*tracking]struct{}
+}
+
+func newTrackingTable() *trackingTable {
+	return &trackingTable{
+		keys:    make(map[string]*trackedKey),
+		clients: make(map[*tracking]struct{}),
+	}
+}
+
+// invalidateFrame returns the RESP3 push of an invalidation. A nil key
+// invalidates every key.
+func invalidateFrame(key []byte) []byte {
+	frame := appendHeader(nil, '>', 2)
+	frame = append(frame, "$10\r\ninvalidate\r\n"...)
+	if key == nil {
+		return append(frame, "_\r\n"...)
+	}
+	frame = append(frame, "*1\r\n$"...)
+	frame = strconv.AppendInt(frame, int64(len(key)), 10)
+	frame = append(frame, "\r\n"...)
+	frame = append(frame, key...)
+	return append(frame, "\r\n"...)
+}
+
+// push queues an invalidation for the client.
+func (t *tracking) push(frame []byte) {
+	t.mu.Lock()
+	if len(t.pending) >= trackingMaxPending {
+		t.pending = append(t.pending[:0], invalidateFrame(nil))
+	} else {
+		t.pending = append(t.pending, frame)
+	}
+	t.mu.Unlock()
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+// flush writes the pending invalidations. The caller must hold mu.
+func (t *tracking) flush() {
+	for _, frame := range t.pending {
+		if _, err := t.conn.Write(frame); err != nil {
+			break
+		}
+	}
+	t.pending = nil
+}
+
+// write writes the invalidations while the client is idle, until tracking
+// is turned off.
+func (t *tracking) write() {
+	for {
+		select {
+		case <-t.quit:
+			return
+		case <-t.notify:
+		}
+		t.mu.Lock()
+		if !t.busy {
+			t.flush()
+		}
+		t.mu.Unlock()
+	}
+}
+
+// begin holds back the invalidations while a command of the client runs.
+func (t *tracking) begin() {
+	t.mu.Lock()
+	t.busy = true
+	t.mu.Unlock()
+}
+
+// end writes the reply of a command of the client, followed by the
+// invalidations that were held back.
+func (t *tracking) end(conn redcon.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if wr := redcon.BaseWriter(conn); wr != nil {
+		wr.Flush()
+	}
+	t.flush()
+	t.busy = false
+}
+
+// matches returns true if a bcast client is sent the invalidations of a
+// database key, and returns the key without the keyspace prefix.
+func (t *tracking) matches(dbkey []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(dbkey, t.ksPrefix) {
+		return nil, false
+	}
+	key := dbkey[len(t.ksPrefix):]
+	if len(t.prefixes) == 0 {
+		return key, true
+	}
+	for _, prefix := range t.prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (tt *trackingTable) active() bool {
+	return atomic.LoadInt32(&tt.n) > 0
+}
+
+func (tt *trackingTable) enable(t *tracking) {
+	tt.mu.Lock()
+	tt.clients[t] = struct{}{}
+	tt.mu.Unlock()
+	atomic.AddInt32(&tt.n, 1)
+	go t.write()
+}
+
+// disable forgets a client that turned tracking off or disconnected.
+func (tt *trackingTable) disable(t *tracking) {
+	tt.mu.Lock()
+	delete(tt.clients, t)
+	if !t.bcast {
+		for dbkey, tk := range tt.keys {
+			delete(tk.clients, t)
+			if len(tk.clients) == 0 {
+				delete(tt.keys, dbkey)
+			}
+		}
+	}
+	tt.mu.Unlock()
+	atomic.AddInt32(&tt.n, -1)
+	close(t.quit)
+}
+
+// record remembers the keys that a client read.
+func (tt *trackingTable) record(t *tracking, ks keyspace, keys [][]byte) {
+	if t.bcast || len(keys) == 0 {
+		return
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	for _, key := range keys {
+		dbkey := string(ks.key(key))
+		tk, ok := tt.keys[dbkey]
+		if !ok {
+			if len(tt.keys) >= trackingMaxKeys {
+				for old := range tt.keys {
+					tt.invalidateKey(old)
+					break
+				}
+			}
+			tk = &trackedKey{
+				key:     append([]byte(nil), key...),
+				clients: make(map[*tracking]struct{}),
+			}
+			tt.keys[dbkey] = tk
+		}
+		tk.clients[t] = struct{}{}
+	}
+}
+
+// invalidateKey sends the invalidation of a database key to the clients
+// that read it, and forgets it. The caller must hold mu.
+func (tt *trackingTable) invalidateKey(dbkey string) {
+	tk, ok := tt.keys[dbkey]
+	if !ok {
+		return
+	}
+	frame := invalidateFrame(tk.key)
+	for t := range tk.clients {
+		t.push(frame)
+	}
+	delete(tt.keys, dbkey)
+}
+
+// invalidate sends the invalidations of database keys that changed.
+func (tt *trackingTable) invalidate(dbkeys [][]byte) {
+	if !tt.active() {
+		return
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	for _, dbkey := range dbkeys {
+		tt.invalidateKey(string(dbkey))
+		for t := range tt.clients {
+			if !t.bcast {
+				continue
+			}
+			if key, ok := t.matches(dbkey); ok {
+				t.push(invalidateFrame(key))
+			}
+		}
+	}
+}
+
+// invalidateAll sends the invalidation of every key to every client with
+// tracking on, such as after a flush.
+func (tt *trackingTable) invalidateAll() {
+	if !tt.active() {
+		return
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	frame := invalidateFrame(nil)
+	for t := range tt.clients {
+		t.push(frame)
+	}
+	tt.keys = make(map[string]*trackedKey)
+}
+
+// invalidateWrite sends the invalidations of a write that was applied from
+// the raft log, on every node. Writes that change keys without naming them
+// invalidate every key.
+func (kvm *Machine) invalidateWrite(ks keyspace, name string, args [][]byte) {
+	switch name {
+	case "evict":
+		// the keys are database keys.
+		kvm.tracking.invalidate(args[1:])
+		return
+	case "flushdb", "flushall", "pdel", "pdelchunk":
+		kvm.tracking.invalidateAll()
+		return
+	case "namespace":
+		if len(args) > 1 && strings.ToLower(string(args[1])) == "drop" {
+			kvm.tracking.invalidateAll()
+		}
+		return
+	}
+	keys := commandKeys(commands[name], args)
+	dbkeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		dbkeys[i] = ks.key(key)
+	}
+	kvm.tracking.invalidate(dbkeys)
+}
+
+// stopTracking turns tracking off for a client, such as when it
+// disconnects or its connection is detached for a stream.
+func (kvm *Machine) stopTracking(c *client) {
+	if c.track != nil {
+		kvm.tracking.disable(c.track)
+		c.track = nil
+	}
+}
+
+// cmdClientTracking handles "CLIENT TRACKING ON|OFF [BCAST] [PREFIX prefix
+// [PREFIX prefix ...]]". The client is sent the invalidations of the keys
+// that it reads, as RESP3 pushes, when the keys are changed by any client of
+// the cluster. With BCAST, the client is sent the invalidations of every key
+// that starts with one of the prefixes, or of every key, in the selected
+// keyspace.
+func (kvm *Machine) cmdClientTracking(c *client, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var on bool
+	switch strings.ToLower(string(cmd.Args[2])) {
+	default:
+		return nil, errSyntaxError
+	case "on":
+		on = true
+	case "off":
+	}
+	var bcast bool
+	var prefixes [][]byte
+	for i := 3; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		default:
+			return nil, errSyntaxError
+		case "bcast":
+			bcast = true
+		case "prefix":
+			if i+1 == len(cmd.Args) {
+				return nil, errSyntaxError
+			}
+			prefixes = append(prefixes, append([]byte(nil), cmd.Args[i+1]...))
+			i++
+		}
+	}
+	if len(prefixes) > 0 && !bcast {
+		return nil, errTrackingPrefix
+	}
+	if on && (!resp3(conn) || conn.NetConn() == nil) {
+		return nil, errTrackingRESP3
+	}
+	kvm.stopTracking(c)
+	if on {
+		c.track = &tracking{
+			conn:     conn.NetConn(),
+			bcast:    bcast,
+			ksPrefix: kvm.clientKeyspace(c).prefix(),
+			prefixes: prefixes,
+			notify:   make(chan struct{}, 1),
+			quit:     make(chan struct{}),
+		}
+		kvm.tracking.enable(c.track)
+	}
+	conn.WriteString("OK")
+	return nil, nil
+}
@@ -0,0 +1,217 @@
+package kvnode
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// stampWindow is how long the stamps of applied writes are remembered, so
+// that the writes that are applied again, when the raft log is replayed
+// after a restart, are recognized. It's much longer than a write may wait
+// to be applied.
+const stampWindow = uint64(time.Minute)
+
+// stampPrune is the most stamps that a write forgets.
+const stampPrune = 16
+
+var (
+	errVersion    = errors.New("ERR version is not an integer or out of range")
+	errStaleStamp = errors.New("ERR write was proposed too long ago, try again")
+)
+
+// The stamps of the writes that were applied within the stampWindow are
+// stored as 'S' + stamp.
+func stampKey(stamp uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = 'S'
+	binary.BigEndian.PutUint64(key[1:], stamp)
+	return key
+}
+
+// versionApplier stamps the writes of clients with a version, which the
+// leader takes from its clock. The write is wrapped as "VEREXEC version
+// command" in the raft log, so that every node stores the same version, even
+// when the log is applied again after a restart. The versions are the
+// versions of the values of SET and MSET, and the revisions of the database.
+type versionApplier struct {
+	finn.Applier
+	kvm *Machine
+}
+
+func (m versionApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn != nil && mutate != nil {
+		stamp := strconv.AppendUint(nil, m.kvm.nextStamp(), 10)
+		args := append([][]byte{[]byte("verexec"), stamp}, cmd.Args...)
+		cmd = redcon.Command{Raw: buildCommand(args...), Args: args}
+	}
+	return m.Applier.Apply(conn, cmd, mutate, respond)
+}
+
+// nextStamp returns a version that's greater than every version that the
+// node has assigned or applied, which is the time in nanoseconds unless the
+// clock is behind.
+func (kvm *Machine) nextStamp() uint64 {
+	for {
+		last := atomic.LoadUint64(&kvm.stamp)
+		next := uint64(time.Now().UnixNano())
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&kvm.stamp, last, next) {
+			return next
+		}
+	}
+}
+
+// observeStamp records an applied version, so that a node that becomes the
+// leader doesn't assign a smaller one.
+func (kvm *Machine) observeStamp(stamp uint64) {
+	for {
+		last := atomic.LoadUint64(&kvm.stamp)
+		if stamp <= last || atomic.CompareAndSwapUint64(&kvm.stamp, last, stamp) {
+			return
+		}
+	}
+}
+
+// admitStamp returns the revision of a write with a stamp. Revisions grow in
+// the order that writes are applied, so a write that reached the raft log
+// after a write with a greater stamp gets the next revision rather than its
+// stamp. Zero is returned for a write that was already applied, when the
+// raft log is replayed, as the database already has its changes.
+func (kvm *Machine) admitStamp(stamp uint64) (uint64, error) {
+	current := atomic.LoadUint64(&kvm.revision)
+	if stamp > current {
+		return stamp, nil
+	}
+	if current-stamp > stampWindow {
+		return 0, errStaleStamp
+	}
+	applied, err := kvm.db.Has(stampKey(stamp), nil)
+	if err != nil || applied {
+		return 0, err
+	}
+	return current + 1, nil
+}
+
+// recordStamp remembers the stamp of an applied write, and makes its revision
+// the revision of the database.
+func (kvm *Machine) recordStamp(stamp, rev uint64) error {
+	var batch leveldb.Batch
+	batch.Put(stampKey(stamp), nil)
+	if rev > stampWindow {
+		iter := kvm.db.NewIterator(&util.Range{
+			Start: []byte{'S'}, Limit: stampKey(rev - stampWindow),
+		}, nil)
+		for ok, n := iter.First(), 0; ok && n < stampPrune; ok, n = iter.Next(), n+1 {
+			batch.Delete(iter.Key())
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+	floor := atomic.LoadUint64(&kvm.revfloor)
+	if kvm.options().RevisionRetention == 0 {
+		floor = rev
+	}
+	kvm.putRevision(&batch, rev, floor)
+	if kvm.gbatch.active {
+		return batch.Replay(&kvm.gbatch)
+	}
+	return kvm.db.Write(&batch, kvm.writeOptions())
+}
+
+// recentStamps returns the stamps that are remembered. The caller must hold
+// the machine lock.
+func (kvm *Machine) recentStamps() ([][]byte, error) {
+	var keys [][]byte
+	iter := kvm.db.NewIterator(util.BytesPrefix([]byte{'S'}), nil)
+	for ok := iter.First(); ok; ok = iter.Next() {
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+	return keys, iter.Error()
+}
+
+// unwrapVersion returns the version and the command of a "VEREXEC version
+// command" entry.
+func unwrapVersion(cmd redcon.Command) (uint64, redcon.Command, error) {
+	if len(cmd.Args) < 3 {
+		return 0, cmd, finn.ErrWrongNumberOfArguments
+	}
+	stamp, err := strconv.ParseUint(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		return 0, cmd, errVersion
+	}
+	args := cmd.Args[2:]
+	return stamp, redcon.Command{Raw: buildCommand(args...), Args: args}, nil
+}
+
+// parseSetOptions parses the "IFVERSION version" and "LWW timestamp"
+// options of SET, of which there may be one. The version is -1 and the
+// timestamp is zero without them.
+func parseSetOptions(args [][]byte) (ifVersion int64, lww uint64, err error) {
+	if len(args) == 0 {
+		return -1, 0, nil
+	}
+	if len(args) != 2 {
+		return 0, 0, errSyntaxError
+	}
+	n, err := strconv.ParseUint(string(args[1]), 10, 63)
+	if err != nil {
+		return 0, 0, errVersion
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "ifversion":
+		return int64(n), 0, nil
+	case "lww":
+		if n == 0 {
+			return 0, 0, errVersion
+		}
+		return -1, n, nil
+	}
+	return 0, 0, errSyntaxError
+}
+
+// cmdGetver handles "GETVER key", which returns the version of a key, or
+// nil when the key doesn't exist. Keys that were written before versions
+// have version zero.
+func (kvm *Machine) cmdGetver(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	ks := keyspaceOf(m)
+	return m.Apply(conn, cmd, nil,
+		func(interface{}) (interface{}, error) {
+			buf := getKeyBuf()
+			defer putKeyBuf(buf)
+			*buf = ks.appendKey(*buf, cmd.Args[1])
+			kvm.dbmu.RLock()
+			defer kvm.dbmu.RUnlock()
+			value, err := kvm.reader(m).Get(*buf, nil)
+			if err != nil {
+				if err == leveldb.ErrNotFound {
+					writeNull(conn)
+					return nil, nil
+				}
+				return nil, err
+			}
+			conn.WriteInt64(int64(valueVersion(value)))
+			return nil, nil
+		},
+	)
+}
@@ -0,0 +1,322 @@
+package kvnode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// watchBuffer is the number of events that may be queued for a watcher
+// before it's considered too slow and is disconnected.
+const watchBuffer = 4096
+
+// watchEvent is a change to the keyspace.
+type watchEvent struct {
+	op    string // "set", "del", "flushdb", "flushall" or "restore"
+	key   []byte
+	value []byte
+	rev   uint64 // the revision of the write, or zero
+}
+
+// watcher receives the events for keys that match its pattern.
+type watcher struct {
+	ks      keyspace
+	pattern string
+	// revs adds the revisions to the events, for watchers that started
+	// at a revision.
+	revs bool
+	ch   chan watchEvent
+	// out is the size of the queued events.
+	out outputQueue
+	// overflow is closed when the watcher falls too far behind.
+	overflow chan struct{}
+}
+
+// watchHub distributes applied changes to watchers. Changes are published
+// from the apply path, which runs on every node, so watchers may be attached
+// to followers too.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+	// limit returns the output buffer limit of the watchers.
+	limit func() OutputBufferLimit
+}
+
+func newWatchHub(limit func() OutputBufferLimit) *watchHub {
+	return &watchHub{watchers: make(map[*watcher]bool), limit: limit}
+}
+
+// watch registers a new watcher for the key pattern in a keyspace.
+func (h *watchHub) watch(ks keyspace, pattern string, revs bool) *watcher {
+	w := &watcher{
+		ks:       ks,
+		pattern:  pattern,
+		revs:     revs,
+		ch:       make(chan watchEvent, watchBuffer),
+		overflow: make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.watchers[w] = true
+	h.mu.Unlock()
+	return w
+}
+
+// unwatch removes the watcher.
+func (h *watchHub) unwatch(w *watcher) {
+	h.mu.Lock()
+	delete(h.watchers, w)
+	h.mu.Unlock()
+}
+
+// publish sends an event to every watcher of the keyspace with a matching
+// pattern, or to every watcher when the keyspace is allKeyspaces. It never
+// blocks, watchers that cannot keep up, or exceed the output buffer limit,
+// are dropped.
+func (h *watchHub) publish(ks keyspace, rev uint64, op string, key, value []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.watchers) == 0 {
+		return
+	}
+	var skey string
+	if key != nil {
+		skey = string(key)
+	}
+	limit := h.limit()
+	size := eventSize(key, value)
+	for w := range h.watchers {
+		if ks != allKeyspaces && w.ks != ks {
+			continue
+		}
+		if key != nil && !match.Match(skey, w.pattern) {
+			continue
+		}
+		if !w.out.add(size, limit) {
+			select {
+			case w.ch <- watchEvent{op: op, key: key, value: value, rev: rev}:
+				continue
+			default:
+			}
+		}
+		delete(h.watchers, w)
+		close(w.overflow)
+	}
+}
+
+// eventSize returns the size of an event in the output buffer of a watcher.
+func eventSize(key, value []byte) int64 {
+	return int64(len(key) + len(value))
+}
+
+// cmdWatchkeys handles "WATCHKEYS pattern [FROM revision] [WITHREV]". The
+// connection is detached and watches the selected database or namespace. It
+// receives a three element array of op, key and value for every change to a
+// matching key. With FROM, the changes after the revision are sent first,
+// from the history that's kept for RevisionRetention. With FROM or WITHREV,
+// the events have a fourth element, which is their revision, the HLC
+// timestamp of the write, so that a client can continue from the last event
+// that it received, or order the changes with other systems. Sending any
+// command ends the stream.
+func (kvm *Machine) cmdWatchkeys(m finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var from uint64
+	var history, revs bool
+	for i := 2; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		default:
+			return nil, errSyntaxError
+		case "from":
+			if i+1 == len(cmd.Args) {
+				return nil, errSyntaxError
+			}
+			n, err := strconv.ParseUint(string(cmd.Args[i+1]), 10, 64)
+			if err != nil {
+				return nil, errRevision
+			}
+			from, history, revs = n, true, true
+			i++
+		case "withrev":
+			revs = true
+		}
+	}
+	pattern := string(cmd.Args[1])
+	w := kvm.watches.watch(keyspaceOf(m), pattern, revs)
+	var ss Snapshot
+	if history {
+		// the watcher is registered before the snapshot is taken, so that
+		// the changes after the snapshot are in its events.
+		var err error
+		kvm.dbmu.RLock()
+		ss, err = kvm.db.GetSnapshot()
+		kvm.dbmu.RUnlock()
+		if err == nil {
+			var floor uint64
+			if _, floor, err = readRevision(ss); err == nil && from < floor {
+				err = errRevisionCompacted
+			}
+			if err != nil {
+				ss.Release()
+			}
+		}
+		if err != nil {
+			kvm.watches.unwatch(w)
+			return nil, err
+		}
+	}
+	c := kvm.client(conn)
+	kvm.stopTracking(c)
+	dconn := conn.Detach()
+	go kvm.streamWatch(dconn, c, w, pattern, ss, from)
+	return nil, nil
+}
+
+func (kvm *Machine) streamWatch(dconn redcon.DetachedConn, c *client, w *watcher, pattern string,
+	ss Snapshot, from uint64,
+) {
+	defer kvm.detachedClosed(c)
+	defer dconn.Close()
+	defer kvm.watches.unwatch(w)
+	if ss != nil {
+		defer ss.Release()
+	}
+	writePush(dconn, 2)
+	dconn.WriteBulkString("watchkeys")
+	dconn.WriteBulkString(pattern)
+	if err := dconn.Flush(); err != nil {
+		return
+	}
+	if ss != nil {
+		rev, err := kvm.writeHistoryEvents(dconn, ss, w, from)
+		if err != nil {
+			dconn.WriteError(err.Error())
+			dconn.Flush()
+			return
+		}
+		if rev > from {
+			from = rev
+		}
+		if err := dconn.Flush(); err != nil {
+			return
+		}
+	}
+	// any input from the client ends the stream.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dconn.ReadCommand()
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-w.overflow:
+			kvm.slowConsumer(c, "pubsub")
+			dconn.WriteError("ERR watcher is too slow, events were dropped")
+			dconn.Flush()
+			return
+		case ev := <-w.ch:
+			var n int64
+			for {
+				n += eventSize(ev.key, ev.value)
+				// the events up to the revision of the history were
+				// already sent.
+				if !w.revs || ev.rev == 0 || ev.rev > from {
+					writeWatchEvent(dconn, ev, w.revs)
+				}
+				// write the pending events together.
+				if len(w.ch) == 0 {
+					break
+				}
+				ev = <-w.ch
+			}
+			if err := dconn.Flush(); err != nil {
+				return
+			}
+			w.out.add(-n, OutputBufferLimit{})
+		}
+	}
+}
+
+// writeHistoryEvents writes the events of a watcher after a revision from
+// the history in a snapshot, in the order of their revisions, and returns
+// the revision of the snapshot. The values that were moved to or from the
+// cold store didn't change, so they're not events.
+func (kvm *Machine) writeHistoryEvents(dconn redcon.DetachedConn, ss Snapshot, w *watcher, from uint64) (uint64, error) {
+	rev, _, err := readRevision(ss)
+	if err != nil || from >= rev {
+		return rev, err
+	}
+	prefix := w.ks.prefix()
+	iter := ss.NewIterator(&util.Range{
+		Start: historyIndexKey(from+1, nil), Limit: historyIndexKey(rev+1, nil),
+	}, nil)
+	defer iter.Release()
+	var n int
+	for ok := iter.First(); ok; ok = iter.Next() {
+		ikey := iter.Key()
+		if len(ikey) < 9 || !bytes.HasPrefix(ikey[9:], prefix) {
+			continue
+		}
+		key := ikey[9:]
+		if !match.Match(string(key[len(prefix):]), w.pattern) {
+			continue
+		}
+		ev := watchEvent{op: "del", key: key[len(prefix):],
+			rev: binary.BigEndian.Uint64(ikey[1:9])}
+		value, err := valueAt(ss, key, ev.rev)
+		if err != nil {
+			return 0, err
+		}
+		if value != nil {
+			if moved, err := tierChange(ss, key, ev.rev, value); err != nil {
+				return 0, err
+			} else if moved {
+				continue
+			}
+			if ev.value, err = kvm.loadValue(nil, value); err != nil {
+				return 0, err
+			}
+			ev.op = "set"
+		}
+		writeWatchEvent(dconn, ev, true)
+		if n++; n%watchBuffer == 0 {
+			if err := dconn.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return rev, iter.Error()
+}
+
+// writeWatchEvent writes the event as a push frame for RESP3 clients or
+// as an array for RESP2 clients, with its revision when revs is set.
+func writeWatchEvent(conn redcon.Conn, ev watchEvent, revs bool) {
+	if revs {
+		writePush(conn, 4)
+	} else {
+		writePush(conn, 3)
+	}
+	conn.WriteBulkString(ev.op)
+	if ev.key == nil {
+		writeNull(conn)
+	} else {
+		conn.WriteBulk(ev.key)
+	}
+	if ev.value == nil {
+		writeNull(conn)
+	} else {
+		conn.WriteBulk(ev.value)
+	}
+	if revs {
+		conn.WriteInt64(int64(ev.rev))
+	}
+}